@@ -0,0 +1,200 @@
+/*
+Copyright © 2021 Ruohang Feng <rh@vonng.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Vonng/pigsty-cli/conf"
+	"github.com/Vonng/pigsty-cli/exec"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	varAuditActor  string
+	varAuditAction string
+	varAuditHost   string
+	varAuditJob    string
+	varAuditSince  string
+	varAuditLimit  int
+)
+
+// auditCmd represents the audit command
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "query audit log",
+	Long: `audit -- query audit log of jobs & config changes made by cli and server (<data-dir>/audit/audit.log)
+
+    pigsty audit                                  list recent operations
+    pigsty audit --host 10.10.10.11 --since 24h   operations touch host in last 24 hours
+    pigsty audit --actor alice --action job_start jobs started by alice
+    pigsty audit verify                           verify hash chain of audit log
+
+each record holds hash of previous record, so modified or removed records are detected by verify
+`,
+	Annotations: map[string]string{annotationNoInventory: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		q := exec.AuditQuery{Actor: varAuditActor, Action: varAuditAction, Host: varAuditHost, JobID: varAuditJob, Limit: varAuditLimit}
+		if varAuditSince != "" {
+			since, err := parseSince(varAuditSince)
+			if err != nil {
+				return err
+			}
+			q.Since = since
+		}
+		log, err := exec.OpenAuditLog(auditLogPath())
+		if err != nil {
+			return err
+		}
+		records, err := log.Query(q)
+		if err != nil {
+			return err
+		}
+		if varFormatJson {
+			b, _ := json.MarshalIndent(records, "", "  ")
+			fmt.Println(string(b))
+			return nil
+		}
+		fmt.Printf("%-5s  %-19s  %-16s  %-9s  %-11s  %-20s  %s\n", "SEQ", "TIME", "ACTOR", "ACTION", "OUTCOME", "TARGET", "COMMAND")
+		for _, r := range records {
+			target := r.Limit
+			if target == "" && r.Action == exec.AUDIT_CONFIG {
+				target = shortHash(r.ConfigBefore) + ">" + shortHash(r.ConfigAfter)
+			}
+			fmt.Printf("%-5d  %-19s  %-16s  %-9s  %-11s  %-20s  %s\n", r.Seq, r.Time.Local().Format("2006-01-02 15:04:05"), r.Actor, r.Action, r.Outcome, target, r.Command)
+		}
+		return nil
+	},
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:         "verify",
+	Short:       "verify hash chain of audit log",
+	Annotations: map[string]string{annotationNoInventory: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		log, err := exec.OpenAuditLog(auditLogPath())
+		if err != nil {
+			return err
+		}
+		n, err := log.Verify()
+		if err != nil {
+			return fmt.Errorf("audit log %s is tampered, %d records verified before: %w", log.Path, n, err)
+		}
+		fmt.Printf("audit log %s verified: %d records\n", log.Path, n)
+		return nil
+	},
+}
+
+// parseSince will parse --since as duration before now (e.g: 24h) or RFC3339 time
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid since %q: duration or RFC3339 time required", s)
+	}
+	return t, nil
+}
+
+// shortHash will abbreviate config hash in table output
+func shortHash(h string) string {
+	if len(h) > 8 {
+		return h[:8]
+	}
+	if h == "" {
+		return "-"
+	}
+	return h
+}
+
+// auditLogPath is audit log in data dir shared with pigsty server
+func auditLogPath() string {
+	return filepath.Join(varServerDataDir, "audit", "audit.log")
+}
+
+// cliAuditor will return auditor of this cli invocation: os user runs command line
+func cliAuditor() *exec.Auditor {
+	log, err := exec.OpenAuditLog(auditLogPath())
+	if err != nil {
+		logrus.Warnf("audit log not available: %s", err)
+	}
+	return &exec.Auditor{Log: log, Source: exec.AUDIT_CLI, Actor: cliActor(), Command: commandLine(os.Args)}
+}
+
+// cliActor is os user running cli, with original user if run via sudo
+func cliActor() string {
+	actor := conf.CurrentUser()
+	if sudo := os.Getenv("SUDO_USER"); sudo != "" && sudo != actor {
+		actor += " (sudo by " + sudo + ")"
+	}
+	return actor
+}
+
+// commandLine will render args as shell command line, args with space or quotes are quoted
+func commandLine(args []string) string {
+	var res []string
+	for i, arg := range args {
+		if i == 0 {
+			arg = filepath.Base(arg)
+		}
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$") {
+			arg = strconv.Quote(arg)
+		}
+		res = append(res, arg)
+	}
+	return strings.Join(res, " ")
+}
+
+// saveConfig will save config with snapshot in history, and record the change to audit log
+func saveConfig(path string, data []byte, action string) error {
+	before := exec.FileHash(path)
+	_, err := configHistory(path).Save(data, conf.CurrentUser(), action)
+	auditConfig(path, before, err)
+	return err
+}
+
+// auditConfig will record config change made by cli to audit log
+func auditConfig(path string, before string, err error) {
+	r := &exec.AuditRecord{Action: exec.AUDIT_CONFIG, ConfigBefore: before, ConfigAfter: exec.FileHash(path), Outcome: "ok"}
+	if err != nil {
+		r.Outcome, r.Error = "error", err.Error()
+	}
+	a := cliAuditor()
+	if EX != nil {
+		r.Command = EX.Redactor.Redact(a.Command)
+	}
+	a.Record(r)
+}
+
+func init() {
+	auditCmd.PersistentFlags().StringVarP(&varServerDataDir, "data-dir", "D", defaultDataDir, "data dir of audit log")
+	auditCmd.Flags().StringVar(&varAuditActor, "actor", "", "operated by this actor")
+	auditCmd.Flags().StringVar(&varAuditAction, "action", "", "job_start | job_done | cancel | config")
+	auditCmd.Flags().StringVar(&varAuditHost, "host", "", "operations touch this host")
+	auditCmd.Flags().StringVar(&varAuditJob, "job", "", "operations of this job id")
+	auditCmd.Flags().StringVar(&varAuditSince, "since", "", "recorded since duration ago (e.g: 24h) or RFC3339 time")
+	auditCmd.Flags().IntVarP(&varAuditLimit, "number", "n", 20, "number of records listed, 0 means all")
+	auditCmd.Flags().BoolVarP(&varFormatJson, "json", "j", false, "json output")
+	auditCmd.AddCommand(auditVerifyCmd)
+	rootCmd.AddCommand(auditCmd)
+}
@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Vonng/pigsty-cli/exec"
+)
+
+const testConfig = `all:
+  children:
+    meta: {hosts: {10.10.10.10: {}}}
+    pg-test:
+      hosts:
+        10.10.10.11: {pg_seq: 1, pg_role: primary}
+        10.10.10.12: {pg_seq: 2, pg_role: replica}
+      vars: {pg_cluster: pg-test}
+`
+
+// testOutput is a recorded pgsql.yml run where 10.10.10.12 failed
+const testOutput = `
+PLAY [init postgres] ***********************************************************
+
+TASK [postgres : Launch postgres] **********************************************
+ok: [10.10.10.11]
+fatal: [10.10.10.12]: FAILED! => {"msg": "postgres failed to start"}
+
+PLAY RECAP *********************************************************************
+10.10.10.11                : ok=1    changed=0    unreachable=0    failed=0    skipped=0    rescued=0    ignored=0
+10.10.10.12                : ok=0    changed=0    unreachable=0    failed=1    skipped=0    rescued=0    ignored=0
+`
+
+// execute will run root command with args, closing job store afterwards
+func execute(args ...string) error {
+	rootCmd.SetArgs(args)
+	err := rootCmd.Execute()
+	if jobStore != nil {
+		_ = jobStore.Close()
+		jobStore = nil
+	}
+	return err
+}
+
+func TestPgsqlInitAndRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pigsty-cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inventory := filepath.Join(dir, "pigsty.yml")
+	if err = ioutil.WriteFile(inventory, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runner := exec.NewFakeRunner(map[string]*exec.Script{"pgsql": {Output: testOutput, ExitCode: 2}})
+	Runner = runner
+	defer func() { Runner = nil }()
+	varServerDataDir = filepath.Join(dir, "data")
+
+	if err = execute("-i", inventory, "pgsql", "init", "-l", "pg-test"); err == nil {
+		t.Errorf("pgsql init should fail")
+	}
+	if err = execute("-i", inventory, "job", "retry", "last", "-f", "--start-at-task", "-D", varServerDataDir); err == nil {
+		t.Errorf("retry should fail again")
+	}
+	calls := runner.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("expect 2 runs, got %q", calls)
+	}
+	retried := EX.ListJobs()[0]
+	if retried.Parent == "" || retried.Limit != "10.10.10.12" || retried.StartAtTask != "postgres : Launch postgres" {
+		t.Errorf("unexpected retry: parent %s, limit %s, start at %s", retried.Parent, retried.Limit, retried.StartAtTask)
+	}
+
+	// both runs are audited by os user
+	log, _ := exec.OpenAuditLog(auditLogPath())
+	records, err := log.Query(exec.AuditQuery{Action: exec.AUDIT_JOB_DONE})
+	if err != nil || len(records) != 2 || records[0].JobID != retried.ID || records[0].Actor != cliActor() || records[0].Source != exec.AUDIT_CLI {
+		t.Errorf("jobs should be audited: %+v %v", records, err)
+	}
+}
+
+func TestNodeBash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pigsty-cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inventory := filepath.Join(dir, "pigsty.yml")
+	if err = ioutil.WriteFile(inventory, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	Runner = exec.NewFakeRunner(map[string]*exec.Script{"shell": {ExitCode: 2, Output: "" +
+		"10.10.10.11 | CHANGED | rc=0 | (stdout) active\n" +
+		"10.10.10.12 | FAILED | rc=3 | (stdout) inactive\n"}})
+	defer func() { Runner = nil }()
+	varServerDataDir = filepath.Join(dir, "data")
+
+	if err = execute("-i", inventory, "node", "bash", "-l", "pg-test", "systemctl is-active patroni"); err == nil || exitCode != 2 {
+		t.Errorf("node bash should fail with exit code 2: %v, %d", err, exitCode)
+	}
+	exitCode = 0
+	groups := exec.GroupOutputs(EX.ListJobs()[0].Outputs())
+	if out := formatOutputGroups(groups, false); out != "10.10.10.11 | changed | rc=0 | 1 host(s)\nactive\n\n10.10.10.12 | failed | rc=3 | 1 host(s)\ninactive\n\n" {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestPlaybookTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pigsty-cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inventory := filepath.Join(dir, "pigsty.yml")
+	if err = ioutil.WriteFile(inventory, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	playbook := "- name: init postgres\n  hosts: all\n  tasks: [ { name: launch postgres, tags: pg_launch, debug: msg=ok } ]\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "pgsql.yml"), []byte(playbook), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runner := exec.NewFakeRunner(map[string]*exec.Script{"pgsql": {}})
+	Runner = runner
+	defer func() { Runner, varTags = nil, nil }()
+	varServerDataDir = filepath.Join(dir, "data")
+
+	if err = execute("-i", inventory, "pgsql", "init", "-l", "pg-test", "-t", "pg_lunch"); err == nil || len(runner.Calls()) != 0 {
+		t.Errorf("unknown tag should be rejected before launching: %v", err)
+	}
+	if err = execute("-i", inventory, "playbook", "tags", "pgsql"); err != nil {
+		t.Errorf("playbook tags should success: %v", err)
+	}
+}
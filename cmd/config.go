@@ -0,0 +1,467 @@
+/*
+Copyright © 2021 Ruohang Feng <rh@vonng.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/Vonng/pigsty-cli/conf"
+	"github.com/Vonng/pigsty-cli/exec"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	varMigrateFrom string
+	varMigrateTo   string
+	varDryRun      bool
+
+	varInitMeta        []string
+	varInitNodes       []string
+	varInitClusters    []string
+	varInitProfile     string
+	varInitDCS         int
+	varInitOutput      string
+	varInitInteractive bool
+
+	varHistoryKeep     int
+	varHistoryKeepDays int
+	varHistoryPrune    bool
+)
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "manage pigsty config file",
+	Long: `SYNOPSIS:
+
+    config init                     generate new config file
+    config edit                     edit config with $EDITOR, validate before save
+    config migrate                  migrate config to new schema version
+    config history                  list config snapshots
+    config rollback <id>            restore config snapshot
+
+`,
+}
+
+var configInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "generate new config file",
+	Long: `init -- generate new config file
+
+    config init -m <meta_ip,...> [-n <node_ip,...>] [-c <cluster=size> ...]
+                [-p tiny|oltp|olap|crit] [--dcs <n>] [-o <path>] [-f] [-I]
+
+    pg-meta cluster is deployed on meta nodes, other clusters take database
+    nodes in order: first node of each cluster is primary, others are replica
+
+EXAMPLES:
+
+    1. single meta node sandbox
+        pigsty config init -m 10.10.10.10 -o pigsty.yml
+
+    2. sandbox with 3-node cluster pg-test
+        pigsty config init -m 10.10.10.10 -n 10.10.10.11,10.10.10.12,10.10.10.13 -c pg-test=3
+
+    3. interactive mode
+        pigsty config init -I
+
+`,
+	Annotations: map[string]string{annotationNoInventory: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if varInitInteractive {
+			promptInitOptions()
+		}
+		opts := conf.GenerateOptions{
+			MetaIPs:  varInitMeta,
+			Nodes:    varInitNodes,
+			Profile:  varInitProfile,
+			DCSCount: varInitDCS,
+		}
+		for _, c := range varInitClusters {
+			layout, err := conf.ParseClusterLayout(c)
+			if err != nil {
+				return err
+			}
+			opts.Clusters = append(opts.Clusters, layout)
+		}
+		data, err := conf.GenerateConfig(opts)
+		if err != nil {
+			return err
+		}
+
+		path := varInitOutput
+		if path == "" {
+			path = varConfig
+		}
+		if path == "-" {
+			fmt.Print(string(data))
+			return nil
+		}
+		if _, err := os.Stat(path); err == nil && !varForce {
+			return fmt.Errorf("config %s already exists, use -f to overwrite (old config will be kept as backup)", path)
+		}
+		if err = saveConfig(path, data, "init"); err != nil {
+			return err
+		}
+		logrus.Infof("config generated: %s", path)
+		return nil
+	},
+}
+
+// promptInitOptions will ask config init options from stdin, flags are used as default
+func promptInitOptions() {
+	reader := bufio.NewReader(os.Stdin)
+	ask := func(question, defaultValue string) string {
+		fmt.Printf("%s [%s]: ", question, defaultValue)
+		answer, _ := reader.ReadString('\n')
+		if answer = strings.TrimSpace(answer); answer == "" {
+			return defaultValue
+		}
+		return answer
+	}
+	splitList := func(s string) (res []string) {
+		for _, item := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+			res = append(res, item)
+		}
+		return res
+	}
+
+	varInitMeta = splitList(ask("meta node ip (comma separated)", strings.Join(varInitMeta, ",")))
+	varInitNodes = splitList(ask("database node ip (comma separated)", strings.Join(varInitNodes, ",")))
+	varInitClusters = splitList(ask("cluster layout, e.g pg-test=3 (comma separated)", strings.Join(varInitClusters, ",")))
+	varInitProfile = ask("sizing profile ("+strings.Join(conf.Profiles, "|")+")", varInitProfile)
+	if n, err := strconv.Atoi(ask("dcs server count (1|3|5)", strconv.Itoa(varInitDCS))); err == nil {
+		varInitDCS = n
+	}
+	if varInitOutput == "" {
+		varInitOutput = varConfig
+	}
+	varInitOutput = ask("output path", varInitOutput)
+}
+
+// editAnnotation prefix lines are added to edit buffer to report problems, and removed before save
+const editAnnotation = "# [pigsty config edit] "
+
+var configEditCmd = &cobra.Command{
+	Use:   "edit",
+	Short: "edit config with $EDITOR",
+	Long: `edit -- edit config with $EDITOR (vi by default)
+
+    a temp copy of config is edited, and saved only if it is valid.
+    if not, editor is re-opened with problems annotated at the top.
+    save is refused if config is modified on disk during edit.
+
+`,
+	Annotations: map[string]string{annotationNoInventory: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := inventoryPath()
+		if err != nil {
+			return err
+		}
+		origin, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		originStat, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		tmp, err := ioutil.TempFile("", "pigsty-*.yml")
+		if err != nil {
+			return err
+		}
+		tmpPath := tmp.Name()
+		tmp.Close()
+		if err = ioutil.WriteFile(tmpPath, origin, 0600); err != nil {
+			return err
+		}
+
+		var data []byte
+		for {
+			if err = runEditor(tmpPath); err != nil {
+				return fmt.Errorf("editor failed, edit is kept in %s: %w", tmpPath, err)
+			}
+			if data, err = ioutil.ReadFile(tmpPath); err != nil {
+				return err
+			}
+			data = stripEditAnnotation(data)
+			if bytes.Equal(data, origin) {
+				os.Remove(tmpPath)
+				fmt.Println("config is not changed")
+				return nil
+			}
+			verr := conf.ValidateConfig(data)
+			if verr == nil {
+				break
+			}
+			fmt.Printf("%s\n\nre-edit config? [Y/n]: ", verr)
+			answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			if answer = strings.ToLower(strings.TrimSpace(answer)); answer == "n" || answer == "no" {
+				return fmt.Errorf("config is not saved, edit is kept in %s", tmpPath)
+			}
+			if err = ioutil.WriteFile(tmpPath, annotateEdit(data, verr), 0600); err != nil {
+				return err
+			}
+		}
+
+		// refuse to save if config is changed during edit
+		current, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		currentStat, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if sha256.Sum256(current) != sha256.Sum256(origin) || !currentStat.ModTime().Equal(originStat.ModTime()) {
+			if err = ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+				return err
+			}
+			return fmt.Errorf("config %s is modified during edit, save refused, edit is kept in %s", path, tmpPath)
+		}
+		if err = saveConfig(path, data, "edit"); err != nil {
+			return fmt.Errorf("fail to save config, edit is kept in %s: %w", tmpPath, err)
+		}
+		os.Remove(tmpPath)
+		logrus.Infof("config %s saved", path)
+		return nil
+	},
+}
+
+var configHistoryCmd = &cobra.Command{
+	Use:   "history",
+	Short: "list config snapshots",
+	Long: `history -- list config snapshots (latest first)
+
+    config history [--prune] [--keep <n>] [--keep-days <n>]
+
+    each snapshot is the config before a change, with author & summary of that change.
+    snapshots violate any retention policy are pruned after each save, or with --prune
+
+`,
+	Annotations: map[string]string{annotationNoInventory: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := inventoryPath()
+		if err != nil {
+			return err
+		}
+		history := configHistory(path)
+		if varHistoryPrune {
+			removed, err := history.Prune()
+			for _, id := range removed {
+				fmt.Printf("snapshot %s pruned\n", id)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		snaps, err := history.List()
+		if err != nil {
+			return err
+		}
+		for _, snap := range snaps {
+			author := snap.Author
+			if author == "" {
+				author = "-"
+			}
+			fmt.Printf("%-16s\t%s\t%-12s\t%-16s\t%s\n", snap.ID, snap.Time.Format("2006-01-02 15:04:05"), author, snap.Action, snap.Summary)
+		}
+		return nil
+	},
+}
+
+var configRollbackCmd = &cobra.Command{
+	Use:         "rollback <id>",
+	Short:       "restore config snapshot",
+	Long:        `rollback -- restore config snapshot by id, current config is snapshotted before restore`,
+	Args:        cobra.ExactArgs(1),
+	Annotations: map[string]string{annotationNoInventory: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := inventoryPath()
+		if err != nil {
+			return err
+		}
+		before := exec.FileHash(path)
+		snap, err := configHistory(path).Rollback(args[0], conf.CurrentUser())
+		auditConfig(path, before, err)
+		if err != nil {
+			return err
+		}
+		if snap != nil {
+			logrus.Infof("config %s restored to %s, previous config is kept as snapshot %s", path, args[0], snap.ID)
+		}
+		return nil
+	},
+}
+
+// configHistory will create config history store with retention flags
+func configHistory(path string) *conf.History {
+	history := conf.NewHistory(path)
+	history.Retention = conf.Retention{Keep: varHistoryKeep, KeepDays: varHistoryKeepDays}
+	return history
+}
+
+// inventoryPath will resolve inventory file path without loading it
+func inventoryPath() (string, error) {
+	path, err := filepath.Abs(varConfig)
+	if err != nil {
+		return "", err
+	}
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, "pigsty.yml")
+	}
+	return path, nil
+}
+
+// runEditor will open file with $EDITOR (vi by default)
+func runEditor(path string) error {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	args := strings.Fields(editor)
+	c := osexec.Command(args[0], append(args[1:], path)...)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return c.Run()
+}
+
+// annotateEdit will add problems as comment at the top of edit buffer
+func annotateEdit(data []byte, problem error) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(editAnnotation + "config is invalid, fix following problems and save again\n")
+	buf.WriteString(editAnnotation + "(lines start with this prefix are removed on save)\n")
+	for _, line := range strings.Split(problem.Error(), "\n") {
+		buf.WriteString(editAnnotation + line + "\n")
+	}
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// stripEditAnnotation will remove annotation lines from edit buffer
+func stripEditAnnotation(data []byte) []byte {
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if !bytes.HasPrefix(line, []byte(editAnnotation)) {
+			buf.Write(line)
+		}
+	}
+	return buf.Bytes()
+}
+
+var configMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "migrate config to new schema version",
+	Long: `migrate -- migrate config to new schema version
+
+    config migrate [--to <ver>] [--from <ver>] [-n|--dry-run]
+
+    version is read from all.vars.pigsty_version, or --from if specified
+    comments and layout of config are preserved, old config is kept as backup
+
+`,
+	Annotations: map[string]string{annotationNoInventory: ""}, // old config may not load with current parser
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := inventoryPath()
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		from := varMigrateFrom
+		if from == "" {
+			doc, err := conf.ParseDocument(data)
+			if err != nil {
+				return err
+			}
+			from = doc.Version()
+		}
+		if conf.CompareVersion(from, varMigrateTo) == 0 {
+			fmt.Printf("config %s is already at version %s\n", path, from)
+			return nil
+		}
+		plan, err := conf.MigrationPath(from, varMigrateTo)
+		if err != nil {
+			return err
+		}
+		for _, m := range plan {
+			fmt.Printf("migration %s -> %s: %s\n", m.From, m.To, m.Desc)
+		}
+
+		out, changes, err := conf.MigrateConfig(data, from, varMigrateTo)
+		if err != nil {
+			return err
+		}
+		fmt.Println("\nchanges:")
+		for _, c := range changes {
+			fmt.Printf("    - %s\n", c)
+		}
+		fmt.Printf("\ndiff:\n%s", conf.TextDiff(data, out, 2))
+		if varDryRun {
+			fmt.Println("\ndry run, config is not modified")
+			return nil
+		}
+		if err = saveConfig(path, out, "migrate to "+varMigrateTo); err != nil {
+			return err
+		}
+		logrus.Infof("config %s migrated from %s to %s", path, from, varMigrateTo)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.PersistentFlags().IntVar(&varHistoryKeep, "keep", conf.DefaultRetention.Keep, "retention: keep latest n config snapshots (0 to disable)")
+	configCmd.PersistentFlags().IntVar(&varHistoryKeepDays, "keep-days", conf.DefaultRetention.KeepDays, "retention: keep config snapshots within n days (0 to disable)")
+
+	// config init
+	configCmd.AddCommand(configInitCmd)
+	configInitCmd.Flags().StringSliceVarP(&varInitMeta, "meta", "m", []string{}, "meta node ip list")
+	configInitCmd.Flags().StringSliceVarP(&varInitNodes, "nodes", "n", []string{}, "database node ip list")
+	configInitCmd.Flags().StringSliceVarP(&varInitClusters, "cluster", "c", []string{}, "cluster layout: name=size")
+	configInitCmd.Flags().StringVarP(&varInitProfile, "profile", "p", "tiny", "sizing profile: tiny|oltp|olap|crit")
+	configInitCmd.Flags().IntVar(&varInitDCS, "dcs", 1, "dcs server count")
+	configInitCmd.Flags().StringVarP(&varInitOutput, "output", "o", "", "output path (inventory path by default, - for stdout)")
+	configInitCmd.Flags().BoolVarP(&varForce, "force", "f", false, "overwrite existing config")
+	configInitCmd.Flags().BoolVarP(&varInitInteractive, "interactive", "I", false, "interactive mode")
+
+	// config edit
+	configCmd.AddCommand(configEditCmd)
+
+	// config history
+	configCmd.AddCommand(configHistoryCmd)
+	configHistoryCmd.Flags().BoolVar(&varHistoryPrune, "prune", false, "prune snapshots according to retention policy")
+
+	// config rollback
+	configCmd.AddCommand(configRollbackCmd)
+
+	// config migrate
+	configCmd.AddCommand(configMigrateCmd)
+	configMigrateCmd.Flags().StringVar(&varMigrateFrom, "from", "", "source schema version (detect from config by default)")
+	configMigrateCmd.Flags().StringVar(&varMigrateTo, "to", conf.SchemaVersion, "target schema version")
+	configMigrateCmd.Flags().BoolVarP(&varDryRun, "dry-run", "n", false, "print changes without modify config")
+}
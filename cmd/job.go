@@ -0,0 +1,302 @@
+/*
+Copyright © 2021 Ruohang Feng <rh@vonng.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Vonng/pigsty-cli/exec"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultDataDir is where pigsty server (and cli) keep logs & job history
+const defaultDataDir = "/tmp/pigsty"
+
+var (
+	varJobFailedOnly  bool
+	varJobStartAtTask string
+	varJobLimit       int
+	varReplaySpeed    float64
+	varReplayIdle     time.Duration
+)
+
+// jobStore is job history shared with pigsty server, jobs run by cli are recorded in it
+var jobStore *exec.FileJobStore
+
+// jobCmd represents the job command
+var jobCmd = &cobra.Command{
+	Use:   "job",
+	Short: "job history",
+	Long: `job -- list & retry jobs in job history (<data-dir>/job/jobs.db)
+
+    pigsty job                                 list recent jobs
+    pigsty job retry <id|last>                 retry job with same playbook, tags, limit & extra vars
+    pigsty job retry <id|last> --failed-only   retry failed & unreachable hosts only
+    pigsty job retry <id|last> -f --start-at-task           resume at first failed task
+    pigsty job retry <id|last> --start-at-task="<task>"     resume at given task
+    pigsty job replay <id|last> [--speed 4]    replay recorded output with timing
+    pigsty job tail [id]                       follow output of running job (latest job by default)
+
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if jobStore == nil {
+			return fmt.Errorf("job history is not available")
+		}
+		jobs, err := jobStore.Query(exec.JobQuery{Limit: varJobLimit})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-36s  %-11s  %-24s  %-20s  %-19s  %s\n", "ID", "STATUS", "NAME", "LIMIT", "START", "PARENT")
+		for _, job := range jobs {
+			fmt.Printf("%-36s  %-11s  %-24s  %-20s  %-19s  %s\n", job.ID, job.Status, job.Name, job.Limit, job.StartAt.Format("2006-01-02 15:04:05"), job.Parent)
+		}
+		return nil
+	},
+}
+
+// jobRetryCmd will retry job from job history
+var jobRetryCmd = &cobra.Command{
+	Use:   "retry <id|last>",
+	Short: "retry job from job history",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if jobStore == nil {
+			return fmt.Errorf("job history is not available")
+		}
+		parent, err := findJob(args[0])
+		if err != nil {
+			return err
+		}
+		var opts []exec.JobOpts
+		if task := varJobStartAtTask; task == "-" {
+			if task = parent.FailedTask(); task == "" {
+				return fmt.Errorf("failed task of job %s not found", parent.ID)
+			}
+			opts = append(opts, exec.WithStartAtTask(task))
+		} else if task != "" {
+			opts = append(opts, exec.WithStartAtTask(task))
+		}
+		job, err := EX.Retry(parent, varJobFailedOnly, opts...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("retry job %s (%s) as %s on %s\n", parent.ID, parent.Status, job.ID, job.Limit)
+		return job.Run(context.TODO())
+	},
+}
+
+// jobReplayCmd will replay recorded job output in terminal
+var jobReplayCmd = &cobra.Command{
+	Use:   "replay <id|last>",
+	Short: "replay recorded job output with timing",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if jobStore == nil {
+			return fmt.Errorf("job history is not available")
+		}
+		job, err := findJob(args[0])
+		if err != nil {
+			return err
+		}
+		if job.Recording == "" {
+			return fmt.Errorf("job %s has no recording", job.ID)
+		}
+		return exec.Replay(context.TODO(), os.Stdout, job.Recording, varReplaySpeed, varReplayIdle)
+	},
+}
+
+// jobTailCmd will follow output of running job
+var jobTailCmd = &cobra.Command{
+	Use:   "tail [id]",
+	Short: "follow output of running job",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if jobStore == nil {
+			return fmt.Errorf("job history is not available")
+		}
+		// job is run by another process (cli or server), its state is followed by records appended to job history,
+		// watched before job is loaded so no record is missed
+		watcher := exec.NewJobWatcher(jobStore.Path)
+		var job *exec.Job
+		var err error
+		if len(args) > 0 {
+			job, err = findJob(args[0])
+		} else if jobs, qErr := jobStore.Query(exec.JobQuery{Limit: 1}); qErr != nil || len(jobs) == 0 {
+			err = fmt.Errorf("no job in job history")
+		} else {
+			job, err = jobStore.Get(jobs[0].ID)
+		}
+		if err != nil {
+			return err
+		}
+		if job.Recording == "" {
+			return fmt.Errorf("job %s has no recording", job.ID)
+		}
+		fmt.Fprintf(os.Stderr, "job %s (%s) %s on %s\n", job.ID, job.Status, job.Name, job.Limit)
+		watcher.Job = job // tail stops when job is finished or its process is gone
+		return exec.Follow(context.TODO(), os.Stdout, job.Recording, watcher.Done)
+	},
+}
+
+// findJob will find job in job history by id, unique id prefix, or 'last' for latest finished job
+func findJob(id string) (*exec.Job, error) {
+	if job, err := jobStore.Get(id); err == nil {
+		return job, nil
+	}
+	jobs, err := jobStore.Query(exec.JobQuery{})
+	if err != nil {
+		return nil, err
+	}
+	var found *exec.Job
+	for _, job := range jobs {
+		if id == "last" && job.Finished() || id != "last" && strings.HasPrefix(job.ID, id) {
+			if id == "last" {
+				found = job
+				break
+			}
+			if found != nil {
+				return nil, fmt.Errorf("job id prefix %s is ambiguous", id)
+			}
+			found = job
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("job %s not found", id)
+	}
+	return jobStore.Get(found.ID)
+}
+
+// initJobStore will attach to job history in data dir, jobs run by EX will be recorded
+func initJobStore() {
+	store, err := exec.AttachFileJobStore(filepath.Join(varServerDataDir, "job", "jobs.db"))
+	if err != nil {
+		logrus.Warnf("job history not available: %s", err)
+		return
+	}
+	jobStore = store
+	EX.JobOpts = append(EX.JobOpts, exec.WithStore(store), exec.WithRecordDir(filepath.Join(varServerDataDir, "log")), exec.WithAuditor(cliAuditor()))
+}
+
+func init() {
+	rootCmd.AddCommand(jobCmd)
+	jobCmd.AddCommand(jobRetryCmd, jobReplayCmd, jobTailCmd)
+	jobCmd.PersistentFlags().StringVarP(&varServerDataDir, "data-dir", "D", defaultDataDir, "data dir of job history")
+	jobCmd.Flags().IntVarP(&varJobLimit, "number", "n", 20, "number of jobs listed")
+	jobRetryCmd.Flags().BoolVarP(&varJobFailedOnly, "failed-only", "f", false, "retry failed & unreachable hosts only")
+	jobRetryCmd.Flags().StringVar(&varJobStartAtTask, "start-at-task", "", "start at this task, first failed task if value is omitted")
+	jobRetryCmd.Flags().Lookup("start-at-task").NoOptDefVal = "-"
+	jobReplayCmd.Flags().Float64Var(&varReplaySpeed, "speed", 1, "replay speed, e.g: 4 means 4x faster")
+	jobReplayCmd.Flags().DurationVar(&varReplayIdle, "idle-limit", exec.DefaultIdleLimit, "cap pause between outputs, 0 means no limit")
+}
+
+// ansi colors of host result status
+var statusColor = map[string]string{
+	exec.HOST_OK:          "\033[32m", // green
+	exec.HOST_CHANGED:     "\033[33m", // yellow
+	exec.HOST_FAILED:      "\033[31m", // red
+	exec.HOST_UNREACHABLE: "\033[35m", // magenta
+}
+
+// useColor tells whether w is a terminal and NO_COLOR is not set
+func useColor(w io.Writer) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// printJobSummary will print per-host results of jobs executed by EX, ordered by start time
+func printJobSummary(w io.Writer) {
+	for _, job := range executedJobs() {
+		if len(job.Results) > 0 {
+			fmt.Fprint(w, formatJobSummary(job, useColor(w)))
+		}
+	}
+}
+
+// executedJobs will return jobs that have been run by EX, ordered by start time
+func executedJobs() []*exec.Job {
+	if EX == nil {
+		return nil
+	}
+	var jobs []*exec.Job
+	for _, job := range EX.ListJobs() {
+		if job.Status != exec.JOB_READY {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].StartAt.Before(jobs[j].StartAt) })
+	return jobs
+}
+
+// outputPlans will print plans of executed jobs, and write them to path as json array if path is given
+func outputPlans(w io.Writer, path string) error {
+	plans := []*exec.Plan{}
+	for _, job := range executedJobs() {
+		plan := job.Plan()
+		plans = append(plans, plan)
+		fmt.Fprintf(w, "\n%s", plan)
+	}
+	if path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(plans, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("fail to write plan to %s: %w", path, err)
+	}
+	fmt.Fprintf(w, "\nplan of %d jobs written to %s\n", len(plans), path)
+	return nil
+}
+
+// formatJobSummary will render job results as table, hosts are mapped to instance names via IpMap
+func formatJobSummary(job *exec.Job, color bool) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "\n[%s] %s %s (%s)\n", job.Status, job.Name, job.ID, job.DoneAt.Sub(job.StartAt).Round(time.Second))
+	fmt.Fprintf(&buf, "%-16s %-24s %-12s %6s %8s %12s %7s %8s %8s %8s\n",
+		"HOST", "INSTANCE", "STATUS", "OK", "CHANGED", "UNREACHABLE", "FAILED", "SKIPPED", "RESCUED", "IGNORED")
+	for _, r := range job.Results {
+		name := "-"
+		if EX != nil && EX.Config != nil {
+			if ins, exists := EX.Config.IpMap[r.Host]; exists {
+				name = ins.Name
+			}
+		}
+		status := fmt.Sprintf("%-12s", r.Status())
+		if color {
+			status = statusColor[r.Status()] + status + "\033[0m"
+		}
+		fmt.Fprintf(&buf, "%-16s %-24s %s %6d %8d %12d %7d %8d %8d %8d\n",
+			r.Host, name, status, r.Ok, r.Changed, r.Unreachable, r.Failed, r.Skipped, r.Rescued, r.Ignored)
+	}
+	return buf.String()
+}
@@ -17,11 +17,24 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/Vonng/pigsty-cli/exec"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
 	"strings"
+	"time"
+)
+
+var (
+	varSSH             bool          // run ad-hoc module with native ssh runner instead of ansible
+	varSSHConcurrency  int           // max hosts connected concurrently
+	varSSHTimeout      time.Duration // per-host timeout
+	varKnownHosts      string        // known_hosts file
+	varHostKeyChecking string        // strict | accept-new | insecure
+	varJumpHost        string        // [user@]host[:port]
 )
 
 // nodesCmd represents the nodes command
@@ -37,7 +50,7 @@ var nodesCmd = &cobra.Command{
 				continue
 			}
 			for _, ins := range cls.Instances {
-				if varLimit != "" && !ins.MatchNames(varLimits) {
+				if !limitHost(ins.IP) {
 					continue
 				}
 				if EX.Config.IsMetaNode(ins.IP) {
@@ -122,9 +135,109 @@ var nodeTuneCmd = &cobra.Command{
 	},
 }
 
+var nodePingCmd = &cobra.Command{
+	Use:   "ping",
+	Short: "check connectivity of nodes",
+	Long: `ping -- check ansible connectivity of nodes (ping module)
+
+    pigsty node ping -l pg-test
+    pigsty node ping -l 'all,!meta' -j
+    pigsty node ping --ssh              # native ssh instead of ansible, much faster
+
+exit status is 2 if some hosts failed, 4 if some hosts are unreachable
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runAdHoc("node ping", exec.MODULE_PING, "")
+	},
+}
+
+var nodeBashCmd = &cobra.Command{
+	Use:   "bash <command>",
+	Short: "run shell command on nodes",
+	Long: `bash -- run shell command on nodes, identical outputs are grouped together
+
+    pigsty node bash -l pg-test 'uptime'
+    pigsty node bash -l pg-test:replica -j 'systemctl is-active patroni'
+    pigsty node bash --ssh --jump admin@10.10.10.10 'patronictl list'
+
+exit status is 2 if command failed on some hosts, 4 if some hosts are unreachable
+`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runAdHoc("node bash", exec.MODULE_SHELL, strings.Join(args, " "))
+	},
+}
+
+// runAdHoc will run ansible module on limited hosts, then print outputs grouped by identical result
+func runAdHoc(name, module, args string) error {
+	opts := []exec.JobOpts{
+		exec.WithModule(module, args),
+		exec.WithName(name),
+		exec.WithLimit(varLimit),
+		exec.WithStdout(ioutil.Discard),
+	}
+	if varSSH {
+		opts = append(opts, exec.WithRunner(&exec.SSHRunner{
+			Concurrency:   varSSHConcurrency,
+			Timeout:       varSSHTimeout,
+			KnownHosts:    varKnownHosts,
+			HostKeyPolicy: varHostKeyChecking,
+			JumpHost:      varJumpHost,
+		}))
+	}
+	job := EX.NewJob(opts...)
+	err := job.Run(context.TODO())
+	outputs := job.Outputs()
+	if varFormatJson {
+		b, _ := json.MarshalIndent(map[string]interface{}{
+			"id":     job.ID,
+			"status": job.Status,
+			"hosts":  outputs,
+			"groups": exec.GroupOutputs(outputs),
+		}, "", "  ")
+		fmt.Println(string(b))
+	} else {
+		fmt.Print(formatOutputGroups(exec.GroupOutputs(outputs), useColor(os.Stdout)))
+	}
+	if err != nil && job.ExitCode > 0 {
+		exitCode = job.ExitCode
+	}
+	return err
+}
+
+// formatOutputGroups will render ad-hoc outputs, one section per group of hosts with identical result
+func formatOutputGroups(groups []exec.OutputGroup, color bool) string {
+	var buf strings.Builder
+	for _, g := range groups {
+		status := g.Status
+		if color {
+			status = statusColor[g.Status] + status + "\033[0m"
+		}
+		fmt.Fprintf(&buf, "%s | %s | rc=%d | %d host(s)\n", strings.Join(g.Hosts, ","), status, g.RC, len(g.Hosts))
+		if g.Output != "" {
+			fmt.Fprintln(&buf, strings.TrimRight(g.Output, "\n"))
+		}
+		fmt.Fprintln(&buf)
+	}
+	return buf.String()
+}
+
 func init() {
 	rootCmd.AddCommand(nodesCmd)
 
+	// node ping & bash
+	nodePingCmd.Flags().BoolVarP(&varFormatJson, "json", "j", false, "json output")
+	nodeBashCmd.Flags().BoolVarP(&varFormatJson, "json", "j", false, "json output")
+	for _, c := range []*cobra.Command{nodePingCmd, nodeBashCmd} {
+		c.Flags().BoolVar(&varSSH, "ssh", false, "use native ssh instead of ansible")
+		c.Flags().IntVar(&varSSHConcurrency, "ssh-concurrency", 16, "max hosts connected concurrently (--ssh)")
+		c.Flags().DurationVar(&varSSHTimeout, "ssh-timeout", 30*time.Second, "per-host timeout (--ssh)")
+		c.Flags().StringVar(&varKnownHosts, "known-hosts", "", "known_hosts file, ~/.ssh/known_hosts by default (--ssh)")
+		c.Flags().StringVar(&varHostKeyChecking, "host-key-checking", exec.HOSTKEY_ACCEPT_NEW, "strict|accept-new|insecure (--ssh)")
+		c.Flags().StringVar(&varJumpHost, "jump", "", "jump host [user@]host[:port] (--ssh)")
+	}
+	nodesCmd.AddCommand(nodePingCmd, nodeBashCmd)
+
 	// node init
 	nodeInitCmd.Flags().BoolVarP(&varForce, "force", "f", false, "force execution")
 	nodesCmd.AddCommand(nodeInitCmd)
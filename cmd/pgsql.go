@@ -18,6 +18,7 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"github.com/Vonng/pigsty-cli/conf"
 	"github.com/Vonng/pigsty-cli/exec"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -41,6 +42,7 @@ var pgsqlCmd = &cobra.Command{
 	Long: `SYNOPSIS:
     
     pgsql list                      show pgsql cluster definition
+    pgsql topo                      show pgsql replication topology
     pgsql init                      init new postgres clusters or instances
     pgsql node                      init pgsql node
     pgsql dcs                       init pgsql dcs (consul)
@@ -59,7 +61,7 @@ var pgsqlCmd = &cobra.Command{
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		for _, c := range EX.Config.Clusters {
-			if c.Name == "meta" || varLimit != "" && !c.MatchNames(varLimits) {
+			if c.Name == "meta" || !limitCluster(&c) {
 				continue // skip meta group, and skip unmatched clusters if limit is set
 			}
 			fmt.Println(c.Repr(parseOutputFormat()))
@@ -74,7 +76,7 @@ var pgsqlListCmd = &cobra.Command{
 	Long:  `list -- list pgsql clusters`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		for _, c := range EX.Config.Clusters {
-			if c.Name == "meta" || varLimit != "" && !c.MatchNames(varLimits) {
+			if c.Name == "meta" || !limitCluster(&c) {
 				continue // skip meta group, and skip unmatched clusters if limit is set
 			}
 			fmt.Println(c.Repr(parseOutputFormat()))
@@ -83,6 +85,22 @@ var pgsqlListCmd = &cobra.Command{
 	},
 }
 
+var pgsqlTopoCmd = &cobra.Command{
+	Use:   "topo",
+	Short: "show pgsql replication topology",
+	Long:  `topo -- show pgsql replication topology as tree (standby cluster & cascade replica included)`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		topo := EX.Config.Topology()
+		fmt.Print(topo.Tree(func(ins *conf.Instance) bool {
+			return limitHost(ins.IP)
+		}))
+		for _, err := range topo.Errors {
+			logrus.Warn(err)
+		}
+		return topo.Err()
+	},
+}
+
 var pgsqlInitCmd = &cobra.Command{
 	Use:   "init",
 	Short: "init pgsql on targets",
@@ -337,6 +355,9 @@ func init() {
 	pgsqlCmd.Flags().BoolVarP(&varFormatYaml, "yaml", "y", false, "yaml output")
 	pgsqlCmd.Flags().BoolVarP(&varFormatJson, "json", "j", false, "json output")
 
+	// pgsql topo
+	pgsqlCmd.AddCommand(pgsqlTopoCmd)
+
 	// pgsql init
 	pgsqlCmd.AddCommand(pgsqlInitCmd)
 	pgsqlInitCmd.Flags().BoolVarP(&varForce, "force", "f", false, "force execution")
@@ -0,0 +1,117 @@
+/*
+Copyright © 2021 Ruohang Feng <rh@vonng.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Vonng/pigsty-cli/exec"
+	"github.com/spf13/cobra"
+	"strings"
+)
+
+var varPlaybookTasks bool
+
+// playbookCmd represents the playbook command
+var playbookCmd = &cobra.Command{
+	Use:   "playbook",
+	Short: "playbooks in pigsty home",
+	Long: `playbook -- list playbooks in pigsty home and their plays, tasks & tags
+
+    pigsty playbook list                list playbooks
+    pigsty playbook tags pgsql          list plays & tags of pgsql.yml (ansible-playbook --list-tags)
+    pigsty playbook tags pgsql --tasks  list tasks with tags (ansible-playbook --list-tasks)
+
+tags given by -t are validated against playbook before launching
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return playbookListCmd.RunE(cmd, args)
+	},
+}
+
+var playbookListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list playbooks in pigsty home",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		playbooks, err := EX.Playbooks()
+		if err != nil {
+			return err
+		}
+		if varFormatJson {
+			b, _ := json.MarshalIndent(playbooks, "", "  ")
+			fmt.Println(string(b))
+			return nil
+		}
+		fmt.Printf("%-24s  %-5s  %-5s  %s\n", "PLAYBOOK", "PLAYS", "TASKS", "TAGS")
+		for _, pb := range playbooks {
+			tasks := 0
+			for _, play := range pb.Plays {
+				tasks += len(play.Tasks)
+			}
+			fmt.Printf("%-24s  %-5d  %-5d  %s\n", pb.Name, len(pb.Plays), tasks, formatTags(pb))
+		}
+		return nil
+	},
+}
+
+var playbookTagsCmd = &cobra.Command{
+	Use:   "tags <playbook>",
+	Short: "list plays, tasks & tags of playbook",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pb, err := EX.LoadPlaybook(args[0])
+		if err != nil {
+			return err
+		}
+		if varFormatJson {
+			b, _ := json.MarshalIndent(pb, "", "  ")
+			fmt.Println(string(b))
+			return nil
+		}
+		fmt.Printf("playbook: %s\n", pb.Name)
+		for i, play := range pb.Plays {
+			fmt.Printf("\n  play #%d (%s): %s\tTAGS: [%s]\n", i+1, play.Hosts, play.Name, strings.Join(play.Tags, ", "))
+			if !varPlaybookTasks {
+				continue
+			}
+			for _, task := range play.Tasks {
+				name := task.Name
+				if task.Role != "" {
+					name = task.Role + " : " + name
+				}
+				fmt.Printf("    %s\tTAGS: [%s]\n", name, strings.Join(task.Tags, ", "))
+			}
+		}
+		fmt.Printf("\n  TASK TAGS: %s\n", formatTags(pb))
+		return nil
+	},
+}
+
+// formatTags will render tags of playbook, dynamic playbook may have more tags than discovered
+func formatTags(pb *exec.Playbook) string {
+	res := "[" + strings.Join(pb.Tags, ", ") + "]"
+	if pb.Dynamic {
+		res += " (incomplete: dynamic includes)"
+	}
+	return res
+}
+
+func init() {
+	playbookCmd.PersistentFlags().BoolVarP(&varFormatJson, "json", "j", false, "json output")
+	playbookTagsCmd.Flags().BoolVar(&varPlaybookTasks, "tasks", false, "list tasks with tags")
+	playbookCmd.AddCommand(playbookListCmd, playbookTagsCmd)
+	rootCmd.AddCommand(playbookCmd)
+}
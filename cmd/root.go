@@ -16,24 +16,53 @@ limitations under the License.
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"github.com/Vonng/pigsty-cli/conf"
 	"github.com/Vonng/pigsty-cli/exec"
 	"github.com/prometheus/common/log"
 	"github.com/spf13/cobra"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var (
-	varConfig   string
-	varLimit    string
-	varTags     []string
-	varLimits   []string
-	varLimitMap map[string]int
+	varConfig  string
+	varLimit   string
+	varTags    []string
+	varHosts   *conf.HostSet // hosts resolved from limit, nil if limit is empty
+	varExplain bool
+	varCheck   bool
+	varDiff    bool
+	varPlanOut string
+
+	varEnv               []string
+	varAnsibleConfig     string
+	varSSHArgs           string
+	varVaultPasswordFile string
+	varTimeout           time.Duration
+	varSerial            string
+	varPause             time.Duration
+	varHealthCheck       string
+	varCLIConfig         string
 )
 
+// exitCode is exit status of failed command, 1 if not set, e.g: 2 if some hosts failed
+var exitCode int
+
 // Ex is the default command executor
 var EX *exec.Executor
 
+// Runner runs jobs of default executor, ansible-playbook if nil (e.g: fake runner in tests)
+var Runner exec.Runner
+
+// annotationNoInventory marks commands that do not load inventory (e.g. config init)
+const annotationNoInventory = "no-inventory"
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "pigsty",
@@ -49,7 +78,11 @@ SYNOPSIS
     pgsql              setup postgres clusters     init|node|dcs|postgres|template|business|monitor|service|monly|remove
     infra              setup infrastructure        init|ca|dns|prometheus|grafana|loki|haproxy|target
     clean              clean pgsql clusters        all|service|monitor|postgres|dcs
-    config             mange pigsty config file    init|edit|info|dump|path
+    job                list & retry jobs           retry
+    config             mange pigsty config file    init|edit|history|rollback|migrate
+    run                run multi-step workflow     <workflow.yml>
+    playbook           playbooks in pigsty home    list|tags
+    audit              query audit log             verify
     serve              run pigsty API server       init|start|stop|restart|reload|status
     demo               setup local demo            init|up|new|clean|start|dns
     log                watch system log            query|postgres|patroni|pgbouncer|message
@@ -76,43 +109,97 @@ EXAMPLES
     6. remove cluster 'pg-test'
         pigsty clean -l pg-test
 
-    7. create user dbuser_vonng on cluster 'pg-test'
+    7. preview changes of cluster 'pg-test' without applying them
+        pigsty pgsql init -l pg-test --check --diff
+        pigsty pgsql init -l pg-test --plan-out plan.json
+
+    8. create user dbuser_vonng on cluster 'pg-test'
         pigsty pg user dbuser_vonng -l pg-test
 
-    8. create database test2 on cluster 'pg-test'
+    9. create database test2 on cluster 'pg-test'
         pigsty pg db test -l pg-test
 
+    10. show hosts of replicas of 'pg-test' except 10.10.10.13
+        pigsty pgsql init -l 'pg-test:replica,!10.10.10.13' --explain
+
+    11. push config to 'pg-test' one host at a time, replicas first, primary last
+        pigsty pgsql config -l pg-test --serial 1 --pause 30s --health-check 'pigsty pgsql list -l pg-test'
+
+    12. show tags available for -t of pgsql.yml
+        pigsty playbook tags pgsql
+
+    13. run hooks (commands or signed webhooks) on pre_run|post_run|on_failure|task_failure
+        pigsty pgsql init -l pg-test --cli-config cli.yml   # hooks: [{on: [on_failure], url: ..., secret: ...}]
+
+    14. who ran what on 10.10.10.11 in last 24 hours
+        pigsty audit --host 10.10.10.11 --since 24h
+
 
 `,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	// Run: func(cmd *cobra.Command, args []string) { },
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if _, skip := cmd.Annotations[annotationNoInventory]; !skip {
+			initExecutor()
+			if varExplain {
+				explainLimit()
+				os.Exit(0)
+			}
+			if cmd != serverCmd { // server has its own job store & signal handling
+				initJobStore()
+				if cmd != runCmd { // workflow is cancelled by its signal aware context
+					go handleSignals()
+				}
+			}
+		}
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	cobra.CheckErr(rootCmd.Execute())
+	err := rootCmd.Execute()
+	printJobSummary(os.Stdout)
+	if jobStore != nil {
+		_ = jobStore.Close()
+	}
+	if varCheck || varPlanOut != "" {
+		if planErr := outputPlans(os.Stdout, varPlanOut); planErr != nil && err == nil {
+			err = planErr
+		}
+	}
+	if err != nil && exitCode > 1 {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitCode)
+	}
+	cobra.CheckErr(err)
 }
 
 func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVarP(&varConfig, "inventory", "i", "./pigsty.yml", "inventory file")
-	rootCmd.PersistentFlags().StringVarP(&varLimit, "limit", "l", "", "limit execution hosts")
+	rootCmd.PersistentFlags().StringVarP(&varLimit, "limit", "l", "", "limit execution hosts, e.g: pg-test:replica,!10.10.10.13 (see --explain)")
+	rootCmd.PersistentFlags().BoolVar(&varExplain, "explain", false, "show hosts resolved from limit and exit")
 	rootCmd.PersistentFlags().StringSliceVarP(&varTags, "tags", "t", []string{}, "limit execution tasks")
+	rootCmd.PersistentFlags().BoolVar(&varCheck, "check", false, "check mode: preview changes without applying them")
+	rootCmd.PersistentFlags().BoolVar(&varDiff, "diff", false, "show changes made (or would be made) to files")
+	rootCmd.PersistentFlags().StringVar(&varPlanOut, "plan-out", "", "write check mode plan to json file (implies --check --diff)")
+	rootCmd.PersistentFlags().DurationVar(&varTimeout, "timeout", 0, "cancel job if it runs longer than this, e.g: 30m (no timeout by default)")
+	rootCmd.PersistentFlags().StringVar(&varSerial, "serial", "", "rolling mode: run in batches of N or N% hosts, replicas first & primaries last")
+	rootCmd.PersistentFlags().DurationVar(&varPause, "pause", 0, "rolling mode: wait between batches, e.g: 30s")
+	rootCmd.PersistentFlags().StringVar(&varHealthCheck, "health-check", "", "rolling mode: shell command run after each batch (hosts in $PIGSTY_BATCH_HOSTS), abort if it fails")
+	rootCmd.PersistentFlags().StringArrayVar(&varEnv, "env", []string{}, "environment of ansible process, KEY=VALUE, repeatable")
+	rootCmd.PersistentFlags().StringVar(&varAnsibleConfig, "ansible-config", "", "private ansible.cfg path (ANSIBLE_CONFIG)")
+	rootCmd.PersistentFlags().StringVar(&varSSHArgs, "ssh-args", "", "ssh arguments used by ansible (ANSIBLE_SSH_ARGS)")
+	rootCmd.PersistentFlags().StringVar(&varCLIConfig, "cli-config", "", "cli config with job hooks (default $PIGSTY_CLI_CONFIG or ~/.pigsty/cli.yml)")
+	rootCmd.PersistentFlags().StringVar(&varVaultPasswordFile, "vault-password-file", "", "vault password file (ANSIBLE_VAULT_PASSWORD_FILE)")
 }
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	log.Debugf("args: --config=%s --limit=%s --tags=%s", varConfig, varLimit, varTags)
 
-	// parse limit string into list and maps
-	varLimits = strings.Split(varLimit, ",")
-	varLimitMap = make(map[string]int)
-	for i, l := range varLimits {
-		varLimitMap[l] = i
-	}
-
 	// use PIGSTY_CONFIG env instead of default args
 	if envConfigPath := os.Getenv("PIGSTY_CONFIG"); varConfig == `./pigsty.yml` && envConfigPath != "" {
 		varConfig = envConfigPath
@@ -124,11 +211,140 @@ func initConfig() {
 		log.Info("pgsql inventory not implemented yet")
 		os.Exit(1)
 	}
+}
 
+// initExecutor will load inventory and build default executor
+func initExecutor() {
 	// build command executor from config path
 	EX = exec.NewExecutor(varConfig)
 	if EX == nil {
 		log.Fatal("fail to create playbook executor")
 		os.Exit(1)
 	}
+	env, err := processEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	EX.Env = env
+	if varLimit != "" && !varExplain { // --explain reports invalid limit itself
+		if varHosts, err = EX.Config.ResolveLimit(varLimit); err != nil {
+			log.Fatalf("invalid limit: %s", err)
+		}
+	}
+	if Runner != nil {
+		EX.Runner = Runner
+	}
+	hooks, err := loadHooks()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(hooks) > 0 {
+		EX.JobOpts = append(EX.JobOpts, exec.WithHooks(hooks...))
+	}
+	if varTimeout > 0 {
+		EX.JobOpts = append(EX.JobOpts, exec.WithTimeout(varTimeout))
+	}
+	if varSerial != "" {
+		EX.JobOpts = append(EX.JobOpts, exec.WithSerial(varSerial), exec.WithPause(varPause), exec.WithHealthCheck(varHealthCheck))
+	}
+	// --plan-out implies check & diff mode
+	if varCheck || varPlanOut != "" {
+		EX.JobOpts = append(EX.JobOpts, exec.WithCheck())
+	}
+	if varDiff || varPlanOut != "" {
+		EX.JobOpts = append(EX.JobOpts, exec.WithDiff())
+	}
+}
+
+// explainLimit will print how limit is resolved against inventory
+func explainLimit() {
+	limit := varLimit
+	if limit == "" {
+		limit = "all"
+	}
+	explain, err := EX.Config.ExplainLimit(limit)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprint(os.Stderr, "\n"+conf.LimitGrammar)
+		os.Exit(1)
+	}
+	fmt.Print(explain)
+	if varSerial != "" {
+		hosts, _ := EX.Config.ResolveLimit(limit)
+		batches, err := exec.Batches(EX.Config, hosts.Hosts, varSerial)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("batches (%d):\n", len(batches))
+		for i, batch := range batches {
+			fmt.Printf("  %-3d %s\n", i+1, strings.Join(batch, ","))
+		}
+	}
+}
+
+// limitHost tells whether host is selected by limit
+func limitHost(ip string) bool {
+	return varHosts == nil || varHosts.Contains(ip)
+}
+
+// limitCluster tells whether any host of cluster is selected by limit
+func limitCluster(cls *conf.Cluster) bool {
+	for _, ins := range cls.Instances {
+		if limitHost(ins.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadHooks will load job hooks from cli config: --cli-config, $PIGSTY_CLI_CONFIG or ~/.pigsty/cli.yml if exists
+func loadHooks() ([]*exec.Hook, error) {
+	path := varCLIConfig
+	if path == "" {
+		path = os.Getenv("PIGSTY_CLI_CONFIG")
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		hooks, err := exec.LoadHooks(filepath.Join(home, ".pigsty", "cli.yml"))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return hooks, err
+	}
+	return exec.LoadHooks(path)
+}
+
+// processEnv will build environment of ansible process from --env and shortcut flags
+func processEnv() (map[string]string, error) {
+	env, err := exec.ParseEnv(varEnv)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range map[string]string{
+		"ANSIBLE_CONFIG":              varAnsibleConfig,
+		"ANSIBLE_SSH_ARGS":            varSSHArgs,
+		"ANSIBLE_VAULT_PASSWORD_FILE": varVaultPasswordFile,
+	} {
+		if v != "" {
+			env[k] = v
+		}
+	}
+	return env, nil
+}
+
+// handleSignals will cancel running jobs on SIGINT & SIGTERM, which are interrupted gracefully.
+// Exit immediately if there are no running jobs
+func handleSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range ch {
+		if EX == nil || EX.CancelJobs() == 0 {
+			os.Exit(130)
+		}
+		log.Warnf("receive %s, cancelling running jobs", sig)
+	}
 }
@@ -0,0 +1,107 @@
+/*
+Copyright © 2021 Ruohang Feng <rh@vonng.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/Vonng/pigsty-cli/exec"
+	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runCmd will run a multi-step workflow
+var runCmd = &cobra.Command{
+	Use:   "run <workflow.yml>",
+	Short: "run multi-step workflow",
+	Long: `run -- run multi-step workflow composed of playbooks
+
+    Steps run one by one in dependency order. A failed step aborts the workflow
+    unless continue_on_error is set, then rollback of steps have run are executed
+    in reverse order. --limit will overwrite workflow's default limit.
+    Ctrl-C cancels running step and aborts the workflow, then rollback is executed
+    and can not be interrupted.
+
+EXAMPLE
+
+    name: create-pg-test
+    limit: pg-test                      # default limit of steps
+    vars: { pg_exists_action: clean }   # default extra vars of steps
+    steps:
+      - name: node
+        playbook: node.yml
+      - name: pgsql
+        playbook: pgsql.yml
+        needs: [ node ]
+        rollback: { playbook: pgsql-remove.yml }
+      - name: monitor
+        playbook: pgsql.yml
+        tags: [ monitor ]
+        needs: [ pgsql ]
+        timeout: 10m
+        serial: 50%                     # rolling in batches, replicas first & primary last
+        pause: 10s
+        continue_on_error: true
+      - name: target
+        playbook: infra.yml
+        tags: [ prometheus_targets, prometheus_reload ]
+        limit: meta
+        needs: [ pgsql ]
+
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		wf, err := exec.LoadWorkflow(args[0])
+		if err != nil {
+			return err
+		}
+		if varLimit != "" {
+			wf.Limit = varLimit
+		}
+		wf.OnStep = printStepProgress
+		// signals are captured until workflow returns, so rollback is not interrupted
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		run, err := wf.Run(ctx, EX)
+		if run != nil {
+			fmt.Printf("\n[%s] workflow %s (%s)\n", run.Status, run.Name, run.DoneAt.Sub(run.StartAt).Round(time.Second))
+		}
+		return err
+	},
+}
+
+// printStepProgress will print workflow step progress to stderr
+func printStepProgress(s *exec.StepRun) {
+	kind := "step"
+	if s.Rollback {
+		kind = "rollback"
+	}
+	switch s.Status {
+	case exec.STEP_RUNNING:
+		fmt.Fprintf(os.Stderr, "\n==> [%d/%d] %s %s: %s\n", s.Index, s.Total, kind, s.Name, s.Job.Command)
+	case exec.STEP_SKIPPED:
+		fmt.Fprintf(os.Stderr, "==> [%d/%d] %s %s: skipped\n", s.Index, s.Total, kind, s.Name)
+	default:
+		fmt.Fprintf(os.Stderr, "==> [%d/%d] %s %s: %s (%s)\n", s.Index, s.Total, kind, s.Name, s.Status, s.DoneAt.Sub(s.StartAt).Round(time.Second))
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(runCmd)
+}
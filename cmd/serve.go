@@ -16,15 +16,21 @@ limitations under the License.
 package cmd
 
 import (
+	"github.com/Vonng/pigsty-cli/exec"
 	"github.com/Vonng/pigsty-cli/server"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"time"
 )
 
 var (
 	varServerListenAddress string
 	varServerDataDir       string
 	varServerPublicDir     string
+	varServerConcurrency   int
+	varServerWatch         time.Duration
+	varServerMaxJobs       int
+	varServerMaxJobAge     time.Duration
 )
 
 // serverCmd represents the server command
@@ -36,8 +42,16 @@ var serverCmd = &cobra.Command{
                  -L|--listen-addr listen_address      (:9633 by default)
                  -P|--public-dir  public resource dir (embed by default)
                  -D|--data-dir     log dir            (/tmp/pigsty by default)
+                 -C|--concurrency max running jobs    (4 by default)
+                 --watch-interval check inventory changes and reload (2s by default, 0 disables)
+                 --max-jobs       finished jobs kept in job history (1000 by default, 0 disables)
+                 --max-job-age    drop jobs finished longer than this, e.g: 720h (0 by default, disabled)
+                 --env KEY=VALUE  environment of job process, with --ansible-config, --ssh-args, --vault-password-file
                   (will create <public_dir>/log for logging purpose)
 
+    inventory is reloaded on SIGHUP or when it changes on disk: new jobs use new config,
+    queued & running jobs keep config they are created with, invalid inventory is not loaded
+
 EXAMPLE:
 
     # run server
@@ -46,23 +60,64 @@ EXAMPLE:
     # get config
         curl http://localhost:9633/api/v1/config
    
-    # post config (YAML config as body)
+    # post config (YAML config as body), invalid config is rejected, changes are returned after reload
         curl -X POST http://localhost:9633/api/v1/config -d@<pigsty.yml>
+
+    # reload inventory edited on disk
+        kill -HUP <server_pid>
    
-    # list jobs
-        curl -X GET http://localhost:9633/api/v1/jobs
+    # list jobs (filter by status, cluster, playbook, since/until in RFC3339, limit)
+        curl -X GET http://localhost:9633/api/v1/jobs?status=failed&cluster=pg-test
+
+    # get job with events by id
+        curl -X GET http://localhost:9633/api/v1/jobs/:jobid
+
+    # follow job output from byte offset, poll with offset=<next> until done
+        curl -X GET http://localhost:9633/api/v1/jobs/:jobid/output?offset=0
+
+    # get asciicast recording of job output (asciinema play)
+        curl -X GET http://localhost:9633/api/v1/jobs/:jobid/cast
 
     # get current job
         curl -X GET http://localhost:9633/api/v1/job
 
-    # create new job ( pgsql init @ pg-test )
+    # list playbooks in pigsty home, get plays, tasks & tags of playbook
+        curl -X GET http://localhost:9633/api/v1/playbooks
+        curl -X GET http://localhost:9633/api/v1/playbooks/pgsql.yml
+
+    # create new job ( pgsql init @ pg-test ), unknown playbook or tags are rejected with 400
         curl -X POST http://localhost:9633/api/v1/job?playbook=pgsql&cluster=pg-test
 
+    # create new job with timeout, job is cancelled (SIGINT, SIGKILL after grace period) if runs longer
+        curl -X POST http://localhost:9633/api/v1/job?playbook=pgsql&cluster=pg-test&timeout=30m
+
+    # create rolling job, one host per batch (replicas first, primary last), wait 30s between batches
+        curl -X POST http://localhost:9633/api/v1/job?playbook=pgsql&cluster=pg-test&tags=pg_conf&serial=1&pause=30s
+
+    # preview changes of new job in check & diff mode, then get its plan
+        curl -X POST http://localhost:9633/api/v1/job?playbook=pgsql&cluster=pg-test&check=true&diff=true
+        curl -X GET http://localhost:9633/api/v1/jobs/:jobid/plan
+
+    # retry failed & unreachable hosts of job, start at first failed task
+        curl -X POST http://localhost:9633/api/v1/jobs/:jobid/retry?failed_only=true&start_at_task=-
+
     # create new job ( pgsql remove @ pg-test2 )
         curl -X POST http://localhost:9633/api/v1/job?playbook=pgsql-remove&cluster=pg-test2
 
-    # cancel job
-        curl -X DELETE http://localhost:9633/api/v1/job
+    # cancel job (latest running job if id is not given)
+        curl -X DELETE http://localhost:9633/api/v1/job?id=<jobid>
+
+    # list running & queued jobs
+        curl -X GET http://localhost:9633/api/v1/queue
+
+    # move queued job to head of queue
+        curl -X POST http://localhost:9633/api/v1/queue/:jobid?pos=0
+
+    # cancel queued or running job
+        curl -X DELETE http://localhost:9633/api/v1/queue/:jobid
+
+    # query audit log (filter by actor, action, host, job, since/until in RFC3339, limit)
+        curl -X GET http://localhost:9633/api/v1/audit?host=10.10.10.11&limit=20
 
     # list logs
         curl -X GET http://localhost:9633/api/v1/logs
@@ -76,13 +131,26 @@ EXAMPLE:
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		logrus.Debugf("pigsty server run @ %s , use config %s, data dir %s, public dir %s", varServerListenAddress, varConfig, varServerDataDir, varServerPublicDir)
-		server.InitDefaultServer(varServerListenAddress, varConfig, varServerDataDir, varServerPublicDir)
+		env, err := processEnv()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		hooks, err := loadHooks()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		server.InitDefaultServer(varServerListenAddress, varConfig, varServerDataDir, varServerPublicDir, varServerConcurrency, server.WithEnv(env), server.WithHooks(hooks...), server.WithWatchInterval(varServerWatch),
+			server.WithJobRetention(exec.JobRetention{MaxJobs: varServerMaxJobs, MaxAge: varServerMaxJobAge}))
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(serverCmd)
 	serverCmd.Flags().StringVarP(&varServerListenAddress, "listen-addr", "L", ":9633", "listen address")
-	serverCmd.Flags().StringVarP(&varServerDataDir, "data-dir", "D", "/tmp/pigsty", "temporary resource dir")
+	serverCmd.Flags().StringVarP(&varServerDataDir, "data-dir", "D", defaultDataDir, "temporary resource dir")
 	serverCmd.Flags().StringVarP(&varServerPublicDir, "public-dir", "P", "embed", "public resource dir")
+	serverCmd.Flags().IntVarP(&varServerConcurrency, "concurrency", "C", exec.DefaultConcurrency, "max running jobs")
+	serverCmd.Flags().DurationVar(&varServerWatch, "watch-interval", server.DefaultWatchInterval, "check inventory changes and reload, 0 disables it")
+	serverCmd.Flags().IntVar(&varServerMaxJobs, "max-jobs", exec.DefaultJobRetention.MaxJobs, "retention: finished jobs kept in job history, 0 disables it")
+	serverCmd.Flags().DurationVar(&varServerMaxJobAge, "max-job-age", exec.DefaultJobRetention.MaxAge, "retention: drop jobs finished longer than this, e.g: 720h, 0 disables it")
 }
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"gopkg.in/yaml.v3"
-	"regexp"
 	"strings"
 )
 
@@ -54,6 +53,7 @@ func (c *Cluster) AddInstance(ip string, vars Vars) error {
 	}
 	seq, seqExists := vars.GetInteger("pg_seq")
 	role, roleExists := vars.GetString("pg_role")
+	upstream, _ := vars.GetString("pg_upstream")
 	if c.Name != GROUP_META { // meta group does not require identity fields
 		if !seqExists {
 			return fmt.Errorf("instance pg_seq is required: %v", vars)
@@ -66,12 +66,13 @@ func (c *Cluster) AddInstance(ip string, vars Vars) error {
 		}
 	}
 	c.Instances = append(c.Instances, Instance{
-		IP:      ip,
-		Name:    fmt.Sprintf("%s-%d", c.Name, seq),
-		Seq:     seq,
-		Role:    role,
-		Vars:    vars,
-		Cluster: c,
+		IP:       ip,
+		Name:     fmt.Sprintf("%s-%d", c.Name, seq),
+		Seq:      seq,
+		Role:     role,
+		Upstream: upstream,
+		Vars:     vars,
+		Cluster:  c,
 	})
 	var ins *Instance
 	ins = &(c.Instances[len(c.Instances)-1])
@@ -194,25 +195,3 @@ func (c *Cluster) Repr(format string) (s string) {
 		return c.String()
 	}
 }
-
-// MatchName test whether a name or glob regexp matches cluster's name
-func (c *Cluster) MatchName(name string) bool {
-	if c.Name == name {
-		return true
-	}
-	re, err := regexp.CompilePOSIX(name)
-	if err != nil {
-		return false
-	}
-	return re.MatchString(c.Name)
-}
-
-// MatchNames perform multiple match
-func (c *Cluster) MatchNames(names []string) bool {
-	for _, n := range names {
-		if c.MatchName(n) {
-			return true
-		}
-	}
-	return false
-}
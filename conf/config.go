@@ -249,36 +249,56 @@ func ParseConfig(data []byte) (cfg *Config, err error) {
 
 // OverwriteConfig will write config content, and old config if exists
 func OverwriteConfig(data []byte, path string) (err error) {
+	_, err = writeConfig(data, path)
+	return err
+}
+
+// writeConfig will replace config with data atomically, old config is kept as
+// <path>.bakYYYYMMDDHHMMSS, and its path is returned (empty if not exists)
+func writeConfig(data []byte, path string) (bakPath string, err error) {
 	// check whether it's a valid config
 	if _, err := ParseConfig(data); err != nil {
-		return fmt.Errorf("invalid config: %w", err)
+		return "", fmt.Errorf("invalid config: %w", err)
 	}
 
-	var dstPath, tmpPath, bakPath string
+	var dstPath, tmpPath string
 	dstPath = path // fix dst path if it is a dir
 	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
 		logrus.Infof("config path %s is a dir, append pigsty.yml to path", path)
 		dstPath = filepath.Join(path, "pigsty.yml")
 	}
-	tmpPath = dstPath + ".tmp"                                       // write new config to tmp
-	bakPath = dstPath + ".bak" + time.Now().Format("20060102150405") // write old config to bak
+	tmpPath = dstPath + ".tmp" // write new config to tmp
 	// write new config to tmp path
 	if err = ioutil.WriteFile(tmpPath, data, 0644); err != nil {
-		return fmt.Errorf("fail to write new config to tmp path: %s %w", tmpPath, err)
+		return "", fmt.Errorf("fail to write new config to tmp path: %s %w", tmpPath, err)
 	}
-	// backup old config to bak path
+	// backup old config to bak path (hard link, or copy if link not available)
 	if fi, err := os.Stat(dstPath); err == nil && !fi.IsDir() {
-		if err = os.Rename(dstPath, bakPath); err != nil {
-			return fmt.Errorf("fail to swap tmp config %s to %s : %w", tmpPath, dstPath, err)
+		bakPath = dstPath + ".bak" + time.Now().Format(bakTimeFormat) // write old config to bak
+		// avoid overwrite snapshot made in same second
+		for i := 1; ; i++ {
+			if _, err := os.Stat(bakPath); os.IsNotExist(err) {
+				break
+			}
+			bakPath = fmt.Sprintf("%s.bak%s-%d", dstPath, time.Now().Format(bakTimeFormat), i)
+		}
+		if err = os.Link(dstPath, bakPath); err != nil {
+			old, err := ioutil.ReadFile(dstPath)
+			if err == nil {
+				err = ioutil.WriteFile(bakPath, old, fi.Mode())
+			}
+			if err != nil {
+				return "", fmt.Errorf("fail to backup config %s to %s : %w", dstPath, bakPath, err)
+			}
 		}
-		logrus.Warnf("rename existing config from %s to %s", dstPath, bakPath)
+		logrus.Warnf("backup existing config from %s to %s", dstPath, bakPath)
 	}
 	// swap new config with dst path
 	if err = os.Rename(tmpPath, dstPath); err != nil {
 		logrus.Errorf("fail to swap tmp config %s to %s", tmpPath, dstPath)
-		return fmt.Errorf("fail to swap tmp config %s to %s : %w", tmpPath, dstPath, err)
+		return bakPath, fmt.Errorf("fail to swap tmp config %s to %s : %w", tmpPath, dstPath, err)
 	}
-	return nil
+	return bakPath, nil
 }
 
 // LoadConfig will read config file from disk
@@ -290,6 +310,9 @@ func LoadConfig(path string) (cfg *Config, err error) {
 	if cfg, err = ParseConfig(data); err != nil {
 		return
 	}
+	if cfg == nil {
+		return nil, fmt.Errorf("empty config %s", path)
+	}
 	cfg.path = path
 	cfg.raw = data
 	return cfg, nil
@@ -15,7 +15,8 @@ const (
 	ROLE_DELAYED = "delayed"
 )
 
-// AvailableRoles contains valid role names
+// AvailableRoles contains valid role names, true if role leads the cluster
+// (it replicates from nothing, or from pg_upstream in a standby cluster)
 var AvailableRoles = map[string]bool{
 	ROLE_PRIMARY: true,
 	ROLE_REPLICA: false,
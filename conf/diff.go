@@ -0,0 +1,154 @@
+package conf
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+/**************************************************************\
+*                       Semantic Diff                          *
+\**************************************************************/
+// change kinds
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// Change is a single semantic difference between two configs
+type Change struct {
+	Kind   string      `json:"kind"`          // added|removed|modified
+	Object string      `json:"object"`        // cluster|instance|var
+	Path   string      `json:"path"`          // cluster name, instance ip, or scope.key for vars
+	Old    interface{} `json:"old,omitempty"` // old value (vars & instance role)
+	New    interface{} `json:"new,omitempty"` // new value (vars & instance role)
+}
+
+// String will print one-line representation of change
+func (c Change) String() string {
+	switch c.Kind {
+	case ChangeAdded:
+		return fmt.Sprintf("+ %s %s", c.Object, c.Path)
+	case ChangeRemoved:
+		return fmt.Sprintf("- %s %s", c.Object, c.Path)
+	default:
+		return fmt.Sprintf("~ %s %s: %v -> %v", c.Object, c.Path, c.Old, c.New)
+	}
+}
+
+// DiffConfig will compare clusters, instances and vars of two configs
+func DiffConfig(a, b *Config) (changes []Change) {
+	changes = append(changes, diffVars("all.vars", a.Vars, b.Vars)...)
+
+	clusters := func(c *Config) map[string]*Cluster {
+		m := make(map[string]*Cluster)
+		for i := range c.Clusters {
+			m[c.Clusters[i].Name] = &(c.Clusters[i])
+		}
+		return m
+	}
+	ac, bc := clusters(a), clusters(b)
+	for _, name := range unionKeys(ac, bc) {
+		x, y := ac[name], bc[name]
+		switch {
+		case y == nil:
+			changes = append(changes, Change{Kind: ChangeRemoved, Object: "cluster", Path: name})
+		case x == nil:
+			changes = append(changes, Change{Kind: ChangeAdded, Object: "cluster", Path: name})
+		default:
+			changes = append(changes, diffCluster(x, y)...)
+		}
+	}
+	return
+}
+
+// diffCluster will compare instances and vars of same cluster
+func diffCluster(a, b *Cluster) (changes []Change) {
+	changes = append(changes, diffVars(a.Name+".vars", a.Vars, b.Vars)...)
+	instances := func(c *Cluster) map[string]*Instance {
+		m := make(map[string]*Instance)
+		for i := range c.Instances {
+			m[c.Instances[i].IP] = &(c.Instances[i])
+		}
+		return m
+	}
+	ai, bi := instances(a), instances(b)
+	for _, ip := range unionKeys(ai, bi) {
+		x, y := ai[ip], bi[ip]
+		path := a.Name + "." + ip
+		switch {
+		case y == nil:
+			changes = append(changes, Change{Kind: ChangeRemoved, Object: "instance", Path: path})
+		case x == nil:
+			changes = append(changes, Change{Kind: ChangeAdded, Object: "instance", Path: path})
+		default:
+			changes = append(changes, diffVars(path, x.Vars, y.Vars)...)
+		}
+	}
+	return
+}
+
+// diffVars will compare vars by key
+func diffVars(scope string, a, b Vars) (changes []Change) {
+	for _, key := range unionKeys(a.Data, b.Data) {
+		x, xok := a.Data[key]
+		y, yok := b.Data[key]
+		path := scope + "." + key
+		switch {
+		case !yok:
+			changes = append(changes, Change{Kind: ChangeRemoved, Object: "var", Path: path, Old: x})
+		case !xok:
+			changes = append(changes, Change{Kind: ChangeAdded, Object: "var", Path: path, New: y})
+		case !reflect.DeepEqual(x, y):
+			changes = append(changes, Change{Kind: ChangeModified, Object: "var", Path: path, Old: x, New: y})
+		}
+	}
+	return
+}
+
+// unionKeys will return sorted keys of two maps
+func unionKeys(a, b interface{}) []string {
+	seen := make(map[string]bool)
+	for _, m := range []interface{}{a, b} {
+		for _, k := range reflect.ValueOf(m).MapKeys() {
+			seen[k.String()] = true
+		}
+	}
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SummarizeChanges will turn changes into one-line summary
+func SummarizeChanges(changes []Change) string {
+	if len(changes) == 0 {
+		return "no semantic change"
+	}
+	var parts []string
+	var vars int
+	for _, c := range changes {
+		if c.Object == "var" {
+			vars++
+			continue
+		}
+		sign := map[string]string{ChangeAdded: "+", ChangeRemoved: "-", ChangeModified: "~"}[c.Kind]
+		parts = append(parts, fmt.Sprintf("%s%s %s", sign, c.Object, c.Path))
+	}
+	if vars > 0 {
+		if vars == 1 {
+			for _, c := range changes {
+				if c.Object == "var" {
+					parts = append(parts, c.String())
+				}
+			}
+		} else {
+			parts = append(parts, fmt.Sprintf("~%d vars", vars))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
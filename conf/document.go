@@ -0,0 +1,407 @@
+package conf
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"strings"
+)
+
+/**************************************************************\
+*                         Document                             *
+\**************************************************************/
+// Document is a comment-preserving view of config file content
+//
+// yaml.Node tree is used for locating entries only, modification are applied
+// to original text lines in place, so comments, blank lines and alignment
+// survive. node tree is re-parsed after each modification.
+type Document struct {
+	lines []string
+	root  *yaml.Node
+}
+
+// ParseDocument will parse config content into document
+func ParseDocument(data []byte) (*Document, error) {
+	d := &Document{lines: strings.Split(string(data), "\n")}
+	if err := d.reparse(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Bytes will return document content
+func (d *Document) Bytes() []byte {
+	return []byte(strings.Join(d.lines, "\n"))
+}
+
+// reparse will rebuild node tree from lines
+func (d *Document) reparse() error {
+	var root yaml.Node
+	if err := yaml.Unmarshal(d.Bytes(), &root); err != nil {
+		return err
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("config document must contain a YAML mapping")
+	}
+	d.root = root.Content[0]
+	return nil
+}
+
+/**************************************************************\
+*                          Lookup                              *
+\**************************************************************/
+// Lookup will return mapping value node by key path, nil if not exists
+func (d *Document) Lookup(path ...string) *yaml.Node {
+	node := d.root
+	for _, key := range path {
+		if node == nil {
+			return nil
+		}
+		_, node = mapEntry(node, key)
+	}
+	return node
+}
+
+// Get will return value node of key in given scope, nil if not exists
+func (d *Document) Get(scope []string, key string) *yaml.Node {
+	m := d.Lookup(scope...)
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil
+	}
+	_, v := mapEntry(m, key)
+	return v
+}
+
+// Scopes will list all variable scopes: global vars, cluster vars and host vars
+func (d *Document) Scopes() (scopes [][]string) {
+	if d.Lookup("all", "vars") != nil {
+		scopes = append(scopes, []string{"all", "vars"})
+	}
+	children := d.Lookup("all", "children")
+	if children == nil || children.Kind != yaml.MappingNode {
+		return
+	}
+	for _, cls := range getMapKeys(*children) {
+		if d.Lookup("all", "children", cls, "vars") != nil {
+			scopes = append(scopes, []string{"all", "children", cls, "vars"})
+		}
+		hosts := d.Lookup("all", "children", cls, "hosts")
+		if hosts == nil || hosts.Kind != yaml.MappingNode {
+			continue
+		}
+		for _, host := range getMapKeys(*hosts) {
+			if h := d.Lookup("all", "children", cls, "hosts", host); h != nil && h.Kind == yaml.MappingNode {
+				scopes = append(scopes, []string{"all", "children", cls, "hosts", host})
+			}
+		}
+	}
+	return
+}
+
+// ScopeName will turn scope path into human readable name
+func ScopeName(scope []string) string {
+	return strings.Join(scope, ".")
+}
+
+/**************************************************************\
+*                        Modification                          *
+\**************************************************************/
+// Rename will rename key in given scope in place
+func (d *Document) Rename(scope []string, key, newKey string) error {
+	m := d.Lookup(scope...)
+	k, _ := mapEntry(m, key)
+	if k == nil {
+		return fmt.Errorf("%s not found in %s", key, ScopeName(scope))
+	}
+	if _, exists := mapEntry(m, newKey); exists != nil {
+		return fmt.Errorf("%s already exists in %s", newKey, ScopeName(scope))
+	}
+	start, end, err := d.tokenSpan(k)
+	if err != nil {
+		return err
+	}
+	d.replace(k.Line, start, end, newKey)
+	return d.reparse()
+}
+
+// Set will overwrite scalar value of key in given scope, or add a new entry
+// value is written as is, so it must be valid YAML flow text
+func (d *Document) Set(scope []string, key, value string) error {
+	m := d.Lookup(scope...)
+	if m == nil || m.Kind != yaml.MappingNode {
+		return fmt.Errorf("scope %s not found", ScopeName(scope))
+	}
+	if _, v := mapEntry(m, key); v != nil {
+		start, end, err := d.tokenSpan(v)
+		if err != nil {
+			return err
+		}
+		d.replace(v.Line, start, end, value)
+		return d.reparse()
+	}
+	return d.Add(scope, key, value)
+}
+
+// Add will append new entry to mapping of given scope, multi-line value is
+// only allowed in block mapping, and should be indented relative to key
+func (d *Document) Add(scope []string, key, value string) error {
+	m := d.Lookup(scope...)
+	if m == nil || m.Kind != yaml.MappingNode {
+		return fmt.Errorf("scope %s not found", ScopeName(scope))
+	}
+	if k, _ := mapEntry(m, key); k != nil {
+		return fmt.Errorf("%s already exists in %s", key, ScopeName(scope))
+	}
+	multiline := strings.Contains(value, "\n")
+
+	// flow mapping: insert entry before closing brace
+	if m.Style&yaml.FlowStyle != 0 {
+		if multiline {
+			return fmt.Errorf("can not add multi-line value %s to flow mapping %s", key, ScopeName(scope))
+		}
+		line, col, sep := m.Line, m.Column, "" // col points at '{', insert after it
+		if n := len(m.Content); n > 0 {
+			last := m.Content[n-1]
+			_, end, err := d.tokenSpan(last)
+			if err != nil {
+				return err
+			}
+			line, col, sep = last.Line, end, ", "
+		}
+		runes := []rune(d.lines[line-1])
+		pos := strings.IndexRune(string(runes[col:]), '}')
+		if pos < 0 {
+			return fmt.Errorf("multi-line flow mapping %s is not supported", ScopeName(scope))
+		}
+		insert := col + len([]rune(string(runes[col:])[:pos]))
+		d.replace(line, col, insert, sep+key+": "+value)
+		return d.reparse()
+	}
+
+	// block mapping: insert lines after last entry with same indent
+	if len(m.Content) == 0 {
+		return fmt.Errorf("empty block mapping %s is not supported", ScopeName(scope))
+	}
+	indent := strings.Repeat(" ", m.Content[0].Column-1)
+	after := subtreeEnd(m.Content[len(m.Content)-1])
+	var inserts []string
+	if multiline {
+		parts := strings.Split(value, "\n")
+		inserts = append(inserts, indent+key+":"+prefixSpace(parts[0]))
+		for _, l := range parts[1:] {
+			inserts = append(inserts, indent+l)
+		}
+	} else {
+		inserts = append(inserts, indent+key+": "+value)
+	}
+	d.lines = append(d.lines[:after], append(inserts, d.lines[after:]...)...)
+	return d.reparse()
+}
+
+// Delete will remove entry from given scope, and return its value text
+// (multi-line value text is indented relative to key, as Add requires)
+func (d *Document) Delete(scope []string, key string) (string, error) {
+	m := d.Lookup(scope...)
+	k, v := mapEntry(m, key)
+	if k == nil {
+		return "", fmt.Errorf("%s not found in %s", key, ScopeName(scope))
+	}
+	value, err := d.valueText(k, v)
+	if err != nil {
+		return "", err
+	}
+
+	if m.Style&yaml.FlowStyle != 0 {
+		if k.Line != subtreeEnd(v) {
+			return "", fmt.Errorf("multi-line flow mapping %s is not supported", ScopeName(scope))
+		}
+		start, _, _ := d.tokenSpan(k)
+		_, end, err := d.valueSpan(v)
+		if err != nil {
+			return "", err
+		}
+		idx := entryIndex(m, key)
+		if idx+2 < len(m.Content) { // not last entry: remove until next key
+			next := m.Content[idx+2]
+			if next.Line != k.Line {
+				return "", fmt.Errorf("multi-line flow mapping %s is not supported", ScopeName(scope))
+			}
+			end, _, _ = d.tokenSpan(next)
+		} else if idx > 0 { // last entry: remove separator after previous value
+			prev := m.Content[idx-1]
+			if prev.Line == k.Line {
+				_, start, _ = d.valueSpan(prev)
+			}
+		}
+		d.replace(k.Line, start, end, "")
+		return value, d.reparse()
+	}
+
+	if len(m.Content) == 2 {
+		return "", fmt.Errorf("can not remove last entry %s of block mapping %s", key, ScopeName(scope))
+	}
+	d.lines = append(d.lines[:k.Line-1], d.lines[subtreeEnd(v):]...)
+	return value, d.reparse()
+}
+
+// Move will move entry from one scope to another
+func (d *Document) Move(from []string, key string, to []string) error {
+	if d.Get(to, key) != nil {
+		return fmt.Errorf("%s already exists in %s", key, ScopeName(to))
+	}
+	if t := d.Lookup(to...); t == nil || t.Kind != yaml.MappingNode {
+		return fmt.Errorf("scope %s not found", ScopeName(to))
+	}
+	value, err := d.Delete(from, key)
+	if err != nil {
+		return err
+	}
+	return d.Add(to, key, value)
+}
+
+/**************************************************************\
+*                         Text Helper                          *
+\**************************************************************/
+// replace will replace runes [start,end) of 1-based line with text
+func (d *Document) replace(line, start, end int, text string) {
+	runes := []rune(d.lines[line-1])
+	d.lines[line-1] = string(runes[:start]) + text + string(runes[end:])
+}
+
+// tokenSpan will return [start,end) rune offset of a single line scalar token
+func (d *Document) tokenSpan(n *yaml.Node) (int, int, error) {
+	if n.Kind != yaml.ScalarNode {
+		return 0, 0, fmt.Errorf("line %d: scalar expected", n.Line)
+	}
+	runes := []rune(d.lines[n.Line-1])
+	start := n.Column - 1
+	if start > len(runes) {
+		return 0, 0, fmt.Errorf("line %d: invalid column %d", n.Line, n.Column)
+	}
+	switch {
+	case n.Style&yaml.SingleQuotedStyle != 0:
+		for i := start + 1; i < len(runes); i++ {
+			if runes[i] == '\'' {
+				if i+1 < len(runes) && runes[i+1] == '\'' {
+					i++ // escaped quote
+					continue
+				}
+				return start, i + 1, nil
+			}
+		}
+	case n.Style&yaml.DoubleQuotedStyle != 0:
+		for i := start + 1; i < len(runes); i++ {
+			if runes[i] == '\\' {
+				i++
+				continue
+			}
+			if runes[i] == '"' {
+				return start, i + 1, nil
+			}
+		}
+	case n.Style&(yaml.LiteralStyle|yaml.FoldedStyle) == 0:
+		end := start + len([]rune(n.Value))
+		if end <= len(runes) && string(runes[start:end]) == n.Value {
+			return start, end, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("line %d: unsupported scalar layout %q", n.Line, n.Value)
+}
+
+// valueSpan will return [start,end) rune offset of single line value (scalar or flow collection)
+func (d *Document) valueSpan(n *yaml.Node) (int, int, error) {
+	if n.Kind == yaml.ScalarNode {
+		return d.tokenSpan(n)
+	}
+	if n.Style&yaml.FlowStyle == 0 || subtreeEnd(n) != n.Line {
+		return 0, 0, fmt.Errorf("line %d: single line value expected", n.Line)
+	}
+	runes := []rune(d.lines[n.Line-1])
+	start, depth, quote := n.Column-1, 0, rune(0)
+	for i := start; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '{' || r == '[':
+			depth++
+		case r == '}' || r == ']':
+			if depth--; depth == 0 {
+				return start, i + 1, nil
+			}
+		}
+	}
+	return 0, 0, fmt.Errorf("line %d: unbalanced flow collection", n.Line)
+}
+
+// valueText will return source text of an entry's value
+func (d *Document) valueText(k, v *yaml.Node) (string, error) {
+	if v.Line == k.Line && subtreeEnd(v) == k.Line {
+		start, end, err := d.valueSpan(v)
+		if err != nil {
+			return "", err
+		}
+		return string([]rune(d.lines[v.Line-1])[start:end]), nil
+	}
+	// multi-line block value: rest of key line and following lines, indent relative to key
+	keyLine := []rune(d.lines[k.Line-1])
+	head := strings.TrimSpace(strings.TrimPrefix(string(keyLine[k.Column-1:]), k.Value))
+	head = strings.TrimSpace(strings.TrimPrefix(head, ":"))
+	parts := []string{head}
+	for _, l := range d.lines[k.Line:subtreeEnd(v)] {
+		parts = append(parts, trimIndent(l, k.Column-1))
+	}
+	return strings.Join(parts, "\n"), nil
+}
+
+// mapEntry will return key & value node of given key in mapping node
+func mapEntry(m *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if m == nil || m.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	if i := entryIndex(m, key); i >= 0 {
+		return m.Content[i], m.Content[i+1]
+	}
+	return nil, nil
+}
+
+// entryIndex will return key node index of given key in mapping node, -1 if not found
+func entryIndex(m *yaml.Node, key string) int {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// subtreeEnd will return last line (1-based) occupied by node and its children
+func subtreeEnd(n *yaml.Node) int {
+	end := n.Line
+	for _, c := range n.Content {
+		if l := subtreeEnd(c); l > end {
+			end = l
+		}
+	}
+	return end
+}
+
+// trimIndent will remove at most n leading spaces
+func trimIndent(s string, n int) string {
+	i := 0
+	for i < n && i < len(s) && s[i] == ' ' {
+		i++
+	}
+	return s[i:]
+}
+
+// prefixSpace will prepend a space to non-empty string
+func prefixSpace(s string) string {
+	if s == "" {
+		return s
+	}
+	return " " + s
+}
@@ -0,0 +1,200 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**************************************************************\
+*                         Generate                             *
+\**************************************************************/
+// Profiles are available sizing profiles, which decide node_tune & pg_conf
+var Profiles = []string{"tiny", "oltp", "olap", "crit"}
+
+// ClusterLayout describe a pgsql cluster to be generated: name=size
+type ClusterLayout struct {
+	Name string
+	Size int
+}
+
+// ParseClusterLayout will parse layout string like pg-test=3
+func ParseClusterLayout(s string) (ClusterLayout, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "=", 2)
+	if len(parts) != 2 {
+		return ClusterLayout{}, fmt.Errorf("invalid cluster layout %q, name=size expected", s)
+	}
+	name := strings.TrimSpace(parts[0])
+	if !clusterNameRegex.MatchString(name) || name == GROUP_META {
+		return ClusterLayout{}, fmt.Errorf("invalid cluster name %q", name)
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || size <= 0 {
+		return ClusterLayout{}, fmt.Errorf("invalid cluster size %q", parts[1])
+	}
+	return ClusterLayout{Name: name, Size: size}, nil
+}
+
+// GenerateOptions are inputs of config generator
+type GenerateOptions struct {
+	MetaIPs  []string        // meta nodes, pg-meta cluster will be deployed on them
+	Nodes    []string        // database nodes, assigned to clusters in order
+	Clusters []ClusterLayout // pgsql clusters on database nodes
+	Profile  string          // sizing profile: tiny|oltp|olap|crit
+	DCSCount int             // number of dcs servers, picked from meta nodes then database nodes
+}
+
+// Validate will check generate options
+func (o *GenerateOptions) Validate() error {
+	if len(o.MetaIPs) == 0 {
+		return fmt.Errorf("at least one meta node is required")
+	}
+	seen := make(map[string]bool)
+	for _, ip := range append(append([]string{}, o.MetaIPs...), o.Nodes...) {
+		if !IsValidIP(ip) {
+			return fmt.Errorf("invalid ip address %q", ip)
+		}
+		if seen[ip] {
+			return fmt.Errorf("duplicate ip address %s", ip)
+		}
+		seen[ip] = true
+	}
+	validProfile := false
+	for _, p := range Profiles {
+		validProfile = validProfile || p == o.Profile
+	}
+	if !validProfile {
+		return fmt.Errorf("invalid profile %q, %s expected", o.Profile, strings.Join(Profiles, "|"))
+	}
+	required, names := 0, map[string]bool{"pg-meta": true}
+	for _, l := range o.Clusters {
+		if names[l.Name] {
+			return fmt.Errorf("duplicate cluster name %s", l.Name)
+		}
+		names[l.Name] = true
+		required += l.Size
+	}
+	if required > len(o.Nodes) {
+		return fmt.Errorf("clusters require %d nodes, only %d given", required, len(o.Nodes))
+	}
+	if o.DCSCount <= 0 || o.DCSCount%2 == 0 {
+		return fmt.Errorf("dcs server count must be odd (1, 3, 5), got %d", o.DCSCount)
+	}
+	if o.DCSCount > len(o.MetaIPs)+len(o.Nodes) {
+		return fmt.Errorf("dcs server count %d exceeds node count %d", o.DCSCount, len(o.MetaIPs)+len(o.Nodes))
+	}
+	return nil
+}
+
+// GenerateConfig will generate pigsty config from options
+//
+// only clusters and environment specific parameters (dcs, dns, ntp, grafana,
+// tuning profile) are generated, other parameters use role default values
+func GenerateConfig(o GenerateOptions) ([]byte, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := func(format string, args ...interface{}) { buf.WriteString(fmt.Sprintf(format, args...)) }
+	metaIP := o.MetaIPs[0]
+
+	w("---\n")
+	w("######################################################################\n")
+	w("# File      :   pigsty.yml\n")
+	w("# Desc      :   Pigsty Configuration file generated by pigsty config init\n")
+	w("# Note      :   follow ansible inventory file format\n")
+	w("# Ctime     :   %s\n", time.Now().Format("2006-01-02"))
+	w("# Profile   :   %s\n", o.Profile)
+	w("######################################################################\n")
+	w("all: # top-level namespace, match all hosts\n\n")
+	w("  children:\n\n")
+
+	// meta group
+	w("    #-----------------------------\n")
+	w("    # meta controller\n")
+	w("    #-----------------------------\n")
+	w("    meta:       # special group 'meta' defines the main controller machine\n")
+	w("      vars:\n")
+	w("        meta_node: true                     # mark node as meta controller\n")
+	w("        ansible_group_priority: 99          # meta group is top priority\n")
+	w("      hosts:\n")
+	for _, ip := range o.MetaIPs {
+		w("        %s: {}\n", ip)
+	}
+
+	// pg-meta on meta nodes, then business clusters on database nodes
+	writeCluster := func(name string, ips []string) {
+		w("\n    #-----------------------------\n")
+		w("    # cluster: %s\n", name)
+		w("    #-----------------------------\n")
+		w("    %s:\n", name)
+		w("      hosts:\n")
+		for i, ip := range ips {
+			role := ROLE_REPLICA
+			if i == 0 {
+				role = ROLE_PRIMARY
+			}
+			w("        %s: {pg_seq: %d, pg_role: %s}\n", ip, i+1, role)
+		}
+		w("      vars:\n")
+		w("        pg_cluster: %-23s # define actual cluster name\n", name)
+	}
+	writeCluster("pg-meta", o.MetaIPs)
+	nodes := o.Nodes
+	for _, l := range o.Clusters {
+		writeCluster(l.Name, nodes[:l.Size])
+		nodes = nodes[l.Size:]
+	}
+
+	// global vars
+	w("\n  vars:\n")
+	w("    %s: %-29s # config schema version\n\n", VersionKey, strconv.Quote(SchemaVersion))
+	w("    # - profile - #\n")
+	w("    node_tune: %-34s # install and activate tuned profile: none|oltp|olap|crit|tiny\n", o.Profile)
+	w("    pg_conf: %-36s # user provided patroni config template path\n\n", o.Profile+".yml")
+	w("    # - dns - #\n")
+	w("    node_dns_hosts:                               # static dns records in /etc/hosts\n")
+	w("      - %s yum.pigsty\n", metaIP)
+	w("    node_dns_server: add                          # add (default) | none (skip) | overwrite (remove old settings)\n")
+	w("    node_dns_servers:                             # dynamic nameserver in /etc/resolv.conf\n")
+	w("      - %s\n", metaIP)
+	w("    dns_records:                                  # dynamic dns record resolved by dnsmasq\n")
+	for i, ip := range o.MetaIPs {
+		w("      - %s meta-%d\n", ip, i+1)
+	}
+	for _, r := range []string{"pigsty", "y.pigsty yum.pigsty", "c.pigsty consul.pigsty", "g.pigsty grafana.pigsty",
+		"p.pigsty prometheus.pigsty", "a.pigsty alertmanager.pigsty", "n.pigsty ntp.pigsty", "h.pigsty haproxy.pigsty"} {
+		w("      - %s %s\n", metaIP, r)
+	}
+	w("\n    # - ntp - #\n")
+	w("    node_ntp_servers:                             # default NTP servers\n")
+	w("      - pool cn.pool.ntp.org iburst\n")
+	w("      - pool pool.ntp.org iburst\n")
+	w("      - time.pool.aliyun.com iburst\n")
+	w("      - server %s iburst\n\n", metaIP)
+	w("    # - grafana - #\n")
+	w("    grafana_url: http://admin:admin@%s:3000 # grafana url\n\n", metaIP)
+	w("    # - dcs - #\n")
+	w("    dcs_type: consul                              # consul | etcd | both\n")
+	w("    dcs_name: pigsty                              # consul dc name | etcd initial cluster token\n")
+	w("    dcs_servers:                                  # dcs server dict in name:ip format\n")
+	for i, ip := range append(append([]string{}, o.MetaIPs...), o.Nodes...)[:o.DCSCount] {
+		if i < len(o.MetaIPs) {
+			w("      meta-%d: %s\n", i+1, ip)
+		} else {
+			w("      node-%d: %s\n", i-len(o.MetaIPs)+1, ip)
+		}
+	}
+
+	data := buf.Bytes()
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("generated config is invalid: %w", err)
+	}
+	if err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("generated config is invalid: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,111 @@
+package conf
+
+import (
+	"testing"
+)
+
+func TestGenerateConfig(t *testing.T) {
+	layout, err := ParseClusterLayout("pg-test=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := GenerateConfig(GenerateOptions{
+		MetaIPs:  []string{"10.10.10.10"},
+		Nodes:    []string{"10.10.10.11", "10.10.10.12", "10.10.10.13", "10.10.10.14"},
+		Clusters: []ClusterLayout{layout},
+		Profile:  "oltp",
+		DCSCount: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cls := cfg.GetCluster("pg-test")
+	if cls == nil || len(cls.Instances) != 3 {
+		t.Fatalf("expect pg-test with 3 instances, got %v", cls)
+	}
+	if cls.Instances[0].Role != ROLE_PRIMARY || cls.Instances[2].Role != ROLE_REPLICA || cls.Instances[2].IP != "10.10.10.13" {
+		t.Errorf("unexpected pg-test layout: %s", cls)
+	}
+	if cfg.GetCluster("pg-meta") == nil || cfg.MetaCluster == nil {
+		t.Errorf("meta group and pg-meta cluster are required")
+	}
+	if dcs, _ := cfg.Vars.GetMap("dcs_servers"); len(dcs) != 3 {
+		t.Errorf("expect 3 dcs servers, got %v", dcs)
+	}
+	if tune, _ := cfg.Vars.GetString("node_tune"); tune != "oltp" {
+		t.Errorf("expect node_tune oltp, got %s", tune)
+	}
+}
+
+func TestGenerateConfigInvalid(t *testing.T) {
+	cases := map[string]GenerateOptions{
+		"no meta":       {Profile: "tiny", DCSCount: 1},
+		"bad profile":   {MetaIPs: []string{"10.10.10.10"}, Profile: "huge", DCSCount: 1},
+		"even dcs":      {MetaIPs: []string{"10.10.10.10"}, Nodes: []string{"10.10.10.11"}, Profile: "tiny", DCSCount: 2},
+		"not enough":    {MetaIPs: []string{"10.10.10.10"}, Clusters: []ClusterLayout{{"pg-test", 1}}, Profile: "tiny", DCSCount: 1},
+		"duplicate ip":  {MetaIPs: []string{"10.10.10.10"}, Nodes: []string{"10.10.10.10"}, Profile: "tiny", DCSCount: 1},
+		"duplicate cls": {MetaIPs: []string{"10.10.10.10"}, Clusters: []ClusterLayout{{"pg-meta", 1}}, Nodes: []string{"10.10.10.11"}, Profile: "tiny", DCSCount: 1},
+	}
+	for name, opts := range cases {
+		if _, err := GenerateConfig(opts); err == nil {
+			t.Errorf("%s: expect error", name)
+		}
+	}
+	for _, s := range []string{"pg-test", "pg-test=0", "meta=1", "1pg=2"} {
+		if _, err := ParseClusterLayout(s); err == nil {
+			t.Errorf("%s: expect invalid layout", s)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testCase := `
+all:
+  children:
+    meta:
+      hosts: {10.10.10.10: {}}
+    pg-test:
+      hosts:
+        10.10.10.11: {pg_seq: 1, pg_role: primary}
+        10.10.10.12: {pg_seq: 1, pg_role: primary}
+      vars: {pg_cluster: pg-test2}
+    pg-dup:
+      hosts:
+        10.10.10.11: {pg_seq: 1, pg_role: primary}
+      vars: {pg_cluster: pg-dup}
+  vars:
+    dcs_servers: {meta-1: 10.10.10.300}
+`
+	cfg, err := ParseConfig([]byte(testCase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.Validate()
+	errs, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("expect ValidationError, got %v", err)
+	}
+	// pg_cluster mismatch, duplicate seq, multiple primary, duplicate ip, invalid dcs ip
+	if len(errs) != 5 {
+		t.Errorf("expect 5 problems, got %s", errs)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	if err := ValidateConfig([]byte("")); err == nil {
+		t.Errorf("empty config should be invalid")
+	}
+	if err := ValidateConfig([]byte("all: [")); err == nil {
+		t.Errorf("malformed config should be invalid")
+	}
+	if err := ValidateConfig([]byte("all: {children: {meta: {hosts: {10.10.10.10: {}}}}}")); err != nil {
+		t.Errorf("minimal config should be valid: %s", err)
+	}
+}
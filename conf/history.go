@@ -0,0 +1,306 @@
+package conf
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**************************************************************\
+*                          History                             *
+\**************************************************************/
+// bakTimeFormat is the timestamp suffix format of config snapshots
+const bakTimeFormat = "20060102150405"
+
+// Retention decide which snapshots are kept, zero value disable a policy
+// snapshot is pruned if it violates any enabled policy
+type Retention struct {
+	Keep     int `json:"keep"`      // keep latest n snapshots
+	KeepDays int `json:"keep_days"` // keep snapshots within n days
+}
+
+// DefaultRetention keeps latest 32 snapshots
+var DefaultRetention = Retention{Keep: 32}
+
+// Snapshot is a backup of config before a change: <config>.bak<id>
+type Snapshot struct {
+	ID      string    `json:"id"`      // timestamp id: YYYYMMDDHHMMSS
+	Path    string    `json:"path"`    // snapshot file path
+	Size    int64     `json:"size"`    // snapshot file size
+	Time    time.Time `json:"time"`    // when this snapshot is replaced
+	Author  string    `json:"author"`  // who replaced this snapshot
+	Action  string    `json:"action"`  // what replaced this snapshot: save|rollback|...
+	Summary string    `json:"summary"` // semantic summary of change made after this snapshot
+}
+
+// History manage config snapshots and change records (<config>.history)
+type History struct {
+	Path      string // config file path
+	Retention Retention
+	lock      sync.Mutex
+}
+
+// NewHistory will create history store of config path (pigsty.yml in dir if path is a dir)
+func NewHistory(path string) *History {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, "pigsty.yml")
+	}
+	return &History{Path: path, Retention: DefaultRetention}
+}
+
+// IndexPath is where change records are stored
+func (h *History) IndexPath() string {
+	return h.Path + ".history"
+}
+
+// Save will overwrite config with data, record author and change summary, then prune snapshots
+func (h *History) Save(data []byte, author, action string) (*Snapshot, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.save(data, author, action)
+}
+
+func (h *History) save(data []byte, author, action string) (*Snapshot, error) {
+	old, _ := ioutil.ReadFile(h.Path)
+	bakPath, err := writeConfig(data, h.Path)
+	if err != nil {
+		return nil, err
+	}
+	if bakPath == "" { // first version, nothing to record
+		return nil, nil
+	}
+	snap := &Snapshot{
+		ID:      strings.TrimPrefix(filepath.Base(bakPath), filepath.Base(h.Path)+".bak"),
+		Path:    bakPath,
+		Size:    int64(len(old)),
+		Time:    time.Now(),
+		Author:  author,
+		Action:  action,
+		Summary: summarize(old, data),
+	}
+	if err = h.appendIndex(snap); err != nil {
+		return snap, fmt.Errorf("config saved, but fail to write history index: %w", err)
+	}
+	if _, err = h.prune(); err != nil {
+		return snap, fmt.Errorf("config saved, but fail to prune history: %w", err)
+	}
+	return snap, nil
+}
+
+// List will return snapshots, latest first
+func (h *History) List() ([]Snapshot, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.list()
+}
+
+func (h *History) list() ([]Snapshot, error) {
+	prefix := filepath.Base(h.Path) + ".bak"
+	entries, err := ioutil.ReadDir(filepath.Dir(h.Path))
+	if err != nil {
+		return nil, err
+	}
+	index := h.readIndex()
+	var snaps []Snapshot
+	for _, fi := range entries {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), prefix) {
+			continue
+		}
+		id := strings.TrimPrefix(fi.Name(), prefix)
+		ts, _, err := snapshotOrder(id)
+		if err != nil {
+			continue
+		}
+		snap := Snapshot{ID: id, Path: filepath.Join(filepath.Dir(h.Path), fi.Name()), Size: fi.Size(), Time: ts}
+		if rec, exists := index[id]; exists {
+			snap.Time, snap.Author, snap.Action, snap.Summary = rec.Time, rec.Author, rec.Action, rec.Summary
+		}
+		snaps = append(snaps, snap)
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		ti, ni, _ := snapshotOrder(snaps[i].ID)
+		tj, nj, _ := snapshotOrder(snaps[j].ID)
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return ni > nj
+	})
+
+	// summarize snapshots without record by comparing with next version
+	for i := range snaps {
+		if snaps[i].Summary != "" {
+			continue
+		}
+		next := h.Path
+		if i > 0 {
+			next = snaps[i-1].Path
+		}
+		a, errA := ioutil.ReadFile(snaps[i].Path)
+		b, errB := ioutil.ReadFile(next)
+		if errA == nil && errB == nil {
+			snaps[i].Summary = summarize(a, b)
+		}
+	}
+	return snaps, nil
+}
+
+// snapshotOrder will parse snapshot id <timestamp>[-<n>] into timestamp & sequence in same second
+func snapshotOrder(id string) (ts time.Time, seq int, err error) {
+	parts := strings.SplitN(id, "-", 2)
+	if ts, err = time.ParseInLocation(bakTimeFormat, parts[0], time.Local); err != nil {
+		return
+	}
+	if len(parts) == 2 {
+		seq, err = strconv.Atoi(parts[1])
+	}
+	return
+}
+
+// Get will return snapshot by id
+func (h *History) Get(id string) (*Snapshot, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.get(id)
+}
+
+func (h *History) get(id string) (*Snapshot, error) {
+	snaps, err := h.list()
+	if err != nil {
+		return nil, err
+	}
+	for i := range snaps {
+		if snaps[i].ID == id {
+			return &snaps[i], nil
+		}
+	}
+	return nil, fmt.Errorf("snapshot %s not found", id)
+}
+
+// Rollback will restore config to snapshot content atomically, current config is snapshotted
+func (h *History) Rollback(id, author string) (*Snapshot, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	snap, err := h.get(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(snap.Path)
+	if err != nil {
+		return nil, err
+	}
+	return h.save(data, author, "rollback to "+id)
+}
+
+// Prune will remove snapshots according to retention policy, return removed snapshot ids
+func (h *History) Prune() ([]string, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.prune()
+}
+
+func (h *History) prune() (removed []string, err error) {
+	snaps, err := h.list()
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().AddDate(0, 0, -h.Retention.KeepDays)
+	for i, snap := range snaps {
+		if (h.Retention.Keep > 0 && i >= h.Retention.Keep) || (h.Retention.KeepDays > 0 && snap.Time.Before(deadline)) {
+			if err = os.Remove(snap.Path); err != nil {
+				return
+			}
+			removed = append(removed, snap.ID)
+		}
+	}
+	if len(removed) > 0 {
+		err = h.compactIndex()
+	}
+	return
+}
+
+/**************************************************************\
+*                           Index                              *
+\**************************************************************/
+// appendIndex will append snapshot record to index file
+func (h *History) appendIndex(snap *Snapshot) error {
+	f, err := os.OpenFile(h.IndexPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// readIndex will read snapshot records from index file
+func (h *History) readIndex() map[string]Snapshot {
+	index := make(map[string]Snapshot)
+	f, err := os.Open(h.IndexPath())
+	if err != nil {
+		return index
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var snap Snapshot
+		if err := json.Unmarshal(scanner.Bytes(), &snap); err == nil {
+			index[snap.ID] = snap
+		}
+	}
+	return index
+}
+
+// compactIndex will drop records of removed snapshots from index file
+func (h *History) compactIndex() error {
+	index := h.readIndex()
+	var lines []string
+	for id, snap := range index {
+		if _, err := os.Stat(snap.Path); err != nil {
+			delete(index, id)
+			continue
+		}
+		b, _ := json.Marshal(snap)
+		lines = append(lines, string(b))
+	}
+	sort.Strings(lines)
+	tmpPath := h.IndexPath() + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, h.IndexPath())
+}
+
+// summarize will return semantic change summary between two config content
+func summarize(a, b []byte) string {
+	x, errA := ParseConfig(a)
+	y, errB := ParseConfig(b)
+	if errA != nil || errB != nil || x == nil || y == nil {
+		return "unparsable config"
+	}
+	return SummarizeChanges(DiffConfig(x, y))
+}
+
+// CurrentUser will return name of current os user, used as author of config change
+func CurrentUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return "unknown"
+}
@@ -0,0 +1,140 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const historyV1 = `all:
+  children:
+    meta: {hosts: {10.10.10.10: {}}}
+    pg-test:
+      hosts: {10.10.10.11: {pg_seq: 1, pg_role: primary}}
+      vars: {pg_cluster: pg-test}
+  vars: {node_tune: tiny}
+`
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pigsty-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pigsty.yml")
+	h := NewHistory(dir)
+	if h.Path != path {
+		t.Fatalf("expect history of %s, got %s", path, h.Path)
+	}
+
+	// first version does not produce snapshot
+	if snap, err := h.Save([]byte(historyV1), "alice", "init"); err != nil || snap != nil {
+		t.Fatalf("first save: snapshot %v, err %v", snap, err)
+	}
+	v2 := strings.Replace(historyV1, "node_tune: tiny", "node_tune: oltp", 1)
+	snap1, err := h.Save([]byte(v2), "alice", "edit")
+	if err != nil || snap1 == nil {
+		t.Fatalf("second save: snapshot %v, err %v", snap1, err)
+	}
+	if snap1.Summary != "~ var all.vars.node_tune: tiny -> oltp" {
+		t.Errorf("unexpected summary: %s", snap1.Summary)
+	}
+	v3 := strings.Replace(v2, "{10.10.10.11: {pg_seq: 1, pg_role: primary}}", "{10.10.10.11: {pg_seq: 1, pg_role: primary}, 10.10.10.12: {pg_seq: 2, pg_role: replica}}", 1)
+	snap2, err := h.Save([]byte(v3), "bob", "edit")
+	if err != nil || snap2 == nil {
+		t.Fatalf("third save: snapshot %v, err %v", snap2, err)
+	}
+	if snap2.Summary != "+instance pg-test.10.10.10.12" {
+		t.Errorf("unexpected summary: %s", snap2.Summary)
+	}
+
+	snaps, err := h.List()
+	if err != nil || len(snaps) != 2 {
+		t.Fatalf("expect 2 snapshots, got %v, err %v", snaps, err)
+	}
+	if snaps[0].ID != snap2.ID || snaps[0].Author != "bob" || snaps[1].Author != "alice" {
+		t.Errorf("unexpected snapshot list: %v", snaps)
+	}
+
+	// rollback to first version, current version is snapshotted
+	if _, err = h.Rollback(snap1.ID, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != historyV1 {
+		t.Errorf("rollback should restore first version, got %s", data)
+	}
+	if snaps, _ = h.List(); len(snaps) != 3 || snaps[0].Author != "carol" || !strings.HasPrefix(snaps[0].Action, "rollback") {
+		t.Errorf("rollback should be recorded: %v", snaps)
+	}
+	if _, err = h.Rollback("19700101000000", "carol"); err == nil {
+		t.Errorf("rollback to non-exist snapshot should fail")
+	}
+
+	// prune with retention
+	h.Retention = Retention{Keep: 1}
+	removed, err := h.Prune()
+	if err != nil || len(removed) != 2 {
+		t.Fatalf("expect 2 snapshots pruned, got %v, err %v", removed, err)
+	}
+	if snaps, _ = h.List(); len(snaps) != 1 || snaps[0].Author != "carol" {
+		t.Errorf("latest snapshot should be kept: %v", snaps)
+	}
+}
+
+func TestHistoryOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pigsty-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h := NewHistory(dir)
+
+	// more than 9 snapshots in same second: -10 is newer than -2
+	ts := time.Now().Add(-time.Hour).Format(bakTimeFormat)
+	for _, id := range []string{ts, ts + "-1", ts + "-2", ts + "-9", ts + "-10", ts + "-11"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, "pigsty.yml.bak"+id), []byte(historyV1), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ioutil.WriteFile(h.Path, []byte(historyV1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snaps, err := h.List()
+	if err != nil || len(snaps) != 6 {
+		t.Fatalf("expect 6 snapshots, got %v, err %v", snaps, err)
+	}
+	var ids []string
+	for _, snap := range snaps {
+		ids = append(ids, snap.ID)
+	}
+	if strings.Join(ids, ",") != strings.Join([]string{ts + "-11", ts + "-10", ts + "-9", ts + "-2", ts + "-1", ts}, ",") {
+		t.Errorf("snapshots should be listed latest first: %v", ids)
+	}
+
+	h.Retention = Retention{Keep: 2}
+	removed, err := h.Prune()
+	if err != nil || len(removed) != 4 {
+		t.Fatalf("expect 4 snapshots pruned, got %v, err %v", removed, err)
+	}
+	if snaps, _ = h.List(); len(snaps) != 2 || snaps[0].ID != ts+"-11" || snaps[1].ID != ts+"-10" {
+		t.Errorf("latest snapshots should be kept: %v", snaps)
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	a, _ := ParseConfig([]byte(historyV1))
+	b, _ := ParseConfig([]byte(strings.Replace(historyV1, "pg-test:", "pg-test2:", 1)))
+	changes := DiffConfig(a, b)
+	if len(changes) != 2 {
+		t.Fatalf("expect cluster removed and added, got %v", changes)
+	}
+	if s := SummarizeChanges(changes); s != "-cluster pg-test, +cluster pg-test2" {
+		t.Errorf("unexpected summary: %s", s)
+	}
+	if s := SummarizeChanges(DiffConfig(a, a)); s != "no semantic change" {
+		t.Errorf("unexpected summary: %s", s)
+	}
+}
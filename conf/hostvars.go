@@ -0,0 +1,51 @@
+package conf
+
+import (
+	"sort"
+)
+
+/**************************************************************\
+*                        Host Vars                             *
+\**************************************************************/
+// HostVars will return effective vars of host as ansible does: global vars, overwritten by vars of
+// groups containing host (ordered by ansible_group_priority), then host vars. nil if host not exists
+func (c *Config) HostVars(ip string) *Vars {
+	var groups []*Cluster
+	for i := range c.Clusters {
+		for _, ins := range c.Clusters[i].Instances {
+			if ins.IP == ip {
+				groups = append(groups, &c.Clusters[i])
+				break
+			}
+		}
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+	sort.SliceStable(groups, func(a, b int) bool {
+		pa, _ := groups[a].Vars.GetInteger("ansible_group_priority")
+		pb, _ := groups[b].Vars.GetInteger("ansible_group_priority")
+		return pa < pb
+	})
+	vars := &Vars{Data: make(map[string]interface{})}
+	merge := func(v Vars) {
+		for _, k := range v.Keys {
+			if _, exists := vars.Data[k]; !exists {
+				vars.Keys = append(vars.Keys, k)
+			}
+			vars.Data[k] = v.Data[k]
+		}
+	}
+	merge(c.Vars)
+	for _, g := range groups {
+		merge(g.Vars)
+	}
+	for _, g := range groups {
+		for _, ins := range g.Instances {
+			if ins.IP == ip {
+				merge(ins.Vars)
+			}
+		}
+	}
+	return vars
+}
@@ -10,12 +10,13 @@ import (
 *                        Instance                              *
 \**************************************************************/
 type Instance struct {
-	IP      string   `yaml:"ip" json:"ip"`
-	Name    string   `yaml:"pg_instance" json:"name"`
-	Seq     int      `yaml:"pg_seq"  json:"seq"`
-	Role    string   `yaml:"pg_role"  json:"role"`
-	Vars    Vars     `yaml:"-,flow"  json:"vars"`
-	Cluster *Cluster `yaml:"-" json:"-"`
+	IP       string   `yaml:"ip" json:"ip"`
+	Name     string   `yaml:"pg_instance" json:"name"`
+	Seq      int      `yaml:"pg_seq"  json:"seq"`
+	Role     string   `yaml:"pg_role"  json:"role"`
+	Upstream string   `yaml:"pg_upstream" json:"upstream,omitempty"`
+	Vars     Vars     `yaml:"-,flow"  json:"vars"`
+	Cluster  *Cluster `yaml:"-" json:"-"`
 }
 
 // MarshalYAML will turn Vars into yaml dict according to v.Keys order
@@ -51,31 +52,3 @@ func (i *Instance) IsValid() bool {
 	// TODO: validate ip
 	return true
 }
-
-// MatchName test whether a name or glob regexp matches cluster's name
-func (i *Instance) MatchName(name string) bool {
-	if i.Name == name || i.Cluster.Name == name {
-		return true
-	}
-	if IsValidIP(name) && i.IP == name {
-		return true
-	}
-
-	re, err := regexp.CompilePOSIX(name)
-	if err != nil {
-		return false
-	}
-	if re.MatchString(i.Name) || re.MatchString(i.Cluster.Name) {
-		return true
-	}
-	return false
-}
-
-func (i *Instance) MatchNames(names []string) bool {
-	for _, n := range names {
-		if i.MatchName(n) {
-			return true
-		}
-	}
-	return false
-}
@@ -0,0 +1,254 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+/**************************************************************\
+*                          Limit                               *
+\**************************************************************/
+// limit operators
+const (
+	LIMIT_UNION     = ""  // a,b     hosts of a or b
+	LIMIT_INTERSECT = "&" // a,&b    hosts of a that are also in b
+	LIMIT_EXCLUDE   = "!" // a,!b    hosts of a except those in b
+)
+
+// LimitGrammar describes limit expression syntax
+const LimitGrammar = `limit expression is a comma separated list of items, resolved to inventory hosts:
+
+    all | *           all hosts
+    <cluster>         hosts of cluster, e.g: pg-test, meta
+    <instance>        host of instance, e.g: pg-test-1
+    <ip>              host with ip, e.g: 10.10.10.11, fd00::11
+    <cidr>            hosts in network, e.g: 10.10.10.0/24, fd00::/64
+    ~<regex>          hosts of clusters or instances whose name matches regex, e.g: ~^pg-t
+    <item>:<role>     hosts above with pg_role, e.g: pg-test:replica, all:primary
+
+    a,b               hosts in a or b
+    a,&b              hosts in a that are also in b
+    a,!b              hosts in a but not in b (all hosts if there is no plain item)
+`
+
+// LimitItem is an item of limit expression
+type LimitItem struct {
+	Op      string // LIMIT_UNION | LIMIT_INTERSECT | LIMIT_EXCLUDE
+	Pattern string // all, cluster, instance, ip, cidr or ~regex
+	Role    string // pg_role filter, empty means any role
+}
+
+// String will render item in limit syntax
+func (li LimitItem) String() string {
+	if li.Role != "" {
+		return li.Op + li.Pattern + ":" + li.Role
+	}
+	return li.Op + li.Pattern
+}
+
+// ParseLimit will parse limit expression into items, syntax is checked without inventory
+func ParseLimit(expr string) ([]LimitItem, error) {
+	var items []LimitItem
+	for _, s := range strings.Split(expr, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		var item LimitItem
+		if strings.HasPrefix(s, LIMIT_INTERSECT) || strings.HasPrefix(s, LIMIT_EXCLUDE) {
+			item.Op, s = s[:1], strings.TrimSpace(s[1:])
+		}
+		// role filter is the suffix after last colon if it is a known role, regex & ipv6 may contain colon itself
+		if i := strings.LastIndex(s, ":"); i >= 0 {
+			if _, valid := AvailableRoles[s[i+1:]]; valid {
+				item.Role, s = s[i+1:], s[:i]
+			} else if !strings.HasPrefix(s, "~") && !isAddress(s) {
+				return nil, fmt.Errorf("invalid role %q in limit item %q", s[i+1:], s)
+			}
+		}
+		if s == "" {
+			return nil, fmt.Errorf("empty limit item in %q", expr)
+		}
+		if strings.HasPrefix(s, "~") {
+			if _, err := regexp.CompilePOSIX(s[1:]); err != nil {
+				return nil, fmt.Errorf("invalid regex in limit item %q: %w", s, err)
+			}
+		} else if strings.Contains(s, "/") {
+			if _, _, err := net.ParseCIDR(s); err != nil {
+				return nil, fmt.Errorf("invalid cidr in limit item %q: %w", s, err)
+			}
+		}
+		item.Pattern = s
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// isAddress tells whether limit item is an ip or cidr
+func isAddress(s string) bool {
+	if _, _, err := net.ParseCIDR(s); err == nil {
+		return true
+	}
+	return IsValidIP(s)
+}
+
+// HostSet is resolved hosts of limit expression, in inventory order
+type HostSet struct {
+	Expr  string   // limit expression
+	Hosts []string // ip list of hosts
+	set   map[string]bool
+}
+
+// Contains tells whether ip is in host set
+func (hs *HostSet) Contains(ip string) bool {
+	return hs.set[ip]
+}
+
+// String will render host set as explicit ansible limit
+func (hs *HostSet) String() string {
+	return strings.Join(hs.Hosts, ",")
+}
+
+// ResolveLimit will resolve limit expression into host set, error if any item or the whole expression matches nothing
+func (c *Config) ResolveLimit(expr string) (*HostSet, error) {
+	items, err := ParseLimit(expr)
+	if err != nil {
+		return nil, err
+	}
+	var union, intersect, exclude map[string]bool
+	for _, item := range items {
+		hosts, err := c.resolveItem(item)
+		if err != nil {
+			return nil, err
+		}
+		switch item.Op {
+		case LIMIT_UNION:
+			if union == nil {
+				union = make(map[string]bool)
+			}
+			for ip := range hosts {
+				union[ip] = true
+			}
+		case LIMIT_INTERSECT:
+			if intersect == nil {
+				intersect = hosts
+			} else {
+				for ip := range intersect {
+					if !hosts[ip] {
+						delete(intersect, ip)
+					}
+				}
+			}
+		case LIMIT_EXCLUDE:
+			if exclude == nil {
+				exclude = make(map[string]bool)
+			}
+			for ip := range hosts {
+				exclude[ip] = true
+			}
+		}
+	}
+	hs := &HostSet{Expr: expr, set: make(map[string]bool)}
+	for _, ins := range c.instances() {
+		ip := ins.IP
+		if hs.set[ip] || union != nil && !union[ip] || intersect != nil && !intersect[ip] || exclude[ip] {
+			continue
+		}
+		hs.set[ip] = true
+		hs.Hosts = append(hs.Hosts, ip)
+	}
+	if len(hs.Hosts) == 0 { // empty limit means all hosts to ansible
+		return nil, fmt.Errorf("limit %q matches no host", expr)
+	}
+	return hs, nil
+}
+
+// resolveItem will resolve single limit item (operator ignored) into ip set
+func (c *Config) resolveItem(item LimitItem) (map[string]bool, error) {
+	var match func(ins *Instance) bool
+	p := item.Pattern
+	switch {
+	case p == "all" || p == "*":
+		match = func(ins *Instance) bool { return true }
+	case strings.HasPrefix(p, "~"):
+		re := regexp.MustCompilePOSIX(p[1:])
+		match = func(ins *Instance) bool { return re.MatchString(ins.Cluster.Name) || re.MatchString(ins.Name) }
+	case strings.Contains(p, "/"):
+		_, network, _ := net.ParseCIDR(p)
+		match = func(ins *Instance) bool { return network.Contains(net.ParseIP(ins.IP)) }
+	case IsValidIP(p):
+		ip := net.ParseIP(p)
+		match = func(ins *Instance) bool { return ip.Equal(net.ParseIP(ins.IP)) }
+	default:
+		match = func(ins *Instance) bool { return ins.Cluster.Name == p || ins.Name == p }
+	}
+	hosts := make(map[string]bool)
+	for _, ins := range c.instances() {
+		if match(ins) && (item.Role == "" || ins.Role == item.Role) {
+			hosts[ins.IP] = true
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("limit item %q matches no host", item.String())
+	}
+	return hosts, nil
+}
+
+// instances will return all instances in inventory order
+func (c *Config) instances() (res []*Instance) {
+	for i := range c.Clusters {
+		for j := range c.Clusters[i].Instances {
+			ins := &c.Clusters[i].Instances[j]
+			if ins.Cluster == nil {
+				ins.Cluster = &c.Clusters[i]
+			}
+			res = append(res, ins)
+		}
+	}
+	return
+}
+
+// ExplainLimit will show how limit expression is resolved item by item
+func (c *Config) ExplainLimit(expr string) (string, error) {
+	items, err := ParseLimit(expr)
+	if err != nil {
+		return "", err
+	}
+	hs, err := c.ResolveLimit(expr)
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "limit: %s\n", expr)
+	for _, item := range items {
+		hosts, _ := c.resolveItem(item)
+		var ips []string
+		for _, ins := range c.instances() {
+			if hosts[ins.IP] {
+				ips = append(ips, ins.IP)
+				delete(hosts, ins.IP)
+			}
+		}
+		op := "+"
+		if item.Op != LIMIT_UNION {
+			op = item.Op
+		}
+		fmt.Fprintf(&buf, "  %s %-24s %s\n", op, LimitItem{Pattern: item.Pattern, Role: item.Role}.String(), strings.Join(ips, ","))
+	}
+	fmt.Fprintf(&buf, "hosts (%d):\n", len(hs.Hosts))
+	for _, ip := range hs.Hosts {
+		var names []string
+		for _, ins := range c.instances() {
+			if ins.IP == ip {
+				name := ins.Name
+				if ins.Role != "" {
+					name += " [" + ins.Role + "]"
+				}
+				names = append(names, name)
+			}
+		}
+		fmt.Fprintf(&buf, "  %-15s %s\n", ip, strings.Join(names, ", "))
+	}
+	return buf.String(), nil
+}
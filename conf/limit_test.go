@@ -0,0 +1,105 @@
+package conf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveLimit(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+all:
+  children:
+    meta:
+      hosts: {10.10.10.10: {ansible_host: meta}}
+    pg-meta:
+      hosts: {10.10.10.10: {pg_seq: 1, pg_role: primary}}
+      vars: {pg_cluster: pg-meta}
+    pg-test:
+      hosts:
+        10.10.10.11: {pg_seq: 1, pg_role: primary}
+        10.10.10.12: {pg_seq: 2, pg_role: replica}
+        10.10.10.13: {pg_seq: 3, pg_role: offline}
+      vars: {pg_cluster: pg-test}
+    pg-src:
+      hosts: {10.10.20.11: {pg_seq: 1, pg_role: primary}}
+      vars: {pg_cluster: pg-src}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"all":                           "10.10.10.10,10.10.10.11,10.10.10.12,10.10.10.13,10.10.20.11",
+		"pg-test":                       "10.10.10.11,10.10.10.12,10.10.10.13",
+		"pg-test-2,10.10.20.11":         "10.10.10.12,10.10.20.11",
+		"meta":                          "10.10.10.10",
+		"10.10.10.0/24,!meta":           "10.10.10.11,10.10.10.12,10.10.10.13",
+		"all:primary":                   "10.10.10.10,10.10.10.11,10.10.20.11",
+		"pg-test,!pg-test:primary":      "10.10.10.12,10.10.10.13",
+		"~^pg-(test|src)$,&all:primary": "10.10.10.11,10.10.20.11",
+		"!pg-test":                      "10.10.10.10,10.10.20.11",
+	}
+	for expr, expected := range cases {
+		hs, err := cfg.ResolveLimit(expr)
+		if err != nil {
+			t.Errorf("%q: %s", expr, err)
+			continue
+		}
+		if hs.String() != expected {
+			t.Errorf("%q: expect %s, got %s", expr, expected, hs.String())
+		}
+	}
+	for _, expr := range []string{"pg-unknown", "pg-test:leader", "10.10.10.99", "10.10.10.0/33", "~(", "pg-test,!pg-test", "pg-test,&pg-src"} {
+		if _, err := cfg.ResolveLimit(expr); err == nil {
+			t.Errorf("%q should be invalid", expr)
+		}
+	}
+
+	explain, err := cfg.ExplainLimit("pg-test,!pg-test:primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"  + pg-test ", "  ! pg-test:primary ", "hosts (2):", "10.10.10.12     pg-test-2 [replica]"} {
+		if !strings.Contains(explain, line) {
+			t.Errorf("explain should contain %q:\n%s", line, explain)
+		}
+	}
+}
+
+func TestResolveLimitIPv6(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+all:
+  children:
+    pg-v6:
+      hosts:
+        "fd00::11": {pg_seq: 1, pg_role: primary}
+        "fd00::12": {pg_seq: 2, pg_role: replica}
+        "fd00:1::13": {pg_seq: 3, pg_role: replica}
+      vars: {pg_cluster: pg-v6}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"fd00::11":               "fd00::11",
+		"fd00:0:0::12":           "fd00::12",
+		"fd00::/64":              "fd00::11,fd00::12",
+		"fd00::/64:replica":      "fd00::12",
+		"pg-v6,!fd00::11":        "fd00::12,fd00:1::13",
+		"all:replica,&fd00::/16": "fd00::12,fd00:1::13",
+	}
+	for expr, expected := range cases {
+		hs, err := cfg.ResolveLimit(expr)
+		if err != nil {
+			t.Errorf("%q: %s", expr, err)
+			continue
+		}
+		if hs.String() != expected {
+			t.Errorf("%q: expect %s, got %s", expr, expected, hs.String())
+		}
+	}
+	for _, expr := range []string{"fd00::99", "fd00::11:leader", "fd00::/129"} {
+		if _, err := cfg.ResolveLimit(expr); err == nil {
+			t.Errorf("%q should be invalid", expr)
+		}
+	}
+}
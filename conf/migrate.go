@@ -0,0 +1,260 @@
+package conf
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**************************************************************\
+*                          Version                             *
+\**************************************************************/
+// SchemaVersion is the config schema version of this pigsty release
+const SchemaVersion = "0.9"
+
+// VersionKey is the global var that records config schema version
+const VersionKey = "pigsty_version"
+
+// DefaultSchemaVersion is assumed when config does not have VersionKey
+const DefaultSchemaVersion = "0.8"
+
+// CompareVersion will compare dot separated version number, return -1, 0, 1
+func CompareVersion(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Version will return schema version of document
+func (d *Document) Version() string {
+	if v := d.Get([]string{"all", "vars"}, VersionKey); v != nil && v.Kind == yaml.ScalarNode && v.Value != "" {
+		return v.Value
+	}
+	return DefaultSchemaVersion
+}
+
+/**************************************************************\
+*                         Migration                            *
+\**************************************************************/
+// Migration upgrade config from one schema version to next one
+type Migration struct {
+	From  string          // schema version before migration
+	To    string          // schema version after migration
+	Desc  string          // human readable description
+	Steps []MigrationStep // ordered steps
+}
+
+// MigrationStep is a single rename|move|transform operation on document
+// it returns human readable changes it made
+type MigrationStep interface {
+	Apply(d *Document) ([]string, error)
+	String() string
+}
+
+// migrations is the registry of known migrations, keyed by From version
+var migrations = make(map[string]*Migration)
+
+// RegisterMigration will add migration to registry
+func RegisterMigration(m *Migration) {
+	if _, exists := migrations[m.From]; exists {
+		panic(fmt.Sprintf("migration from %s already registered", m.From))
+	}
+	if CompareVersion(m.From, m.To) >= 0 {
+		panic(fmt.Sprintf("invalid migration %s -> %s", m.From, m.To))
+	}
+	migrations[m.From] = m
+}
+
+// Migrations will return all registered migrations in version order
+func Migrations() (res []*Migration) {
+	for _, m := range migrations {
+		res = append(res, m)
+	}
+	sort.Slice(res, func(i, j int) bool { return CompareVersion(res[i].From, res[j].From) < 0 })
+	return
+}
+
+// MigrationPath will return ordered migrations that upgrade from one version to another
+func MigrationPath(from, to string) ([]*Migration, error) {
+	if CompareVersion(from, to) > 0 {
+		return nil, fmt.Errorf("downgrade from %s to %s is not supported", from, to)
+	}
+	var path []*Migration
+	for v := from; CompareVersion(v, to) < 0; {
+		m, exists := migrations[v]
+		if !exists {
+			return nil, fmt.Errorf("no migration path from %s to %s: missing migration from %s", from, to, v)
+		}
+		if CompareVersion(m.To, to) > 0 {
+			return nil, fmt.Errorf("no migration path from %s to %s: %s migrates to %s", from, to, v, m.To)
+		}
+		path = append(path, m)
+		v = m.To
+	}
+	return path, nil
+}
+
+// MigrateConfig will upgrade config content to target schema version, comments
+// and layout are preserved. version is detected from content if from is empty
+func MigrateConfig(data []byte, from, to string) ([]byte, []string, error) {
+	doc, err := ParseDocument(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if from == "" {
+		from = doc.Version()
+	}
+	path, err := MigrationPath(from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	var changes []string
+	for _, m := range path {
+		for _, step := range m.Steps {
+			c, err := step.Apply(doc)
+			if err != nil {
+				return nil, changes, fmt.Errorf("migration %s -> %s: %s: %w", m.From, m.To, step, err)
+			}
+			changes = append(changes, c...)
+		}
+		if err = doc.Set([]string{"all", "vars"}, VersionKey, strconv.Quote(m.To)); err != nil {
+			return nil, changes, fmt.Errorf("fail to set %s: %w", VersionKey, err)
+		}
+		changes = append(changes, fmt.Sprintf("set all.vars.%s = %s", VersionKey, m.To))
+	}
+	out := doc.Bytes()
+	if _, err = ParseConfig(out); err != nil {
+		return nil, changes, fmt.Errorf("migrated config is invalid: %w", err)
+	}
+	return out, changes, nil
+}
+
+/**************************************************************\
+*                           Steps                              *
+\**************************************************************/
+// RenameStep rename variable in every scope (global, cluster, instance)
+type RenameStep struct {
+	From string
+	To   string
+}
+
+func (s RenameStep) String() string {
+	return fmt.Sprintf("rename %s to %s", s.From, s.To)
+}
+
+// Apply will rename key in all scopes
+func (s RenameStep) Apply(d *Document) (changes []string, err error) {
+	for _, scope := range d.Scopes() {
+		if d.Get(scope, s.From) == nil {
+			continue
+		}
+		if err = d.Rename(scope, s.From, s.To); err != nil {
+			return
+		}
+		changes = append(changes, fmt.Sprintf("rename %s.%s to %s", ScopeName(scope), s.From, s.To))
+	}
+	return
+}
+
+// MoveStep move variable from one scope to another
+type MoveStep struct {
+	Key  string
+	From []string
+	To   []string
+}
+
+func (s MoveStep) String() string {
+	return fmt.Sprintf("move %s from %s to %s", s.Key, ScopeName(s.From), ScopeName(s.To))
+}
+
+// Apply will move key if exists in source scope
+func (s MoveStep) Apply(d *Document) ([]string, error) {
+	if d.Get(s.From, s.Key) == nil {
+		return nil, nil
+	}
+	if err := d.Move(s.From, s.Key, s.To); err != nil {
+		return nil, err
+	}
+	return []string{fmt.Sprintf("move %s.%s to %s", ScopeName(s.From), s.Key, ScopeName(s.To))}, nil
+}
+
+// TransformStep rewrite scalar variable in every scope, Func takes old value
+// and returns new key and new value text (valid YAML flow text)
+type TransformStep struct {
+	Key  string
+	Desc string
+	Func func(value string) (key string, text string, err error)
+}
+
+func (s TransformStep) String() string {
+	return fmt.Sprintf("transform %s: %s", s.Key, s.Desc)
+}
+
+// Apply will transform key in all scopes
+func (s TransformStep) Apply(d *Document) (changes []string, err error) {
+	for _, scope := range d.Scopes() {
+		v := d.Get(scope, s.Key)
+		if v == nil {
+			continue
+		}
+		if v.Kind != yaml.ScalarNode {
+			return changes, fmt.Errorf("%s.%s is not a scalar", ScopeName(scope), s.Key)
+		}
+		key, text, err := s.Func(v.Value)
+		if err != nil {
+			return changes, fmt.Errorf("%s.%s: %w", ScopeName(scope), s.Key, err)
+		}
+		if key != s.Key {
+			if err = d.Rename(scope, s.Key, key); err != nil {
+				return changes, err
+			}
+		}
+		if err = d.Set(scope, key, text); err != nil {
+			return changes, err
+		}
+		changes = append(changes, fmt.Sprintf("transform %s.%s: %s -> %s: %s", ScopeName(scope), s.Key, v.Value, key, text))
+	}
+	return
+}
+
+/**************************************************************\
+*                         Registry                             *
+\**************************************************************/
+func init() {
+	RegisterMigration(&Migration{
+		From: "0.8",
+		To:   "0.9",
+		Desc: "vip_enabled is replaced by vip_mode (none|l2|l4)",
+		Steps: []MigrationStep{
+			TransformStep{
+				Key:  "vip_enabled",
+				Desc: "true -> vip_mode: l2, false -> vip_mode: none",
+				Func: func(value string) (string, string, error) {
+					switch strings.ToLower(value) {
+					case "true", "yes", "on":
+						return "vip_mode", "l2", nil
+					case "false", "no", "off", "":
+						return "vip_mode", "none", nil
+					}
+					return "", "", fmt.Errorf("invalid boolean %q", value)
+				},
+			},
+		},
+	})
+}
@@ -0,0 +1,116 @@
+package conf
+
+import (
+	"strings"
+	"testing"
+)
+
+const migrateTestCase = `---
+# header comment survives
+all:
+  children:
+    meta:
+      vars:
+        meta_node: true                     # mark node as meta controller
+      hosts: {10.10.10.10: {ansible_host: meta}}
+    pg-test:
+      hosts:
+        10.10.10.11: {pg_seq: 1, pg_role: primary, vip_enabled: true}
+      vars:
+        pg_cluster: pg-test                 # cluster name
+        vip_enabled: true                   # enable vip
+  vars:
+    vip_enabled: false                      # global vip switch
+    node_dns_hosts:                         # static dns records
+      - 10.10.10.10 yum.pigsty
+    repo_home: /www
+`
+
+func TestMigrateConfig(t *testing.T) {
+	out, changes, err := MigrateConfig([]byte(migrateTestCase), "", SchemaVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 4 {
+		t.Errorf("expect 4 changes, got %v", changes)
+	}
+	s := string(out)
+	for _, line := range []string{
+		"# header comment survives",
+		"        vip_mode: l2                   # enable vip",
+		"    vip_mode: none                      # global vip switch",
+		"        10.10.10.11: {pg_seq: 1, pg_role: primary, vip_mode: l2}",
+		`    pigsty_version: "0.9"`,
+	} {
+		if !strings.Contains(s, line+"\n") {
+			t.Errorf("migrated config missing line %q:\n%s", line, s)
+		}
+	}
+	cfg, err := ParseConfig(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode, _ := cfg.Vars.GetString("vip_mode"); mode != "none" {
+		t.Errorf("expect vip_mode none, got %s", mode)
+	}
+
+	// migrate again is no-op
+	if _, changes, err = MigrateConfig(out, "", SchemaVersion); err != nil || len(changes) != 0 {
+		t.Errorf("expect no changes, got %v %v", changes, err)
+	}
+	// downgrade is not allowed
+	if _, _, err = MigrateConfig(out, "", "0.8"); err == nil {
+		t.Errorf("expect downgrade error")
+	}
+}
+
+func TestDocumentMove(t *testing.T) {
+	doc, err := ParseDocument([]byte(migrateTestCase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	global, meta := []string{"all", "vars"}, []string{"all", "children", "meta", "vars"}
+	host := []string{"all", "children", "pg-test", "hosts", "10.10.10.11"}
+
+	// block value between block mappings
+	if err = doc.Move(global, "node_dns_hosts", meta); err != nil {
+		t.Fatal(err)
+	}
+	// scalar from flow mapping into block mapping
+	if err = doc.Move(host, "vip_enabled", meta); err != nil {
+		t.Fatal(err)
+	}
+	// scalar from block mapping into flow mapping
+	if err = doc.Move(global, "repo_home", host); err != nil {
+		t.Fatal(err)
+	}
+	s := string(doc.Bytes())
+	for _, block := range []string{
+		"        meta_node: true                     # mark node as meta controller\n" +
+			"        node_dns_hosts: # static dns records\n" +
+			"          - 10.10.10.10 yum.pigsty\n" +
+			"        vip_enabled: true\n",
+		"        10.10.10.11: {pg_seq: 1, pg_role: primary, repo_home: /www}\n",
+	} {
+		if !strings.Contains(s, block) {
+			t.Errorf("document missing %q:\n%s", block, s)
+		}
+	}
+	if !strings.HasSuffix(s, "  vars:\n    vip_enabled: false                      # global vip switch\n") {
+		t.Errorf("moved entries should be removed from global vars:\n%s", s)
+	}
+	if _, err = ParseConfig(doc.Bytes()); err != nil {
+		t.Error(err)
+	}
+	if err = doc.Move(global, "repo_home", meta); err == nil {
+		t.Errorf("expect error on moving non-exist key")
+	}
+}
+
+func TestTextDiff(t *testing.T) {
+	diff := TextDiff([]byte("a\nb\nc\nd"), []byte("a\nB\nc\nd\ne"), 0)
+	expect := "@@ -2 +2 @@\n- b\n+ B\n@@ -5 +5 @@\n+ e\n"
+	if diff != expect {
+		t.Errorf("want:\n%s\ngot:\n%s", expect, diff)
+	}
+}
@@ -0,0 +1,74 @@
+package conf
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/**************************************************************\
+*                          Secrets                             *
+\**************************************************************/
+// VAULT_PREFIX is header of ansible vault encrypted value (!vault tag)
+const VAULT_PREFIX = "$ANSIBLE_VAULT"
+
+// secretKeyRegex matches names of vars holding secrets, e.g: pg_admin_password, ansible_ssh_pass, api_token
+var secretKeyRegex = regexp.MustCompile(`(?i)(^|_)(password|passwd|pass|secret|token)$`)
+
+// IsSecretKey tells whether var of this name holds a secret
+func IsSecretKey(key string) bool {
+	return secretKeyRegex.MatchString(key)
+}
+
+// Secrets will collect secret values from vars: values of secret keys and vault values, at any depth,
+// e.g: password of pg_users entries
+func Secrets(v interface{}) []string {
+	var res []string
+	var walk func(key string, v interface{})
+	walk = func(key string, v interface{}) {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for k, item := range t {
+				walk(k, item)
+			}
+		case []interface{}:
+			for _, item := range t {
+				walk(key, item)
+			}
+		case Vars:
+			walk(key, t.Data)
+		case nil:
+		case string:
+			if IsSecretKey(key) || strings.HasPrefix(t, VAULT_PREFIX) {
+				res = append(res, t)
+			}
+		default:
+			if IsSecretKey(key) {
+				res = append(res, fmt.Sprint(t))
+			}
+		}
+	}
+	walk("", v)
+	return res
+}
+
+// Secrets will collect secret values of inventory: global, cluster and instance vars, sorted & unique
+func (c *Config) Secrets() []string {
+	var all []string
+	all = append(all, Secrets(c.Vars)...)
+	for _, cls := range c.Clusters {
+		all = append(all, Secrets(cls.Vars)...)
+		for _, ins := range cls.Instances {
+			all = append(all, Secrets(ins.Vars)...)
+		}
+	}
+	sort.Strings(all)
+	var res []string
+	for i, s := range all {
+		if s != "" && (i == 0 || s != all[i-1]) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
@@ -0,0 +1,41 @@
+package conf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSecrets(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+all:
+  children:
+    meta:
+      hosts: {10.10.10.10: {ansible_ssh_pass: Host.Pass}}
+      vars:
+        grafana_admin_password: Grafana.Admin
+        api_token: !vault |
+          $ANSIBLE_VAULT;1.1;AES256
+          6162636465
+    pg-test:
+      hosts: {10.10.10.11: {pg_seq: 1, pg_role: primary}}
+      vars:
+        pg_cluster: pg-test
+        pg_users: [ { name: dbuser_test, password: User.Test, pgbouncer: true } ]
+  vars:
+    pg_admin_password: DBUser.Admin
+    pg_monitor_password: 12345678
+    pg_passwordless: DBUser.NotSecret
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"$ANSIBLE_VAULT;1.1;AES256\n6162636465\n", "12345678", "DBUser.Admin", "Grafana.Admin", "Host.Pass", "User.Test"}
+	if secrets := cfg.Secrets(); !reflect.DeepEqual(secrets, expected) {
+		t.Errorf("unexpected secrets:\n%q\n%q", secrets, expected)
+	}
+	for key, secret := range map[string]bool{"pg_admin_password": true, "ansible_ssh_pass": true, "password": true, "PASSWORD": true, "pg_passwordless": false, "bypass": false} {
+		if IsSecretKey(key) != secret {
+			t.Errorf("IsSecretKey(%s) should be %v", key, secret)
+		}
+	}
+}
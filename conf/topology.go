@@ -0,0 +1,251 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+/**************************************************************\
+*                         Topology                             *
+\**************************************************************/
+// Topology is the replication graph of all pgsql instances in inventory
+//
+// upstream of an instance is decided in following order:
+//   1. instance level pg_upstream (cascade replica or standby leader)
+//   2. cluster level pg_upstream, applies to cluster leader only (standby cluster)
+//   3. cluster primary for non-leader instances, none for leader
+//
+// pg_upstream could be an ip address, an instance name or a cluster name
+// (which refers to that cluster's primary)
+type Topology struct {
+	Nodes      map[string]*Instance // all pgsql instances: ip -> instance
+	Upstreams  map[string]string    // instance ip -> upstream ip
+	Downstream map[string][]string  // upstream ip -> downstream ips (inventory order)
+	Roots      []string             // instances without upstream (inventory order)
+	Dangling   map[string]string    // instance ip -> unresolved pg_upstream reference
+	Cycles     [][]string           // replication cycles, in replication order
+	Errors     []error              // problems found while building graph
+}
+
+// Topology will build replication graph across the inventory
+func (c *Config) Topology() *Topology {
+	t := &Topology{
+		Nodes:      make(map[string]*Instance),
+		Upstreams:  make(map[string]string),
+		Downstream: make(map[string][]string),
+		Dangling:   make(map[string]string),
+	}
+
+	// collect nodes in inventory order
+	var order []string
+	for i := range c.Clusters {
+		if c.Clusters[i].Name == GROUP_META {
+			continue
+		}
+		for j := range c.Clusters[i].Instances {
+			ins := &(c.Clusters[i].Instances[j])
+			t.Nodes[ins.IP] = ins
+			order = append(order, ins.IP)
+		}
+	}
+
+	// find upstream of each node
+	for _, ip := range order {
+		ins := t.Nodes[ip]
+		ref, leader := ins.Upstream, AvailableRoles[ins.Role]
+		if ref == "" && leader {
+			ref, _ = ins.Cluster.Vars.GetString("pg_upstream")
+		}
+		if ref == "" {
+			if leader {
+				t.Roots = append(t.Roots, ip)
+				continue
+			}
+			primary := c.clusterPrimary(ins.Cluster.Name)
+			if primary == nil {
+				t.Errors = append(t.Errors, fmt.Errorf("%s (%s) has no upstream: cluster %s does not have a primary", ins.Name, ip, ins.Cluster.Name))
+				t.Roots = append(t.Roots, ip)
+				continue
+			}
+			ref = primary.IP
+		}
+		upstream := c.resolveUpstream(ref)
+		if upstream == nil {
+			t.Errors = append(t.Errors, fmt.Errorf("%s (%s) has dangling upstream: %s", ins.Name, ip, ref))
+			t.Dangling[ip] = ref
+			t.Roots = append(t.Roots, ip)
+			continue
+		}
+		t.Upstreams[ip] = upstream.IP
+		t.Downstream[upstream.IP] = append(t.Downstream[upstream.IP], ip)
+	}
+
+	t.findCycles(order)
+	return t
+}
+
+// clusterPrimary will return primary instance of given cluster
+func (c *Config) clusterPrimary(name string) *Instance {
+	cls := c.ClusterMap[name]
+	if cls == nil {
+		return nil
+	}
+	for i := range cls.Instances {
+		if cls.Instances[i].Role == ROLE_PRIMARY {
+			return &(cls.Instances[i])
+		}
+	}
+	return nil
+}
+
+// resolveUpstream will translate ip, instance name or cluster name into instance
+func (c *Config) resolveUpstream(ref string) *Instance {
+	switch c.NameType(ref) {
+	case NameIP:
+		return c.IpMap[ref]
+	case NameInstance:
+		return c.InstanceMap[ref]
+	case NameCluster:
+		return c.clusterPrimary(ref)
+	default:
+		return nil
+	}
+}
+
+// findCycles will detect replication cycles, each cycle is reported once
+func (t *Topology) findCycles(order []string) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(order))
+	for _, start := range order {
+		if state[start] != unvisited {
+			continue
+		}
+		var path []string
+		ip := start
+		for ip != "" && state[ip] == unvisited {
+			state[ip] = visiting
+			path = append(path, ip)
+			ip = t.Upstreams[ip]
+		}
+		if ip != "" && state[ip] == visiting { // back to current path: found a cycle
+			var cycle []string
+			for i := len(path) - 1; i >= 0; i-- {
+				cycle = append(cycle, path[i])
+				if path[i] == ip {
+					break
+				}
+			}
+			t.Cycles = append(t.Cycles, cycle)
+			var names []string
+			for _, n := range cycle {
+				names = append(names, t.Nodes[n].Name)
+			}
+			names = append(names, t.Nodes[ip].Name)
+			t.Errors = append(t.Errors, fmt.Errorf("replication cycle detected: %s", strings.Join(names, " -> ")))
+		}
+		for _, n := range path {
+			state[n] = visited
+		}
+	}
+}
+
+// Err will return all topology errors as one, nil if graph is sane
+func (t *Topology) Err() error {
+	if len(t.Errors) == 0 {
+		return nil
+	}
+	var msgs []string
+	for _, err := range t.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Errorf("invalid replication topology: %s", strings.Join(msgs, "; "))
+}
+
+// Upstream will return upstream instance of given instance, nil if not exists
+func (t *Topology) Upstream(ins *Instance) *Instance {
+	if up, exists := t.Upstreams[ins.IP]; exists {
+		return t.Nodes[up]
+	}
+	return nil
+}
+
+// IsStandbyLeader tells whether instance leads a cluster replicating from another cluster
+func (t *Topology) IsStandbyLeader(ins *Instance) bool {
+	up := t.Upstream(ins)
+	return up != nil && up.Cluster.Name != ins.Cluster.Name
+}
+
+// Tree will render replication graph as tree, only trees with any instance
+// matching filter are rendered, nil filter matches everything
+func (t *Topology) Tree(filter func(*Instance) bool) string {
+	var buf bytes.Buffer
+	for _, root := range t.Roots {
+		if filter != nil && !t.anyMatch(root, filter) {
+			continue
+		}
+		t.writeNode(&buf, root, "", "")
+	}
+	for _, cycle := range t.Cycles {
+		if filter != nil && !t.anyMatch(cycle[0], filter) {
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("[cycle] %s\n", t.label(cycle[0])))
+		for i := 1; i < len(cycle); i++ {
+			buf.WriteString(fmt.Sprintf("    <- %s\n", t.label(cycle[i])))
+		}
+	}
+	return buf.String()
+}
+
+// anyMatch tells whether any instance in subtree (or cycle) matches filter
+func (t *Topology) anyMatch(ip string, filter func(*Instance) bool) bool {
+	seen := make(map[string]bool)
+	var walk func(string) bool
+	walk = func(n string) bool {
+		if seen[n] {
+			return false
+		}
+		seen[n] = true
+		if filter(t.Nodes[n]) {
+			return true
+		}
+		for _, d := range t.Downstream[n] {
+			if walk(d) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(ip)
+}
+
+// label will print one-line representation of an instance in tree
+func (t *Topology) label(ip string) string {
+	ins := t.Nodes[ip]
+	s := fmt.Sprintf("%s (%s) [%s]", ins.Name, ins.IP, ins.Role)
+	if ref, dangling := t.Dangling[ip]; dangling {
+		s += fmt.Sprintf(" <- %s (dangling)", ref)
+	} else if t.IsStandbyLeader(ins) {
+		up := t.Upstream(ins)
+		s += fmt.Sprintf(" <- %s (standby of %s)", up.Name, up.Cluster.Name)
+	}
+	return s
+}
+
+// writeNode will write node and its downstream recursively
+func (t *Topology) writeNode(buf *bytes.Buffer, ip string, prefix, childPrefix string) {
+	buf.WriteString(prefix + t.label(ip) + "\n")
+	children := t.Downstream[ip]
+	for i, child := range children {
+		if i == len(children)-1 {
+			t.writeNode(buf, child, childPrefix+"└── ", childPrefix+"    ")
+		} else {
+			t.writeNode(buf, child, childPrefix+"├── ", childPrefix+"│   ")
+		}
+	}
+}
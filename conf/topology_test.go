@@ -0,0 +1,103 @@
+package conf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTopology(t *testing.T) {
+	testCase := `
+all:
+  children:
+    meta:
+      hosts: {10.10.10.10: {ansible_host: meta}}
+    pg-test:
+      hosts:
+        10.10.10.11: {pg_seq: 1, pg_role: primary}
+        10.10.10.12: {pg_seq: 2, pg_role: replica}
+        10.10.10.13: {pg_seq: 3, pg_role: offline, pg_upstream: pg-test-2}
+      vars: {pg_cluster: pg-test}
+    pg-test2:
+      hosts:
+        10.10.10.21: {pg_seq: 1, pg_role: primary}
+        10.10.10.22: {pg_seq: 2, pg_role: replica}
+      vars: {pg_cluster: pg-test2, pg_upstream: pg-test}
+`
+	cfg, err := ParseConfig([]byte(testCase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo := cfg.Topology()
+	if err := topo.Err(); err != nil {
+		t.Fatalf("unexpected topology error: %s", err)
+	}
+	expects := map[string]string{
+		"10.10.10.12": "10.10.10.11", // replica -> primary
+		"10.10.10.13": "10.10.10.12", // cascade replica
+		"10.10.10.21": "10.10.10.11", // standby leader -> upstream cluster primary
+		"10.10.10.22": "10.10.10.21", // standby cluster replica -> standby leader
+	}
+	for ip, up := range expects {
+		if topo.Upstreams[ip] != up {
+			t.Errorf("upstream of %s: want %s, got %s", ip, up, topo.Upstreams[ip])
+		}
+	}
+	if len(topo.Roots) != 1 || topo.Roots[0] != "10.10.10.11" {
+		t.Errorf("roots: want [10.10.10.11], got %v", topo.Roots)
+	}
+	if !topo.IsStandbyLeader(cfg.IpMap["10.10.10.21"]) {
+		t.Errorf("pg-test2-1 should be standby leader")
+	}
+
+	tree := topo.Tree(nil)
+	for _, line := range []string{
+		"pg-test-1 (10.10.10.11) [primary]",
+		"├── pg-test-2 (10.10.10.12) [replica]",
+		"│   └── pg-test-3 (10.10.10.13) [offline]",
+		"└── pg-test2-1 (10.10.10.21) [primary] <- pg-test-1 (standby of pg-test)",
+		"    └── pg-test2-2 (10.10.10.22) [replica]",
+	} {
+		if !strings.Contains(tree, line+"\n") {
+			t.Errorf("tree missing line %q:\n%s", line, tree)
+		}
+	}
+}
+
+func TestTopologyErrors(t *testing.T) {
+	testCase := `
+all:
+  children:
+    meta:
+      hosts: {10.10.10.10: {ansible_host: meta}}
+    pg-test:
+      hosts:
+        10.10.10.11: {pg_seq: 1, pg_role: primary, pg_upstream: 10.10.10.12}
+        10.10.10.12: {pg_seq: 2, pg_role: replica}
+        10.10.10.13: {pg_seq: 3, pg_role: replica, pg_upstream: 10.10.10.99}
+      vars: {pg_cluster: pg-test}
+    pg-orphan:
+      hosts:
+        10.10.10.21: {pg_seq: 1, pg_role: replica}
+      vars: {pg_cluster: pg-orphan}
+`
+	cfg, err := ParseConfig([]byte(testCase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo := cfg.Topology()
+	if topo.Err() == nil {
+		t.Fatalf("expect topology error")
+	}
+	if len(topo.Cycles) != 1 || len(topo.Cycles[0]) != 2 {
+		t.Errorf("expect one cycle of 2 instances, got %v", topo.Cycles)
+	}
+	if ref := topo.Dangling["10.10.10.13"]; ref != "10.10.10.99" {
+		t.Errorf("expect dangling upstream 10.10.10.99 on 10.10.10.13, got %q", ref)
+	}
+	if len(topo.Errors) != 3 {
+		t.Errorf("expect 3 errors (cycle, dangling, no primary), got %v", topo.Errors)
+	}
+	if tree := topo.Tree(nil); !strings.Contains(tree, "[cycle]") {
+		t.Errorf("tree should render cycle:\n%s", tree)
+	}
+}
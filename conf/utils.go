@@ -1,8 +1,11 @@
 package conf
 
 import (
+	"bytes"
+	"fmt"
 	"gopkg.in/yaml.v3"
 	"net"
+	"strings"
 )
 
 // IsValidIP tells if a string is a valid ip address
@@ -54,3 +57,69 @@ func sortMapNode(mapNode *yaml.Node, keys []string) {
 	}
 	mapNode.Content = sortedNodes
 }
+
+// TextDiff will return unified style line diff between a and b, with n lines of context
+func TextDiff(a, b []byte, n int) string {
+	x, y := strings.Split(string(a), "\n"), strings.Split(string(b), "\n")
+
+	// lcs[i][j] is length of longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// build edit script: ' ' keep, '-' delete, '+' insert
+	type edit struct {
+		op     byte
+		line   string
+		ai, bj int // position in a and b when this edit applies (1-based)
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			edits = append(edits, edit{' ', x[i], i + 1, j + 1})
+			i, j = i+1, j+1
+		case j < len(y) && (i == len(x) || lcs[i][j+1] > lcs[i+1][j]):
+			edits = append(edits, edit{'+', y[j], i + 1, j + 1})
+			j++
+		default:
+			edits = append(edits, edit{'-', x[i], i + 1, j + 1})
+			i++
+		}
+	}
+
+	// print changed lines with context
+	var buf bytes.Buffer
+	last := -1
+	for k := range edits {
+		near := false
+		for d := k - n; d <= k+n; d++ {
+			if d >= 0 && d < len(edits) && edits[d].op != ' ' {
+				near = true
+				break
+			}
+		}
+		if !near {
+			continue
+		}
+		if last < 0 || k != last+1 {
+			buf.WriteString(fmt.Sprintf("@@ -%d +%d @@\n", edits[k].ai, edits[k].bj))
+		}
+		buf.WriteString(fmt.Sprintf("%c %s\n", edits[k].op, edits[k].line))
+		last = k
+	}
+	return buf.String()
+}
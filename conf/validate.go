@@ -0,0 +1,108 @@
+package conf
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/**************************************************************\
+*                         Validate                             *
+\**************************************************************/
+// ValidationError hold all problems found in config
+type ValidationError []error
+
+// Error will list all problems, one per line
+func (e ValidationError) Error() string {
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d problems found in config:\n  - %s", len(e), strings.Join(msgs, "\n  - "))
+}
+
+// ValidateConfig will parse and validate config content
+func ValidateConfig(data []byte) error {
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if cfg == nil {
+		return fmt.Errorf("invalid config: empty content")
+	}
+	return cfg.Validate()
+}
+
+// clusterNameRegex is valid cluster name pattern
+var clusterNameRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+
+// Validate will check config semantics beyond syntax, return ValidationError if any problem found
+func (c *Config) Validate() error {
+	var errs ValidationError
+
+	// meta group
+	if c.MetaCluster == nil || len(c.MetaCluster.Instances) == 0 {
+		errs = append(errs, fmt.Errorf("meta group is required and must have at least one host"))
+	}
+
+	// clusters & instances
+	ipOwner := make(map[string]string)
+	for _, cls := range c.Clusters {
+		if cls.Name == GROUP_META {
+			continue
+		}
+		if !clusterNameRegex.MatchString(cls.Name) {
+			errs = append(errs, fmt.Errorf("invalid cluster name %s", cls.Name))
+		}
+		if name, exists := cls.Vars.GetString("pg_cluster"); exists && name != cls.Name {
+			errs = append(errs, fmt.Errorf("cluster %s: pg_cluster %s does not match group name", cls.Name, name))
+		}
+		if len(cls.Instances) == 0 {
+			errs = append(errs, fmt.Errorf("cluster %s does not have any instance", cls.Name))
+		}
+		var primaries []string
+		seqs := make(map[int]string)
+		for _, ins := range cls.Instances {
+			if owner, exists := ipOwner[ins.IP]; exists {
+				errs = append(errs, fmt.Errorf("ip %s is used by both %s and %s", ins.IP, owner, ins.Name))
+			} else {
+				ipOwner[ins.IP] = ins.Name
+			}
+			if owner, exists := seqs[ins.Seq]; exists {
+				errs = append(errs, fmt.Errorf("cluster %s: pg_seq %d is used by both %s and %s", cls.Name, ins.Seq, owner, ins.IP))
+			} else {
+				seqs[ins.Seq] = ins.IP
+			}
+			if ins.Seq < 0 {
+				errs = append(errs, fmt.Errorf("%s: pg_seq must be non-negative", ins.IP))
+			}
+			if ins.Role == ROLE_PRIMARY {
+				primaries = append(primaries, ins.IP)
+			}
+		}
+		if len(primaries) > 1 {
+			errs = append(errs, fmt.Errorf("cluster %s has multiple primary: %s", cls.Name, strings.Join(primaries, ", ")))
+		}
+	}
+
+	// dcs servers
+	if dcsServers, exists := c.Vars.Data["dcs_servers"]; exists {
+		if servers, ok := dcsServers.(map[string]interface{}); !ok {
+			errs = append(errs, fmt.Errorf("dcs_servers must be a name:ip dict"))
+		} else {
+			for name, ip := range servers {
+				if s, ok := ip.(string); !ok || !IsValidIP(s) {
+					errs = append(errs, fmt.Errorf("dcs_servers: invalid ip %v for %s", ip, name))
+				}
+			}
+		}
+	}
+
+	// replication topology
+	errs = append(errs, c.Topology().Errors...)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
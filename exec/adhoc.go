@@ -0,0 +1,129 @@
+package exec
+
+import (
+	"github.com/apenella/go-ansible/pkg/adhoc"
+	"sort"
+	"strings"
+)
+
+/**************************************************************\
+*                          Ad-Hoc                              *
+\**************************************************************/
+// ad-hoc modules
+const (
+	MODULE_PING    = "ping"
+	MODULE_COMMAND = "command"
+	MODULE_SHELL   = "shell"
+	MODULE_RAW     = "raw"
+	MODULE_FETCH   = "fetch"
+)
+
+// WithModule will run ansible module with args on limited hosts instead of playbook, e.g: shell uptime
+func WithModule(module, args string) JobOpts {
+	return func(j *Job) {
+		j.Module = module
+		j.Args = args
+	}
+}
+
+// IsAdHoc tells whether job runs ad-hoc module instead of playbook
+func (j *Job) IsAdHoc() bool {
+	return j.Module != ""
+}
+
+// newAdHocCmd will build ansible ad-hoc command of job, output in one-line format
+func (e *Executor) newAdHocCmd(j *Job) *adhoc.AnsibleAdhocCmd {
+	return &adhoc.AnsibleAdhocCmd{
+		Pattern: "all",
+		Options: &adhoc.AnsibleAdhocOptions{
+			Inventory:  e.Inventory,
+			ModuleName: j.Module,
+			Args:       j.Args,
+			Limit:      j.Opts.Limit,
+			Check:      j.Opts.Check,
+			Diff:       j.Opts.Diff,
+			ExtraVars:  j.Opts.ExtraVars,
+			OneLine:    true,
+		},
+	}
+}
+
+// commandLine will return command line of job: ansible-playbook or ansible ad-hoc
+func (j *Job) commandLine() string {
+	if j.AdHoc != nil {
+		return j.AdHoc.String()
+	}
+	return j.CMD.String()
+}
+
+// setLimit will overwrite limit of job command, e.g: hosts of a rolling batch
+func (j *Job) setLimit(limit string) {
+	j.Opts.Limit = limit
+	if j.AdHoc != nil {
+		j.AdHoc.Options.Limit = limit
+	}
+}
+
+// HostOutput is result of ad-hoc module on a host
+type HostOutput struct {
+	Host   string `json:"host"`
+	Status string `json:"status"` // ok | changed | failed | unreachable | skipped
+	RC     int    `json:"rc"`     // return code of command, 0 for modules without rc
+	Output string `json:"output"` // stdout (and stderr) of command, or module result
+}
+
+// Outputs will return latest result of each host, in order of hosts
+func (j *Job) Outputs() []HostOutput {
+	j.eventLock.Lock()
+	defer j.eventLock.Unlock()
+	index := make(map[string]int)
+	var res []HostOutput
+	for _, ev := range j.Events {
+		if !ev.IsHostEvent() {
+			continue
+		}
+		out := HostOutput{Host: ev.Host, Status: strings.TrimPrefix(ev.Type, "host_"), RC: ev.Stats["rc"], Output: ev.Message}
+		if i, exists := index[ev.Host]; exists {
+			res[i] = out
+			continue
+		}
+		index[ev.Host] = len(res)
+		res = append(res, out)
+	}
+	order := make(map[string]int, len(j.Hosts))
+	for i, host := range j.Hosts {
+		order[host] = i + 1
+	}
+	sort.SliceStable(res, func(a, b int) bool {
+		oa, ob := order[res[a].Host], order[res[b].Host]
+		if oa == 0 || ob == 0 { // hosts not in limit go last
+			return oa > ob
+		}
+		return oa < ob
+	})
+	return res
+}
+
+// OutputGroup is hosts with identical ad-hoc result
+type OutputGroup struct {
+	Hosts  []string `json:"hosts"`
+	Status string   `json:"status"`
+	RC     int      `json:"rc"`
+	Output string   `json:"output"`
+}
+
+// GroupOutputs will group hosts by identical status, rc & output, in order of first host of group
+func GroupOutputs(outputs []HostOutput) []OutputGroup {
+	var groups []OutputGroup
+	index := make(map[HostOutput]int)
+	for _, out := range outputs {
+		key := HostOutput{Status: out.Status, RC: out.RC, Output: out.Output}
+		if i, exists := index[key]; exists {
+			groups[i].Hosts = append(groups[i].Hosts, out.Host)
+			continue
+		}
+		index[key] = len(groups)
+		groups = append(groups, OutputGroup{Hosts: []string{out.Host}, Status: out.Status, RC: out.RC, Output: out.Output})
+	}
+	return groups
+}
@@ -0,0 +1,52 @@
+package exec
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// adhocOutput is a recorded `ansible all -o -m shell -a 'uptime'` run
+const adhocOutput = `10.10.10.12 | CHANGED | rc=0 | (stdout)  16:07:24 up 3 days,  load average: 0.00
+10.10.10.11 | CHANGED | rc=0 | (stdout)  16:07:24 up 3 days,  load average: 0.00
+10.10.10.10 | FAILED | rc=1 | (stdout) line1\nline2 (stderr) bash: oops
+10.10.10.13 | UNREACHABLE!: Failed to connect to the host via ssh: Connection refused
+`
+
+func TestAdHoc(t *testing.T) {
+	e, runner := newTestExecutor(t, map[string]*Script{"shell": {Output: adhocOutput, ExitCode: 4}})
+	defer os.RemoveAll(e.WorkDir)
+
+	job := e.NewJob(WithModule(MODULE_SHELL, "uptime"), WithName("node bash"), WithLimit("all"), WithStdout(ioutil.Discard))
+	if err := job.Run(context.TODO()); err == nil || job.ExitCode != 4 || job.Status != JOB_FAILED {
+		t.Errorf("ad-hoc job should fail: %v, exit code %d", err, job.ExitCode)
+	}
+	if calls := runner.Calls(); len(calls) != 1 || calls[0] != "ansible all  --args uptime --inventory pigsty.yml --limit 10.10.10.10,10.10.10.11,10.10.10.12,10.10.10.13 --module-name shell --one-line" {
+		t.Errorf("unexpected calls: %q", calls)
+	}
+	if len(job.Results) != 0 {
+		t.Errorf("ad-hoc job should not have results: %v", job.Results)
+	}
+
+	outputs := job.Outputs()
+	if len(outputs) != 4 || outputs[0].Host != "10.10.10.10" || outputs[3].Host != "10.10.10.13" {
+		t.Fatalf("outputs should be in order of hosts: %+v", outputs)
+	}
+	if out := outputs[0]; out.Status != HOST_FAILED || out.RC != 1 || out.Output != "line1\nline2\nbash: oops" {
+		t.Errorf("unexpected output: %+v", out)
+	}
+	if out := outputs[3]; out.Status != HOST_UNREACHABLE || out.Output != "Failed to connect to the host via ssh: Connection refused" {
+		t.Errorf("unexpected output: %+v", out)
+	}
+
+	var p EventParser
+	if ev := p.Parse(`10.10.10.10 | SUCCESS => {"changed": false, "ping": "pong"}`); ev == nil || ev.Type != EVENT_HOST_OK || ev.Message != `{"changed": false, "ping": "pong"}` {
+		t.Errorf("unexpected ping event: %+v", ev)
+	}
+
+	groups := GroupOutputs(outputs)
+	if len(groups) != 3 || len(groups[1].Hosts) != 2 || groups[1].Hosts[0] != "10.10.10.11" || groups[1].Status != HOST_CHANGED {
+		t.Errorf("identical outputs should be grouped: %+v", groups)
+	}
+}
@@ -0,0 +1,330 @@
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+/**************************************************************\
+*                          Audit                               *
+\**************************************************************/
+// audit actions
+const (
+	AUDIT_JOB_START = "job_start" // job starts running
+	AUDIT_JOB_DONE  = "job_done"  // job is done, outcome is job status
+	AUDIT_CANCEL    = "cancel"    // job is cancelled by request
+	AUDIT_CONFIG    = "config"    // inventory is changed: init, edit, post, rollback, migrate
+)
+
+// audit sources
+const (
+	AUDIT_CLI = "cli" // operation run by pigsty command line
+	AUDIT_API = "api" // operation requested via pigsty server api
+)
+
+// AuditRecord is an entry of audit log, chained to previous one by hash
+type AuditRecord struct {
+	Seq          int64     `json:"seq"`                     // sequence number, start from 1
+	Time         time.Time `json:"time"`                    // when operation is recorded
+	Actor        string    `json:"actor"`                   // os user of cli, api token fingerprint or X-Pigsty-User of api
+	Source       string    `json:"source"`                  // cli | api
+	Remote       string    `json:"remote,omitempty"`        // client address of api request
+	Action       string    `json:"action"`                  // job_start | job_done | cancel | config
+	Command      string    `json:"command"`                 // cli command line or api route
+	JobID        string    `json:"job_id,omitempty"`        // job id of job actions
+	Playbook     string    `json:"playbook,omitempty"`      // playbook of job
+	Module       string    `json:"module,omitempty"`        // ad-hoc module of job
+	Tags         []string  `json:"tags,omitempty"`          // execution tags of job
+	Limit        string    `json:"limit,omitempty"`         // limit expression of job
+	Hosts        []string  `json:"hosts,omitempty"`         // hosts resolved from limit
+	Check        bool      `json:"check,omitempty"`         // job runs in check mode, nothing is changed
+	ConfigBefore string    `json:"config_before,omitempty"` // sha256 of inventory before operation
+	ConfigAfter  string    `json:"config_after,omitempty"`  // sha256 of inventory after operation
+	Outcome      string    `json:"outcome"`                 // job status, ok or error
+	ExitCode     int       `json:"exit_code,omitempty"`     // exit code of finished job
+	Error        string    `json:"error,omitempty"`         // error message if operation failed
+	Prev         string    `json:"prev"`                    // hash of previous record, empty for first record
+	Hash         string    `json:"hash"`                    // sha256 of this record with empty hash
+}
+
+// digest will compute hash of record, which covers all fields but hash itself
+func (r AuditRecord) digest() string {
+	r.Hash = ""
+	b, _ := json.Marshal(r)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditQuery filter audit records, zero value fields are ignored
+type AuditQuery struct {
+	Actor  string    // operated by this actor
+	Action string    // audit action
+	JobID  string    // records of this job
+	Host   string    // operations touch this host
+	Since  time.Time // recorded at or after this
+	Until  time.Time // recorded before this
+	Limit  int       // max number of records returned
+}
+
+// Match tells whether record satisfy query
+func (q *AuditQuery) Match(r *AuditRecord) bool {
+	if q.Actor != "" && r.Actor != q.Actor || q.Action != "" && r.Action != q.Action || q.JobID != "" && r.JobID != q.JobID {
+		return false
+	}
+	if !q.Since.IsZero() && r.Time.Before(q.Since) || !q.Until.IsZero() && !r.Time.Before(q.Until) {
+		return false
+	}
+	if q.Host != "" {
+		for _, host := range r.Hosts {
+			if host == q.Host {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// AuditLog is an append-only, hash chained audit log file shared by cli & server processes.
+// every record holds hash of previous one, so modified or removed records break the chain
+type AuditLog struct {
+	Path string
+}
+
+// OpenAuditLog will open audit log at path, its directory is created if not exists
+func OpenAuditLog(path string) (*AuditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return &AuditLog{Path: path}, nil
+}
+
+// Append will chain record to last one and append it, file is locked so concurrent processes append in order
+func (a *AuditLog) Append(r *AuditRecord) error {
+	f, err := os.OpenFile(a.Path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	last, err := lastRecord(f)
+	if err != nil {
+		return err
+	}
+	r.Seq, r.Prev = 1, ""
+	if last != nil {
+		r.Seq, r.Prev = last.Seq+1, last.Hash
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	r.Time = r.Time.UTC()
+	r.Hash = r.digest()
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// lastRecord will read last record of audit log file, nil if file is empty
+func lastRecord(f *os.File) (*AuditRecord, error) {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return nil, err
+	}
+	// read backward until a complete last line is found
+	for size := int64(4096); ; size *= 2 {
+		if size > info.Size() {
+			size = info.Size()
+		}
+		buf := make([]byte, size)
+		if _, err = f.ReadAt(buf, info.Size()-size); err != nil && err != io.EOF {
+			return nil, err
+		}
+		buf = bytes.TrimRight(buf, "\n")
+		i := bytes.LastIndexByte(buf, '\n')
+		if i < 0 && size < info.Size() {
+			continue
+		}
+		var r AuditRecord
+		if err = json.Unmarshal(buf[i+1:], &r); err != nil {
+			return nil, fmt.Errorf("corrupted audit log %s: %w", f.Name(), err)
+		}
+		return &r, nil
+	}
+}
+
+// Records will read all records of audit log, in order
+func (a *AuditLog) Records() ([]AuditRecord, error) {
+	f, err := os.Open(a.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var r AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("corrupted audit log %s at line %d: %w", a.Path, line, err)
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// Query will return records satisfy query, latest first
+func (a *AuditLog) Query(q AuditQuery) ([]AuditRecord, error) {
+	records, err := a.Records()
+	if err != nil {
+		return nil, err
+	}
+	res := []AuditRecord{}
+	for i := len(records) - 1; i >= 0; i-- {
+		if !q.Match(&records[i]) {
+			continue
+		}
+		res = append(res, records[i])
+		if q.Limit > 0 && len(res) >= q.Limit {
+			break
+		}
+	}
+	return res, nil
+}
+
+// Verify will check hash chain of audit log, return number of verified records.
+// error tells the first record which is modified, removed or inserted
+func (a *AuditLog) Verify() (int, error) {
+	records, err := a.Records()
+	if err != nil {
+		return 0, err
+	}
+	var prev string
+	for i, r := range records {
+		switch {
+		case r.Seq != int64(i+1):
+			return i, fmt.Errorf("record #%d: sequence %d is out of order, records are removed or inserted", i+1, r.Seq)
+		case r.Prev != prev:
+			return i, fmt.Errorf("record #%d: previous hash mismatch, chain is broken", r.Seq)
+		case r.digest() != r.Hash:
+			return i, fmt.Errorf("record #%d: hash mismatch, record is modified", r.Seq)
+		}
+		prev = r.Hash
+	}
+	return len(records), nil
+}
+
+// FileHash will return sha256 of file content, empty if file can not be read
+func FileHash(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+/**************************************************************\
+*                         Auditor                              *
+\**************************************************************/
+// Auditor records operations of an actor to audit log, e.g: a cli invocation or an api request
+type Auditor struct {
+	Log     *AuditLog
+	Actor   string // who: os user, api token fingerprint, ...
+	Source  string // cli | api
+	Remote  string // client address of api request
+	Command string // cli command line or api route
+}
+
+// Record will fill actor info of record and append it to audit log, failure is logged
+func (a *Auditor) Record(r *AuditRecord) {
+	if a == nil || a.Log == nil {
+		return
+	}
+	r.Actor, r.Source, r.Remote = a.Actor, a.Source, a.Remote
+	if r.Command == "" {
+		r.Command = a.Command
+	}
+	if err := a.Log.Append(r); err != nil {
+		logrus.Errorf("fail to write audit log %s: %s", a.Log.Path, err)
+	}
+}
+
+// WithAuditor will record start & outcome of job to audit log
+func WithAuditor(a *Auditor) JobOpts {
+	return func(j *Job) {
+		j.auditor = a
+	}
+}
+
+// inventoryPath is path of job executor's inventory, empty if unknown
+func (j *Job) inventoryPath() string {
+	if j.Exec == nil || j.Exec.Inventory == "" {
+		return ""
+	}
+	return filepath.Join(j.Exec.WorkDir, j.Exec.Inventory)
+}
+
+// auditRecord will build audit record of job, secrets in command are masked
+func (j *Job) auditRecord(action string) *AuditRecord {
+	return &AuditRecord{
+		Action:   action,
+		Command:  j.Redact(j.auditor.Command),
+		JobID:    j.ID,
+		Playbook: j.Playbook,
+		Module:   j.Module,
+		Tags:     j.Tags,
+		Limit:    j.Limit,
+		Hosts:    j.Hosts,
+		Check:    j.Check,
+	}
+}
+
+// auditStart will record job start with inventory hash
+func (j *Job) auditStart() {
+	if j.auditor == nil {
+		return
+	}
+	j.configHash = FileHash(j.inventoryPath())
+	r := j.auditRecord(AUDIT_JOB_START)
+	r.ConfigBefore, r.Outcome = j.configHash, JOB_RUNNING
+	j.auditor.Record(r)
+}
+
+// auditDone will record job outcome with inventory hash before & after job
+func (j *Job) auditDone() {
+	if j.auditor == nil {
+		return
+	}
+	r := j.auditRecord(AUDIT_JOB_DONE)
+	r.ConfigAfter, r.Outcome, r.ExitCode = FileHash(j.inventoryPath()), j.Status, j.ExitCode
+	if r.ConfigBefore = j.configHash; r.ConfigBefore == "" { // job never starts
+		r.ConfigBefore = r.ConfigAfter
+	}
+	if j.prepErr != nil {
+		r.Error = j.Redact(j.prepErr.Error())
+	}
+	j.auditor.Record(r)
+}
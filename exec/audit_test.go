@@ -0,0 +1,77 @@
+package exec
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	e, _ := newTestExecutor(t, map[string]*Script{"pgsql": {Output: sampleOutput, ExitCode: 2}})
+	defer os.RemoveAll(e.WorkDir)
+	log, err := OpenAuditLog(filepath.Join(e.WorkDir, "audit", "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// job start & outcome are recorded, secrets in command line are masked
+	auditor := &Auditor{Log: log, Actor: "alice", Source: AUDIT_CLI, Command: "pigsty pgsql init -l pg-test -e pg_admin_password=Admin.Pass"}
+	job := e.NewJob(WithPlaybook("pgsql.yml"), WithLimit("pg-test"), WithTags("pg_init"), WithExtraVars("pg_admin_password", "Admin.Pass"),
+		WithAuditor(auditor), WithStdout(ioutil.Discard), WithStderr(ioutil.Discard))
+	_ = job.Run(context.TODO())
+	records, err := log.Query(AuditQuery{JobID: job.ID})
+	if err != nil || len(records) != 2 {
+		t.Fatalf("job should be recorded twice: %v %v", records, err)
+	}
+	done, start := records[0], records[1]
+	if start.Action != AUDIT_JOB_START || done.Action != AUDIT_JOB_DONE || done.Outcome != JOB_FAILED || done.ExitCode != 2 {
+		t.Errorf("unexpected records: %+v %+v", start, done)
+	}
+	hash := FileHash(filepath.Join(e.WorkDir, "pigsty.yml"))
+	if done.Actor != "alice" || done.Playbook != "pgsql.yml" || strings.Join(done.Hosts, ",") != "10.10.10.11,10.10.10.12" ||
+		done.Tags[0] != "pg_init" || done.ConfigBefore != hash || done.ConfigAfter != hash || len(hash) != 64 {
+		t.Errorf("unexpected job record: %+v", done)
+	}
+	if strings.Contains(done.Command, "Admin.Pass") || !strings.Contains(done.Command, REDACTED) {
+		t.Errorf("secret in command should be masked: %s", done.Command)
+	}
+
+	// concurrent appends are chained in order
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			other, _ := OpenAuditLog(log.Path)
+			(&Auditor{Log: other, Actor: "bob", Source: AUDIT_API}).Record(&AuditRecord{Action: AUDIT_CANCEL, Outcome: "ok"})
+		}()
+	}
+	wg.Wait()
+	if n, err := log.Verify(); n != 22 || err != nil {
+		t.Fatalf("audit log should be verified: %d %v", n, err)
+	}
+	if records, _ = log.Query(AuditQuery{Actor: "bob", Limit: 5}); len(records) != 5 || records[0].Seq != 22 {
+		t.Errorf("unexpected query result: %v", records)
+	}
+	if records, _ = log.Query(AuditQuery{Host: "10.10.10.12"}); len(records) != 2 {
+		t.Errorf("records should be queried by host: %v", records)
+	}
+
+	// modified, removed records break the chain
+	b, _ := ioutil.ReadFile(log.Path)
+	lines := strings.SplitAfter(string(b), "\n")
+	cases := map[string]string{
+		"modified": strings.Join(lines[:2], "") + strings.Replace(lines[2], `"actor":"bob"`, `"actor":"eve"`, 1) + strings.Join(lines[3:], ""),
+		"removed":  strings.Join(lines[:2], "") + strings.Join(lines[3:], ""),
+	}
+	for name, content := range cases {
+		_ = ioutil.WriteFile(log.Path, []byte(content), 0644)
+		if n, err := log.Verify(); err == nil || n != 2 {
+			t.Errorf("%s record should be detected: %d %v", name, n, err)
+		}
+	}
+}
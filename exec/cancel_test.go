@@ -0,0 +1,91 @@
+package exec
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestJobTimeoutAndCancel(t *testing.T) {
+	e, bin := newSchedulerExecutor(t)
+	dir := filepath.Dir(bin)
+	defer os.RemoveAll(dir)
+	output := "echo 'PLAY [init] ****'; echo 'TASK [node : hostname] ****'; echo 'ok: [10.10.10.11]'; echo 'changed: [10.10.10.12]'\n"
+
+	// ansible-playbook exit on SIGINT: job timeout with partial results
+	script := "#!/bin/sh\ntrap 'echo interrupted; exit 99' INT\n" + output + "sleep 10 &\nwait\n"
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	job := e.NewJob(WithPlaybook("node.yml"), WithStdout(ioutil.Discard), WithTimeout(300*time.Millisecond))
+	job.CMD.Binary = bin
+	if err := job.Run(context.Background()); err == nil {
+		t.Fatalf("timeout job should return error")
+	}
+	if elapsed := job.DoneAt.Sub(job.StartAt); elapsed > 3*time.Second {
+		t.Errorf("children should not block timeout job, took %s", elapsed)
+	}
+	if job.Status != JOB_TIMEOUT || job.ExitCode != 99 || !job.Partial || len(job.Results) != 2 {
+		t.Fatalf("unexpected timeout job: %s, exit code %d, partial %v, results %v", job.Status, job.ExitCode, job.Partial, job.Results)
+	}
+	if r := job.Results[1]; r.Host != "10.10.10.12" || r.Ok != 1 || r.Changed != 1 {
+		t.Errorf("unexpected partial result: %+v", r)
+	}
+	if job.Cancel() {
+		t.Errorf("finished job should not be cancelled")
+	}
+
+	// ansible-playbook ignore SIGINT: process group killed after grace period
+	pidFile := filepath.Join(dir, "child.pid")
+	script = "#!/bin/sh\ntrap '' INT\n" + output + "sleep 30 &\necho $! > " + pidFile + "\nwait\n"
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	job = e.NewJob(WithPlaybook("node.yml"), WithStdout(ioutil.Discard), WithGracePeriod(200*time.Millisecond))
+	job.CMD.Binary = bin
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		job.Cancel()
+	}()
+	start := time.Now()
+	if err := job.Run(context.Background()); err == nil {
+		t.Fatalf("cancelled job should return error")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("job should be killed after grace period, took %s", elapsed)
+	}
+	if job.Status != JOB_CANCELLED || job.ExitCode != -1 || len(job.Results) != 2 {
+		t.Errorf("unexpected cancelled job: %s, exit code %d, results %v", job.Status, job.ExitCode, job.Results)
+	}
+	b, _ := ioutil.ReadFile(pidFile)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; alive(pid); i++ {
+		if i == 20 {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("child process %d should be killed with process group", pid)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// alive tells whether process exists and is not a zombie
+func alive(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	b, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return true // no procfs
+	}
+	fields := strings.Fields(string(b)[strings.LastIndex(string(b), ")")+1:])
+	return len(fields) == 0 || fields[0] != "Z"
+}
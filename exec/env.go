@@ -0,0 +1,92 @@
+package exec
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+/**************************************************************\
+*                        Environment                           *
+\**************************************************************/
+// DefaultEnv is ansible environment applied to every job, could be overwritten by executor & job env
+var DefaultEnv = map[string]string{
+	"ANSIBLE_STDOUT_CALLBACK":               "default", // events are parsed from default callback output
+	"ANSIBLE_TRANSFORM_INVALID_GROUP_CHARS": "ignore",
+	"ANSIBLE_DEPRECATION_WARNINGS":          "False",
+	"ANSIBLE_SYSTEM_WARNINGS":               "False",
+	"ANSIBLE_ACTION_WARNINGS":               "False",
+	"ANSIBLE_COMMAND_WARNINGS":              "False",
+	"ANSIBLE_DEVEL_WARNING":                 "False",
+	"ANSIBLE_DISPLAY_ARGS_TO_STDOUT":        "False",
+}
+
+// WithEnv will set environment variable of job process
+func WithEnv(key, value string) JobOpts {
+	return func(j *Job) {
+		if j.Env == nil {
+			j.Env = make(map[string]string)
+		}
+		j.Env[key] = value
+	}
+}
+
+// WithAnsibleConfig will use a private ansible.cfg for job
+func WithAnsibleConfig(path string) JobOpts {
+	return WithEnv("ANSIBLE_CONFIG", path)
+}
+
+// WithSSHArgs will overwrite ssh arguments used by ansible
+func WithSSHArgs(args string) JobOpts {
+	return WithEnv("ANSIBLE_SSH_ARGS", args)
+}
+
+// WithVaultPasswordFile will decrypt vault with password in given file
+func WithVaultPasswordFile(path string) JobOpts {
+	return WithEnv("ANSIBLE_VAULT_PASSWORD_FILE", path)
+}
+
+// ParseEnv will parse KEY=VALUE pairs into env map
+func ParseEnv(pairs []string) (map[string]string, error) {
+	env := make(map[string]string, len(pairs))
+	for _, kv := range pairs {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid env %q, KEY=VALUE expected", kv)
+		}
+		env[kv[:i]] = kv[i+1:]
+	}
+	return env, nil
+}
+
+// Environ will return environment of job process: current process env overwritten by
+// DefaultEnv, executor env, job env and ANSIBLE_LOG_PATH of job in order
+func (j *Job) Environ() []string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	for k, v := range DefaultEnv {
+		env[k] = v
+	}
+	if j.Exec != nil {
+		for k, v := range j.Exec.Env {
+			env[k] = v
+		}
+	}
+	for k, v := range j.Env {
+		env[k] = v
+	}
+	if j.LogPath != "" {
+		env["ANSIBLE_LOG_PATH"] = j.LogPath
+	}
+	res := make([]string, 0, len(env))
+	for k, v := range env {
+		res = append(res, k+"="+v)
+	}
+	sort.Strings(res)
+	return res
+}
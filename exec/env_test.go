@@ -0,0 +1,61 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestJobEnv(t *testing.T) {
+	e, bin := newSchedulerExecutor(t)
+	dir := filepath.Dir(bin)
+	defer os.RemoveAll(dir)
+	script := "#!/bin/sh\nsleep 0.2\necho \"log=$ANSIBLE_LOG_PATH cfg=$ANSIBLE_CONFIG ssh=$ANSIBLE_SSH_ARGS cb=$ANSIBLE_STDOUT_CALLBACK fork=$ANSIBLE_FORKS\"\n"
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	e.Env = map[string]string{"ANSIBLE_FORKS": "10", "ANSIBLE_CONFIG": "/etc/ansible.cfg"}
+
+	var outs [2]bytes.Buffer
+	jobs := []*Job{
+		e.NewJob(WithPlaybook("a.yml"), WithStdout(&outs[0]), WithLogPath(filepath.Join(dir, "a.log")), WithAnsibleConfig("/tmp/a.cfg")),
+		e.NewJob(WithPlaybook("b.yml"), WithStdout(&outs[1]), WithLogPath(filepath.Join(dir, "b.log")), WithSSHArgs("-o ControlMaster=no"), WithEnv("ANSIBLE_FORKS", "1")),
+	}
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		job.CMD.Binary = bin
+		wg.Add(1)
+		go func(job *Job) {
+			defer wg.Done()
+			if err := job.Run(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}(job)
+	}
+	wg.Wait()
+
+	expected := []string{
+		"log=" + filepath.Join(dir, "a.log") + " cfg=/tmp/a.cfg ssh= cb=default fork=10",
+		"log=" + filepath.Join(dir, "b.log") + " cfg=/etc/ansible.cfg ssh=-o ControlMaster=no cb=default fork=1",
+	}
+	for i := range jobs {
+		if out := strings.TrimSpace(outs[i].String()); out != expected[i] {
+			t.Errorf("job %d: expect %q, got %q", i, expected[i], out)
+		}
+	}
+	if os.Getenv("ANSIBLE_LOG_PATH") != "" {
+		t.Errorf("process environment should not be modified")
+	}
+
+	if _, err := ParseEnv([]string{"A=1=2", "B="}); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseEnv([]string{"=1"}); err == nil {
+		t.Errorf("env without key should be rejected")
+	}
+}
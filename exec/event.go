@@ -0,0 +1,308 @@
+package exec
+
+import (
+	"bytes"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**************************************************************\
+*                          Event                               *
+\**************************************************************/
+// event types
+const (
+	EVENT_PLAY_START       = "play_start"       // PLAY [name]
+	EVENT_TASK_START       = "task_start"       // TASK [name] or RUNNING HANDLER [name]
+	EVENT_HOST_OK          = "host_ok"          // ok: [host]
+	EVENT_HOST_CHANGED     = "host_changed"     // changed: [host]
+	EVENT_HOST_FAILED      = "host_failed"      // fatal: [host]: FAILED! or failed: [host]
+	EVENT_HOST_UNREACHABLE = "host_unreachable" // fatal: [host]: UNREACHABLE!
+	EVENT_HOST_SKIPPED     = "host_skipped"     // skipping: [host]
+	EVENT_HOST_IGNORED     = "host_ignored"     // ...ignoring: previous failure is ignored
+	EVENT_RECAP            = "recap"            // one per host in PLAY RECAP
+)
+
+// subscriberBuffer is channel buffer size of event subscriber
+const subscriberBuffer = 1024
+
+// Event is a typed progress record parsed from ansible output
+type Event struct {
+	Seq     int            `json:"seq"`               // sequence number in job, start from 1
+	Type    string         `json:"type"`              // event type
+	Time    time.Time      `json:"time"`              // when event is parsed
+	Play    string         `json:"play,omitempty"`    // current play name
+	Task    string         `json:"task,omitempty"`    // current task name
+	Host    string         `json:"host,omitempty"`    // target host (host events & recap)
+	Item    string         `json:"item,omitempty"`    // loop item label if any
+	Message string         `json:"message,omitempty"` // raw result after => if any
+	Diff    string         `json:"diff,omitempty"`    // file diff printed before result (--diff)
+	Stats   map[string]int `json:"stats,omitempty"`   // recap counters: ok, changed, unreachable, failed, ... or rc of ad-hoc command
+	Offset  int64          `json:"offset"`            // byte offset of source line in job output
+}
+
+// IsHostEvent tells whether event is a per-host task result
+func (e *Event) IsHostEvent() bool {
+	return strings.HasPrefix(e.Type, "host_")
+}
+
+var (
+	ansiRegex    = regexp.MustCompile(`\x1b\[[0-9;]*[a-zA-Z]`)
+	headerRegex  = regexp.MustCompile(`^(PLAY|TASK|RUNNING HANDLER) \[(.*)\] \**$`)
+	recapRegex   = regexp.MustCompile(`^PLAY RECAP \**$`)
+	resultRegex  = regexp.MustCompile(`^(ok|changed|skipping|fatal|failed): \[([^\]]+)\](: (FAILED|UNREACHABLE)!)?( \(item=(.*?)\))?( => (.*))?$`)
+	statsRegex   = regexp.MustCompile(`^(\S+)\s+: ((\w+=\d+\s*)+)$`)
+	counterRegex = regexp.MustCompile(`(\w+)=(\d+)`)
+	adhocRegex   = regexp.MustCompile(`^(\S+) \| (SUCCESS|CHANGED|FAILED!?|UNREACHABLE!|SKIPPED)(?: \| rc=(-?\d+) \| \(stdout\) (.*?)(?: \(stderr\) (.*))?| => (.*)|: (.*))?$`)
+	unescaper    = strings.NewReplacer(`\n`, "\n", `\r`, "\r")
+)
+
+// EventParser turns ansible default callback output into events line by line
+type EventParser struct {
+	play    string
+	task    string
+	inRecap bool
+	last    *Event   // last host event, used by ...ignoring
+	diff    []string // diff lines waiting for next host result
+}
+
+// Parse will parse one line of output, nil if line is not an event
+func (p *EventParser) Parse(line string) *Event {
+	line = strings.TrimRight(ansiRegex.ReplaceAllString(line, ""), " \r\n")
+	if p.diff != nil && !resultRegex.MatchString(line) && !headerRegex.MatchString(line) {
+		p.diff = append(p.diff, line)
+		return nil
+	}
+	if line == "" {
+		return nil
+	}
+	if strings.HasPrefix(line, "--- before") {
+		p.diff = []string{line}
+		return nil
+	}
+	if recapRegex.MatchString(line) {
+		p.inRecap, p.task = true, ""
+		return nil
+	}
+	if m := headerRegex.FindStringSubmatch(line); m != nil {
+		p.inRecap, p.last, p.diff = false, nil, nil
+		if m[1] == "PLAY" {
+			p.play, p.task = m[2], ""
+			return &Event{Type: EVENT_PLAY_START, Play: p.play}
+		}
+		p.task = m[2]
+		return &Event{Type: EVENT_TASK_START, Play: p.play, Task: p.task}
+	}
+	if p.inRecap {
+		m := statsRegex.FindStringSubmatch(line)
+		if m == nil {
+			return nil
+		}
+		stats := make(map[string]int)
+		for _, kv := range counterRegex.FindAllStringSubmatch(m[2], -1) {
+			stats[kv[1]], _ = strconv.Atoi(kv[2])
+		}
+		return &Event{Type: EVENT_RECAP, Play: p.play, Host: m[1], Stats: stats}
+	}
+	if m := adhocRegex.FindStringSubmatch(line); m != nil {
+		return parseAdHoc(m)
+	}
+	if strings.HasPrefix(line, "...ignoring") && p.last != nil {
+		ev := *p.last
+		ev.Type, ev.Message = EVENT_HOST_IGNORED, ""
+		p.last = nil
+		return &ev
+	}
+	m := resultRegex.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	ev := &Event{Play: p.play, Task: p.task, Host: strings.SplitN(m[2], " -> ", 2)[0], Item: m[6], Message: m[8]}
+	if p.diff != nil {
+		ev.Diff = strings.TrimRight(strings.Join(p.diff, "\n"), "\n") + "\n"
+		p.diff = nil
+	}
+	switch {
+	case m[4] == "UNREACHABLE":
+		ev.Type = EVENT_HOST_UNREACHABLE
+	case m[1] == "fatal" || m[1] == "failed":
+		ev.Type = EVENT_HOST_FAILED
+	case m[1] == "changed":
+		ev.Type = EVENT_HOST_CHANGED
+	case m[1] == "skipping":
+		ev.Type = EVENT_HOST_SKIPPED
+	default:
+		ev.Type = EVENT_HOST_OK
+	}
+	p.last = ev
+	return ev
+}
+
+// parseAdHoc will build host event from ad-hoc one-line result: host | STATE | rc=N | (stdout) ...,
+// host | STATE => {json}, or host | UNREACHABLE!: msg. Message is output of host, rc is recorded in stats
+func parseAdHoc(m []string) *Event {
+	ev := &Event{Host: m[1]}
+	switch m[2] {
+	case "SUCCESS":
+		ev.Type = EVENT_HOST_OK
+	case "CHANGED":
+		ev.Type = EVENT_HOST_CHANGED
+	case "SKIPPED":
+		ev.Type = EVENT_HOST_SKIPPED
+	case "UNREACHABLE!":
+		ev.Type = EVENT_HOST_UNREACHABLE
+	default:
+		ev.Type = EVENT_HOST_FAILED
+	}
+	switch {
+	case m[3] != "":
+		rc, _ := strconv.Atoi(m[3])
+		ev.Stats = map[string]int{"rc": rc}
+		ev.Message = unescaper.Replace(m[4])
+		if m[5] != "" {
+			ev.Message += "\n" + unescaper.Replace(m[5])
+		}
+	case m[6] != "":
+		ev.Message = m[6]
+	default:
+		ev.Message = m[7]
+	}
+	return ev
+}
+
+/**************************************************************\
+*                     Job Event Stream                         *
+\**************************************************************/
+// Subscribe will return a channel of job events, existing events are replayed first.
+// channel is closed when job is done. events are dropped if subscriber is too slow,
+// use EventsSince to catch up in that case
+func (j *Job) Subscribe() <-chan Event {
+	j.eventLock.Lock()
+	defer j.eventLock.Unlock()
+	ch := make(chan Event, len(j.Events)+subscriberBuffer)
+	for _, ev := range j.Events {
+		ch <- ev
+	}
+	if j.eventDone {
+		close(ch)
+		return ch
+	}
+	j.subscribers = append(j.subscribers, ch)
+	return ch
+}
+
+// EventsSince will return copy of events with sequence number greater than seq
+func (j *Job) EventsSince(seq int) []Event {
+	j.eventLock.Lock()
+	defer j.eventLock.Unlock()
+	if seq < 0 {
+		seq = 0
+	}
+	if seq >= len(j.Events) {
+		return []Event{}
+	}
+	return append([]Event{}, j.Events[seq:]...)
+}
+
+// emit will record event on job and deliver it to subscribers
+func (j *Job) emit(ev *Event) {
+	j.eventLock.Lock()
+	defer j.eventLock.Unlock()
+	ev.Seq, ev.Time = len(j.Events)+1, time.Now()
+	j.Events = append(j.Events, *ev)
+	if ev.Type == EVENT_RECAP {
+		j.addResult(ev)
+	}
+	j.watchFailure(ev)
+	if j.Store != nil {
+		if err := j.Store.AppendEvent(j.ID, *ev); err != nil {
+			logrus.Errorf("fail to persist event %d of job %s: %s", ev.Seq, j.ID, err)
+		}
+	}
+	for _, ch := range j.subscribers {
+		select {
+		case ch <- *ev:
+		default:
+			logrus.Debugf("job %s: drop event %d for slow subscriber", j.ID, ev.Seq)
+		}
+	}
+}
+
+// closeEvents will close all subscriber channels, called when job is done
+func (j *Job) closeEvents() {
+	j.eventLock.Lock()
+	defer j.eventLock.Unlock()
+	if j.eventDone {
+		return
+	}
+	j.eventDone = true
+	for _, ch := range j.subscribers {
+		close(ch)
+	}
+	j.subscribers = nil
+}
+
+// eventWriter forward redacted ansible output to job stdout and parse events from it
+type eventWriter struct {
+	job    *Job
+	rec    *Recorder // record output with timing if set
+	parser EventParser
+	buf    []byte
+	offset int64 // output offset of buf head
+}
+
+// Write will redact complete lines of p, write them to job stdout (os.Stdout if not set) and emit their
+// events. incomplete line is kept until next write or flush, so secrets split across writes are masked too
+func (w *eventWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	i := bytes.LastIndexByte(w.buf, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	lines := string(w.buf[:i+1])
+	w.buf = append([]byte{}, w.buf[i+1:]...)
+	if err := w.write(lines); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush will write last line without trailing newline and emit its event, if any
+func (w *eventWriter) flush() {
+	if len(w.buf) == 0 {
+		return
+	}
+	_ = w.write(string(w.buf))
+	w.buf = nil
+}
+
+// write will redact lines, write them to job stdout and emit events of them
+func (w *eventWriter) write(lines string) error {
+	var out io.Writer = os.Stdout
+	if w.job.Stdout != nil {
+		out = w.job.Stdout
+	}
+	lines = w.job.Redact(lines)
+	_, err := io.WriteString(out, lines)
+	if w.rec != nil {
+		if recErr := w.rec.WriteString(lines); recErr != nil {
+			logrus.Errorf("fail to record output of job %s: %s", w.job.ID, recErr)
+			w.rec = nil
+		}
+	}
+	for _, line := range strings.SplitAfter(lines, "\n") {
+		if line == "" {
+			continue
+		}
+		if ev := w.parser.Parse(strings.TrimSuffix(line, "\n")); ev != nil {
+			ev.Offset = w.offset
+			w.job.emit(ev)
+		}
+		w.offset += int64(len(line))
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package exec
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const sampleOutput = "\n" +
+	"PLAY [init node] ***************************************************************\n" +
+	"\n" +
+	"TASK [node : Setup hostname] ***************************************************\n" +
+	"ok: [10.10.10.11]\n" +
+	"\x1b[0;33mchanged: [10.10.10.12]\x1b[0m\n" +
+	"fatal: [10.10.10.13]: UNREACHABLE! => {\"changed\": false, \"unreachable\": true}\n" +
+	"\n" +
+	"TASK [node : Install packages] *************************************************\n" +
+	"skipping: [10.10.10.11]\n" +
+	"changed: [10.10.10.12] => (item=vim)\n" +
+	"failed: [10.10.10.12] (item=bad) => {\"msg\": \"no package\"}\n" +
+	"fatal: [10.10.10.12 -> 10.10.10.10]: FAILED! => {\"msg\": \"failed\"}\n" +
+	"...ignoring\n" +
+	"\n" +
+	"RUNNING HANDLER [node : restart tuned] *****************************************\n" +
+	"changed: [10.10.10.12]\n" +
+	"\n" +
+	"PLAY RECAP *********************************************************************\n" +
+	"10.10.10.11                : ok=1    changed=0    unreachable=0    failed=0    skipped=1    rescued=0    ignored=0\n" +
+	"10.10.10.12                : ok=3    changed=3    unreachable=0    failed=0    skipped=0    rescued=0    ignored=1\n" +
+	"10.10.10.13                : ok=0    changed=0    unreachable=1    failed=0    skipped=0    rescued=0    ignored=0\n"
+
+func TestEventParser(t *testing.T) {
+	var p EventParser
+	var events []*Event
+	for _, line := range strings.Split(sampleOutput, "\n") {
+		if ev := p.Parse(line); ev != nil {
+			events = append(events, ev)
+		}
+	}
+	expected := []string{
+		EVENT_PLAY_START, EVENT_TASK_START, EVENT_HOST_OK, EVENT_HOST_CHANGED, EVENT_HOST_UNREACHABLE,
+		EVENT_TASK_START, EVENT_HOST_SKIPPED, EVENT_HOST_CHANGED, EVENT_HOST_FAILED, EVENT_HOST_FAILED, EVENT_HOST_IGNORED,
+		EVENT_TASK_START, EVENT_HOST_CHANGED, EVENT_RECAP, EVENT_RECAP, EVENT_RECAP,
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expect %d events, got %d", len(expected), len(events))
+	}
+	for i, ev := range events {
+		if ev.Type != expected[i] {
+			t.Errorf("event %d: expect %s, got %s", i, expected[i], ev.Type)
+		}
+	}
+	if ev := events[3]; ev.Host != "10.10.10.12" || ev.Task != "node : Setup hostname" || ev.Play != "init node" {
+		t.Errorf("unexpected changed event: %+v", ev)
+	}
+	if ev := events[8]; ev.Item != "bad" || ev.Message != `{"msg": "no package"}` {
+		t.Errorf("unexpected item event: %+v", ev)
+	}
+	if ev := events[9]; ev.Host != "10.10.10.12" {
+		t.Errorf("delegated host should be stripped: %+v", ev)
+	}
+	if ev := events[12]; ev.Task != "node : restart tuned" {
+		t.Errorf("handler should be parsed as task: %+v", ev)
+	}
+	if ev := events[14]; ev.Host != "10.10.10.12" || ev.Stats["changed"] != 3 || ev.Stats["ignored"] != 1 {
+		t.Errorf("unexpected recap event: %+v", ev)
+	}
+}
+
+func TestJobSubscribe(t *testing.T) {
+	var out bytes.Buffer
+	job := &Job{ID: "test", Stdout: &out}
+	w := &eventWriter{job: job}
+	early := job.Subscribe()
+
+	// write in arbitrary chunks, events are emitted per complete line
+	for i := 0; i < len(sampleOutput); i += 7 {
+		end := i + 7
+		if end > len(sampleOutput) {
+			end = len(sampleOutput)
+		}
+		if _, err := w.Write([]byte(sampleOutput[i:end])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	job.closeEvents()
+	if out.String() != sampleOutput {
+		t.Errorf("output should be forwarded as is")
+	}
+
+	var seqs []int
+	for ev := range early {
+		seqs = append(seqs, ev.Seq)
+	}
+	if len(seqs) != 16 || seqs[0] != 1 || seqs[15] != 16 {
+		t.Errorf("subscriber should receive all events in order: %v", seqs)
+	}
+	// late subscriber get replay and a closed channel
+	late := 0
+	for range job.Subscribe() {
+		late++
+	}
+	if late != 16 {
+		t.Errorf("late subscriber should receive 16 events, got %d", late)
+	}
+	if evs := job.EventsSince(0); evs[0].Offset != 1 || evs[1].Offset != int64(strings.Index(sampleOutput, "TASK")) {
+		t.Errorf("event offset should point to source line: %d, %d", evs[0].Offset, evs[1].Offset)
+	}
+	if evs := job.EventsSince(14); len(evs) != 2 || evs[0].Seq != 15 {
+		t.Errorf("unexpected events since 14: %v", evs)
+	}
+}
@@ -3,14 +3,18 @@ package exec
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/Vonng/pigsty-cli/conf"
-	"github.com/apenella/go-ansible/pkg/execute"
+	"github.com/apenella/go-ansible/pkg/adhoc"
 	"github.com/apenella/go-ansible/pkg/playbook"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,12 +24,19 @@ import (
 *                          Const                               *
 \**************************************************************/
 const (
-	JOB_READY   = "ready"
-	JOB_RUNNING = "running"
-	JOB_FAILED  = "failed"
-	JOB_SUCCESS = "success"
+	JOB_READY       = "ready"
+	JOB_QUEUED      = "queued"
+	JOB_RUNNING     = "running"
+	JOB_FAILED      = "failed"
+	JOB_SUCCESS     = "success"
+	JOB_CANCELLED   = "cancelled"
+	JOB_INTERRUPTED = "interrupted" // job is unfinished when previous process exit
+	JOB_TIMEOUT     = "timeout"     // job is cancelled because it runs longer than its timeout
 )
 
+// DefaultGracePeriod is how long ansible-playbook could clean up after SIGINT before SIGKILL
+const DefaultGracePeriod = 10 * time.Second
+
 /**************************************************************\
 *                        Executor                              *
 \**************************************************************/
@@ -36,6 +47,14 @@ type Executor struct {
 	Config    *conf.Config
 	Jobs      map[string]*Job
 	Lock      *sync.Mutex
+	JobOpts   []JobOpts         // default options applied to every job before its own options
+	Env       map[string]string // default environment of job process, overwritten by job env
+	Runner    Runner            // run jobs of executor, DefaultRunner if nil
+	Redactor  *Redactor         // mask secrets of inventory in job output, logs & json
+	jobLock   sync.Mutex        // protect Jobs
+
+	configLock sync.RWMutex // protect Config & Redactor swapped by reload
+	configHash string       // sha256 of inventory content loaded
 }
 
 // NewExecutor will create ansible playbook executor based on config path
@@ -69,15 +88,17 @@ func NewExecutor(path string) *Executor {
 
 	logrus.Debugf("load config from %s", path)
 	return &Executor{
-		WorkDir:   pigstyDir,
-		Inventory: pigstyFile,
-		Config:    cfg,
-		Jobs:      make(map[string]*Job),
+		WorkDir:    pigstyDir,
+		Inventory:  pigstyFile,
+		Config:     cfg,
+		Jobs:       make(map[string]*Job),
+		Lock:       &sync.Mutex{},
+		Env:        make(map[string]string),
+		Redactor:   NewRedactor(cfg.Secrets()...),
+		configHash: FileHash(configPath),
 	}
 }
 
-func (e *Executor) Reload() {}
-
 // Static return static resource of this executor (.pigsty/public by default)
 func (e *Executor) StaticDir() string {
 	return filepath.Join(e.WorkDir, ".pigsty", "public")
@@ -93,64 +114,163 @@ func (e *Executor) NewJob(options ...JobOpts) *Job {
 	var job Job
 	job.Opts = &playbook.AnsiblePlaybookOptions{ExtraVars: map[string]interface{}{}}
 	job.Exec = e
+	cfg, redactor := e.Snapshot() // job keeps this config even if executor is reloaded
+	job.Config = cfg
 	id, err := uuid.NewUUID()
 	if err != nil {
 		id = uuid.New()
 	}
 	job.ID = id.String()
-	for _, opt := range options {
+	job.PID = os.Getpid()
+	for _, opt := range append(append([]JobOpts{}, e.JobOpts...), options...) {
 		opt(&job)
 	}
 
 	// overwrite important options
 	if job.Limit != "" && job.Opts.Limit == "" {
 		job.Opts.Limit = job.Limit
+		// limit expression is resolved against inventory, ansible runs on explicit host list
+		if cfg != nil {
+			if hosts, err := cfg.ResolveLimit(job.Limit); err != nil {
+				job.prepErr = err
+			} else {
+				job.Hosts = hosts.Hosts
+				job.Opts.Limit = hosts.String()
+			}
+		}
 	}
 	if job.Tags != nil && len(job.Tags) > 0 && job.Opts.Tags == "" {
 		job.Opts.Tags = strings.Join(job.Tags, ",")
 	}
-	execOpts := []execute.ExecuteOptions{execute.WithCmdRunDir(e.WorkDir)}
-	if job.Stdout != nil {
-		execOpts = append(execOpts, execute.WithWrite(job.Stdout))
+	job.Opts.Check = job.Opts.Check || job.Check
+	job.Opts.Diff = job.Opts.Diff || job.Diff
+	if job.StartAtTask != "" && job.Opts.StartAtTask == "" {
+		job.Opts.StartAtTask = job.StartAtTask
+	}
+	if len(job.Opts.ExtraVars) > 0 {
+		job.ExtraVars = job.Opts.ExtraVars
 	}
-	if job.Stderr != nil {
-		execOpts = append(execOpts, execute.WithWriteError(job.Stderr))
+	job.Resources = resources(cfg, job.Opts.Limit)
+	if job.Serial != "" && job.prepErr == nil {
+		hosts := job.Hosts
+		if len(hosts) == 0 && cfg != nil { // no limit means all hosts
+			if all, err := cfg.ResolveLimit("all"); err == nil {
+				hosts = all.Hosts
+			}
+		}
+		if job.Batches, job.prepErr = Batches(cfg, hosts, job.Serial); job.prepErr == nil && len(job.Batches) == 0 {
+			job.prepErr = fmt.Errorf("rolling %s requires hosts from inventory", job.Playbook)
+		}
+	}
+
+	// tags are validated against playbook if it is found in pigsty home
+	if job.Opts.Tags != "" && !job.IsAdHoc() && job.prepErr == nil {
+		if pb, err := e.LoadPlaybook(job.Playbook); err == nil {
+			job.prepErr = pb.ValidateTags([]string{job.Opts.Tags})
+		}
+	}
+
+	// command is run by job runner, ansible-playbook with job env by default
+	if job.Runner == nil {
+		job.Runner = e.Runner
 	}
 	job.CMD = &playbook.AnsiblePlaybookCmd{
 		Playbooks: []string{job.Playbook},
 		Options:   job.Opts,
-		Exec:      execute.NewDefaultExecute(execOpts...),
 	}
-	job.Command = job.CMD.String()
+	if job.IsAdHoc() {
+		job.AdHoc = e.newAdHocCmd(&job)
+	}
+	job.redactor = e.newRedactor(&job, redactor)
+	job.Command = job.redactedCommand()
 	job.StartAt = time.Now()
 	job.Status = JOB_READY
+	e.jobLock.Lock()
 	e.Jobs[job.ID] = &job
+	e.jobLock.Unlock()
 	return &job
 }
 
+// ListJobs will return jobs spawned by executor, in no particular order
+func (e *Executor) ListJobs() []*Job {
+	e.jobLock.Lock()
+	defer e.jobLock.Unlock()
+	jobs := make([]*Job, 0, len(e.Jobs))
+	for _, job := range e.Jobs {
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// CancelJobs will cancel all running jobs of executor, return number of cancelled jobs
+func (e *Executor) CancelJobs() (n int) {
+	for _, job := range e.ListJobs() {
+		if job.Cancel() {
+			n++
+		}
+	}
+	return
+}
+
 /**************************************************************\
 *                          Job                                 *
 \**************************************************************/
 // Job is spawned by executor
 type Job struct {
-	ID       string                           `json:"id"`       // uuid v1
-	Name     string                           `json:"name"`     // human readable job info
-	Playbook string                           `json:"playbook"` // playbook name
-	Limit    string                           `json:"limit"`    // limit execution targets
-	Tags     []string                         `json:"tags"`     // execution tags
-	LogPath  string                           `json:"log_path"` // write playbook log to ANSIBLE_LOG_PATH
-	Status   string                           `json:"status"`   // ready | running | failed | success
-	StartAt  time.Time                        `json:"start_at"` // job start at
-	DoneAt   time.Time                        `json:"done_at"`  // job done at
-	Command  string                           `json:"command"`  // job raw shell command
-	CMD      *playbook.AnsiblePlaybookCmd     `json:"-"`        // ansible command
-	Opts     *playbook.AnsiblePlaybookOptions `json:"-"`        // playbook options
-	Exec     *Executor                        `json:"-"`        // Executor
-
-	Stdout io.Writer          `json:"-"` // write output to this
-	Stderr io.Writer          `json:"-"` // write error to this
-	ctx    context.Context    // job context
-	cancel context.CancelFunc // job cancel func
+	ID          string                           `json:"id"`                      // uuid v1
+	Name        string                           `json:"name"`                    // human readable job info
+	Playbook    string                           `json:"playbook"`                // playbook name
+	Limit       string                           `json:"limit"`                   // limit execution targets
+	Hosts       []string                         `json:"hosts,omitempty"`         // hosts resolved from limit expression
+	Tags        []string                         `json:"tags"`                    // execution tags
+	Resources   []string                         `json:"resources"`               // resource lock keys derived from limit
+	LogPath     string                           `json:"log_path"`                // write playbook log to ANSIBLE_LOG_PATH
+	Recording   string                           `json:"recording,omitempty"`     // record output with timing to this asciicast file
+	Check       bool                             `json:"check"`                   // run in check mode, nothing is changed
+	Diff        bool                             `json:"diff"`                    // show changes made (or would be made) to files
+	ExtraVars   map[string]interface{}           `json:"extra_vars,omitempty"`    // playbook extra vars
+	StartAtTask string                           `json:"start_at_task,omitempty"` // start playbook at this task
+	Parent      string                           `json:"parent,omitempty"`        // id of job this job retries
+	PID         int                              `json:"pid,omitempty"`           // process runs job, unfinished job is orphaned once it exits
+	Env         map[string]string                `json:"env,omitempty"`           // environment of job process (besides executor env)
+	Timeout     time.Duration                    `json:"timeout,omitempty"`       // cancel job if runs longer than this
+	GracePeriod time.Duration                    `json:"grace_period,omitempty"`  // wait after SIGINT before SIGKILL (DefaultGracePeriod)
+	Serial      string                           `json:"serial,omitempty"`        // rolling batch size: N or N%
+	Pause       time.Duration                    `json:"pause,omitempty"`         // wait between batches of rolling job
+	HealthCheck string                           `json:"health_check,omitempty"`  // shell command run after each batch, abort if fails
+	Batches     [][]string                       `json:"batches,omitempty"`       // hosts of batches, replicas first & primaries last
+	Status      string                           `json:"status"`                  // ready | queued | running | failed | success | cancelled | timeout | interrupted
+	ExitCode    int                              `json:"exit_code"`               // ansible-playbook exit code, -1 if unknown
+	StartAt     time.Time                        `json:"start_at"`                // job start at
+	DoneAt      time.Time                        `json:"done_at"`                 // job done at
+	Command     string                           `json:"command"`                 // job raw shell command
+	Module      string                           `json:"module,omitempty"`        // ad-hoc module run instead of playbook
+	Args        string                           `json:"args,omitempty"`          // ad-hoc module args
+	CMD         *playbook.AnsiblePlaybookCmd     `json:"-"`                       // ansible command
+	AdHoc       *adhoc.AnsibleAdhocCmd           `json:"-"`                       // ansible ad-hoc command if module is set
+	Opts        *playbook.AnsiblePlaybookOptions `json:"-"`                       // playbook options
+	Exec        *Executor                        `json:"-"`                       // Executor
+	Config      *conf.Config                     `json:"-"`                       // inventory snapshot when job is created
+	Store       JobStore                         `json:"-"`                       // persist state & events if set
+	Runner      Runner                           `json:"-"`                       // run job command, DefaultRunner if nil
+	Hooks       []*Hook                          `json:"-"`                       // run on job lifecycle events
+	Events      []Event                          `json:"events"`                  // progress events parsed from output
+	Results     []HostResult                     `json:"results"`                 // per-host results parsed from PLAY RECAP
+	Partial     bool                             `json:"partial,omitempty"`       // results are counted from events since job stopped before recap
+
+	Stdout      io.Writer          `json:"-"` // write output to this
+	Stderr      io.Writer          `json:"-"` // write error to this
+	ctx         context.Context    // job context
+	cancel      context.CancelFunc // job cancel func, nil if job is not running
+	prepErr     error              // job can not be prepared (e.g: invalid limit), fails without running
+	redactor    *Redactor          // mask secrets in output, logs & json, nil for jobs loaded from store
+	hooks       jobHooks           // track task failures for hooks
+	auditor     *Auditor           // record job start & outcome to audit log if set
+	configHash  string             // inventory hash when job starts, for audit
+	runLock     sync.Mutex         // protect cancel func
+	eventLock   sync.Mutex         // protect events & subscribers
+	eventDone   bool               // no more events will be emitted
+	subscribers []chan Event       // event subscribers
 }
 
 // JobOpts will configure job
@@ -209,6 +329,41 @@ func WithLogPath(logPath string) JobOpts {
 	}
 }
 
+// WithCheck will run playbook in check mode (dry run)
+func WithCheck() JobOpts {
+	return func(j *Job) {
+		j.Check = true
+	}
+}
+
+// WithDiff will collect changes made (or would be made in check mode) to files and templates
+func WithDiff() JobOpts {
+	return func(j *Job) {
+		j.Diff = true
+	}
+}
+
+// WithTimeout will cancel job if it runs longer than timeout
+func WithTimeout(timeout time.Duration) JobOpts {
+	return func(j *Job) {
+		j.Timeout = timeout
+	}
+}
+
+// WithGracePeriod will set how long to wait after SIGINT before SIGKILL when job is cancelled
+func WithGracePeriod(grace time.Duration) JobOpts {
+	return func(j *Job) {
+		j.GracePeriod = grace
+	}
+}
+
+// WithStore will persist job state transitions and events to store
+func WithStore(store JobStore) JobOpts {
+	return func(j *Job) {
+		j.Store = store
+	}
+}
+
 // WithAnsibleOpts will overwrite entire options, use with caution!
 func WithAnsibleOpts(opts *playbook.AnsiblePlaybookOptions) JobOpts {
 	return func(j *Job) {
@@ -237,38 +392,145 @@ func (j *Job) CreateLog(name string) (io.WriteCloser, error) {
 
 // Run will run given command under context
 func (j *Job) Run(ctx context.Context) error {
-	setupOsEnv()
-	// create filelog
-	j.Command = j.CMD.String()
+	defer j.closeEvents()
+	// create filelog, which is written by ansible via ANSIBLE_LOG_PATH in job env
+	command := j.redactedCommand()
+	j.eventLock.Lock() // job state is read by MarshalJSON concurrently
+	j.Command = command
+	j.eventLock.Unlock()
+	defer j.auditDone()
+	if j.prepErr != nil {
+		j.setDone(JOB_FAILED, -1)
+		j.persist()
+		return j.prepErr
+	}
 	if j.LogPath != "" {
-		_ = os.Setenv("ANSIBLE_LOG_PATH", j.LogPath)
 		f, err := os.Create(j.LogPath)
 		f.Close()
 		if err != nil {
-			j.Status = JOB_FAILED
+			j.setDone(JOB_FAILED, -1)
+			j.persist()
 			return err
 		}
 	}
-	j.StartAt = time.Now()
-	j.ctx, j.cancel = context.WithCancel(ctx)
-	j.Status = JOB_RUNNING
-	logrus.Infof(j.CMD.String())
-	err := j.CMD.Run(j.ctx)
-	j.DoneAt = time.Now()
-	if err != nil {
-		logrus.Errorf("job failed: %s", err)
-		j.Status = JOB_FAILED
+	j.eventLock.Lock()
+	j.StartAt, j.Status = time.Now(), JOB_RUNNING
+	j.eventLock.Unlock()
+	j.runLock.Lock()
+	if j.Timeout > 0 {
+		j.ctx, j.cancel = context.WithTimeout(ctx, j.Timeout)
 	} else {
-		j.Status = JOB_SUCCESS
+		j.ctx, j.cancel = context.WithCancel(ctx)
+	}
+	j.runLock.Unlock()
+	j.persist()
+	j.auditStart()
+	defer j.finishHooks()
+	if err := j.runHooks(HOOK_PRE_RUN, j.hookPayload(HOOK_PRE_RUN, nil)); err != nil {
+		logrus.Errorf("job aborted: %s", err)
+		j.runLock.Lock()
+		j.cancel()
+		j.cancel = nil
+		j.runLock.Unlock()
+		j.setDone(JOB_FAILED, -1)
+		j.persist()
+		return err
 	}
+	logrus.Info(j.Command)
+	runner := j.Runner
+	if runner == nil {
+		runner = DefaultRunner
+	}
+	var errOut io.Writer = os.Stderr
+	if j.Stderr != nil {
+		errOut = j.Stderr
+	}
+	stderr := j.redactor.Writer(errOut)
+	stdout := &eventWriter{job: j} // stdout is redacted & parsed into events, then forwarded to job.Stdout
+	if j.Recording != "" {
+		if rec, err := NewRecorder(j.Recording, j.Name); err != nil {
+			logrus.Errorf("fail to record job output %s: %s", j.Recording, err)
+		} else {
+			stdout.rec = rec
+			defer rec.Close()
+		}
+	}
+	var err error
+	if len(j.Batches) > 0 {
+		err = j.runRolling(runner, stdout, stderr)
+	} else {
+		err = runner.Run(j.ctx, j, stdout, stderr)
+		stdout.flush()
+	}
+	_ = stderr.Flush()
+	if j.LogPath != "" {
+		if err := j.redactor.RedactFile(j.LogPath); err != nil {
+			logrus.Errorf("fail to redact log %s: %s", j.LogPath, err)
+		}
+	}
+	status := JOB_SUCCESS
+	switch {
+	case err == nil:
+	case errors.Is(j.ctx.Err(), context.DeadlineExceeded):
+		logrus.Errorf("job timeout after %s: %s", j.Timeout, err)
+		status = JOB_TIMEOUT
+	case j.ctx.Err() != nil:
+		logrus.Errorf("job cancelled: %s", err)
+		status = JOB_CANCELLED
+	default:
+		logrus.Errorf("job failed: %s", err)
+		status = JOB_FAILED
+	}
+	j.setDone(status, exitCode(err))
+	j.runLock.Lock()
+	j.cancel()
+	j.cancel = nil
+	j.runLock.Unlock()
+	if err != nil {
+		j.countResults()
+	}
+	j.persist()
 	return err
 }
 
-func (j *Job) Cancel() {
-	if j.cancel != nil {
-		j.cancel()
+// setStatus will update job status under event lock, which is read by MarshalJSON concurrently
+func (j *Job) setStatus(status string) {
+	j.eventLock.Lock()
+	defer j.eventLock.Unlock()
+	j.Status = status
+}
+
+// setDone will mark job done with final status & exit code
+func (j *Job) setDone(status string, code int) {
+	j.eventLock.Lock()
+	defer j.eventLock.Unlock()
+	j.DoneAt, j.Status, j.ExitCode = time.Now(), status, code
+}
+
+// exitStatusRegex extract exit code from command execution error
+var exitStatusRegex = regexp.MustCompile(`exit status (\d+)`)
+
+// exitCode will return exit code of ansible-playbook according to run error, -1 if unknown
+func exitCode(err error) int {
+	if err == nil {
+		return 0
 	}
-	return
+	if m := exitStatusRegex.FindStringSubmatch(err.Error()); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return code
+	}
+	return -1
+}
+
+// Cancel will interrupt running job: SIGINT, then SIGKILL after grace period. false if job is not running
+func (j *Job) Cancel() bool {
+	j.runLock.Lock()
+	defer j.runLock.Unlock()
+	if j.cancel == nil {
+		return false
+	}
+	j.cancel()
+	return true
 }
 
 func (j *Job) MutexRun(ctx context.Context) error {
@@ -296,14 +558,3 @@ func (j *Job) AsyncRun() string {
 	}()
 	return j.ID
 }
-
-// setupOsEnv will setup ansible environment
-func setupOsEnv() {
-	_ = os.Setenv("ANSIBLE_TRANSFORM_INVALID_GROUP_CHARS", "ignore")
-	_ = os.Setenv("ANSIBLE_DEPRECATION_WARNINGS", "False")
-	_ = os.Setenv("ANSIBLE_SYSTEM_WARNINGS", "False")
-	_ = os.Setenv("ANSIBLE_ACTION_WARNINGS", "False")
-	_ = os.Setenv("ANSIBLE_COMMAND_WARNINGS", "False")
-	_ = os.Setenv("ANSIBLE_DEVEL_WARNING", "False")
-	_ = os.Setenv("ANSIBLE_DISPLAY_ARGS_TO_STDOUT", "False")
-}
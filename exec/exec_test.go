@@ -2,28 +2,74 @@ package exec
 
 import (
 	"context"
-	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
+// newTestExecutor will create executor on a temp pigsty home with fake runner
+func newTestExecutor(t *testing.T, scripts map[string]*Script) (*Executor, *FakeRunner) {
+	dir, err := ioutil.TempDir("", "pigsty-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "pigsty.yml"), []byte(schedulerConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := NewExecutor(dir)
+	runner := NewFakeRunner(scripts)
+	e.Runner = runner
+	return e, runner
+}
+
 func TestNewExecutor(t *testing.T) {
-	e := NewExecutor(`/Users/vonng/pigsty/pigsty.yml`)
-	fmt.Println(e)
+	e, _ := newTestExecutor(t, nil)
+	defer os.RemoveAll(e.WorkDir)
+	if e.Inventory != "pigsty.yml" || e.Config == nil || len(e.Config.Clusters) == 0 {
+		t.Errorf("unexpected executor: %+v", e)
+	}
+	if e2 := NewExecutor(filepath.Join(e.WorkDir, "pigsty.yml")); e2.WorkDir != e.WorkDir || e2.Inventory != "pigsty.yml" {
+		t.Errorf("executor from file should have same home: %s", e2.WorkDir)
+	}
 }
 
 func TestExecutor_NewJob(t *testing.T) {
-	e := NewExecutor(`/Users/vonng/pigsty/pigsty.yml`)
+	e, runner := newTestExecutor(t, map[string]*Script{
+		"pgsql": {Output: sampleOutput, ExitCode: 2},
+		"slow":  {Output: sampleOutput, Delay: 50 * time.Millisecond},
+	})
+	defer os.RemoveAll(e.WorkDir)
+
 	job := e.NewJob(
 		WithPlaybook("pgsql.yml"),
 		WithName("pgsql init"),
-		WithLogPath("/tmp/test.log"),
+		WithLogPath(filepath.Join(e.WorkDir, "test.log")),
+		WithStdout(ioutil.Discard),
 	)
+	if err := job.Run(context.TODO()); err == nil {
+		t.Errorf("job should fail with exit code 2")
+	}
+	if job.Status != JOB_FAILED || job.ExitCode != 2 || len(job.Events) != 16 || len(job.Results) != 3 || job.Partial {
+		t.Errorf("unexpected job: %s, exit code %d, %d events, %d results", job.Status, job.ExitCode, len(job.Events), len(job.Results))
+	}
 
-	print(job.JSON())
+	job = e.NewJob(WithPlaybook("slow.yml"), WithStdout(ioutil.Discard), WithStderr(ioutil.Discard))
 	go func() {
-		time.Sleep(time.Second * 2)
+		time.Sleep(200 * time.Millisecond)
 		job.Cancel()
 	}()
-	job.Run(context.TODO())
+	_ = job.Run(context.TODO())
+	if job.Status != JOB_CANCELLED || job.ExitCode != 99 || len(job.Events) == 0 || len(job.Events) == 16 {
+		t.Errorf("unexpected cancelled job: %s, exit code %d, %d events", job.Status, job.ExitCode, len(job.Events))
+	}
+
+	job = e.NewJob(WithPlaybook("unknown.yml"), WithStdout(ioutil.Discard), WithStderr(ioutil.Discard))
+	if err := job.Run(context.TODO()); err == nil || job.ExitCode != 1 {
+		t.Errorf("playbook without script should fail: %v", err)
+	}
+	if calls := runner.Calls(); len(calls) != 3 || calls[0] != "ansible-playbook  pgsql.yml" {
+		t.Errorf("unexpected calls: %q", calls)
+	}
 }
@@ -0,0 +1,159 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**************************************************************\
+*                        Fake Runner                           *
+\**************************************************************/
+// Script is a recorded playbook run replayed by FakeRunner
+type Script struct {
+	Output   string        // recorded ansible output, used if Events is empty
+	Events   []Event       // recorded events (e.g: from job store), rendered as ansible output
+	ExitCode int           // exit code of the run, non-zero means failure
+	Delay    time.Duration // delay before each output line
+}
+
+// ScriptFromJob will record events & exit code of finished job as script
+func ScriptFromJob(job *Job) *Script {
+	return &Script{Events: append([]Event{}, job.Events...), ExitCode: job.ExitCode}
+}
+
+// FakeRunner replays scripts instead of running ansible, for tests & demos
+type FakeRunner struct {
+	Scripts map[string]*Script // scripts by playbook (with or without .yml suffix) or ad-hoc module. "*" matches others
+	calls   []string           // commands run, one per batch of rolling job
+	lock    sync.Mutex
+}
+
+// NewFakeRunner will create fake runner with scripts
+func NewFakeRunner(scripts map[string]*Script) *FakeRunner {
+	if scripts == nil {
+		scripts = make(map[string]*Script)
+	}
+	return &FakeRunner{Scripts: scripts}
+}
+
+// Calls will return commands of jobs run by this runner in order
+func (r *FakeRunner) Calls() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string{}, r.calls...)
+}
+
+// script will find script of playbook
+func (r *FakeRunner) script(playbook string) *Script {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, name := range []string{playbook, strings.TrimSuffix(playbook, ".yml"), "*"} {
+		if s, exists := r.Scripts[name]; exists {
+			return s
+		}
+	}
+	return nil
+}
+
+// Run implements Runner, output of script is written line by line until ctx is done
+func (r *FakeRunner) Run(ctx context.Context, job *Job, stdout, stderr io.Writer) error {
+	r.lock.Lock()
+	r.calls = append(r.calls, job.commandLine())
+	r.lock.Unlock()
+	name := job.Playbook
+	if job.IsAdHoc() {
+		name = job.Module
+	}
+	s := r.script(name)
+	if s == nil {
+		fmt.Fprintf(stderr, "ERROR! the playbook: %s could not be found\n", name)
+		return fmt.Errorf("fake run %s failed: exit status 1", name)
+	}
+	output := s.Output
+	if len(s.Events) > 0 {
+		output = RenderEvents(s.Events)
+	}
+	for _, line := range strings.SplitAfter(output, "\n") {
+		if line == "" {
+			continue
+		}
+		if s.Delay > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(s.Delay):
+			}
+		}
+		if ctx.Err() != nil {
+			fmt.Fprintln(stderr, "[ERROR]: User interrupted execution")
+			return fmt.Errorf("fake run %s interrupted: %w (exit status 99)", job.Playbook, ctx.Err())
+		}
+		if _, err := io.WriteString(stdout, line); err != nil {
+			return err
+		}
+	}
+	if s.ExitCode != 0 {
+		return fmt.Errorf("fake run %s failed: exit status %d", job.Playbook, s.ExitCode)
+	}
+	return nil
+}
+
+// RenderEvents will render events as ansible default callback output, which parses into same events
+func RenderEvents(events []Event) string {
+	var buf strings.Builder
+	header := func(title string) {
+		stars := 79 - len(title)
+		if stars < 3 {
+			stars = 3
+		}
+		fmt.Fprintf(&buf, "\n%s %s\n", title, strings.Repeat("*", stars))
+	}
+	inRecap := false
+	for _, ev := range events {
+		if ev.Diff != "" {
+			buf.WriteString(ev.Diff)
+		}
+		host := "[" + ev.Host + "]"
+		if ev.Item != "" {
+			host += " (item=" + ev.Item + ")"
+		}
+		msg := ""
+		if ev.Message != "" {
+			msg = " => " + ev.Message
+		}
+		switch ev.Type {
+		case EVENT_PLAY_START:
+			header("PLAY [" + ev.Play + "]")
+			inRecap = false
+		case EVENT_TASK_START:
+			header("TASK [" + ev.Task + "]")
+		case EVENT_HOST_OK:
+			fmt.Fprintf(&buf, "ok: %s%s\n", host, msg)
+		case EVENT_HOST_CHANGED:
+			fmt.Fprintf(&buf, "changed: %s%s\n", host, msg)
+		case EVENT_HOST_SKIPPED:
+			fmt.Fprintf(&buf, "skipping: %s%s\n", host, msg)
+		case EVENT_HOST_FAILED:
+			if ev.Item != "" {
+				fmt.Fprintf(&buf, "failed: %s%s\n", host, msg)
+			} else {
+				fmt.Fprintf(&buf, "fatal: %s: FAILED!%s\n", host, msg)
+			}
+		case EVENT_HOST_UNREACHABLE:
+			fmt.Fprintf(&buf, "fatal: %s: UNREACHABLE!%s\n", host, msg)
+		case EVENT_HOST_IGNORED:
+			buf.WriteString("...ignoring\n")
+		case EVENT_RECAP:
+			if !inRecap {
+				header("PLAY RECAP")
+				inRecap = true
+			}
+			fmt.Fprintf(&buf, "%-26s : ok=%-4d changed=%-4d unreachable=%-4d failed=%-4d skipped=%-4d rescued=%-4d ignored=%d\n",
+				ev.Host, ev.Stats["ok"], ev.Stats["changed"], ev.Stats["unreachable"], ev.Stats["failed"], ev.Stats["skipped"], ev.Stats["rescued"], ev.Stats["ignored"])
+		}
+	}
+	return buf.String()
+}
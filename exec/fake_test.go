@@ -0,0 +1,34 @@
+package exec
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderEvents(t *testing.T) {
+	parse := func(output string) (events []Event) {
+		var p EventParser
+		for _, line := range strings.Split(output, "\n") {
+			if ev := p.Parse(line); ev != nil {
+				events = append(events, *ev)
+			}
+		}
+		return
+	}
+	recorded := parse(sampleOutput + diffOutput)
+	replayed := parse(RenderEvents(recorded))
+	if len(replayed) != len(recorded) {
+		t.Fatalf("expect %d events, got %d", len(recorded), len(replayed))
+	}
+	for i := range recorded {
+		a, b := recorded[i], replayed[i]
+		if a.Type != b.Type || a.Play != b.Play || a.Task != b.Task || a.Host != b.Host || a.Item != b.Item || a.Message != b.Message || a.Diff != b.Diff {
+			t.Errorf("event %d: expect %+v, got %+v", i, a, b)
+		}
+		for k, v := range a.Stats {
+			if b.Stats[k] != v {
+				t.Errorf("event %d: expect %s=%d, got %d", i, k, v, b.Stats[k])
+			}
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net/http"
+	"os"
+	osexec "os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**************************************************************\
+*                           Hook                               *
+\**************************************************************/
+// hook events
+const (
+	HOOK_PRE_RUN      = "pre_run"      // before job runs, job is aborted if a required hook fails
+	HOOK_POST_RUN     = "post_run"     // after job is done, whatever its status is
+	HOOK_ON_FAILURE   = "on_failure"   // after job is done if it is not successful
+	HOOK_TASK_FAILURE = "task_failure" // once per failed task, ignored failures excluded
+)
+
+// hook defaults
+const (
+	DefaultHookTimeout       = 10 * time.Second // timeout of each hook attempt
+	DefaultHookAttempts      = 3                // max attempts of hook delivery
+	DefaultHookRetryInterval = time.Second      // wait before second attempt, doubled each time
+)
+
+// Hook runs a local command or posts json payload to webhook url on job lifecycle events
+type Hook struct {
+	Name          string            `yaml:"name" json:"name"`                                         // hook name used in logs
+	On            []string          `yaml:"on" json:"on"`                                             // pre_run | post_run | on_failure | task_failure
+	Command       string            `yaml:"command,omitempty" json:"command,omitempty"`               // shell command, payload json in stdin
+	URL           string            `yaml:"url,omitempty" json:"url,omitempty"`                       // webhook url, payload json is posted to it
+	Secret        string            `yaml:"secret,omitempty" json:"-"`                                // sign webhook payload with HMAC-SHA256 if set
+	Headers       map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`               // extra headers of webhook request
+	Attempts      int               `yaml:"attempts,omitempty" json:"attempts,omitempty"`             // max attempts (DefaultHookAttempts), 1 means no retry
+	RetryInterval time.Duration     `yaml:"retry_interval,omitempty" json:"retry_interval,omitempty"` // wait before retry (DefaultHookRetryInterval), doubled each time
+	Timeout       time.Duration     `yaml:"timeout,omitempty" json:"timeout,omitempty"`               // timeout of each attempt (DefaultHookTimeout)
+	Required      bool              `yaml:"required,omitempty" json:"required,omitempty"`             // abort job if this pre_run hook fails
+}
+
+// HookPayload is sent to hooks: posted to webhook url, or written to stdin of hook command
+type HookPayload struct {
+	Event    string       `json:"event"`              // hook event
+	JobID    string       `json:"job_id"`             // job id
+	Name     string       `json:"name"`               // job name
+	Playbook string       `json:"playbook,omitempty"` // playbook name
+	Module   string       `json:"module,omitempty"`   // ad-hoc module
+	Limit    string       `json:"limit"`              // limit expression
+	Hosts    []string     `json:"hosts,omitempty"`    // hosts resolved from limit
+	Tags     []string     `json:"tags,omitempty"`     // execution tags
+	Status   string       `json:"status"`             // job status when hook runs
+	ExitCode int          `json:"exit_code"`          // exit code of finished job
+	StartAt  time.Time    `json:"start_at"`           // job start at
+	DoneAt   *time.Time   `json:"done_at,omitempty"`  // job done at, nil if job is not done
+	Duration float64      `json:"duration"`           // seconds since job start
+	Recap    []HostResult `json:"recap,omitempty"`    // per-host results
+	Failure  *Event       `json:"failure,omitempty"`  // failed host event of task_failure hook
+}
+
+// hookConfig is the hook section of cli config
+type hookConfig struct {
+	Hooks []*Hook `yaml:"hooks"`
+}
+
+// LoadHooks will load hooks from cli config file, e.g:
+//
+//	hooks:
+//	  - name: slack
+//	    on: [on_failure, task_failure]
+//	    url: https://hooks.example.com/pigsty
+//	    secret: hmac-key
+//	  - name: cmdb
+//	    on: [post_run]
+//	    command: cmdb-sync --stdin
+func LoadHooks(path string) ([]*Hook, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg hookConfig
+	if err = yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid cli config %s: %w", path, err)
+	}
+	for i, h := range cfg.Hooks {
+		if h == nil {
+			return nil, fmt.Errorf("invalid cli config %s: hook #%d is empty", path, i+1)
+		}
+		if h.Name == "" {
+			h.Name = fmt.Sprintf("hook-%d", i+1)
+		}
+		if err = h.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid cli config %s: %w", path, err)
+		}
+	}
+	return cfg.Hooks, nil
+}
+
+// Validate will check hook has valid events and exactly one of command & url
+func (h *Hook) Validate() error {
+	if (h.Command == "") == (h.URL == "") {
+		return fmt.Errorf("hook %s: exactly one of command and url is required", h.Name)
+	}
+	if len(h.On) == 0 {
+		return fmt.Errorf("hook %s: no event given in on", h.Name)
+	}
+	for _, event := range h.On {
+		switch event {
+		case HOOK_PRE_RUN, HOOK_POST_RUN, HOOK_ON_FAILURE, HOOK_TASK_FAILURE:
+		default:
+			return fmt.Errorf("hook %s: unknown event %q", h.Name, event)
+		}
+	}
+	if h.Required && (len(h.On) != 1 || h.On[0] != HOOK_PRE_RUN) {
+		return fmt.Errorf("hook %s: only pre_run hook could be required", h.Name)
+	}
+	return nil
+}
+
+// Handles tells whether hook runs on given event
+func (h *Hook) Handles(event string) bool {
+	for _, e := range h.On {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Fire will deliver payload to hook, retry with backoff until attempts are exhausted
+func (h *Hook) Fire(ctx context.Context, p *HookPayload, env map[string]string) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	attempts, interval := h.Attempts, h.RetryInterval
+	if attempts <= 0 {
+		attempts = DefaultHookAttempts
+	}
+	if interval <= 0 {
+		interval = DefaultHookRetryInterval
+	}
+	delivery := fmt.Sprintf("%s-%s-%d", p.JobID, p.Event, time.Now().UnixNano())
+	for i := 1; ; i++ {
+		var retry bool
+		if h.URL != "" {
+			retry, err = h.post(ctx, p.Event, delivery, body)
+		} else {
+			retry, err = true, h.exec(ctx, body, env)
+		}
+		if err == nil || !retry || i >= attempts {
+			return err
+		}
+		logrus.Warnf("hook %s attempt %d/%d failed: %s", h.Name, i, attempts, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+}
+
+// timeout returns timeout of each attempt
+func (h *Hook) timeout() time.Duration {
+	if h.Timeout > 0 {
+		return h.Timeout
+	}
+	return DefaultHookTimeout
+}
+
+// Sign will return signature of webhook body: sha256=<hex of HMAC-SHA256 with hook secret>
+func (h *Hook) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post will post payload to webhook url, client errors except 429 are not retried
+func (h *Hook) post(ctx context.Context, event, delivery string, body []byte) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "pigsty-cli")
+	req.Header.Set("X-Pigsty-Event", event)
+	req.Header.Set("X-Pigsty-Delivery", delivery)
+	if h.Secret != "" {
+		req.Header.Set("X-Pigsty-Signature", h.Sign(body))
+	}
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("webhook %s responds %s", h.URL, resp.Status)
+}
+
+// exec will run hook command via sh -c with payload json in stdin
+func (h *Hook) exec(ctx context.Context, body []byte, env map[string]string) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout())
+	defer cancel()
+	cmd := osexec.CommandContext(ctx, "sh", "-c", h.Command)
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdin = bytes.NewReader(body)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+/**************************************************************\
+*                         Job Hooks                            *
+\**************************************************************/
+// WithHooks will run hooks on job lifecycle events
+func WithHooks(hooks ...*Hook) JobOpts {
+	return func(j *Job) {
+		j.Hooks = append(j.Hooks, hooks...)
+	}
+}
+
+// jobHooks tracks failed tasks of running job, so task_failure hooks run once per task
+type jobHooks struct {
+	wg      sync.WaitGroup  // running task_failure hooks
+	fired   map[string]bool // tasks whose failure is reported
+	pending *Event          // last failure, reported unless next event ignores or supersedes it
+}
+
+// hasHook tells whether job has hook on given event
+func (j *Job) hasHook(event string) bool {
+	for _, h := range j.Hooks {
+		if h.Handles(event) {
+			return true
+		}
+	}
+	return false
+}
+
+// hookPayload will build payload of hook event from job state, secrets are already masked in events
+func (j *Job) hookPayload(event string, failure *Event) *HookPayload {
+	p := &HookPayload{
+		Event:    event,
+		JobID:    j.ID,
+		Name:     j.Name,
+		Playbook: j.Playbook,
+		Module:   j.Module,
+		Limit:    j.Limit,
+		Hosts:    j.Hosts,
+		Tags:     j.Tags,
+		Status:   j.Status,
+		ExitCode: j.ExitCode,
+		StartAt:  j.StartAt,
+		Recap:    append([]HostResult{}, j.Results...),
+		Failure:  failure,
+	}
+	if !j.DoneAt.IsZero() {
+		doneAt := j.DoneAt
+		p.DoneAt = &doneAt
+		p.Duration = j.DoneAt.Sub(j.StartAt).Seconds()
+	} else if !j.StartAt.IsZero() {
+		p.Duration = time.Since(j.StartAt).Seconds()
+	}
+	return p
+}
+
+// runHooks will fire hooks of event one by one, error of required hook is returned
+func (j *Job) runHooks(event string, p *HookPayload) error {
+	env := map[string]string{
+		"PIGSTY_HOOK_EVENT": event,
+		"PIGSTY_JOB_ID":     j.ID,
+		"PIGSTY_JOB_STATUS": p.Status,
+		"PIGSTY_PLAYBOOK":   j.Playbook,
+		"PIGSTY_LIMIT":      j.Limit,
+	}
+	for _, h := range j.Hooks {
+		if !h.Handles(event) {
+			continue
+		}
+		if err := h.Fire(context.Background(), p, env); err != nil {
+			logrus.Errorf("job %s: %s hook %s failed: %s", j.ID, event, h.Name, j.Redact(err.Error()))
+			if h.Required && event == HOOK_PRE_RUN {
+				return fmt.Errorf("pre_run hook %s failed: %s", h.Name, j.Redact(err.Error()))
+			}
+		}
+	}
+	return nil
+}
+
+// watchFailure is called on each event with event lock held: a failed host event is kept pending until
+// next event, which may ignore it (ignore_errors) or supersede it (final result of failed loop items),
+// then task_failure hooks run in background, once per task
+func (j *Job) watchFailure(ev *Event) {
+	if !j.hasHook(HOOK_TASK_FAILURE) {
+		return
+	}
+	failed := ev.Type == EVENT_HOST_FAILED || ev.Type == EVENT_HOST_UNREACHABLE
+	if p := j.hooks.pending; p != nil {
+		j.hooks.pending = nil
+		superseded := failed && ev.Task == p.Task && ev.Host == p.Host
+		if ev.Type != EVENT_HOST_IGNORED && !superseded {
+			j.fireTaskFailure(p)
+		}
+	}
+	if failed && !j.hooks.fired[ev.Task] {
+		failure := *ev
+		j.hooks.pending = &failure
+	}
+}
+
+// fireTaskFailure will run task_failure hooks in background
+func (j *Job) fireTaskFailure(ev *Event) {
+	if j.hooks.fired == nil {
+		j.hooks.fired = make(map[string]bool)
+	}
+	j.hooks.fired[ev.Task] = true
+	p := j.hookPayload(HOOK_TASK_FAILURE, ev)
+	j.hooks.wg.Add(1)
+	go func() {
+		defer j.hooks.wg.Done()
+		_ = j.runHooks(HOOK_TASK_FAILURE, p)
+	}()
+}
+
+// finishHooks will report pending task failure, wait task_failure hooks, then run post_run & on_failure hooks
+func (j *Job) finishHooks() {
+	if len(j.Hooks) == 0 {
+		return
+	}
+	j.eventLock.Lock()
+	if p := j.hooks.pending; p != nil {
+		j.hooks.pending = nil
+		j.fireTaskFailure(p)
+	}
+	j.eventLock.Unlock()
+	j.hooks.wg.Wait()
+	_ = j.runHooks(HOOK_POST_RUN, j.hookPayload(HOOK_POST_RUN, nil))
+	if j.Status != JOB_SUCCESS {
+		_ = j.runHooks(HOOK_ON_FAILURE, j.hookPayload(HOOK_ON_FAILURE, nil))
+	}
+}
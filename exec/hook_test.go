@@ -0,0 +1,121 @@
+package exec
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookStandIn records payloads posted to it, responds 500 to first request and status to others
+type webhookStandIn struct {
+	sync.Mutex
+	status   int
+	requests int
+	payloads []HookPayload
+	headers  []http.Header
+}
+
+func (s *webhookStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.requests++
+	if s.requests == 1 {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	var p HookPayload
+	_ = json.Unmarshal(body, &p)
+	if (&Hook{Secret: "s3cret"}).Sign(body) != r.Header.Get("X-Pigsty-Signature") {
+		p.Event = "bad signature"
+	}
+	s.payloads = append(s.payloads, p)
+	s.headers = append(s.headers, r.Header)
+	w.WriteHeader(s.status)
+}
+
+func TestHooks(t *testing.T) {
+	e, runner := newTestExecutor(t, map[string]*Script{"pgsql": {Output: sampleOutput, ExitCode: 2}})
+	defer os.RemoveAll(e.WorkDir)
+	standIn := &webhookStandIn{status: http.StatusOK}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+	out := filepath.Join(e.WorkDir, "hook.out")
+
+	webhook := &Hook{Name: "web", URL: server.URL, Secret: "s3cret", RetryInterval: time.Millisecond,
+		On: []string{HOOK_PRE_RUN, HOOK_TASK_FAILURE, HOOK_POST_RUN, HOOK_ON_FAILURE}}
+	command := &Hook{Name: "cmd", On: []string{HOOK_POST_RUN}, Command: `(cat; echo; echo $PIGSTY_HOOK_EVENT $PIGSTY_JOB_STATUS) > ` + out}
+	job := e.NewJob(WithPlaybook("pgsql.yml"), WithLimit("pg-test"), WithStdout(ioutil.Discard), WithStderr(ioutil.Discard), WithHooks(webhook, command))
+	if err := job.Run(context.TODO()); err == nil {
+		t.Fatalf("job should fail")
+	}
+
+	// pre_run is retried, ignored failure does not fire task_failure
+	var events []string
+	for _, p := range standIn.payloads {
+		events = append(events, p.Event)
+	}
+	if standIn.requests != 5 || strings.Join(events, ",") != "pre_run,task_failure,post_run,on_failure" {
+		t.Fatalf("unexpected webhook deliveries: %d requests, events %v", standIn.requests, events)
+	}
+	failure, post := standIn.payloads[1], standIn.payloads[2]
+	if failure.Failure == nil || failure.Failure.Host != "10.10.10.13" || failure.Failure.Task != "node : Setup hostname" || failure.Status != JOB_RUNNING {
+		t.Errorf("unexpected task failure payload: %+v", failure)
+	}
+	if post.JobID != job.ID || post.Playbook != "pgsql.yml" || post.Limit != "pg-test" || post.Status != JOB_FAILED ||
+		post.ExitCode != 2 || len(post.Recap) != 3 || post.DoneAt == nil || post.Duration <= 0 {
+		t.Errorf("unexpected post run payload: %+v", post)
+	}
+	if h := standIn.headers[2]; h.Get("X-Pigsty-Event") != HOOK_POST_RUN || h.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected webhook headers: %v", h)
+	}
+	b, _ := ioutil.ReadFile(out)
+	if lines := strings.Split(strings.TrimSpace(string(b)), "\n"); len(lines) != 2 || !strings.Contains(lines[0], `"job_id":"`+job.ID) || lines[1] != "post_run failed" {
+		t.Errorf("command hook should get payload in stdin and event in env: %s", b)
+	}
+
+	// required pre_run hook aborts job, client error is not retried
+	standIn.status = http.StatusForbidden
+	calls := len(runner.Calls())
+	required := &Hook{Name: "gate", URL: server.URL, Required: true, On: []string{HOOK_PRE_RUN}}
+	job = e.NewJob(WithPlaybook("pgsql.yml"), WithStdout(ioutil.Discard), WithStderr(ioutil.Discard), WithHooks(required))
+	if err := job.Run(context.TODO()); err == nil || !strings.Contains(err.Error(), "pre_run hook gate failed") {
+		t.Errorf("failed required hook should abort job: %v", err)
+	}
+	if job.Status != JOB_FAILED || len(runner.Calls()) != calls || standIn.requests != 6 {
+		t.Errorf("aborted job should not run: %s, %d calls, %d requests", job.Status, len(runner.Calls()), standIn.requests)
+	}
+}
+
+func TestLoadHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pigsty-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cli.yml")
+	_ = ioutil.WriteFile(path, []byte("hooks:\n  - on: [post_run]\n    url: http://localhost:8080\n    timeout: 3s\n    retry_interval: 500ms\n"), 0644)
+	hooks, err := LoadHooks(path)
+	if err != nil || len(hooks) != 1 || hooks[0].Name != "hook-1" || hooks[0].Timeout != 3*time.Second || hooks[0].RetryInterval != 500*time.Millisecond {
+		t.Errorf("unexpected hooks: %v %v", hooks, err)
+	}
+	for _, invalid := range []string{
+		"hooks:\n  - on: [post_run]\n",
+		"hooks:\n  - on: [post_run]\n    url: http://x\n    command: echo\n",
+		"hooks:\n  - on: [done]\n    command: echo\n",
+		"hooks:\n  - on: [post_run]\n    command: echo\n    required: true\n",
+	} {
+		_ = ioutil.WriteFile(path, []byte(invalid), 0644)
+		if _, err := LoadHooks(path); err == nil {
+			t.Errorf("hooks should be invalid: %s", invalid)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package exec
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/**************************************************************\
+*                           Plan                               *
+\**************************************************************/
+// PlanChange is a task result that would change (or fail on) a host in check mode
+type PlanChange struct {
+	Host     string `json:"host"`               // target host
+	Instance string `json:"instance,omitempty"` // instance name of host if found in config
+	Play     string `json:"play"`               // play name
+	Task     string `json:"task"`               // task name
+	Item     string `json:"item,omitempty"`     // loop item label
+	Status   string `json:"status"`             // changed | failed | unreachable
+	Diff     string `json:"diff,omitempty"`     // file diff if run with --diff
+	Message  string `json:"message,omitempty"`  // error message of failed task
+}
+
+// Plan is a reviewable summary of what a check mode job would change on which host
+type Plan struct {
+	JobID     string       `json:"job_id"`
+	Name      string       `json:"name"`
+	Playbook  string       `json:"playbook"`
+	Limit     string       `json:"limit"`
+	Tags      []string     `json:"tags"`
+	Command   string       `json:"command"`
+	Check     bool         `json:"check"` // false means changes are already applied
+	CreatedAt time.Time    `json:"created_at"`
+	Changes   []PlanChange `json:"changes"`
+	Results   []HostResult `json:"results"`
+}
+
+// Plan will collect changes from job events, which is only meaningful after job is done
+func (j *Job) Plan() *Plan {
+	p := &Plan{
+		JobID: j.ID, Name: j.Name, Playbook: j.Playbook, Limit: j.Limit, Tags: j.Tags,
+		Command: j.Command, Check: j.Check, CreatedAt: time.Now(), Changes: []PlanChange{},
+	}
+	j.eventLock.Lock()
+	defer j.eventLock.Unlock()
+	p.Results = append([]HostResult{}, j.Results...)
+	for _, ev := range j.Events {
+		var status string
+		switch ev.Type {
+		case EVENT_HOST_CHANGED:
+			status = HOST_CHANGED
+		case EVENT_HOST_FAILED:
+			status = HOST_FAILED
+		case EVENT_HOST_UNREACHABLE:
+			status = HOST_UNREACHABLE
+		default:
+			continue
+		}
+		change := PlanChange{Host: ev.Host, Play: ev.Play, Task: ev.Task, Item: ev.Item, Status: status, Diff: ev.Diff}
+		if status != HOST_CHANGED {
+			change.Message = ev.Message
+		}
+		if cfg := j.inventory(); cfg != nil {
+			if ins, exists := cfg.IpMap[ev.Host]; exists {
+				change.Instance = ins.Name
+			}
+		}
+		p.Changes = append(p.Changes, change)
+	}
+	return p
+}
+
+// Hosts will return hosts with changes in order of first appearance
+func (p *Plan) Hosts() (hosts []string) {
+	seen := make(map[string]bool)
+	for _, c := range p.Changes {
+		if !seen[c.Host] {
+			seen[c.Host] = true
+			hosts = append(hosts, c.Host)
+		}
+	}
+	return
+}
+
+// String will render plan grouped by host
+func (p *Plan) String() string {
+	var buf strings.Builder
+	mode := "check"
+	if !p.Check {
+		mode = "applied"
+	}
+	fmt.Fprintf(&buf, "PLAN %s (%s) job=%s limit=%s tags=%s\n", p.Playbook, mode, p.JobID, p.Limit, strings.Join(p.Tags, ","))
+	if len(p.Changes) == 0 {
+		buf.WriteString("  no change\n")
+		return buf.String()
+	}
+	sign := map[string]string{HOST_CHANGED: "~", HOST_FAILED: "!", HOST_UNREACHABLE: "x"}
+	for _, host := range p.Hosts() {
+		var changes []PlanChange
+		for _, c := range p.Changes {
+			if c.Host == host {
+				changes = append(changes, c)
+			}
+		}
+		name := host
+		if changes[0].Instance != "" {
+			name = fmt.Sprintf("%s (%s)", host, changes[0].Instance)
+		}
+		fmt.Fprintf(&buf, "\n%s: %d changes\n", name, len(changes))
+		for _, c := range changes {
+			task := c.Task
+			if c.Item != "" {
+				task += " (item=" + c.Item + ")"
+			}
+			fmt.Fprintf(&buf, "  %s [%s] %s\n", sign[c.Status], c.Play, task)
+			if c.Message != "" {
+				fmt.Fprintf(&buf, "      %s\n", c.Message)
+			}
+			for _, line := range strings.Split(strings.TrimRight(c.Diff, "\n"), "\n") {
+				if line != "" {
+					fmt.Fprintf(&buf, "      %s\n", line)
+				}
+			}
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,68 @@
+package exec
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const diffOutput = "\n" +
+	"PLAY [init postgres] ***********************************************************\n" +
+	"\n" +
+	"TASK [postgres : Render postgres config] ***************************************\n" +
+	"--- before: /pg/data/postgresql.conf\n" +
+	"+++ after: /root/.ansible/tmp/postgresql.conf.j2\n" +
+	"@@ -1,2 +1,2 @@\n" +
+	"-max_connections = 100\n" +
+	"+max_connections = 200\n" +
+	"\n" +
+	"changed: [10.10.10.11]\n" +
+	"ok: [10.10.10.12]\n" +
+	"\n" +
+	"TASK [postgres : Launch postgres] **********************************************\n" +
+	"fatal: [10.10.10.12]: FAILED! => {\"msg\": \"port in use\"}\n" +
+	"\n" +
+	"PLAY RECAP *********************************************************************\n" +
+	"10.10.10.11                : ok=2    changed=1    unreachable=0    failed=0    skipped=0    rescued=0    ignored=0\n" +
+	"10.10.10.12                : ok=1    changed=0    unreachable=0    failed=1    skipped=0    rescued=0    ignored=0\n"
+
+func TestPlan(t *testing.T) {
+	job := &Job{ID: "test", Playbook: "pgsql.yml", Limit: "pg-test", Check: true}
+	var p EventParser
+	for _, line := range strings.Split(diffOutput, "\n") {
+		if ev := p.Parse(line); ev != nil {
+			job.emit(ev)
+		}
+	}
+
+	plan := job.Plan()
+	if len(plan.Changes) != 2 || len(plan.Results) != 2 {
+		t.Fatalf("expect 2 changes & 2 results, got %+v", plan)
+	}
+	c := plan.Changes[0]
+	if c.Host != "10.10.10.11" || c.Status != HOST_CHANGED || c.Task != "postgres : Render postgres config" {
+		t.Errorf("unexpected change: %+v", c)
+	}
+	if !strings.HasPrefix(c.Diff, "--- before: /pg/data/postgresql.conf\n") || !strings.Contains(c.Diff, "+max_connections = 200") {
+		t.Errorf("diff should be attached to changed event: %q", c.Diff)
+	}
+	if c = plan.Changes[1]; c.Host != "10.10.10.12" || c.Status != HOST_FAILED || c.Message != `{"msg": "port in use"}` || c.Diff != "" {
+		t.Errorf("unexpected failed change: %+v", c)
+	}
+
+	text := plan.String()
+	for _, s := range []string{"PLAN pgsql.yml (check)", "10.10.10.11: 1 changes", "~ [init postgres] postgres : Render postgres config", "      -max_connections = 100", "! [init postgres] postgres : Launch postgres"} {
+		if !strings.Contains(text, s) {
+			t.Errorf("plan text should contain %q:\n%s", s, text)
+		}
+	}
+
+	b, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Plan
+	if err = json.Unmarshal(b, &decoded); err != nil || len(decoded.Changes) != 2 || decoded.Changes[0].Diff != plan.Changes[0].Diff {
+		t.Errorf("plan should survive json round trip: %s", b)
+	}
+}
@@ -0,0 +1,386 @@
+package exec
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/**************************************************************\
+*                    Playbook Discovery                        *
+\**************************************************************/
+// tags with special meaning in ansible, always valid
+var specialTags = map[string]bool{"all": true, "always": true, "never": true, "tagged": true, "untagged": true}
+
+// max depth of nested imports & includes
+const maxIncludeDepth = 16
+
+// Playbook is a playbook found in pigsty home, with its plays, tasks and tags
+type Playbook struct {
+	Name    string   `json:"name"`              // file name in pigsty home, e.g: pgsql.yml
+	Path    string   `json:"path"`              // absolute path of playbook
+	Plays   []*Play  `json:"plays"`             // plays in order, including imported playbooks
+	Tags    []string `json:"tags"`              // all tags of playbook, sorted
+	Dynamic bool     `json:"dynamic,omitempty"` // some roles or includes can not be resolved statically, tags may be incomplete
+}
+
+// Play is a play of playbook, like ansible-playbook --list-tasks
+type Play struct {
+	Name  string   `json:"name"`
+	Hosts string   `json:"hosts"`
+	Tags  []string `json:"tags"`  // all tags of play: play, role, block & task tags, sorted
+	Tasks []Task   `json:"tasks"` // tasks in order, role tasks are expanded
+}
+
+// Task is a task of play, with effective tags (inherited from play, role, block & imports)
+type Task struct {
+	Name string   `json:"name"`
+	Role string   `json:"role,omitempty"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+// Playbooks will scan pigsty home for playbooks (*.yml with plays), sorted by name
+func (e *Executor) Playbooks() ([]*Playbook, error) {
+	var files []string
+	for _, pattern := range []string{"*.yml", "*.yaml"} {
+		matches, err := filepath.Glob(filepath.Join(e.WorkDir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	var res []*Playbook
+	for _, file := range files {
+		if pb, err := e.LoadPlaybook(filepath.Base(file)); err == nil {
+			res = append(res, pb)
+		}
+	}
+	return res, nil
+}
+
+// LoadPlaybook will parse playbook in pigsty home by name, .yml suffix is optional
+func (e *Executor) LoadPlaybook(name string) (*Playbook, error) {
+	if ext := filepath.Ext(name); ext != ".yml" && ext != ".yaml" {
+		name += ".yml"
+	}
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("invalid playbook name %s", name)
+	}
+	pb := &Playbook{Name: name, Path: filepath.Join(e.WorkDir, name)}
+	if _, err := os.Stat(pb.Path); err != nil {
+		return nil, fmt.Errorf("playbook %s not found in %s", name, e.WorkDir)
+	}
+	p := &playbookParser{home: e.WorkDir, pb: pb}
+	plays, err := p.plays(pb.Path, 0)
+	if err != nil {
+		return nil, err
+	}
+	pb.Plays = plays
+	var tags []string
+	for _, play := range plays {
+		tags = append(tags, play.Tags...)
+	}
+	pb.Tags = uniqueTags(tags)
+	return pb, nil
+}
+
+// HasTag tells whether tag is defined in playbook, special tags like always are always valid
+func (pb *Playbook) HasTag(tag string) bool {
+	if specialTags[tag] {
+		return true
+	}
+	i := sort.SearchStrings(pb.Tags, tag)
+	return i < len(pb.Tags) && pb.Tags[i] == tag
+}
+
+// ValidateTags will check given tags are defined in playbook, skipped if playbook is dynamic
+func (pb *Playbook) ValidateTags(tags []string) error {
+	if pb.Dynamic {
+		return nil
+	}
+	var unknown []string
+	for _, tag := range splitTags(tags) {
+		if !pb.HasTag(tag) {
+			unknown = append(unknown, tag)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown tags %s of %s, see: pigsty playbook tags %s", strings.Join(unknown, ","), pb.Name, pb.Name)
+	}
+	return nil
+}
+
+/**************************************************************\
+*                     Playbook Parser                          *
+\**************************************************************/
+// playbookParser expands imports, roles and includes of playbook statically
+type playbookParser struct {
+	home string
+	pb   *Playbook
+}
+
+// plays will parse plays of playbook file, imported playbooks are expanded
+func (p *playbookParser) plays(path string, depth int) ([]*Play, error) {
+	if depth > maxIncludeDepth {
+		return nil, fmt.Errorf("%s: imports nested too deep", path)
+	}
+	var items []map[string]interface{}
+	if err := readYAML(path, &items); err != nil {
+		return nil, fmt.Errorf("%s is not a playbook: %w", filepath.Base(path), err)
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%s is not a playbook: no plays", filepath.Base(path))
+	}
+	var plays []*Play
+	for _, item := range items {
+		if imported, ok := item["import_playbook"].(string); ok {
+			if strings.Contains(imported, "{{") {
+				p.pb.Dynamic = true
+				continue
+			}
+			sub, err := p.plays(filepath.Join(filepath.Dir(path), imported), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			plays = append(plays, sub...)
+			continue
+		}
+		if _, ok := item["hosts"]; !ok {
+			return nil, fmt.Errorf("%s is not a playbook: play without hosts", filepath.Base(path))
+		}
+		plays = append(plays, p.play(item, filepath.Dir(path)))
+	}
+	return plays, nil
+}
+
+// play will expand tasks of play in ansible order: pre_tasks, roles, tasks, post_tasks
+func (p *playbookParser) play(item map[string]interface{}, dir string) *Play {
+	play := &Play{Name: str(item["name"]), Hosts: str(item["hosts"])}
+	tags := toTags(item["tags"])
+	play.Tasks = append(play.Tasks, p.tasks(item["pre_tasks"], dir, "", tags, 0)...)
+	if roles, ok := item["roles"].([]interface{}); ok {
+		for _, r := range roles {
+			switch v := r.(type) {
+			case string:
+				play.Tasks = append(play.Tasks, p.role(v, "main", tags, 0)...)
+			case map[string]interface{}:
+				name := str(v["role"])
+				if name == "" {
+					name = str(v["name"])
+				}
+				play.Tasks = append(play.Tasks, p.role(name, "main", uniqueTags(append(append([]string{}, tags...), toTags(v["tags"])...)), 0)...)
+			}
+		}
+	}
+	play.Tasks = append(play.Tasks, p.tasks(item["tasks"], dir, "", tags, 0)...)
+	play.Tasks = append(play.Tasks, p.tasks(item["post_tasks"], dir, "", tags, 0)...)
+	all := append([]string{}, tags...)
+	for _, t := range play.Tasks {
+		all = append(all, t.Tags...)
+	}
+	play.Tags = uniqueTags(all)
+	return play
+}
+
+// role will expand tasks file of role in pigsty home roles directory
+func (p *playbookParser) role(name, file string, tags []string, depth int) []Task {
+	if name == "" || strings.Contains(name, "{{") {
+		p.pb.Dynamic = true
+		return nil
+	}
+	dir := filepath.Join(p.home, "roles", name, "tasks")
+	path := filepath.Join(dir, file+".yml")
+	if _, err := os.Stat(path); err != nil {
+		path = filepath.Join(dir, file+".yaml")
+	}
+	var items []interface{}
+	if err := readYAML(path, &items); err != nil {
+		p.pb.Dynamic = true // role not in pigsty home
+		return nil
+	}
+	return p.tasks(items, dir, name, tags, depth+1)
+}
+
+// tasks will expand task list: blocks, task imports/includes and role imports/includes
+func (p *playbookParser) tasks(list interface{}, dir, role string, inherited []string, depth int) []Task {
+	items, _ := list.([]interface{})
+	if depth > maxIncludeDepth {
+		p.pb.Dynamic = true
+		return nil
+	}
+	var res []Task
+	for _, i := range items {
+		item, ok := i.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		tags := uniqueTags(append(append([]string{}, inherited...), toTags(item["tags"])...))
+		if _, ok := item["block"]; ok {
+			for _, key := range []string{"block", "rescue", "always"} {
+				res = append(res, p.tasks(item[key], dir, role, tags, depth)...)
+			}
+			continue
+		}
+		if file, static, ok := taskInclude(item); ok {
+			if !static { // dynamic include is a task, its tags apply to children via apply only
+				res = append(res, Task{Name: str(item["name"]), Role: role, Tags: tags})
+				tags = uniqueTags(append(append([]string{}, inherited...), applyTags(item)...))
+			}
+			if strings.Contains(file, "{{") {
+				p.pb.Dynamic = true
+				continue
+			}
+			var sub []interface{}
+			path := filepath.Join(dir, file)
+			if err := readYAML(path, &sub); err != nil {
+				p.pb.Dynamic = true
+				continue
+			}
+			res = append(res, p.tasks(sub, filepath.Dir(path), role, tags, depth+1)...)
+			continue
+		}
+		if name, static, ok := roleInclude(item); ok {
+			if !static {
+				res = append(res, Task{Name: str(item["name"]), Role: role, Tags: tags})
+				tags = uniqueTags(append(append([]string{}, inherited...), applyTags(item)...))
+			}
+			file := "main"
+			if args, ok := roleArgs(item); ok && str(args["tasks_from"]) != "" {
+				file = strings.TrimSuffix(strings.TrimSuffix(str(args["tasks_from"]), ".yml"), ".yaml")
+			}
+			res = append(res, p.role(name, file, tags, depth)...)
+			continue
+		}
+		res = append(res, Task{Name: str(item["name"]), Role: role, Tags: tags})
+	}
+	return res
+}
+
+// taskInclude will return file of import_tasks (static) or include_tasks / include (dynamic)
+func taskInclude(item map[string]interface{}) (file string, static bool, ok bool) {
+	for _, key := range []string{"import_tasks", "ansible.builtin.import_tasks", "include_tasks", "ansible.builtin.include_tasks", "include"} {
+		v, exists := item[key]
+		if !exists {
+			continue
+		}
+		static = strings.HasSuffix(key, "import_tasks")
+		switch arg := v.(type) {
+		case string:
+			if fields := strings.Fields(arg); len(fields) > 0 { // free-form: file.yml var=value
+				return fields[0], static, true
+			}
+		case map[string]interface{}:
+			return str(arg["file"]), static, true
+		}
+		return "", static, true
+	}
+	return "", false, false
+}
+
+// roleInclude will return role name of import_role (static) or include_role (dynamic)
+func roleInclude(item map[string]interface{}) (name string, static bool, ok bool) {
+	args, ok := roleArgs(item)
+	if !ok {
+		return "", false, false
+	}
+	_, static = item["import_role"]
+	if !static {
+		_, static = item["ansible.builtin.import_role"]
+	}
+	return str(args["name"]), static, true
+}
+
+// roleArgs will return args of import_role / include_role
+func roleArgs(item map[string]interface{}) (map[string]interface{}, bool) {
+	for _, key := range []string{"import_role", "ansible.builtin.import_role", "include_role", "ansible.builtin.include_role"} {
+		if v, exists := item[key]; exists {
+			args, _ := v.(map[string]interface{})
+			return args, true
+		}
+	}
+	return nil, false
+}
+
+// applyTags will return tags applied to children of dynamic include
+func applyTags(item map[string]interface{}) []string {
+	for _, key := range []string{"include_tasks", "ansible.builtin.include_tasks", "include_role", "ansible.builtin.include_role"} {
+		if args, ok := item[key].(map[string]interface{}); ok {
+			if apply, ok := args["apply"].(map[string]interface{}); ok {
+				return toTags(apply["tags"])
+			}
+		}
+	}
+	return nil
+}
+
+/**************************************************************\
+*                          Helpers                             *
+\**************************************************************/
+// readYAML will unmarshal yaml file into v
+func readYAML(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, v)
+}
+
+// str will render scalar yaml value as string
+func str(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// toTags will parse tags field: a list or comma separated string, templated tags are ignored
+func toTags(v interface{}) []string {
+	var raw []string
+	switch t := v.(type) {
+	case string:
+		raw = []string{t}
+	case []interface{}:
+		for _, i := range t {
+			raw = append(raw, str(i))
+		}
+	}
+	var tags []string
+	for _, tag := range splitTags(raw) {
+		if !strings.Contains(tag, "{{") {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// splitTags will split comma separated tags and trim spaces
+func splitTags(tags []string) []string {
+	var res []string
+	for _, t := range tags {
+		for _, tag := range strings.Split(t, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				res = append(res, tag)
+			}
+		}
+	}
+	return res
+}
+
+// uniqueTags will return sorted unique tags
+func uniqueTags(tags []string) []string {
+	set := make(map[string]bool, len(tags))
+	res := []string{}
+	for _, tag := range tags {
+		if !set[tag] {
+			set[tag] = true
+			res = append(res, tag)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,140 @@
+package exec
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// playbookFiles is a minimal pigsty home with playbooks, imports, roles and includes
+var playbookFiles = map[string]string{
+	"pgsql.yml": `---
+- name: init postgres
+  hosts: all
+  tags: pgsql
+  roles:
+    - { role: postgres, tags: postgres }
+    - { role: monitor,  tags: monitor }
+  tasks:
+    - name: register service
+      tags: [ register, pg_hba ]
+      debug: msg=ok
+`,
+	"infra.yml": `---
+- import_playbook: pgsql.yml
+- name: infra
+  hosts: meta
+  tasks:
+    - block:
+        - name: render targets
+          tags: prometheus_targets
+          template: src=a dest=b
+      rescue:
+        - name: reload
+          debug: msg=reload
+      tags: prometheus
+`,
+	"dynamic.yml": `---
+- name: dynamic
+  hosts: all
+  roles: [ "{{ role_name }}" ]
+`,
+	"roles/postgres/tasks/main.yml": `---
+- name: install
+  tags: pg_install
+  package: name=postgresql
+- import_tasks: config.yml
+  tags: pg_config
+- include_tasks:
+    file: launch.yml
+    apply: { tags: pg_launch }
+  tags: pg_launch
+`,
+	"roles/postgres/tasks/config.yml": `---
+- name: render config
+  tags: [ pg_conf ]
+  template: src=a dest=b
+`,
+	"roles/postgres/tasks/launch.yml": `---
+- name: launch
+  systemd: name=postgres state=started
+`,
+	"roles/monitor/tasks/main.yml": `---
+- import_role: { name: postgres, tasks_from: config }
+- name: setup exporter
+  tags: pg_exporter
+  debug: msg=ok
+`,
+}
+
+func TestPlaybooks(t *testing.T) {
+	e, runner := newTestExecutor(t, map[string]*Script{"*": {}})
+	defer os.RemoveAll(e.WorkDir)
+	for name, content := range playbookFiles {
+		path := filepath.Join(e.WorkDir, name)
+		_ = os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	playbooks, err := e.Playbooks()
+	if err != nil || len(playbooks) != 3 {
+		t.Fatalf("inventory and task files should not be playbooks: %v %v", playbooks, err)
+	}
+	if names := []string{playbooks[0].Name, playbooks[1].Name, playbooks[2].Name}; !reflect.DeepEqual(names, []string{"dynamic.yml", "infra.yml", "pgsql.yml"}) {
+		t.Errorf("unexpected playbooks: %v", names)
+	}
+	if !playbooks[0].Dynamic || playbooks[2].Dynamic {
+		t.Errorf("only templated role should be dynamic")
+	}
+
+	pb, err := e.LoadPlaybook("pgsql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"monitor", "pg_conf", "pg_config", "pg_exporter", "pg_hba", "pg_install", "pg_launch", "pgsql", "postgres", "register"}
+	if !reflect.DeepEqual(pb.Tags, expected) {
+		t.Errorf("unexpected tags:\n%v\n%v", pb.Tags, expected)
+	}
+	var tasks []string
+	for _, task := range pb.Plays[0].Tasks {
+		tasks = append(tasks, task.Role+":"+task.Name+strings.Join(task.Tags, ","))
+	}
+	if len(tasks) != 7 || tasks[0] != "postgres:installpg_install,pgsql,postgres" ||
+		tasks[1] != "postgres:render configpg_conf,pg_config,pgsql,postgres" ||
+		tasks[3] != "postgres:launchpg_launch,pgsql,postgres" ||
+		tasks[4] != "postgres:render configmonitor,pg_conf,pgsql" {
+		t.Errorf("unexpected tasks: %q", tasks)
+	}
+
+	infra, _ := e.LoadPlaybook("infra.yml")
+	if len(infra.Plays) != 2 || !infra.HasTag("prometheus_targets") || !infra.HasTag("pg_hba") || !infra.HasTag("always") {
+		t.Errorf("imported playbook & block tags should be found: %v", infra.Tags)
+	}
+	if _, err := e.LoadPlaybook("../pgsql.yml"); err == nil {
+		t.Errorf("playbook outside pigsty home should be rejected")
+	}
+	if _, err := e.LoadPlaybook("pigsty.yml"); err == nil {
+		t.Errorf("inventory is not a playbook")
+	}
+
+	// unknown tags are rejected before launching, unless playbook is dynamic or not found
+	job := e.NewJob(WithPlaybook("pgsql.yml"), WithTags("pg_hba", "pg_hab"))
+	if err := job.Run(context.TODO()); err == nil || !strings.Contains(err.Error(), "unknown tags pg_hab") || len(runner.Calls()) != 0 {
+		t.Errorf("unknown tag should fail job before running: %v", err)
+	}
+	for _, pb := range []string{"pgsql.yml", "dynamic.yml", "missing.yml"} {
+		tag := "pg_hba"
+		if pb != "pgsql.yml" {
+			tag = "whatever"
+		}
+		if err := e.NewJob(WithPlaybook(pb), WithTags(tag), WithStdout(ioutil.Discard)).Run(context.TODO()); err != nil {
+			t.Errorf("%s with tag %s should run: %v", pb, tag, err)
+		}
+	}
+}
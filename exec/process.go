@@ -0,0 +1,125 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"github.com/apenella/go-ansible/pkg/execute"
+	"github.com/apenella/go-ansible/pkg/stdoutcallback"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	osexec "os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/**************************************************************\
+*                      Process Execute                         *
+\**************************************************************/
+// processExecute run ansible-playbook as child process with job's own environment,
+// instead of modifying environment of current process
+type processExecute struct {
+	job    *Job
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// Execute implements execute.Executor, output is written to stdout & stderr.
+// ansible-playbook runs in its own process group. When ctx is done, SIGINT is sent to the
+// group, which is killed by SIGKILL if it does not exit in grace period
+func (e *processExecute) Execute(ctx context.Context, command []string, _ stdoutcallback.StdoutCallbackResultsFunc, _ ...execute.ExecuteOptions) error {
+	j := e.job
+	cmd := osexec.Command(command[0], command[1:]...)
+	cmd.Env = j.Environ()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true} // background group can not read tty, stdin is /dev/null
+	if j.Exec != nil {
+		cmd.Dir = j.Exec.WorkDir
+	}
+	// output is read via pipes, so Wait will not block on lingering children that hold them
+	outR, outDone, err := pipeOutput(&cmd.Stdout, e.stdout)
+	if err != nil {
+		return err
+	}
+	defer outR.Close()
+	errR, errDone, err := pipeOutput(&cmd.Stderr, e.stderr)
+	if err != nil {
+		return err
+	}
+	defer errR.Close()
+	err = cmd.Start()
+	cmd.Stdout.(*os.File).Close()
+	cmd.Stderr.(*os.File).Close()
+	if err != nil {
+		return fmt.Errorf("fail to start %s: %w", command[0], err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = j.terminate(cmd.Process.Pid, done)
+	}
+	if ctx.Err() != nil { // kill lingering processes of group, which may hold stdout
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	timeout := time.After(outputDelay)
+	for _, pipe := range []struct {
+		r    *os.File
+		done <-chan struct{}
+	}{{outR, outDone}, {errR, errDone}} {
+		select {
+		case <-pipe.done:
+		case <-timeout:
+			logrus.Warnf("job %s: output is still held by other process after exit, stop reading", j.ID)
+			pipe.r.Close()
+			<-pipe.done
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s interrupted: %w (%s)", strings.Join(command, " "), ctx.Err(), err)
+		}
+		return fmt.Errorf("%s failed: %w", strings.Join(command, " "), err)
+	}
+	return nil
+}
+
+// pipeOutput will set *dst to write end of a new pipe, whose output is copied to w until done
+func pipeOutput(dst *io.Writer, w io.Writer) (*os.File, <-chan struct{}, error) {
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	*dst = pw
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(w, r)
+		close(done)
+	}()
+	return r, done, nil
+}
+
+// outputDelay is how long to wait for remaining output after ansible-playbook exit
+const outputDelay = 5 * time.Second
+
+// terminate will send SIGINT to process group, then SIGKILL after grace period, return wait error
+func (j *Job) terminate(pgid int, done <-chan error) error {
+	grace := j.GracePeriod
+	if grace <= 0 {
+		grace = DefaultGracePeriod
+	}
+	logrus.Warnf("job %s: interrupt process group %d, kill in %s", j.ID, pgid, grace)
+	_ = syscall.Kill(-pgid, syscall.SIGINT)
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		logrus.Warnf("job %s: kill process group %d after %s grace period", j.ID, pgid, grace)
+		_ = syscall.Kill(-pgid, syscall.SIGKILL)
+		return <-done
+	}
+}
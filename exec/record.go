@@ -0,0 +1,211 @@
+package exec
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/**************************************************************\
+*                         Recording                            *
+\**************************************************************/
+// CAST_EXT is file extension of job output recording, placed alongside job log
+const CAST_EXT = ".cast"
+
+// recording terminal size, ansible output is not wrapped by width
+const (
+	castWidth  = 120
+	castHeight = 40
+)
+
+// DefaultIdleLimit caps pause between chunks during replay, e.g: a long running task
+const DefaultIdleLimit = 2 * time.Second
+
+// followInterval is how often recording of running job is polled by Follow
+const followInterval = 200 * time.Millisecond
+
+// CastHeader is the first line of asciicast v2 recording
+type CastHeader struct {
+	Version   int    `json:"version"`         // always 2
+	Width     int    `json:"width"`           // terminal columns
+	Height    int    `json:"height"`          // terminal rows
+	Timestamp int64  `json:"timestamp"`       // unix time of recording start
+	Title     string `json:"title,omitempty"` // job name
+}
+
+// CastChunk is a timestamped piece of job output, recorded as [time, "o", data]
+type CastChunk struct {
+	Time   float64 `json:"time"`   // seconds since recording start
+	Data   string  `json:"data"`   // redacted output
+	Offset int64   `json:"offset"` // byte offset of data in job output, same as event offset
+}
+
+// Recorder writes job output as asciicast v2 recording, every write is a chunk
+type Recorder struct {
+	f     *os.File
+	start time.Time
+	lock  sync.Mutex
+}
+
+// NewRecorder will create recording file with header, its directory is created if not exists
+func NewRecorder(path string, title string) (*Recorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{f: f, start: time.Now()}
+	b, _ := json.Marshal(CastHeader{Version: 2, Width: castWidth, Height: castHeight, Timestamp: r.start.Unix(), Title: title})
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// WriteString will append output chunk with elapsed time, chunk is written at once so followers see whole lines
+func (r *Recorder) WriteString(s string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	b, _ := json.Marshal([]interface{}{json.Number(fmt.Sprintf("%.6f", time.Since(r.start).Seconds())), "o", s})
+	_, err := r.f.Write(append(b, '\n'))
+	return err
+}
+
+// Close will close recording file
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.f.Close()
+}
+
+// ReadCast will read header and chunks of recording with output offset no less than offset.
+// a chunk containing offset is cut at it, incomplete last line of a recording in progress is ignored
+func ReadCast(path string, offset int64) (*CastHeader, []CastChunk, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+	line, err := rd.ReadBytes('\n')
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid recording %s: missing header", path)
+	}
+	var header CastHeader
+	if err = json.Unmarshal(line, &header); err != nil || header.Version != 2 {
+		return nil, nil, fmt.Errorf("invalid recording %s: bad header", path)
+	}
+	chunks := []CastChunk{}
+	var pos int64
+	for {
+		line, err = rd.ReadBytes('\n')
+		if err == io.EOF {
+			return &header, chunks, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		var ev []interface{}
+		if err = json.Unmarshal(line, &ev); err != nil || len(ev) < 3 {
+			return nil, nil, fmt.Errorf("invalid recording %s: bad event %s", path, line)
+		}
+		t, _ := ev[0].(float64)
+		data, _ := ev[2].(string)
+		if code, _ := ev[1].(string); code != "o" {
+			continue
+		}
+		end := pos + int64(len(data))
+		if end > offset {
+			if offset > pos {
+				data = data[offset-pos:]
+				pos = offset
+			}
+			chunks = append(chunks, CastChunk{Time: t, Data: data, Offset: pos})
+		}
+		pos = end
+	}
+}
+
+// Replay will write recorded output to w with recorded timing: pauses are divided by speed,
+// and capped at idleLimit (no limit if 0)
+func Replay(ctx context.Context, w io.Writer, path string, speed float64, idleLimit time.Duration) error {
+	_, chunks, err := ReadCast(path, 0)
+	if err != nil {
+		return err
+	}
+	if speed <= 0 {
+		speed = 1
+	}
+	var last float64
+	for _, chunk := range chunks {
+		wait := time.Duration((chunk.Time - last) / speed * float64(time.Second))
+		if idleLimit > 0 && wait > idleLimit {
+			wait = idleLimit
+		}
+		last = chunk.Time
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+		if _, err = io.WriteString(w, chunk.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Follow will write recorded output to w, then poll recording for new output until done returns true,
+// e.g: job is finished. output after done is checked is written before return
+func Follow(ctx context.Context, w io.Writer, path string, done func() bool) error {
+	var offset int64
+	for {
+		finished := done()
+		_, chunks, err := ReadCast(path, offset)
+		if err != nil && !(os.IsNotExist(err) && !finished) { // recording of queued job is not created yet
+			return err
+		}
+		for _, chunk := range chunks {
+			if _, err = io.WriteString(w, chunk.Data); err != nil {
+				return err
+			}
+			offset = chunk.Offset + int64(len(chunk.Data))
+		}
+		if finished {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(followInterval):
+		}
+	}
+}
+
+/**************************************************************\
+*                        Job Recording                         *
+\**************************************************************/
+// WithRecording will record job output with timing to given path, see Recorder
+func WithRecording(path string) JobOpts {
+	return func(j *Job) {
+		j.Recording = path
+	}
+}
+
+// WithRecordDir will record job output to <dir>/<job id>.cast
+func WithRecordDir(dir string) JobOpts {
+	return func(j *Job) {
+		j.Recording = filepath.Join(dir, j.ID+CAST_EXT)
+	}
+}
@@ -0,0 +1,101 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRecording(t *testing.T) {
+	e, _ := newTestExecutor(t, nil)
+	defer os.RemoveAll(e.WorkDir)
+	e.Runner = runnerFunc(func(ctx context.Context, job *Job, stdout, stderr io.Writer) error {
+		for _, line := range strings.SplitAfter(sampleOutput, "\n") {
+			fmt.Fprint(stdout, line)
+			time.Sleep(2 * time.Millisecond)
+		}
+		fmt.Fprint(stderr, "[WARNING]: not recorded\n")
+		return nil
+	})
+	var stdout bytes.Buffer
+	job := e.NewJob(WithPlaybook("pgsql.yml"), WithName("pgsql init"), WithRecordDir(filepath.Join(e.WorkDir, "log")), WithStdout(&stdout), WithStderr(ioutil.Discard))
+	if job.Recording != filepath.Join(e.WorkDir, "log", job.ID+CAST_EXT) {
+		t.Fatalf("unexpected recording path %s", job.Recording)
+	}
+	if err := job.Run(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	header, chunks, err := ReadCast(job.Recording, 0)
+	if err != nil || header.Version != 2 || header.Title != "pgsql init" || len(chunks) < 10 {
+		t.Fatalf("unexpected recording: %+v, %d chunks, %v", header, len(chunks), err)
+	}
+	var recorded strings.Builder
+	for i, chunk := range chunks {
+		if chunk.Offset != int64(recorded.Len()) || i > 0 && chunk.Time < chunks[i-1].Time {
+			t.Errorf("chunk %d should be in order: %+v", i, chunk)
+		}
+		recorded.WriteString(chunk.Data)
+	}
+	if recorded.String() != stdout.String() {
+		t.Errorf("recording should match output:\n%s", recorded.String())
+	}
+
+	// offsets of events & recording are the same
+	recap := job.Events[len(job.Events)-3]
+	_, since, _ := ReadCast(job.Recording, recap.Offset+3)
+	if len(since) != 3 || since[0].Offset != recap.Offset+3 || !strings.HasPrefix(since[0].Data, recap.Host[3:]) {
+		t.Errorf("chunks since offset should be cut at offset: %+v", since)
+	}
+
+	var replayed bytes.Buffer
+	start := time.Now()
+	if err = Replay(context.TODO(), &replayed, job.Recording, 1000, 0); err != nil || replayed.String() != stdout.String() {
+		t.Errorf("replay should write recorded output: %v\n%s", err, replayed.String())
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("replay should be sped up")
+	}
+}
+
+func TestFollow(t *testing.T) {
+	e, _ := newTestExecutor(t, nil)
+	defer os.RemoveAll(e.WorkDir)
+	release := make(chan struct{})
+	e.Runner = runnerFunc(func(ctx context.Context, job *Job, stdout, stderr io.Writer) error {
+		fmt.Fprint(stdout, "TASK [first] ***\n")
+		<-release
+		fmt.Fprint(stdout, "TASK [second] ***\n")
+		return nil
+	})
+	job := e.NewJob(WithPlaybook("pgsql.yml"), WithRecording(filepath.Join(e.WorkDir, "job.cast")), WithStdout(ioutil.Discard))
+	var done int32
+	go func() {
+		_ = job.Run(context.TODO())
+		atomic.StoreInt32(&done, 1)
+	}()
+
+	// follower starts before recording is created, and gets output written after it started
+	r, w := io.Pipe()
+	go func() {
+		err := Follow(context.TODO(), w, job.Recording, func() bool { return atomic.LoadInt32(&done) == 1 })
+		w.CloseWithError(err)
+	}()
+	buf := make([]byte, 17)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "TASK [first] ***\n" {
+		t.Fatalf("follower should get output of running job: %q %v", buf, err)
+	}
+	close(release)
+	rest, err := ioutil.ReadAll(r)
+	if err != nil || string(rest) != "TASK [second] ***\n" {
+		t.Errorf("follower should get rest output and stop when job is done: %q %v", rest, err)
+	}
+}
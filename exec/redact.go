@@ -0,0 +1,242 @@
+package exec
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Vonng/pigsty-cli/conf"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+/**************************************************************\
+*                        Redaction                             *
+\**************************************************************/
+// REDACTED replaces secrets in job output, logs, events and job json
+const REDACTED = "********"
+
+// secrets shorter than this are not masked in text, otherwise output would be garbled.
+// they are still masked as values of secret vars in job json
+const minSecretLength = 4
+
+// Redactor masks secret values in text
+type Redactor struct {
+	secrets  []string
+	replacer *strings.Replacer
+}
+
+// NewRedactor will create redactor of given secrets, json escaped forms are masked too
+func NewRedactor(secrets ...string) *Redactor {
+	set := make(map[string]bool)
+	for _, s := range secrets {
+		if len(s) < minSecretLength {
+			continue
+		}
+		set[s] = true
+		b, _ := json.Marshal(s) // secret in json output, e.g: msg of failed task
+		set[strings.Trim(string(b), `"`)] = true
+	}
+	r := &Redactor{}
+	for s := range set {
+		r.secrets = append(r.secrets, s)
+	}
+	// longer secrets first, so a secret containing another one is masked entirely
+	sort.Slice(r.secrets, func(i, j int) bool {
+		if len(r.secrets[i]) != len(r.secrets[j]) {
+			return len(r.secrets[i]) > len(r.secrets[j])
+		}
+		return r.secrets[i] < r.secrets[j]
+	})
+	var pairs []string
+	for _, s := range r.secrets {
+		pairs = append(pairs, s, REDACTED)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+	return r
+}
+
+// With will return a new redactor with extra secrets
+func (r *Redactor) With(secrets ...string) *Redactor {
+	if r != nil {
+		secrets = append(append([]string{}, r.secrets...), secrets...)
+	}
+	return NewRedactor(secrets...)
+}
+
+// Empty tells whether redactor has no secret to mask
+func (r *Redactor) Empty() bool {
+	return r == nil || len(r.secrets) == 0
+}
+
+// Redact will mask secrets in s
+func (r *Redactor) Redact(s string) string {
+	if r.Empty() {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
+
+// RedactFile will mask secrets in file in place, e.g: ansible log written via ANSIBLE_LOG_PATH
+func (r *Redactor) RedactFile(path string) error {
+	if r.Empty() {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	redacted := r.Redact(string(b))
+	if redacted == string(b) {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(redacted), info.Mode())
+}
+
+// Writer will return writer which masks secrets line by line before writing to w, Flush writes last line
+func (r *Redactor) Writer(w io.Writer) *RedactWriter {
+	return &RedactWriter{r: r, w: w}
+}
+
+// RedactWriter masks secrets of complete lines, so secrets split across writes are masked too
+type RedactWriter struct {
+	r   *Redactor
+	w   io.Writer
+	buf []byte
+}
+
+// Write will write redacted complete lines of p, incomplete line is kept until next write or flush
+func (w *RedactWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	i := bytes.LastIndexByte(w.buf, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	lines := string(w.buf[:i+1])
+	w.buf = append([]byte{}, w.buf[i+1:]...)
+	if _, err := io.WriteString(w.w, w.r.Redact(lines)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush will write redacted incomplete line if any
+func (w *RedactWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(w.w, w.r.Redact(string(w.buf)))
+	w.buf = nil
+	return err
+}
+
+/**************************************************************\
+*                      Job Redaction                           *
+\**************************************************************/
+// newRedactor will build redactor of job: inventory secrets of base, secrets in extra vars & env
+func (e *Executor) newRedactor(j *Job, base *Redactor) *Redactor {
+	secrets := conf.Secrets(j.Opts.ExtraVars)
+	for _, env := range []map[string]string{e.Env, j.Env} {
+		for k, v := range env {
+			if conf.IsSecretKey(k) {
+				secrets = append(secrets, v)
+			}
+		}
+	}
+	return base.With(secrets...)
+}
+
+// Redact will mask secrets of job in s: inventory secrets, secrets in extra vars & env
+func (j *Job) Redact(s string) string {
+	return j.redactor.Redact(s)
+}
+
+// redactedCommand will return command line of job with secrets masked, including short secrets in extra vars
+func (j *Job) redactedCommand() string {
+	vars, _ := redactValue(j.redactor, "", j.Opts.ExtraVars).(map[string]interface{})
+	if j.AdHoc != nil {
+		cmd, opts := *j.AdHoc, *j.AdHoc.Options
+		opts.ExtraVars, cmd.Options = vars, &opts
+		return j.Redact(cmd.String())
+	}
+	cmd, opts := *j.CMD, *j.CMD.Options
+	opts.ExtraVars, cmd.Options = vars, &opts
+	return j.Redact(cmd.String())
+}
+
+// MarshalJSON will marshal job with secrets masked: values of secret vars (e.g: extra vars) are replaced,
+// and secrets in any string (command, events, ...) are masked. jobs loaded from store are already redacted
+func (j *Job) MarshalJSON() ([]byte, error) {
+	type job Job // without MarshalJSON
+
+	// marshal under event lock, state & events are written by running job concurrently
+	j.eventLock.Lock()
+	b, err := json.Marshal((*job)(j))
+	j.eventLock.Unlock()
+	if err != nil || j.redactor == nil {
+		return b, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err = d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(redactValue(j.redactor, "", v))
+}
+
+// isRedacted tells whether value or any of its items is masked
+func isRedacted(v interface{}) bool {
+	switch t := v.(type) {
+	case string:
+		return t == REDACTED
+	case map[string]interface{}:
+		for _, item := range t {
+			if isRedacted(item) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range t {
+			if isRedacted(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redactValue will return copy of decoded json value with secrets masked
+func redactValue(r *Redactor, key string, v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(t))
+		for k, item := range t {
+			res[k] = redactValue(r, k, item)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(t))
+		for i, item := range t {
+			res[i] = redactValue(r, key, item)
+		}
+		return res
+	case nil:
+		return nil
+	case string:
+		if conf.IsSecretKey(key) || strings.HasPrefix(t, conf.VAULT_PREFIX) {
+			return REDACTED
+		}
+		return r.Redact(t)
+	default:
+		if conf.IsSecretKey(key) {
+			return REDACTED
+		}
+		return t
+	}
+}
@@ -0,0 +1,146 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// redactConfig is an inventory with secrets in global, cluster & host vars
+const redactConfig = `all:
+  children:
+    meta:
+      hosts: {10.10.10.10: {ansible_ssh_pass: Host.Pass}}
+    pg-test:
+      hosts: {10.10.10.11: {pg_seq: 1, pg_role: primary}}
+      vars:
+        pg_cluster: pg-test
+        pg_users: [ { name: dbuser_test, password: "User\"Quoted" } ]
+  vars:
+    pg_admin_password: DBUser.Admin
+`
+
+// runnerFunc is a stand-in runner leaking secrets to every output
+type runnerFunc func(ctx context.Context, job *Job, stdout, stderr io.Writer) error
+
+func (f runnerFunc) Run(ctx context.Context, job *Job, stdout, stderr io.Writer) error {
+	return f(ctx, job, stdout, stderr)
+}
+
+func TestRedact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pigsty-redact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "pigsty.yml"), []byte(redactConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := NewExecutor(dir)
+	e.Env["VAULT_TOKEN"] = "Vault.Token"
+	store, err := OpenFileJobStore(filepath.Join(dir, "jobs.db"), DefaultJobRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	secrets := []string{"DBUser.Admin", "Host.Pass", `User"Quoted`, `User\"Quoted`, "Vault.Token", "Mon1tor.Pass", "pwd"}
+
+	e.Runner = runnerFunc(func(ctx context.Context, job *Job, stdout, stderr io.Writer) error {
+		_ = ioutil.WriteFile(job.LogPath, []byte("2021-05-01 | psql -U dbsu -W DBUser.Admin\n"), 0644)
+		// secret split across writes, and secret in json message
+		fmt.Fprint(stdout, "\nTASK [postgres : Create user] ***\nok: [10.10.10.11] => {\"msg\": \"create user dbuser_test with password DBUser.")
+		fmt.Fprint(stdout, "Admin\"}\nfatal: [10.10.10.10]: FAILED! => {\"msg\": \"auth failed: User\\\"Quoted, Host.Pass, Mon1tor.Pass\"}\n")
+		fmt.Fprint(stderr, "[WARNING]: vault token Vault.")
+		fmt.Fprint(stderr, "Token expired")
+		return fmt.Errorf("exit status 2")
+	})
+	var stdout, stderr bytes.Buffer
+	job := e.NewJob(
+		WithPlaybook("pgsql.yml"),
+		WithLimit("all"),
+		WithExtraVars("pg_monitor_password", "Mon1tor.Pass"),
+		WithExtraVars("pg_replication_password", "pwd"), // too short to mask in text, masked as secret var
+		WithLogPath(filepath.Join(dir, "job.log")),
+		WithStore(store),
+		WithStdout(&stdout),
+		WithStderr(&stderr),
+	)
+	if err := job.Run(context.TODO()); err == nil || job.ExitCode != 2 {
+		t.Fatalf("job should fail: %v", err)
+	}
+	log, _ := ioutil.ReadFile(job.LogPath)
+	stored, _ := store.Get(job.ID)
+	outputs := map[string]string{
+		"command": job.Command,
+		"stdout":  stdout.String(),
+		"stderr":  stderr.String(),
+		"log":     string(log),
+		"json":    job.JSON(),
+		"stored":  stored.JSON(),
+	}
+	for name, out := range outputs {
+		for _, secret := range secrets {
+			if secret == "pwd" && name != "json" && name != "stored" {
+				continue
+			}
+			if strings.Contains(out, secret) {
+				t.Errorf("secret %s leaked in %s:\n%s", secret, name, out)
+			}
+		}
+		if !strings.Contains(out, REDACTED) {
+			t.Errorf("%s should be redacted:\n%s", name, out)
+		}
+	}
+	if len(job.Events) != 3 || job.Events[1].Message != `{"msg": "create user dbuser_test with password ********"}` {
+		t.Errorf("unexpected events: %+v", job.Events)
+	}
+	if events := stored.Events; len(events) != 3 || strings.Contains(events[2].Message, "Host.Pass") {
+		t.Errorf("stored events should be redacted: %+v", events)
+	}
+	if !strings.Contains(stderr.String(), "vault token ******** expired") {
+		t.Errorf("secret split across writes should be masked: %s", stderr.String())
+	}
+	if job.ExtraVars["pg_monitor_password"] != "Mon1tor.Pass" {
+		t.Errorf("secrets in memory should be kept for running")
+	}
+
+	// job with redacted extra vars can not be retried from store
+	if _, err := e.Retry(stored, false); err == nil || !strings.Contains(err.Error(), "redacted") {
+		t.Errorf("job with redacted extra vars should not be retried: %v", err)
+	}
+}
+
+func TestJobMarshalWhileRunning(t *testing.T) {
+	e, _ := newTestExecutor(t, map[string]*Script{"pgsql": {Output: sampleOutput, Delay: time.Millisecond}})
+	defer os.RemoveAll(e.WorkDir)
+	job := e.NewJob(WithPlaybook("pgsql.yml"), WithLimit("pg-test"), WithStdout(ioutil.Discard), WithStderr(ioutil.Discard))
+	s := NewScheduler(1)
+	s.Submit(job)
+	done := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		if _, err := json.Marshal(job); err != nil {
+			t.Fatal(err)
+		}
+		_ = copyJob(job, true)
+	}
+	if !job.Finished() || len(job.Results) == 0 {
+		t.Errorf("unexpected job: %s", job.JSON())
+	}
+}
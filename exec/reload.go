@@ -0,0 +1,86 @@
+package exec
+
+import (
+	"fmt"
+	"github.com/Vonng/pigsty-cli/conf"
+	"path/filepath"
+	"time"
+)
+
+/**************************************************************\
+*                          Reload                              *
+\**************************************************************/
+// ConfigChange is the inventory change applied by executor reload
+type ConfigChange struct {
+	Time    time.Time     `json:"time"`    // when config is swapped
+	Before  string        `json:"before"`  // sha256 of inventory before reload
+	After   string        `json:"after"`   // sha256 of inventory after reload
+	Changes []conf.Change `json:"changes"` // semantic diff between old & new config
+	Summary string        `json:"summary"` // one-line summary of changes
+}
+
+// InventoryPath is absolute path of executor's inventory file
+func (e *Executor) InventoryPath() string {
+	return filepath.Join(e.WorkDir, e.Inventory)
+}
+
+// Snapshot will return config & redactor used by new jobs, which are not changed by later reload
+func (e *Executor) Snapshot() (*conf.Config, *Redactor) {
+	e.configLock.RLock()
+	defer e.configLock.RUnlock()
+	return e.Config, e.Redactor
+}
+
+// CurrentConfig will return config used by new jobs
+func (e *Executor) CurrentConfig() *conf.Config {
+	cfg, _ := e.Snapshot()
+	return cfg
+}
+
+// CurrentRedactor will return redactor of inventory secrets used by new jobs
+func (e *Executor) CurrentRedactor() *Redactor {
+	_, r := e.Snapshot()
+	return r
+}
+
+// ConfigHash will return sha256 of inventory content currently loaded
+func (e *Executor) ConfigHash() string {
+	e.configLock.RLock()
+	defer e.configLock.RUnlock()
+	return e.configHash
+}
+
+// inventory is config snapshot of job, or current config of executor for jobs loaded from store
+func (j *Job) inventory() *conf.Config {
+	if j.Config == nil && j.Exec != nil {
+		return j.Exec.CurrentConfig()
+	}
+	return j.Config
+}
+
+// Reload will re-read and validate inventory, then swap config used by new jobs atomically.
+// jobs already created keep their config snapshot, and current config is kept if inventory is invalid
+func (e *Executor) Reload() (*ConfigChange, error) {
+	path := e.InventoryPath()
+	hash := FileHash(path)
+	cfg, err := conf.LoadConfig(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to load inventory %s: %w", path, err)
+	}
+	if err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid inventory %s: %w", path, err)
+	}
+	redactor := NewRedactor(cfg.Secrets()...)
+
+	e.configLock.Lock()
+	old, before := e.Config, e.configHash
+	e.Config, e.Redactor, e.configHash = cfg, redactor, hash
+	e.configLock.Unlock()
+
+	change := &ConfigChange{Time: time.Now(), Before: before, After: hash}
+	if old != nil {
+		change.Changes = conf.DiffConfig(old, cfg)
+	}
+	change.Summary = conf.SummarizeChanges(change.Changes)
+	return change, nil
+}
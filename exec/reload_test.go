@@ -0,0 +1,70 @@
+package exec
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExecutor_Reload(t *testing.T) {
+	e, _ := newTestExecutor(t, map[string]*Script{"pgsql": {Output: sampleOutput}})
+	defer os.RemoveAll(e.WorkDir)
+	path := e.InventoryPath()
+	before := e.ConfigHash()
+	old := e.NewJob(WithPlaybook("pgsql.yml"), WithLimit("pg-test"), WithStdout(ioutil.Discard), WithStderr(ioutil.Discard))
+
+	// new jobs use reloaded config & secrets, while jobs created before keep their snapshot
+	changed := strings.Replace(schedulerConfig, "10.10.10.12: {pg_seq: 2, pg_role: replica}",
+		"10.10.10.12: {pg_seq: 2, pg_role: replica}\n        10.10.10.14: {pg_seq: 3, pg_role: replica}", 1) +
+		"  vars: {pg_admin_password: Reload.Pass}\n"
+	if err := ioutil.WriteFile(path, []byte(changed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		_ = old.Run(context.TODO())
+		close(done)
+	}()
+	change, err := e.Reload()
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Before != before || change.After != FileHash(path) || change.Before == change.After || len(change.Changes) != 2 {
+		t.Errorf("unexpected change: %+v", change)
+	}
+	if !strings.Contains(change.Summary, "+instance pg-test.10.10.10.14") {
+		t.Errorf("unexpected change summary: %s", change.Summary)
+	}
+	job := e.NewJob(WithPlaybook("pgsql.yml"), WithLimit("pg-test"))
+	if strings.Join(job.Hosts, ",") != "10.10.10.11,10.10.10.12,10.10.10.14" || job.Config != e.CurrentConfig() {
+		t.Errorf("new job should use reloaded config: %v", job.Hosts)
+	}
+	if strings.Join(old.Hosts, ",") != "10.10.10.11,10.10.10.12" || old.Config == job.Config || len(old.Config.IpMap) != 4 {
+		t.Errorf("existing job should keep its config: %v", old.Hosts)
+	}
+	if job.Redact("pass: Reload.Pass") != "pass: "+REDACTED || old.Redact("Reload.Pass") != "Reload.Pass" {
+		t.Errorf("new job should mask reloaded secrets")
+	}
+
+	// invalid inventory is rejected, current config is kept
+	current, hash := e.CurrentConfig(), e.ConfigHash()
+	invalid := map[string]string{
+		"syntax":   "all: [",
+		"empty":    "",
+		"semantic": strings.Replace(schedulerConfig, "pg_seq: 2, pg_role: replica", "pg_seq: 2, pg_role: primary", 1),
+	}
+	for name, content := range invalid {
+		if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = e.Reload(); err == nil {
+			t.Errorf("%s error inventory should be rejected", name)
+		}
+		if e.CurrentConfig() != current || e.ConfigHash() != hash {
+			t.Errorf("config should be kept after %s error", name)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package exec
+
+import (
+	"sort"
+)
+
+/**************************************************************\
+*                         Result                               *
+\**************************************************************/
+// host result status, by severity
+const (
+	HOST_OK          = "ok"
+	HOST_CHANGED     = "changed"
+	HOST_FAILED      = "failed"
+	HOST_UNREACHABLE = "unreachable"
+)
+
+// HostResult is per-host counters parsed from PLAY RECAP
+type HostResult struct {
+	Host        string `json:"host"`
+	Ok          int    `json:"ok"`
+	Changed     int    `json:"changed"`
+	Unreachable int    `json:"unreachable"`
+	Failed      int    `json:"failed"`
+	Skipped     int    `json:"skipped"`
+	Rescued     int    `json:"rescued"`
+	Ignored     int    `json:"ignored"`
+}
+
+// Status will return overall status of host: unreachable > failed > changed > ok
+func (r *HostResult) Status() string {
+	switch {
+	case r.Unreachable > 0:
+		return HOST_UNREACHABLE
+	case r.Failed > 0:
+		return HOST_FAILED
+	case r.Changed > 0:
+		return HOST_CHANGED
+	default:
+		return HOST_OK
+	}
+}
+
+// OK tells whether host is neither failed nor unreachable
+func (r *HostResult) OK() bool {
+	return r.Unreachable == 0 && r.Failed == 0
+}
+
+// newHostResult will build host result from recap event stats
+func newHostResult(host string, stats map[string]int) HostResult {
+	return HostResult{
+		Host:        host,
+		Ok:          stats["ok"],
+		Changed:     stats["changed"],
+		Unreachable: stats["unreachable"],
+		Failed:      stats["failed"],
+		Skipped:     stats["skipped"],
+		Rescued:     stats["rescued"],
+		Ignored:     stats["ignored"],
+	}
+}
+
+// addResult will record recap of a host, a host appears in recap again will overwrite previous one
+func (j *Job) addResult(ev *Event) {
+	res := newHostResult(ev.Host, ev.Stats)
+	for i := range j.Results {
+		if j.Results[i].Host == res.Host {
+			j.Results[i] = res
+			return
+		}
+	}
+	j.Results = append(j.Results, res)
+	sort.SliceStable(j.Results, func(a, b int) bool { return j.Results[a].Host < j.Results[b].Host })
+}
+
+// countResults will count per-host results from events if job stopped before recap, ad-hoc job has
+// no recap, whose results are its outputs
+func (j *Job) countResults() {
+	j.eventLock.Lock()
+	defer j.eventLock.Unlock()
+	if len(j.Results) > 0 || j.IsAdHoc() {
+		return
+	}
+	results := make(map[string]*HostResult)
+	for _, ev := range j.Events {
+		if !ev.IsHostEvent() {
+			continue
+		}
+		r, exists := results[ev.Host]
+		if !exists {
+			r = &HostResult{Host: ev.Host}
+			results[ev.Host] = r
+		}
+		switch ev.Type {
+		case EVENT_HOST_OK:
+			r.Ok++
+		case EVENT_HOST_CHANGED:
+			r.Ok++
+			r.Changed++
+		case EVENT_HOST_FAILED:
+			r.Failed++
+		case EVENT_HOST_UNREACHABLE:
+			r.Unreachable++
+		case EVENT_HOST_SKIPPED:
+			r.Skipped++
+		case EVENT_HOST_IGNORED: // previous failure is ignored
+			r.Failed--
+			r.Ignored++
+		}
+	}
+	for _, r := range results {
+		j.Results = append(j.Results, *r)
+	}
+	sort.Slice(j.Results, func(a, b int) bool { return j.Results[a].Host < j.Results[b].Host })
+	j.Partial = len(j.Results) > 0
+}
+
+// FailedHosts will return hosts that failed or unreachable according to recap
+func (j *Job) FailedHosts() (hosts []string) {
+	for _, r := range j.Results {
+		if !r.OK() {
+			hosts = append(hosts, r.Host)
+		}
+	}
+	return
+}
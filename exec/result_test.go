@@ -0,0 +1,34 @@
+package exec
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJobResults(t *testing.T) {
+	job := &Job{ID: "test"}
+	var p EventParser
+	for _, line := range strings.Split(sampleOutput, "\n") {
+		if ev := p.Parse(line); ev != nil {
+			job.emit(ev)
+		}
+	}
+	if len(job.Results) != 3 {
+		t.Fatalf("expect 3 host results, got %v", job.Results)
+	}
+	expected := map[string]string{"10.10.10.11": HOST_OK, "10.10.10.12": HOST_CHANGED, "10.10.10.13": HOST_UNREACHABLE}
+	for _, r := range job.Results {
+		if r.Status() != expected[r.Host] {
+			t.Errorf("%s: expect %s, got %s", r.Host, expected[r.Host], r.Status())
+		}
+	}
+	if r := job.Results[1]; r.Ok != 3 || r.Changed != 3 || r.Ignored != 1 {
+		t.Errorf("unexpected counters: %+v", r)
+	}
+	if hosts := job.FailedHosts(); len(hosts) != 1 || hosts[0] != "10.10.10.13" {
+		t.Errorf("unexpected failed hosts: %v", hosts)
+	}
+	if !strings.Contains(job.JSON(), `"results":[{"host":"10.10.10.11","ok":1`) {
+		t.Errorf("results should be included in job json: %s", job.JSON())
+	}
+}
@@ -0,0 +1,120 @@
+package exec
+
+import (
+	"fmt"
+	"strings"
+)
+
+/**************************************************************\
+*                          Retry                               *
+\**************************************************************/
+// WithParent will link job to the job it retries
+func WithParent(id string) JobOpts {
+	return func(j *Job) {
+		j.Parent = id
+	}
+}
+
+// WithStartAtTask will start playbook at the task matching this name
+func WithStartAtTask(task string) JobOpts {
+	return func(j *Job) {
+		j.StartAtTask = task
+	}
+}
+
+// Retry will spawn a new job with same playbook (or module), tags, extra vars, rolling & timeout settings as finished parent job.
+// If failedOnly is set, limit is narrowed to failed & unreachable hosts of parent.
+// options are applied after parent's settings, which could overwrite them.
+func (e *Executor) Retry(parent *Job, failedOnly bool, options ...JobOpts) (*Job, error) {
+	if !parent.Finished() {
+		return nil, fmt.Errorf("job %s is %s, only finished job can be retried", parent.ID, parent.Status)
+	}
+	limit := parent.Limit
+	if failedOnly {
+		hosts := parent.RetryHosts()
+		if len(hosts) == 0 {
+			return nil, fmt.Errorf("job %s has no failed or unreachable hosts", parent.ID)
+		}
+		limit = strings.Join(hosts, ",")
+	}
+	opts := []JobOpts{
+		WithPlaybook(parent.Playbook),
+		WithName(parent.Name),
+		WithLimit(limit),
+		WithTags(parent.Tags...),
+		WithParent(parent.ID),
+	}
+	if parent.IsAdHoc() {
+		opts = append(opts, WithModule(parent.Module, parent.Args))
+	}
+	for k, v := range parent.ExtraVars {
+		if isRedacted(v) { // secrets are not persisted
+			return nil, fmt.Errorf("extra var %s of job %s is redacted, run a new job with it instead", k, parent.ID)
+		}
+		opts = append(opts, WithExtraVars(k, v))
+	}
+	if parent.Check {
+		opts = append(opts, WithCheck())
+	}
+	if parent.Diff {
+		opts = append(opts, WithDiff())
+	}
+	if parent.Serial != "" { // rolling job is retried in batches with same pause & health check
+		opts = append(opts, WithSerial(parent.Serial), WithPause(parent.Pause), WithHealthCheck(parent.HealthCheck))
+	}
+	if parent.Timeout > 0 {
+		opts = append(opts, WithTimeout(parent.Timeout))
+	}
+	return e.NewJob(append(opts, options...)...), nil
+}
+
+// RetryHosts will return failed & unreachable hosts of job according to recap,
+// or according to failure events if job is aborted before recap
+func (j *Job) RetryHosts() []string {
+	if len(j.Results) > 0 {
+		return j.FailedHosts()
+	}
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, ev := range j.failures() {
+		if !seen[ev.Host] {
+			seen[ev.Host] = true
+			hosts = append(hosts, ev.Host)
+		}
+	}
+	return hosts
+}
+
+// FailedTask will return the first task failed on retry hosts, empty string if not found
+func (j *Job) FailedTask() string {
+	failed := make(map[string]bool)
+	for _, host := range j.RetryHosts() {
+		failed[host] = true
+	}
+	for _, ev := range j.failures() {
+		if failed[ev.Host] {
+			return ev.Task
+		}
+	}
+	return ""
+}
+
+// failures will return failed & unreachable events of job, ignored failures are excluded
+func (j *Job) failures() []Event {
+	j.eventLock.Lock()
+	defer j.eventLock.Unlock()
+	type key struct{ host, task, item string }
+	ignored := make(map[key]bool)
+	for _, ev := range j.Events {
+		if ev.Type == EVENT_HOST_IGNORED {
+			ignored[key{ev.Host, ev.Task, ev.Item}] = true
+		}
+	}
+	var events []Event
+	for _, ev := range j.Events {
+		if (ev.Type == EVENT_HOST_FAILED || ev.Type == EVENT_HOST_UNREACHABLE) && !ignored[key{ev.Host, ev.Task, ev.Item}] {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
@@ -0,0 +1,88 @@
+package exec
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	e, bin := newSchedulerExecutor(t)
+	defer os.RemoveAll(filepath.Dir(bin))
+	parent := e.NewJob(WithPlaybook("node.yml"), WithName("node init"), WithLimit("pg-test,pg-src"), WithTags("node"), WithExtraVars("node_tune", "oltp"), WithCheck())
+	var p EventParser
+	for _, line := range strings.Split(sampleOutput, "\n") {
+		if ev := p.Parse(line); ev != nil {
+			parent.emit(ev)
+		}
+	}
+	if _, err := e.Retry(parent, true); err == nil {
+		t.Errorf("unfinished job should not be retried")
+	}
+	parent.Status = JOB_FAILED
+
+	job, err := e.Retry(parent, true, WithStartAtTask(parent.FailedTask()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Limit != "10.10.10.13" || job.Parent != parent.ID || job.Playbook != "node.yml" || strings.Join(job.Tags, ",") != "node" || !job.Check {
+		t.Errorf("unexpected retry job: %s", job.JSON())
+	}
+	if job.ExtraVars["node_tune"] != "oltp" || job.Opts.StartAtTask != "node : Setup hostname" {
+		t.Errorf("extra vars & start at task should be set: %v %s", job.ExtraVars, job.Opts.StartAtTask)
+	}
+	if !strings.Contains(job.Command, "--start-at-task node : Setup hostname") {
+		t.Errorf("unexpected command: %s", job.Command)
+	}
+
+	if job, _ = e.Retry(parent, false); job.Limit != "pg-test,pg-src" || job.Opts.StartAtTask != "" {
+		t.Errorf("retry all should keep parent limit: %s", job.Limit)
+	}
+
+	// without recap: failed hosts come from failure events, ignored failures excluded
+	parent.Results = nil
+	if hosts := strings.Join(parent.RetryHosts(), ","); hosts != "10.10.10.13,10.10.10.12" {
+		t.Errorf("unexpected retry hosts: %s", hosts)
+	}
+	parent.Events = parent.Events[:2]
+	if _, err = e.Retry(parent, true); err == nil {
+		t.Errorf("job without failed hosts should not be retried with failed only")
+	}
+}
+
+func TestRetryAdHoc(t *testing.T) {
+	e, bin := newSchedulerExecutor(t)
+	defer os.RemoveAll(filepath.Dir(bin))
+	parent := e.NewJob(WithModule(MODULE_SHELL, "uptime"), WithLimit("pg-test"))
+	parent.Status = JOB_FAILED
+	job, err := e.Retry(parent, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !job.IsAdHoc() || job.Module != MODULE_SHELL || job.Args != "uptime" || job.AdHoc == nil || job.Limit != "pg-test" {
+		t.Errorf("ad-hoc job should be retried with same module: %s", job.JSON())
+	}
+	if !strings.Contains(job.Command, "uptime") {
+		t.Errorf("unexpected command: %s", job.Command)
+	}
+}
+
+func TestRetryRolling(t *testing.T) {
+	e, bin := newSchedulerExecutor(t)
+	defer os.RemoveAll(filepath.Dir(bin))
+	parent := e.NewJob(WithPlaybook("pgsql.yml"), WithLimit("pg-test"), WithSerial("1"), WithPause(time.Second),
+		WithHealthCheck("pg_isready"), WithTimeout(time.Hour))
+	parent.Status = JOB_FAILED
+	job, err := e.Retry(parent, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Serial != "1" || job.Pause != time.Second || job.HealthCheck != "pg_isready" || job.Timeout != time.Hour {
+		t.Errorf("rolling & timeout settings should be kept: %s", job.JSON())
+	}
+	if len(job.Batches) != 2 || job.prepErr != nil {
+		t.Errorf("retry job should run in batches: %v %v", job.Batches, job.prepErr)
+	}
+}
@@ -0,0 +1,151 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Vonng/pigsty-cli/conf"
+	"github.com/sirupsen/logrus"
+	"io"
+	"math"
+	osexec "os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**************************************************************\
+*                         Rolling                              *
+\**************************************************************/
+// EVENT_BATCH_START is emitted before each batch of rolling job, Host is comma separated hosts of batch
+const EVENT_BATCH_START = "batch_start"
+
+// WithSerial will run job in batches of N hosts or N% of hosts, replicas first and primaries last
+func WithSerial(serial string) JobOpts {
+	return func(j *Job) {
+		j.Serial = serial
+	}
+}
+
+// WithPause will wait between batches of rolling job
+func WithPause(pause time.Duration) JobOpts {
+	return func(j *Job) {
+		j.Pause = pause
+	}
+}
+
+// WithHealthCheck will run shell command after each batch of rolling job, abort if it fails.
+// hosts of batch are passed via PIGSTY_BATCH_HOSTS (comma separated)
+func WithHealthCheck(command string) JobOpts {
+	return func(j *Job) {
+		j.HealthCheck = command
+	}
+}
+
+// ParseSerial will translate N or N% into batch size of total hosts, at least 1
+func ParseSerial(serial string, total int) (int, error) {
+	s := strings.TrimSpace(serial)
+	percent := strings.HasSuffix(s, "%")
+	n, err := strconv.Atoi(strings.TrimSuffix(s, "%"))
+	if err != nil || n <= 0 || percent && n > 100 {
+		return 0, fmt.Errorf("invalid serial %q, N or N%% expected", serial)
+	}
+	if percent {
+		n = int(math.Ceil(float64(total) * float64(n) / 100))
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n, nil
+}
+
+// Batches will split hosts into batches of serial size: non-primary hosts first, then primaries,
+// a batch never mixes primaries with others, so replicas are done before their primary is touched
+func Batches(cfg *conf.Config, hosts []string, serial string) ([][]string, error) {
+	size, err := ParseSerial(serial, len(hosts))
+	if err != nil {
+		return nil, err
+	}
+	primary := make(map[string]bool)
+	if cfg != nil {
+		for _, cls := range cfg.Clusters {
+			for _, ins := range cls.Instances {
+				if ins.Role == conf.ROLE_PRIMARY {
+					primary[ins.IP] = true
+				}
+			}
+		}
+	}
+	var others, primaries []string
+	for _, ip := range hosts {
+		if primary[ip] {
+			primaries = append(primaries, ip)
+		} else {
+			others = append(others, ip)
+		}
+	}
+	var batches [][]string
+	for _, group := range [][]string{others, primaries} {
+		for i := 0; i < len(group); i += size {
+			end := i + size
+			if end > len(group) {
+				end = len(group)
+			}
+			batches = append(batches, group[i:end])
+		}
+	}
+	return batches, nil
+}
+
+// runRolling will run job batch by batch, with pause & health check between batches. first failed batch
+// aborts the run, hosts in remaining batches are left untouched
+func (j *Job) runRolling(runner Runner, stdout *eventWriter, stderr io.Writer) error {
+	limit := j.Opts.Limit
+	defer j.setLimit(limit)
+	for i, batch := range j.Batches {
+		if i > 0 && j.Pause > 0 {
+			logrus.Infof("pause %s before batch %d/%d", j.Pause, i+1, len(j.Batches))
+			select {
+			case <-j.ctx.Done():
+				return fmt.Errorf("rolling %s interrupted before batch %d/%d: %w", j.Playbook, i+1, len(j.Batches), j.ctx.Err())
+			case <-time.After(j.Pause):
+			}
+		}
+		hosts := strings.Join(batch, ",")
+		j.emit(&Event{Type: EVENT_BATCH_START, Host: hosts, Message: fmt.Sprintf("batch %d/%d", i+1, len(j.Batches))})
+		j.setLimit(hosts)
+		logrus.Infof("batch %d/%d: %s", i+1, len(j.Batches), j.redactedCommand())
+		if err := runner.Run(j.ctx, j, stdout, stderr); err != nil {
+			stdout.flush()
+			return fmt.Errorf("batch %d/%d (%s) aborted rolling: %w", i+1, len(j.Batches), hosts, err)
+		}
+		stdout.flush()
+		if j.HealthCheck != "" {
+			if err := j.healthCheck(batch, stderr); err != nil {
+				return fmt.Errorf("health check after batch %d/%d (%s) aborted rolling: %w", i+1, len(j.Batches), hosts, err)
+			}
+		}
+	}
+	return nil
+}
+
+// healthCheck will run health check command of job with hosts of batch
+func (j *Job) healthCheck(batch []string, stderr io.Writer) error {
+	cmd := osexec.CommandContext(j.ctx, "sh", "-c", j.HealthCheck)
+	cmd.Env = append(j.Environ(), "PIGSTY_BATCH_HOSTS="+strings.Join(batch, ","))
+	if j.Exec != nil {
+		cmd.Dir = j.Exec.WorkDir
+	}
+	cmd.Stdout, cmd.Stderr = stderr, stderr
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if j.ctx.Err() != nil {
+		return fmt.Errorf("%q interrupted: %w", j.HealthCheck, j.ctx.Err())
+	}
+	var exitErr *osexec.ExitError
+	if errors.As(err, &exitErr) { // not reported as exit status, which is exit code of ansible-playbook
+		return fmt.Errorf("%q failed with code %d", j.HealthCheck, exitErr.ExitCode())
+	}
+	return fmt.Errorf("%q failed: %s", j.HealthCheck, err)
+}
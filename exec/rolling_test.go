@@ -0,0 +1,68 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBatches(t *testing.T) {
+	e, _ := newTestExecutor(t, nil)
+	defer os.RemoveAll(e.WorkDir)
+	all, _ := e.Config.ResolveLimit("all")
+	cases := map[string]string{
+		"1":    "[[10.10.10.12] [10.10.10.10] [10.10.10.11] [10.10.10.13]]",
+		"2":    "[[10.10.10.12] [10.10.10.10 10.10.10.11] [10.10.10.13]]",
+		"50%":  "[[10.10.10.12] [10.10.10.10 10.10.10.11] [10.10.10.13]]",
+		"100%": "[[10.10.10.12] [10.10.10.10 10.10.10.11 10.10.10.13]]",
+		"10%":  "[[10.10.10.12] [10.10.10.10] [10.10.10.11] [10.10.10.13]]",
+	}
+	for serial, expected := range cases {
+		batches, err := Batches(e.Config, all.Hosts, serial)
+		if err != nil || fmt.Sprint(batches) != expected {
+			t.Errorf("serial %s: expect %s, got %v %v", serial, expected, batches, err)
+		}
+	}
+	for _, serial := range []string{"0", "-1", "x", "101%", ""} {
+		if _, err := ParseSerial(serial, 4); err == nil {
+			t.Errorf("serial %q should be invalid", serial)
+		}
+	}
+}
+
+func TestRolling(t *testing.T) {
+	e, runner := newTestExecutor(t, map[string]*Script{"pgsql": {Output: sampleOutput}, "bad": {Output: sampleOutput, ExitCode: 2}})
+	defer os.RemoveAll(e.WorkDir)
+	quiet := []JobOpts{WithStdout(ioutil.Discard), WithStderr(ioutil.Discard)}
+
+	job := e.NewJob(append(quiet, WithPlaybook("pgsql.yml"), WithLimit("pg-test"), WithSerial("1"))...)
+	if err := job.Run(context.TODO()); err != nil || job.Status != JOB_SUCCESS {
+		t.Fatalf("rolling job should succeed: %s %v", job.Status, err)
+	}
+	calls := runner.Calls()
+	if len(calls) != 2 || calls[0] != "ansible-playbook  --limit 10.10.10.12 pgsql.yml" || calls[1] != "ansible-playbook  --limit 10.10.10.11 pgsql.yml" {
+		t.Errorf("replica should run before primary: %q", calls)
+	}
+	if job.Opts.Limit != "10.10.10.11,10.10.10.12" || job.Events[0].Type != EVENT_BATCH_START || job.Events[0].Host != "10.10.10.12" {
+		t.Errorf("unexpected rolling job: limit %s, first event %+v", job.Opts.Limit, job.Events[0])
+	}
+
+	// failed batch aborts rolling
+	job = e.NewJob(append(quiet, WithPlaybook("bad.yml"), WithLimit("pg-test"), WithSerial("1"))...)
+	if err := job.Run(context.TODO()); err == nil || job.ExitCode != 2 || len(runner.Calls()) != 3 {
+		t.Errorf("failed batch should abort rolling: %v, exit code %d, %d calls", err, job.ExitCode, len(runner.Calls()))
+	}
+
+	// failed health check aborts rolling
+	job = e.NewJob(append(quiet, WithPlaybook("pgsql.yml"), WithSerial("1"), WithHealthCheck(`test "$PIGSTY_BATCH_HOSTS" != 10.10.10.10`))...)
+	if err := job.Run(context.TODO()); err == nil || job.Status != JOB_FAILED || job.ExitCode != -1 || len(runner.Calls()) != 5 {
+		t.Errorf("failed health check should abort rolling: %v, exit code %d, %d calls", err, job.ExitCode, len(runner.Calls()))
+	}
+
+	job = e.NewJob(append(quiet, WithPlaybook("pgsql.yml"), WithSerial("0"))...)
+	if err := job.Run(context.TODO()); err == nil || len(runner.Calls()) != 5 {
+		t.Errorf("invalid serial should fail without running: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package exec
+
+import (
+	"context"
+	"io"
+)
+
+/**************************************************************\
+*                          Runner                              *
+\**************************************************************/
+// Runner runs a job, writing output in ansible default callback format to stdout,
+// which is parsed into job events. A non-nil error means job is not successful,
+// an "exit status N" in error message is recorded as job's exit code
+type Runner interface {
+	Run(ctx context.Context, job *Job, stdout, stderr io.Writer) error
+}
+
+// AnsibleRunner runs job's ansible-playbook command as child process
+type AnsibleRunner struct {
+	Binary string // ansible-playbook binary, overwritten by job.CMD.Binary if set. ad-hoc jobs run ansible
+}
+
+// DefaultRunner is used by jobs & executors without runner
+var DefaultRunner Runner = &AnsibleRunner{}
+
+// Run implements Runner
+func (r *AnsibleRunner) Run(ctx context.Context, job *Job, stdout, stderr io.Writer) error {
+	if job.AdHoc != nil {
+		job.AdHoc.Exec = &processExecute{job: job, stdout: stdout, stderr: stderr}
+		return job.AdHoc.Run(ctx)
+	}
+	if job.CMD.Binary == "" {
+		job.CMD.Binary = r.Binary
+	}
+	job.CMD.Exec = &processExecute{job: job, stdout: stdout, stderr: stderr}
+	return job.CMD.Run(ctx)
+}
+
+// WithRunner will run job with given runner instead of executor's runner
+func WithRunner(runner Runner) JobOpts {
+	return func(j *Job) {
+		j.Runner = runner
+	}
+}
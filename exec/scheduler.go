@@ -0,0 +1,290 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"github.com/Vonng/pigsty-cli/conf"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+)
+
+/**************************************************************\
+*                        Resources                             *
+\**************************************************************/
+// resource lock keys, jobs sharing any key are serialized
+const (
+	RESOURCE_ALL    = "*"    // job targets all hosts (or unknown targets)
+	RESOURCE_META   = "meta" // job touches meta node
+	resourceCluster = "cluster:"
+	resourceIP      = "ip:"
+)
+
+// Resources will translate limit expression into resource lock keys: cluster:<name>, ip:<ip>, meta, or * if
+// limit is empty, all, or can not be resolved against inventory
+func (e *Executor) Resources(limit string) []string {
+	return resources(e.CurrentConfig(), limit)
+}
+
+// resources will translate limit expression into resource lock keys against given config
+func resources(cfg *conf.Config, limit string) []string {
+	limit = strings.TrimSpace(limit)
+	if limit == "" || limit == "all" || cfg == nil {
+		return []string{RESOURCE_ALL}
+	}
+	hosts, err := cfg.ResolveLimit(limit)
+	if err != nil {
+		return []string{RESOURCE_ALL}
+	}
+	keys := make(map[string]bool)
+	for i := range cfg.Clusters {
+		cls := &cfg.Clusters[i]
+		for _, ins := range cls.Instances {
+			if !hosts.Contains(ins.IP) {
+				continue
+			}
+			keys[resourceCluster+cls.Name] = true
+			keys[resourceIP+ins.IP] = true
+			if cfg.IsMetaNode(ins.IP) {
+				keys[RESOURCE_META] = true
+			}
+		}
+	}
+	res := make([]string, 0, len(keys))
+	for k := range keys {
+		res = append(res, k)
+	}
+	return res
+}
+
+// conflict tells whether two resource sets overlap, empty set is treated as all
+func conflict(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return true
+	}
+	set := make(map[string]bool, len(a))
+	for _, k := range a {
+		if k == RESOURCE_ALL {
+			return true
+		}
+		set[k] = true
+	}
+	for _, k := range b {
+		if k == RESOURCE_ALL || set[k] {
+			return true
+		}
+	}
+	return false
+}
+
+/**************************************************************\
+*                        Scheduler                             *
+\**************************************************************/
+// DefaultConcurrency is default max running jobs of scheduler
+const DefaultConcurrency = 4
+
+// Scheduler run jobs in FIFO order with limited concurrency. jobs with disjoint resources run in
+// parallel, while jobs sharing cluster, ip or meta node are serialized. a queued job never overtake
+// an earlier queued job that it conflicts with
+type Scheduler struct {
+	Concurrency int            // max running jobs, non-positive means unlimited
+	OnDone      func(job *Job) // called after job is finished or cancelled, may be called concurrently (optional)
+	pending     []*Job
+	running     []*Job // in start order
+	cancels     map[string]context.CancelFunc
+	idle        *sync.Cond
+	lock        sync.Mutex
+}
+
+// NewScheduler will create a job scheduler with given concurrency
+func NewScheduler(concurrency int) *Scheduler {
+	s := &Scheduler{
+		Concurrency: concurrency,
+		cancels:     make(map[string]context.CancelFunc),
+	}
+	s.idle = sync.NewCond(&s.lock)
+	return s
+}
+
+// Submit will append job to queue and schedule it as soon as possible
+func (s *Scheduler) Submit(job *Job) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	job.setStatus(JOB_QUEUED)
+	job.persist()
+	s.pending = append(s.pending, job)
+	s.schedule()
+}
+
+// Queue will return queued jobs in order
+func (s *Scheduler) Queue() []*Job {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*Job{}, s.pending...)
+}
+
+// Running will return running jobs, earliest first
+func (s *Scheduler) Running() []*Job {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*Job{}, s.running...)
+}
+
+// Get will return queued or running job by id, nil if not found
+func (s *Scheduler) Get(id string) *Job {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.find(id)
+}
+
+// Move will move queued job to given position (0 is head of queue)
+func (s *Scheduler) Move(id string, pos int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	idx := s.index(id)
+	if idx < 0 {
+		return fmt.Errorf("job %s is not queued", id)
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	if pos >= len(s.pending) {
+		pos = len(s.pending) - 1
+	}
+	job := s.pending[idx]
+	s.pending = append(s.pending[:idx], s.pending[idx+1:]...)
+	s.pending = append(s.pending[:pos], append([]*Job{job}, s.pending[pos:]...)...)
+	s.schedule()
+	return nil
+}
+
+// Cancel will remove queued job from queue, or cancel running job
+func (s *Scheduler) Cancel(id string) (*Job, error) {
+	s.lock.Lock()
+	if cancel, exists := s.cancels[id]; exists {
+		job := s.find(id)
+		cancel()
+		s.lock.Unlock()
+		return job, nil
+	}
+	idx := s.index(id)
+	if idx < 0 {
+		s.lock.Unlock()
+		return nil, fmt.Errorf("job %s is not queued or running", id)
+	}
+	job := s.pending[idx]
+	s.pending = append(s.pending[:idx], s.pending[idx+1:]...)
+	job.setDone(JOB_CANCELLED, job.ExitCode)
+	job.persist()
+	job.closeEvents()
+	s.schedule()
+	s.idle.Broadcast()
+	s.lock.Unlock()
+
+	if s.OnDone != nil {
+		s.OnDone(job)
+	}
+	return job, nil
+}
+
+// CancelAll will clear queue and cancel all running jobs
+func (s *Scheduler) CancelAll() {
+	for _, job := range s.Queue() {
+		_, _ = s.Cancel(job.ID)
+	}
+	for _, job := range s.Running() {
+		_, _ = s.Cancel(job.ID)
+	}
+}
+
+// Busy tells whether there are queued or running jobs
+func (s *Scheduler) Busy() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.pending)+len(s.running) > 0
+}
+
+// Wait will block until all queued and running jobs are done
+func (s *Scheduler) Wait() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.pending)+len(s.running) > 0 {
+		s.idle.Wait()
+	}
+}
+
+// find will return queued or running job by id, must be called with lock held
+func (s *Scheduler) find(id string) *Job {
+	for _, jobs := range [][]*Job{s.running, s.pending} {
+		for _, job := range jobs {
+			if job.ID == id {
+				return job
+			}
+		}
+	}
+	return nil
+}
+
+// index will return position of job in queue, -1 if not found
+func (s *Scheduler) index(id string) int {
+	for i, job := range s.pending {
+		if job.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// schedule will start runnable jobs, must be called with lock held
+func (s *Scheduler) schedule() {
+	var blocked [][]string // resources of earlier queued jobs that can not start yet
+	remain := s.pending[:0]
+	for _, job := range s.pending {
+		runnable := s.Concurrency <= 0 || len(s.running) < s.Concurrency
+		for _, r := range s.running {
+			runnable = runnable && !conflict(job.Resources, r.Resources)
+		}
+		for _, res := range blocked {
+			runnable = runnable && !conflict(job.Resources, res)
+		}
+		if !runnable {
+			blocked = append(blocked, job.Resources)
+			remain = append(remain, job)
+			continue
+		}
+		s.start(job)
+	}
+	for i := len(remain); i < len(s.pending); i++ {
+		s.pending[i] = nil
+	}
+	s.pending = remain
+}
+
+// start will run job on background, must be called with lock held
+func (s *Scheduler) start(job *Job) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.running = append(s.running, job)
+	s.cancels[job.ID] = cancel
+	job.setStatus(JOB_RUNNING)
+	logrus.Infof("job %s started: %s", job.ID, job.Name)
+	go func() {
+		if err := job.Run(ctx); err != nil {
+			logrus.Errorf("job %s failed: %s", job.ID, err)
+		}
+		cancel()
+		if s.OnDone != nil {
+			s.OnDone(job)
+		}
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for i := range s.running {
+			if s.running[i] == job {
+				s.running = append(s.running[:i], s.running[i+1:]...)
+				break
+			}
+		}
+		delete(s.cancels, job.ID)
+		s.schedule()
+		s.idle.Broadcast()
+	}()
+}
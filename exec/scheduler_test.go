@@ -0,0 +1,133 @@
+package exec
+
+import (
+	"github.com/Vonng/pigsty-cli/conf"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const schedulerConfig = `all:
+  children:
+    meta: {hosts: {10.10.10.10: {}}}
+    pg-meta:
+      hosts: {10.10.10.10: {pg_seq: 1, pg_role: primary}}
+      vars: {pg_cluster: pg-meta}
+    pg-test:
+      hosts:
+        10.10.10.11: {pg_seq: 1, pg_role: primary}
+        10.10.10.12: {pg_seq: 2, pg_role: replica}
+      vars: {pg_cluster: pg-test}
+    pg-src:
+      hosts: {10.10.10.13: {pg_seq: 1, pg_role: primary}}
+      vars: {pg_cluster: pg-src}
+`
+
+// newSchedulerExecutor will create executor whose jobs run a sleeping stand-in of ansible-playbook
+func newSchedulerExecutor(t *testing.T) (*Executor, string) {
+	cfg, err := conf.ParseConfig([]byte(schedulerConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "pigsty-scheduler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "ansible-playbook")
+	if err = ioutil.WriteFile(bin, []byte("#!/bin/sh\nsleep 0.3\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &Executor{WorkDir: dir, Config: cfg, Jobs: make(map[string]*Job)}, bin
+}
+
+func TestResources(t *testing.T) {
+	e, dir := newSchedulerExecutor(t)
+	defer os.RemoveAll(filepath.Dir(dir))
+	cases := map[string]string{
+		"":                         "*",
+		"all":                      "*",
+		"pg-test":                  "cluster:pg-test ip:10.10.10.11 ip:10.10.10.12",
+		"10.10.10.12":              "cluster:pg-test ip:10.10.10.12",
+		"pg-meta":                  "cluster:meta cluster:pg-meta ip:10.10.10.10 meta",
+		"meta":                     "cluster:meta cluster:pg-meta ip:10.10.10.10 meta", // meta node is also in pg-meta
+		"pg-src,!10.10.10.11":      "cluster:pg-src ip:10.10.10.13",
+		"pg-test,!pg-test:primary": "cluster:pg-test ip:10.10.10.12",
+		"pg-src,unknown-cluster":   "*",
+	}
+	for limit, expected := range cases {
+		res := e.Resources(limit)
+		sort.Strings(res)
+		if strings.Join(res, " ") != expected {
+			t.Errorf("%q: expect %s, got %v", limit, expected, res)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	e, bin := newSchedulerExecutor(t)
+	defer os.RemoveAll(filepath.Dir(bin))
+	newJob := func(limit string) *Job {
+		job := e.NewJob(WithPlaybook("pgsql.yml"), WithLimit(limit), WithStdout(ioutil.Discard))
+		job.CMD.Binary = bin
+		return job
+	}
+
+	var done []string
+	var lock sync.Mutex
+	s := NewScheduler(2)
+	s.OnDone = func(job *Job) {
+		lock.Lock()
+		defer lock.Unlock()
+		done = append(done, job.ID)
+	}
+	a, b, c := newJob("pg-test"), newJob("10.10.10.12"), newJob("pg-src")
+	d, x := newJob("pg-test"), newJob("pg-meta")
+	for _, job := range []*Job{a, b, c, d, x} {
+		s.Submit(job)
+	}
+
+	// a & c are disjoint, b conflicts with a, concurrency limit holds x
+	if running := s.Running(); len(running) != 2 || running[0] != a || running[1] != c || s.Get(a.ID) != a {
+		t.Fatalf("a and c should be running: %v", running)
+	}
+	if queue := s.Queue(); len(queue) != 3 || queue[0] != b || queue[1] != d || queue[2] != x {
+		t.Fatalf("unexpected queue: %v", queue)
+	}
+
+	// reorder & cancel queued jobs
+	if err := s.Move(d.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if queue := s.Queue(); queue[0] != d || queue[1] != b {
+		t.Errorf("d should be moved to head of queue: %v", queue)
+	}
+	if job, err := s.Cancel(b.ID); err != nil || job != b || b.Status != JOB_CANCELLED {
+		t.Errorf("fail to cancel queued job b: %v", err)
+	}
+	if _, err := s.Cancel("not-exists"); err == nil {
+		t.Errorf("cancel unknown job should fail")
+	}
+	if err := s.Move(a.ID, 0); err == nil {
+		t.Errorf("running job can not be moved")
+	}
+
+	s.Wait()
+	if s.Busy() {
+		t.Errorf("scheduler should be idle")
+	}
+	for _, job := range []*Job{a, c, d, x} {
+		if job.Status != JOB_SUCCESS {
+			t.Errorf("job %s (%s) should success, got %s", job.ID, job.Limit, job.Status)
+		}
+	}
+	if d.StartAt.Before(a.DoneAt) {
+		t.Errorf("d should start after a is done")
+	}
+	if len(done) != 5 {
+		t.Errorf("expect 5 done callbacks, got %d", len(done))
+	}
+}
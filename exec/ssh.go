@@ -0,0 +1,479 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Vonng/pigsty-cli/conf"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**************************************************************\
+*                        SSH Runner                            *
+\**************************************************************/
+// host key policies of ssh runner
+const (
+	HOSTKEY_STRICT     = "strict"     // host key must be in known_hosts
+	HOSTKEY_ACCEPT_NEW = "accept-new" // unknown host key is added to known_hosts, changed key is rejected
+	HOSTKEY_INSECURE   = "insecure"   // host key is not checked (ansible host_key_checking = False)
+)
+
+// ad-hoc exit status, same as ansible: bitwise or of failed & unreachable
+const (
+	exitFailedHosts      = 2
+	exitUnreachableHosts = 4
+)
+
+// SSHRunner runs ad-hoc jobs (ping, command, shell, raw, fetch) over native ssh connections, which is much
+// faster than spawning ansible for quick operations. Connection settings are read from effective host vars:
+// ansible_host, ansible_port, ansible_user, ansible_ssh_private_key_file, ansible_password and ProxyJump in
+// ansible_ssh_common_args. Output is written in ansible one-line format. Playbook jobs are run by Fallback
+type SSHRunner struct {
+	Concurrency   int           // max hosts run concurrently, 16 by default
+	Timeout       time.Duration // per-host timeout of connecting & running, 30s by default
+	User          string        // default user if ansible_user is not set, current user by default
+	Port          int           // default port if ansible_port is not set, 22 by default
+	KeyFiles      []string      // default private keys, ~/.ssh/id_rsa, id_ecdsa, id_ed25519 by default
+	KnownHosts    string        // known_hosts file, ~/.ssh/known_hosts by default
+	HostKeyPolicy string        // strict | accept-new | insecure, accept-new by default
+	JumpHost      string        // [user@]host[:port] jump host, overwritten by ProxyJump of host vars
+	Fallback      Runner        // runs playbook jobs, DefaultRunner if nil
+	knownLock     sync.Mutex    // protect known_hosts file
+	writeLock     sync.Mutex    // protect stdout
+}
+
+// NewSSHRunner will create ssh runner with defaults
+func NewSSHRunner() *SSHRunner {
+	return &SSHRunner{}
+}
+
+// Run implements Runner, hosts are job's (batch) limit, or all hosts if limit is empty
+func (r *SSHRunner) Run(ctx context.Context, job *Job, stdout, stderr io.Writer) error {
+	if !job.IsAdHoc() {
+		fallback := r.Fallback
+		if fallback == nil {
+			fallback = DefaultRunner
+		}
+		return fallback.Run(ctx, job, stdout, stderr)
+	}
+	switch job.Module {
+	case MODULE_PING, MODULE_COMMAND, MODULE_SHELL, MODULE_RAW, MODULE_FETCH:
+	default:
+		return fmt.Errorf("module %s is not supported by ssh runner", job.Module)
+	}
+	if job.Config == nil {
+		return fmt.Errorf("ssh runner requires inventory")
+	}
+	cfg := job.Config
+	var hosts []string
+	if job.Opts.Limit != "" {
+		hosts = strings.Split(job.Opts.Limit, ",")
+	} else if all, err := cfg.ResolveLimit("all"); err == nil {
+		hosts = all.Hosts
+	}
+	concurrency := r.Concurrency
+	if concurrency <= 0 {
+		concurrency = 16
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	code := 0
+	for _, host := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(host string) {
+			defer func() { <-sem; wg.Done() }()
+			status := r.runHost(ctx, job, cfg, host, stdout)
+			lock.Lock()
+			code |= status
+			lock.Unlock()
+		}(host)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return fmt.Errorf("ssh %s interrupted: %w", job.Module, ctx.Err())
+	}
+	if code != 0 {
+		return fmt.Errorf("ssh %s failed: exit status %d", job.Module, code)
+	}
+	return nil
+}
+
+// runHost will run job module on host, writing one-line result, return exit status bits of host
+func (r *SSHRunner) runHost(ctx context.Context, job *Job, cfg *conf.Config, host string, stdout io.Writer) int {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	client, err := r.dial(ctx, cfg, host)
+	if err != nil {
+		r.writeLine(stdout, fmt.Sprintf("%s | UNREACHABLE!: %s", host, oneLine(err.Error())))
+		return exitUnreachableHosts
+	}
+	defer client.Close()
+	go func() { // interrupt running command when timeout or cancelled
+		<-ctx.Done()
+		client.Close()
+	}()
+
+	command := job.Args
+	switch job.Module {
+	case MODULE_PING:
+		command = "echo pong"
+	case MODULE_FETCH:
+		return r.fetch(ctx, client, job, host, stdout)
+	}
+	out, errOut, rc, err := runSession(client, command)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%s: %w", err, ctx.Err())
+		}
+		r.writeLine(stdout, fmt.Sprintf("%s | UNREACHABLE!: %s", host, oneLine(err.Error())))
+		return exitUnreachableHosts
+	}
+	if job.Module == MODULE_PING {
+		if rc != 0 {
+			r.writeLine(stdout, fmt.Sprintf("%s | FAILED! => %s", host, jsonLine(map[string]interface{}{"changed": false, "msg": strings.TrimSpace(errOut)})))
+			return exitFailedHosts
+		}
+		r.writeLine(stdout, fmt.Sprintf("%s | SUCCESS => %s", host, jsonLine(map[string]interface{}{"changed": false, "ping": "pong"})))
+		return 0
+	}
+	caption, status := "CHANGED", 0
+	if rc != 0 {
+		caption, status = "FAILED", exitFailedHosts
+	}
+	line := fmt.Sprintf("%s | %s | rc=%d | (stdout) %s", host, caption, rc, escapeLine(strings.TrimRight(out, "\n")))
+	if errOut != "" {
+		line += " (stderr) " + escapeLine(strings.TrimRight(errOut, "\n"))
+	}
+	r.writeLine(stdout, line)
+	return status
+}
+
+// fetch will copy remote file src to dest/<host>/<src> as ansible fetch module does
+func (r *SSHRunner) fetch(ctx context.Context, client *ssh.Client, job *Job, host string, stdout io.Writer) int {
+	args := parseModuleArgs(job.Args)
+	src, dest := args["src"], args["dest"]
+	fail := func(msg string) int {
+		r.writeLine(stdout, fmt.Sprintf("%s | FAILED! => %s", host, jsonLine(map[string]interface{}{"changed": false, "msg": msg})))
+		return exitFailedHosts
+	}
+	if src == "" || dest == "" {
+		return fail("src and dest are required")
+	}
+	out, errOut, rc, err := runSession(client, "cat "+shellQuote(src))
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%s: %w", err, ctx.Err())
+		}
+		r.writeLine(stdout, fmt.Sprintf("%s | UNREACHABLE!: %s", host, oneLine(err.Error())))
+		return exitUnreachableHosts
+	}
+	if rc != 0 {
+		return fail(strings.TrimSpace(errOut))
+	}
+	path := filepath.Join(dest, host, src)
+	if args["flat"] == "yes" || args["flat"] == "true" {
+		path = dest
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+		err = ioutil.WriteFile(path, []byte(out), 0644)
+	}
+	if err != nil {
+		return fail(err.Error())
+	}
+	r.writeLine(stdout, fmt.Sprintf("%s | CHANGED => %s", host, jsonLine(map[string]interface{}{"changed": true, "src": src, "dest": path})))
+	return 0
+}
+
+// runSession will run command in new session, return stdout, stderr and exit code
+func runSession(client *ssh.Client, command string) (string, string, int, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", "", -1, err
+	}
+	defer session.Close()
+	var out, errOut bytes.Buffer
+	session.Stdout, session.Stderr = &out, &errOut
+	err = session.Run(command)
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return out.String(), errOut.String(), exitErr.ExitStatus(), nil
+	}
+	if err != nil {
+		return out.String(), errOut.String(), -1, err
+	}
+	return out.String(), errOut.String(), 0, nil
+}
+
+// writeLine will write a line of output, lines of concurrent hosts are not interleaved
+func (r *SSHRunner) writeLine(w io.Writer, line string) {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	_, _ = io.WriteString(w, line+"\n")
+}
+
+/**************************************************************\
+*                       SSH Connection                         *
+\**************************************************************/
+// sshTarget is connection settings of a host
+type sshTarget struct {
+	addr     string // host:port
+	user     string
+	keyFiles []string
+	password string
+	jump     string // [user@]host[:port]
+}
+
+// proxyJumpRegex extract jump host from ssh args: -J host or -o ProxyJump=host
+var proxyJumpRegex = regexp.MustCompile(`(?:-J\s*|ProxyJump[= ])([^\s'"]+)`)
+
+// target will build connection settings of host from effective host vars
+func (r *SSHRunner) target(cfg *conf.Config, host string) sshTarget {
+	t := sshTarget{user: r.User, keyFiles: r.KeyFiles, jump: r.JumpHost}
+	if t.user == "" {
+		if u, err := user.Current(); err == nil {
+			t.user = u.Username
+		}
+	}
+	if len(t.keyFiles) == 0 {
+		if home, err := os.UserHomeDir(); err == nil {
+			for _, name := range []string{"id_rsa", "id_ecdsa", "id_ed25519"} {
+				t.keyFiles = append(t.keyFiles, filepath.Join(home, ".ssh", name))
+			}
+		}
+	}
+	port, addr := r.Port, host
+	if port <= 0 {
+		port = 22
+	}
+	if vars := cfg.HostVars(host); vars != nil {
+		str := func(keys ...string) string {
+			for _, k := range keys {
+				if v, exists := vars.Data[k]; exists && v != nil {
+					return fmt.Sprint(v)
+				}
+			}
+			return ""
+		}
+		if v := str("ansible_host", "ansible_ssh_host"); v != "" {
+			addr = v
+		}
+		if v, err := strconv.Atoi(str("ansible_port", "ansible_ssh_port")); err == nil {
+			port = v
+		}
+		if v := str("ansible_user", "ansible_ssh_user"); v != "" {
+			t.user = v
+		}
+		if v := str("ansible_ssh_private_key_file", "ansible_private_key_file"); v != "" {
+			t.keyFiles = []string{expandHome(v)}
+		}
+		t.password = str("ansible_password", "ansible_ssh_pass")
+		if m := proxyJumpRegex.FindStringSubmatch(str("ansible_ssh_common_args", "ansible_ssh_extra_args")); m != nil {
+			t.jump = m[1]
+		}
+	}
+	t.addr = net.JoinHostPort(addr, strconv.Itoa(port))
+	return t
+}
+
+// dial will connect to host, via jump host if set
+func (r *SSHRunner) dial(ctx context.Context, cfg *conf.Config, host string) (*ssh.Client, error) {
+	t := r.target(cfg, host)
+	config, err := r.clientConfig(t)
+	if err != nil {
+		return nil, err
+	}
+	if t.jump == "" {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", t.addr)
+		if err != nil {
+			return nil, err
+		}
+		return r.handshake(ctx, conn, t.addr, config)
+	}
+
+	// jump host use same credential unless user is specified
+	jt := t
+	jt.addr, jt.jump = t.jump, ""
+	if i := strings.Index(jt.addr, "@"); i >= 0 {
+		jt.user, jt.addr = jt.addr[:i], jt.addr[i+1:]
+	}
+	if _, _, err := net.SplitHostPort(jt.addr); err != nil {
+		jt.addr = net.JoinHostPort(jt.addr, "22")
+	}
+	jumpConfig, err := r.clientConfig(jt)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", jt.addr)
+	if err != nil {
+		return nil, fmt.Errorf("jump host %s: %w", jt.addr, err)
+	}
+	jump, err := r.handshake(ctx, conn, jt.addr, jumpConfig)
+	if err != nil {
+		return nil, fmt.Errorf("jump host %s: %w", jt.addr, err)
+	}
+	conn, err = jump.Dial("tcp", t.addr)
+	if err != nil {
+		jump.Close()
+		return nil, fmt.Errorf("jump via %s: %w", jt.addr, err)
+	}
+	client, err := r.handshake(ctx, conn, t.addr, config)
+	if err != nil {
+		jump.Close()
+		return nil, err
+	}
+	go func() { // close jump connection with target connection
+		client.Wait()
+		jump.Close()
+	}()
+	return client, nil
+}
+
+// handshake will establish ssh client over conn, aborted if ctx is done
+func (r *SSHRunner) handshake(ctx context.Context, conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// clientConfig will build ssh client config of target: key & password auth, host key policy
+func (r *SSHRunner) clientConfig(t sshTarget) (*ssh.ClientConfig, error) {
+	var signers []ssh.Signer
+	for _, path := range t.keyFiles {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	var auth []ssh.AuthMethod
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if t.password != "" {
+		auth = append(auth, ssh.Password(t.password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no private key or password available for %s@%s", t.user, t.addr)
+	}
+	callback, err := r.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.ClientConfig{User: t.user, Auth: auth, HostKeyCallback: callback}, nil
+}
+
+// hostKeyCallback will check host key according to host key policy
+func (r *SSHRunner) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if r.HostKeyPolicy == HOSTKEY_INSECURE {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	path := r.KnownHosts
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	strict := r.HostKeyPolicy == HOSTKEY_STRICT
+	if _, err := os.Stat(path); os.IsNotExist(err) && !strict {
+		_ = os.MkdirAll(filepath.Dir(path), 0700)
+		_ = ioutil.WriteFile(path, nil, 0600)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		r.knownLock.Lock()
+		defer r.knownLock.Unlock()
+		check, err := knownhosts.New(path)
+		if err != nil {
+			return err
+		}
+		err = check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if strict || !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return err // known, or key changed, or strict mode
+		}
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+		return err
+	}, nil
+}
+
+/**************************************************************\
+*                          Helpers                             *
+\**************************************************************/
+// escapeLine will escape newlines as ansible one-line callback does
+func escapeLine(s string) string {
+	return strings.NewReplacer("\n", `\n`, "\r", `\r`).Replace(s)
+}
+
+// oneLine will squash message into single line
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// jsonLine will marshal module result into single line json
+func jsonLine(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// shellQuote will quote s as single shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// expandHome will expand leading ~ of path
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[2:])
+		}
+	}
+	return path
+}
+
+// parseModuleArgs will parse k=v module args
+func parseModuleArgs(args string) map[string]string {
+	res := make(map[string]string)
+	for _, kv := range strings.Fields(args) {
+		if i := strings.Index(kv, "="); i > 0 {
+			res[kv[:i]] = kv[i+1:]
+		}
+	}
+	return res
+}
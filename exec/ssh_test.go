@@ -0,0 +1,271 @@
+package exec
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// sshd is an in-process stand-in of sshd: runs exec requests with sh -c and forwards direct-tcpip
+type sshd struct {
+	addr  string
+	jumps int32 // number of direct-tcpip channels
+}
+
+// newSSHD will start sshd stand-in accepting given client key, return server & its host key
+func newSSHD(t *testing.T, client ssh.PublicKey) (*sshd, ssh.PublicKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, _ := ssh.NewSignerFromKey(key)
+	config := &ssh.ServerConfig{PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if string(key.Marshal()) != string(client.Marshal()) {
+			return nil, fmt.Errorf("unknown key")
+		}
+		return nil, nil
+	}}
+	config.AddHostKey(hostKey)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sshd{addr: l.Addr().String()}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s, hostKey.PublicKey()
+}
+
+func (s *sshd) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			ch, reqs, err := nc.Accept()
+			if err == nil {
+				go s.session(ch, reqs)
+			}
+		case "direct-tcpip":
+			var target struct {
+				Host     string
+				Port     uint32
+				OrigHost string
+				OrigPort uint32
+			}
+			_ = ssh.Unmarshal(nc.ExtraData(), &target)
+			remote, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+			if err != nil {
+				nc.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				remote.Close()
+				continue
+			}
+			atomic.AddInt32(&s.jumps, 1)
+			go ssh.DiscardRequests(reqs)
+			go func() { io.Copy(ch, remote); ch.Close() }()
+			go func() { io.Copy(remote, ch); remote.Close() }()
+		default:
+			nc.Reject(ssh.UnknownChannelType, "unsupported")
+		}
+	}
+}
+
+func (s *sshd) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		_ = ssh.Unmarshal(req.Payload, &payload)
+		req.Reply(true, nil)
+		cmd := osexec.Command("sh", "-c", payload.Command)
+		cmd.Stdout, cmd.Stderr = ch, ch.Stderr()
+		status := uint32(0)
+		if err := cmd.Run(); err != nil {
+			status = 255
+			if exitErr, ok := err.(*osexec.ExitError); ok {
+				status = uint32(exitErr.ExitCode())
+			}
+		}
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
+
+// newSSHExecutor will create executor whose hosts are served by sshd stand-in:
+// 10.10.10.10-11 directly, 10.10.10.12 on a closed port, 10.10.10.13 via jump host
+func newSSHExecutor(t *testing.T) (*Executor, *SSHRunner, *sshd, ssh.PublicKey) {
+	dir, err := ioutil.TempDir("", "pigsty-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalECPrivateKey(key)
+	keyFile := filepath.Join(dir, "id_ecdsa")
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, _ := ssh.NewSignerFromKey(key)
+	server, hostKey := newSSHD(t, signer.PublicKey())
+	_, port, _ := net.SplitHostPort(server.addr)
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	_, closed, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	inventory := fmt.Sprintf(`all:
+  children:
+    meta: {hosts: {10.10.10.10: {}}}
+    pg-test:
+      hosts:
+        10.10.10.10: {pg_seq: 1, pg_role: primary}
+        10.10.10.11: {pg_seq: 2, pg_role: replica}
+        10.10.10.12: {pg_seq: 3, pg_role: replica, ansible_port: %s}
+        10.10.10.13: {pg_seq: 4, pg_role: replica, ansible_ssh_common_args: '-o ProxyJump=jump@127.0.0.1:%s'}
+      vars: {pg_cluster: pg-test, ansible_host: 127.0.0.1, ansible_port: %s, ansible_user: test}
+`, closed, port, port)
+	if err = ioutil.WriteFile(filepath.Join(dir, "pigsty.yml"), []byte(inventory), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := NewExecutor(dir)
+	runner := &SSHRunner{Concurrency: 2, KeyFiles: []string{keyFile}, KnownHosts: filepath.Join(dir, "known_hosts")}
+	e.Runner = runner
+	return e, runner, server, hostKey
+}
+
+func TestSSHRunner(t *testing.T) {
+	e, runner, server, _ := newSSHExecutor(t)
+
+	// ping: unknown host key is accepted & recorded
+	job := e.NewJob(WithModule(MODULE_PING, ""), WithLimit("10.10.10.10,10.10.10.11"), WithStdout(ioutil.Discard))
+	if err := job.Run(context.TODO()); err != nil || job.Status != JOB_SUCCESS {
+		t.Fatalf("ping should success: %v", err)
+	}
+	if outputs := job.Outputs(); len(outputs) != 2 || outputs[0].Status != HOST_OK || outputs[1].Status != HOST_OK {
+		t.Errorf("unexpected ping outputs: %+v", outputs)
+	}
+	if b, _ := ioutil.ReadFile(runner.KnownHosts); strings.Count(string(b), "\n") != 1 {
+		t.Errorf("host key should be recorded once: %q", b)
+	}
+
+	// shell on all hosts: 10.10.10.12 unreachable, 10.10.10.13 via jump host
+	job = e.NewJob(WithModule(MODULE_SHELL, "echo hello"), WithLimit("all"), WithStdout(ioutil.Discard))
+	if err := job.Run(context.TODO()); err == nil || job.ExitCode != 4 {
+		t.Errorf("unreachable host should fail job with 4: %v", err)
+	}
+	outputs := job.Outputs()
+	if len(outputs) != 4 || outputs[2].Host != "10.10.10.12" || outputs[2].Status != HOST_UNREACHABLE {
+		t.Fatalf("unexpected shell outputs: %+v", outputs)
+	}
+	for _, i := range []int{0, 1, 3} {
+		if out := outputs[i]; out.Status != HOST_CHANGED || out.RC != 0 || out.Output != "hello" {
+			t.Errorf("unexpected output: %+v", out)
+		}
+	}
+	if n := atomic.LoadInt32(&server.jumps); n != 1 {
+		t.Errorf("10.10.10.13 should be connected via jump host, got %d forwards", n)
+	}
+
+	// failed command: rc, stdout & stderr
+	job = e.NewJob(WithModule(MODULE_SHELL, "echo out; echo err >&2; exit 3"), WithLimit("10.10.10.10"), WithStdout(ioutil.Discard))
+	if err := job.Run(context.TODO()); err == nil || job.ExitCode != 2 {
+		t.Errorf("failed command should fail job with 2: %v", err)
+	}
+	if out := job.Outputs(); len(out) != 1 || out[0].Status != HOST_FAILED || out[0].RC != 3 || out[0].Output != "out\nerr" {
+		t.Errorf("unexpected failed output: %+v", out)
+	}
+
+	// fetch: remote file is saved as dest/<host>/<src>
+	src := filepath.Join(e.WorkDir, "remote.txt")
+	_ = ioutil.WriteFile(src, []byte("patroni\n"), 0644)
+	dest := filepath.Join(e.WorkDir, "fetched")
+	job = e.NewJob(WithModule(MODULE_FETCH, "src="+src+" dest="+dest), WithLimit("10.10.10.11"), WithStdout(ioutil.Discard))
+	if err := job.Run(context.TODO()); err != nil {
+		t.Fatalf("fetch should success: %v", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dest, "10.10.10.11", src)); err != nil || string(b) != "patroni\n" {
+		t.Errorf("unexpected fetched file: %q %v", b, err)
+	}
+
+	// playbook jobs are run by fallback runner
+	fake := NewFakeRunner(map[string]*Script{"*": {}})
+	runner.Fallback = fake
+	if err := e.NewJob(WithPlaybook("pgsql.yml"), WithStdout(ioutil.Discard)).Run(context.TODO()); err != nil || len(fake.Calls()) != 1 {
+		t.Errorf("playbook should be run by fallback: %v %v", err, fake.Calls())
+	}
+}
+
+func TestSSHRunnerHostKey(t *testing.T) {
+	e, runner, server, hostKey := newSSHExecutor(t)
+
+	// strict: unknown host is rejected
+	runner.HostKeyPolicy = HOSTKEY_STRICT
+	_ = ioutil.WriteFile(runner.KnownHosts, nil, 0600)
+	job := e.NewJob(WithModule(MODULE_PING, ""), WithLimit("10.10.10.10"), WithStdout(ioutil.Discard))
+	if err := job.Run(context.TODO()); err == nil || job.ExitCode != 4 {
+		t.Errorf("unknown host should be unreachable in strict mode: %v", err)
+	}
+
+	// strict: known host is accepted
+	_, port, _ := net.SplitHostPort(server.addr)
+	line := fmt.Sprintf("[127.0.0.1]:%s %s", port, ssh.MarshalAuthorizedKey(hostKey))
+	_ = ioutil.WriteFile(runner.KnownHosts, []byte(line), 0600)
+	job = e.NewJob(WithModule(MODULE_PING, ""), WithLimit("10.10.10.10"), WithStdout(ioutil.Discard))
+	if err := job.Run(context.TODO()); err != nil {
+		t.Errorf("known host should be accepted: %v", err)
+	}
+
+	// accept-new: changed host key is rejected
+	runner.HostKeyPolicy = HOSTKEY_ACCEPT_NEW
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ssh.NewPublicKey(&other.PublicKey)
+	line = fmt.Sprintf("[127.0.0.1]:%s %s", port, ssh.MarshalAuthorizedKey(otherKey))
+	_ = ioutil.WriteFile(runner.KnownHosts, []byte(line), 0600)
+	job = e.NewJob(WithModule(MODULE_PING, ""), WithLimit("10.10.10.10"), WithStdout(ioutil.Discard))
+	if err := job.Run(context.TODO()); err == nil || !strings.Contains(job.Outputs()[0].Output, "key mismatch") {
+		t.Errorf("changed host key should be rejected: %v %+v", err, job.Outputs())
+	}
+
+	// insecure: host key is not checked
+	runner.HostKeyPolicy = HOSTKEY_INSECURE
+	job = e.NewJob(WithModule(MODULE_PING, ""), WithLimit("10.10.10.10"), WithStdout(ioutil.Discard))
+	if err := job.Run(context.TODO()); err != nil {
+		t.Errorf("insecure mode should ignore host key: %v", err)
+	}
+}
@@ -0,0 +1,632 @@
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/**************************************************************\
+*                         JobStore                             *
+\**************************************************************/
+// JobStore persist job state transitions and events
+type JobStore interface {
+	Save(job *Job) error                   // persist job state (events are persisted separately)
+	AppendEvent(id string, ev Event) error // persist a job event
+	Get(id string) (*Job, error)           // get job with events by id
+	Query(q JobQuery) ([]*Job, error)      // query jobs (without events), latest first
+	Recover() ([]*Job, error)              // mark orphaned unfinished jobs as interrupted
+	Close() error
+}
+
+// JobQuery filter jobs, zero value fields are ignored
+type JobQuery struct {
+	Status   string    `form:"status"`   // job status
+	Cluster  string    `form:"cluster"`  // jobs touch this cluster (jobs touch all hosts included)
+	Playbook string    `form:"playbook"` // playbook name, with or without .yml suffix
+	Since    time.Time `form:"since"`    // jobs start at or after this
+	Until    time.Time `form:"until"`    // jobs start before this
+	Limit    int       `form:"limit"`    // max number of jobs returned
+}
+
+// Match tells whether job satisfy query
+func (q *JobQuery) Match(job *Job) bool {
+	if q.Status != "" && job.Status != q.Status {
+		return false
+	}
+	if q.Playbook != "" && job.Playbook != q.Playbook && job.Playbook != q.Playbook+".yml" {
+		return false
+	}
+	if !q.Since.IsZero() && job.StartAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !job.StartAt.Before(q.Until) {
+		return false
+	}
+	if q.Cluster != "" && !conflict(job.Resources, []string{resourceCluster + q.Cluster}) {
+		return false
+	}
+	return true
+}
+
+// Finished tells whether job will not change any more
+func (j *Job) Finished() bool {
+	switch j.Status {
+	case JOB_SUCCESS, JOB_FAILED, JOB_CANCELLED, JOB_TIMEOUT, JOB_INTERRUPTED:
+		return true
+	default:
+		return false
+	}
+}
+
+// persist will save job state to store if any
+func (j *Job) persist() {
+	if j.Store == nil {
+		return
+	}
+	if err := j.Store.Save(j); err != nil {
+		logrus.Errorf("fail to persist job %s: %s", j.ID, err)
+	}
+}
+
+// stateJSON will marshal job without events, which is safe while job is running (see MarshalJSON)
+func (j *Job) stateJSON() ([]byte, error) {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]json.RawMessage
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	delete(m, "events")
+	return json.Marshal(m)
+}
+
+/**************************************************************\
+*                       FileJobStore                           *
+\**************************************************************/
+// JobRetention decide which finished jobs are kept by compaction, zero value disable a policy.
+// a finished job is dropped if it violates any enabled policy, unfinished jobs are always kept
+type JobRetention struct {
+	MaxJobs int           `json:"max_jobs"` // keep latest n finished jobs
+	MaxAge  time.Duration `json:"max_age"`  // keep jobs finished within this duration
+}
+
+// DefaultJobRetention keeps latest 1000 finished jobs
+var DefaultJobRetention = JobRetention{MaxJobs: 1000}
+
+// compactMinSize is the min store file size which triggers compaction of owned store
+var compactMinSize int64 = 16 * 1024 * 1024
+
+// storeRecord is a line of job store file
+type storeRecord struct {
+	Type  string          `json:"t"`               // job|event
+	ID    string          `json:"id"`              // job id
+	Job   json.RawMessage `json:"job,omitempty"`   // job state (job record)
+	Event *Event          `json:"event,omitempty"` // job event (event record)
+}
+
+// FileJobStore is a single file job store: an append-only log of job states and events,
+// replayed into memory and compacted with retention when opened, or grown twice as large by owner.
+// the file is shared by pigsty server & cli processes, appending and compaction are serialized
+// by flock on <path>.lock. events of finished jobs are not kept in memory, but read from file
+type FileJobStore struct {
+	Path      string
+	Retention JobRetention // applied when store is compacted by owner
+	file      *os.File
+	lockFile  *os.File // flock of store file across processes
+	jobs      map[string]*Job
+	loaded    bool  // store file is replayed into jobs
+	owned     bool  // store is compacted by this process
+	compactAt int64 // owned store is compacted when file grows to this size
+	lock      sync.Mutex
+}
+
+// OpenFileJobStore will open (or create) job store file, which is owned by this process
+func OpenFileJobStore(path string, retention JobRetention) (*FileJobStore, error) {
+	return openFileJobStore(path, true, retention)
+}
+
+// AttachFileJobStore will open job store file which may be owned by a running pigsty server.
+// The file is not compacted, records are appended to it line by line, and it is loaded on first read
+func AttachFileJobStore(path string) (*FileJobStore, error) {
+	return openFileJobStore(path, false, JobRetention{})
+}
+
+// openFileJobStore will load & compact job store file if it is owned, then open it for append
+func openFileJobStore(path string, owned bool, retention JobRetention) (*FileJobStore, error) {
+	s := &FileJobStore{Path: path, Retention: retention, owned: owned, jobs: make(map[string]*Job)}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	lockFile, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.lockFile = lockFile
+	if owned {
+		if err = s.flock(syscall.LOCK_EX); err != nil {
+			lockFile.Close()
+			return nil, err
+		}
+		err = s.rewrite()
+		s.funlock()
+		if err != nil {
+			lockFile.Close()
+			return nil, fmt.Errorf("fail to load job store %s: %w", path, err)
+		}
+	}
+	if err = s.reopen(); err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// flock will lock store file across processes with given mode: LOCK_SH or LOCK_EX
+func (s *FileJobStore) flock(how int) error {
+	return syscall.Flock(int(s.lockFile.Fd()), how)
+}
+
+// funlock will release flock of store file
+func (s *FileJobStore) funlock() {
+	_ = syscall.Flock(int(s.lockFile.Fd()), syscall.LOCK_UN)
+}
+
+// reopen will open store file for append, if it is not opened or replaced by compaction of another process
+func (s *FileJobStore) reopen() error {
+	if s.file != nil {
+		current, err := os.Stat(s.Path)
+		opened, err2 := s.file.Stat()
+		if err == nil && err2 == nil && os.SameFile(current, opened) {
+			return nil
+		}
+		s.file.Close()
+		s.file = nil
+	}
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	return nil
+}
+
+// ensureLoaded will replay store file on first read of attached store, must be called with lock held.
+// jobs saved by this process before are appended to file, so they are replayed too
+func (s *FileJobStore) ensureLoaded() error {
+	if s.loaded {
+		return nil
+	}
+	if err := s.flock(syscall.LOCK_SH); err != nil {
+		return err
+	}
+	defer s.funlock()
+	s.jobs = make(map[string]*Job)
+	if err := s.load(); err != nil {
+		return fmt.Errorf("fail to load job store %s: %w", s.Path, err)
+	}
+	s.dropEvents()
+	return nil
+}
+
+// rewrite will replay store file, including records appended by other processes, then drop jobs
+// beyond retention and compact it. must be called with lock & exclusive flock held
+func (s *FileJobStore) rewrite() error {
+	jobs := s.jobs
+	s.jobs = make(map[string]*Job)
+	if err := s.load(); err != nil {
+		s.jobs = jobs
+		return err
+	}
+	pruned := s.prune()
+	if err := s.compact(); err != nil {
+		return err
+	}
+	s.dropEvents()
+	s.compactAt = compactMinSize
+	if fi, err := os.Stat(s.Path); err == nil && 2*fi.Size() > s.compactAt {
+		s.compactAt = 2 * fi.Size()
+	}
+	logrus.Debugf("job store %s compacted: %d jobs kept, %d jobs dropped by retention", s.Path, len(s.jobs), pruned)
+	return nil
+}
+
+// prune will drop finished jobs violating retention policy from memory, return number of dropped jobs
+func (s *FileJobStore) prune() (pruned int) {
+	deadline := time.Now().Add(-s.Retention.MaxAge)
+	kept := 0
+	for _, job := range s.sorted() {
+		if !job.Finished() {
+			continue
+		}
+		doneAt := job.DoneAt
+		if doneAt.IsZero() {
+			doneAt = job.StartAt
+		}
+		if (s.Retention.MaxJobs > 0 && kept >= s.Retention.MaxJobs) || (s.Retention.MaxAge > 0 && doneAt.Before(deadline)) {
+			delete(s.jobs, job.ID)
+			pruned++
+			continue
+		}
+		kept++
+	}
+	return
+}
+
+// dropEvents will release events of finished jobs from memory, they are read from file on demand
+func (s *FileJobStore) dropEvents() {
+	for _, job := range s.jobs {
+		if job.Finished() {
+			job.Events = nil
+		}
+	}
+}
+
+// readEvents will read events of job from store file, must be called with lock held
+func (s *FileJobStore) readEvents(id string) ([]Event, error) {
+	if err := s.flock(syscall.LOCK_SH); err != nil {
+		return nil, err
+	}
+	defer s.funlock()
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	events := []Event{}
+	key := []byte(`"id":"` + id + `"`)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if !bytes.Contains(scanner.Bytes(), key) { // skip records of other jobs without parsing
+			continue
+		}
+		var rec storeRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) == nil && rec.Type == "event" && rec.ID == id && rec.Event != nil {
+			events = append(events, *rec.Event)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// load will replay store file into memory, a truncated last line is ignored
+func (s *FileJobStore) load() error {
+	f, err := os.Open(s.Path)
+	if os.IsNotExist(err) {
+		s.loaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var rec storeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			logrus.Warnf("skip corrupted job store record: %s", err)
+			continue
+		}
+		switch rec.Type {
+		case "job":
+			var job Job
+			if err := json.Unmarshal(rec.Job, &job); err != nil {
+				continue
+			}
+			if old, exists := s.jobs[rec.ID]; exists {
+				job.Events = old.Events
+			}
+			s.jobs[rec.ID] = &job
+		case "event":
+			if job, exists := s.jobs[rec.ID]; exists && rec.Event != nil {
+				job.Events = append(job.Events, *rec.Event)
+			}
+		}
+	}
+	if err = scanner.Err(); err == nil {
+		s.loaded = true
+	}
+	return err
+}
+
+// compact will rewrite store file with latest state of each job
+func (s *FileJobStore) compact() error {
+	tmpPath := s.Path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, job := range s.sorted() {
+		state, err := job.stateJSON()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		err = writeRecord(w, storeRecord{Type: "job", ID: job.ID, Job: state})
+		for i := 0; i < len(job.Events) && err == nil; i++ {
+			err = writeRecord(w, storeRecord{Type: "event", ID: job.ID, Event: &job.Events[i]})
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.Path)
+}
+
+// writeRecord will write record as one json line
+func writeRecord(w interface{ Write([]byte) (int, error) }, rec storeRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// sorted will return jobs by start time, latest first
+func (s *FileJobStore) sorted() []*Job {
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].StartAt.Equal(jobs[j].StartAt) {
+			return jobs[i].ID > jobs[j].ID
+		}
+		return jobs[i].StartAt.After(jobs[j].StartAt)
+	})
+	return jobs
+}
+
+// Save will append job state to store
+func (s *FileJobStore) Save(job *Job) error {
+	state, err := job.stateJSON()
+	if err != nil {
+		return err
+	}
+	var copied Job
+	if err = json.Unmarshal(state, &copied); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if old, exists := s.jobs[job.ID]; exists && !copied.Finished() {
+		copied.Events = old.Events
+	}
+	s.jobs[job.ID] = &copied
+	return s.append(storeRecord{Type: "job", ID: job.ID, Job: state})
+}
+
+// AppendEvent will append job event to store
+func (s *FileJobStore) AppendEvent(id string, ev Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	job, exists := s.jobs[id]
+	if !exists {
+		return fmt.Errorf("job %s not found in store", id)
+	}
+	if !job.Finished() {
+		job.Events = append(job.Events, ev)
+	}
+	return s.append(storeRecord{Type: "event", ID: id, Event: &ev})
+}
+
+// append will write record to store file under flock, must be called with lock held.
+// owned store is compacted once file grows to compactAt, records appended by other processes included
+func (s *FileJobStore) append(rec storeRecord) error {
+	if s.file == nil {
+		return fmt.Errorf("job store %s is closed", s.Path)
+	}
+	if err := s.flock(syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer s.funlock()
+	if err := s.reopen(); err != nil {
+		return err
+	}
+	if err := writeRecord(s.file, rec); err != nil {
+		return err
+	}
+	if fi, err := s.file.Stat(); err == nil && s.owned && fi.Size() >= s.compactAt {
+		if err = s.rewrite(); err != nil {
+			logrus.Errorf("fail to compact job store %s: %s", s.Path, err)
+			s.compactAt = 2 * fi.Size() // do not retry on every append
+		}
+		return s.reopen()
+	}
+	return nil
+}
+
+// Get will return copy of job with events
+func (s *FileJobStore) Get(id string) (*Job, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.ensureLoaded(); err != nil {
+		return nil, err
+	}
+	job, exists := s.jobs[id]
+	if !exists {
+		return nil, fmt.Errorf("job %s not found", id)
+	}
+	if !job.Finished() {
+		return copyJob(job, true), nil
+	}
+	events, err := s.readEvents(id)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read events of job %s: %w", id, err)
+	}
+	c := copyJob(job, false)
+	c.Events = events
+	return c, nil
+}
+
+// Query will return copy of jobs (without events) satisfy query, latest first
+func (s *FileJobStore) Query(q JobQuery) ([]*Job, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.ensureLoaded(); err != nil {
+		return nil, err
+	}
+	res := []*Job{}
+	for _, job := range s.sorted() {
+		if !q.Match(job) {
+			continue
+		}
+		res = append(res, copyJob(job, false))
+		if q.Limit > 0 && len(res) >= q.Limit {
+			break
+		}
+	}
+	return res, nil
+}
+
+// Recover will mark unfinished jobs as interrupted, which is left by previous process.
+// jobs run by other live processes (e.g: pigsty cli) are not orphans
+func (s *FileJobStore) Recover() ([]*Job, error) {
+	s.lock.Lock()
+	if err := s.ensureLoaded(); err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+	var orphans []*Job
+	for _, job := range s.sorted() {
+		if !job.Finished() && !processAlive(job.PID) {
+			orphans = append(orphans, job)
+		}
+	}
+	s.lock.Unlock()
+	for _, job := range orphans {
+		job.Status, job.DoneAt = JOB_INTERRUPTED, time.Now()
+		if err := s.Save(job); err != nil {
+			return orphans, err
+		}
+	}
+	return orphans, nil
+}
+
+// Close will close store file
+func (s *FileJobStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	_ = s.lockFile.Close()
+	return err
+}
+
+// JobWatcher follows state of a job run by another process, by reading records appended to job store file
+type JobWatcher struct {
+	Path   string
+	Job    *Job        // latest known state of job
+	file   os.FileInfo // store file being read, which is replaced by compaction
+	offset int64       // records before this offset are read
+}
+
+// NewJobWatcher will watch job store file from its current end, set Job before checking
+func NewJobWatcher(path string) *JobWatcher {
+	w := &JobWatcher{Path: path}
+	if fi, err := os.Stat(path); err == nil {
+		w.file, w.offset = fi, fi.Size()
+	}
+	return w
+}
+
+// Done tells whether job is finished, or its owner process is gone so it will never finish
+func (w *JobWatcher) Done() bool {
+	if err := w.read(); err != nil {
+		logrus.Debugf("fail to read job store %s: %s", w.Path, err)
+	}
+	return w.Job.Finished() || !processAlive(w.Job.PID)
+}
+
+// read will apply job records appended since last read, compacted file is read from start
+func (w *JobWatcher) read() error {
+	f, err := os.Open(w.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if w.file == nil || !os.SameFile(fi, w.file) || fi.Size() < w.offset {
+		w.offset = 0
+	}
+	w.file = fi
+	if fi.Size() == w.offset {
+		return nil
+	}
+	b := make([]byte, fi.Size()-w.offset)
+	if _, err = f.ReadAt(b, w.offset); err != nil && err != io.EOF {
+		return err
+	}
+	end := bytes.LastIndexByte(b, '\n') // incomplete last line is read next time
+	if end < 0 {
+		return nil
+	}
+	w.offset += int64(end + 1)
+	for _, line := range bytes.Split(b[:end], []byte{'\n'}) {
+		var rec storeRecord
+		if json.Unmarshal(line, &rec) != nil || rec.Type != "job" || rec.ID != w.Job.ID {
+			continue
+		}
+		var job Job
+		if json.Unmarshal(rec.Job, &job) == nil {
+			w.Job = &job
+		}
+	}
+	return nil
+}
+
+// processAlive tells whether process which runs job is still alive, previous process of this pid is not
+func processAlive(pid int) bool {
+	if pid <= 0 || pid == os.Getpid() {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// Copy will return a snapshot of job with events, which is safe to read & marshal while job is running
+func (j *Job) Copy() *Job {
+	return copyJob(j, true)
+}
+
+// copyJob will copy a stored job via its json state
+func copyJob(job *Job, withEvents bool) *Job {
+	var c Job
+	if state, err := job.stateJSON(); err == nil {
+		_ = json.Unmarshal(state, &c)
+	}
+	if withEvents {
+		job.eventLock.Lock()
+		c.Events = append([]Event{}, job.Events...)
+		job.eventLock.Unlock()
+	}
+	return &c
+}
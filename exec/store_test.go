@@ -0,0 +1,302 @@
+package exec
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileJobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pigsty-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "job", "jobs.db")
+	store, err := OpenFileJobStore(path, DefaultJobRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Now().Add(-time.Hour)
+	done := &Job{ID: "a", Name: "pgsql init", Playbook: "pgsql.yml", Limit: "pg-test", Resources: []string{"cluster:pg-test", "ip:10.10.10.11"}, StartAt: base, Status: JOB_RUNNING, Store: store}
+	running := &Job{ID: "b", Name: "node init", Playbook: "node.yml", Resources: []string{RESOURCE_ALL}, StartAt: base.Add(time.Minute), Status: JOB_RUNNING, Store: store}
+	queued := &Job{ID: "c", Name: "pgsql init", Playbook: "pgsql.yml", Limit: "pg-src", Resources: []string{"cluster:pg-src"}, StartAt: base.Add(2 * time.Minute), Status: JOB_QUEUED, Store: store}
+	for _, job := range []*Job{done, running, queued} {
+		job.persist()
+	}
+
+	// events & final state of job a
+	var p EventParser
+	for _, line := range strings.Split(sampleOutput, "\n") {
+		if ev := p.Parse(line); ev != nil {
+			done.emit(ev)
+		}
+	}
+	done.Status, done.ExitCode, done.DoneAt = JOB_FAILED, 4, base.Add(time.Minute)
+	done.persist()
+
+	if err = store.AppendEvent("not-exists", Event{}); err == nil {
+		t.Errorf("append event to unknown job should fail")
+	}
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// simulate a crash during write: truncated last line is ignored
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	_, _ = f.WriteString(`{"t":"job","id":"d","job":{"id":`)
+	f.Close()
+
+	// reopen & recover
+	if store, err = OpenFileJobStore(path, DefaultJobRetention); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	orphans, err := store.Recover()
+	if err != nil || len(orphans) != 2 {
+		t.Fatalf("expect 2 orphan jobs, got %v, err %v", orphans, err)
+	}
+	job, err := store.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != JOB_FAILED || job.ExitCode != 4 || len(job.Events) != 16 || len(job.Results) != 3 {
+		t.Errorf("unexpected job a: status %s, exit code %d, %d events, %d results", job.Status, job.ExitCode, len(job.Events), len(job.Results))
+	}
+	if job.Events[0].Seq != 1 || job.Events[15].Seq != 16 || job.Events[15].Type != EVENT_RECAP {
+		t.Errorf("event should be stored in order: %v", job.Events[:4])
+	}
+	if _, err = store.Get("d"); err == nil {
+		t.Errorf("truncated job record should be ignored")
+	}
+
+	query := func(q JobQuery) (ids []string) {
+		jobs, err := store.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, job := range jobs {
+			ids = append(ids, job.ID)
+		}
+		return
+	}
+	cases := []struct {
+		q        JobQuery
+		expected string
+	}{
+		{JobQuery{}, "c b a"},
+		{JobQuery{Status: JOB_INTERRUPTED}, "c b"},
+		{JobQuery{Cluster: "pg-test"}, "b a"}, // b touches all hosts
+		{JobQuery{Playbook: "pgsql"}, "c a"},
+		{JobQuery{Since: base.Add(time.Minute)}, "c b"},
+		{JobQuery{Until: base.Add(time.Minute)}, "a"},
+		{JobQuery{Limit: 1}, "c"},
+	}
+	for _, c := range cases {
+		if ids := strings.Join(query(c.q), " "); ids != c.expected {
+			t.Errorf("query %+v: expect %s, got %s", c.q, c.expected, ids)
+		}
+	}
+}
+
+func TestSharedFileJobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pigsty-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "job", "jobs.db")
+	owner, err := OpenFileJobStore(path, DefaultJobRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// attached store is loaded on first read
+	cli, err := AttachFileJobStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if cli.loaded {
+		t.Errorf("attached store should be loaded lazily")
+	}
+
+	// concurrent appends of processes (each with its own file & flock) are not interleaved
+	long := strings.Repeat("x", 16*1024)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, _ := AttachFileJobStore(path)
+			defer s.Close()
+			for j := 0; j < 10; j++ {
+				job := &Job{ID: fmt.Sprintf("job-%d-%d", i, j), Name: long, Status: JOB_SUCCESS, Store: s}
+				job.persist()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// record appended by attached store after owner compaction is kept in new file
+	running := &Job{ID: "cli", Status: JOB_RUNNING, PID: os.Getppid(), Store: cli}
+	running.persist()
+	_ = owner.Close()
+	if owner, err = OpenFileJobStore(path, DefaultJobRetention); err != nil {
+		t.Fatal(err)
+	}
+	running.Status = JOB_SUCCESS
+	running.persist()
+	_ = owner.Close()
+
+	if owner, err = OpenFileJobStore(path, DefaultJobRetention); err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Close()
+	if jobs, err := owner.Query(JobQuery{}); err != nil || len(jobs) != 41 {
+		t.Fatalf("expect 41 jobs, got %d: %v", len(jobs), err)
+	}
+	if job, err := owner.Get("cli"); err != nil || job.Status != JOB_SUCCESS {
+		t.Errorf("job state appended after compaction should be kept: %v %v", job, err)
+	}
+
+	// unfinished job run by another live process is not orphan
+	other := &Job{ID: "other", Status: JOB_RUNNING, PID: os.Getppid(), Store: owner}
+	other.persist()
+	dead := &Job{ID: "dead", Status: JOB_RUNNING, Store: owner}
+	dead.persist()
+	if orphans, err := owner.Recover(); err != nil || len(orphans) != 1 || orphans[0].ID != "dead" {
+		t.Errorf("only job of exited process is orphan: %v %v", orphans, err)
+	}
+}
+
+func TestFileJobStoreRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pigsty-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.db")
+	retention := JobRetention{MaxJobs: 3, MaxAge: time.Hour}
+	owner, err := OpenFileJobStore(path, retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// events of finished jobs are released from memory, and read from file by get
+	base := time.Now().Add(-30 * time.Minute)
+	old := &Job{ID: "old", Status: JOB_SUCCESS, StartAt: base.Add(-time.Hour), DoneAt: base.Add(-time.Hour), Store: owner}
+	old.persist()
+	running := &Job{ID: "running", Status: JOB_RUNNING, StartAt: base.Add(-2 * time.Hour), PID: os.Getppid(), Store: owner}
+	running.persist()
+	for i := 0; i < 4; i++ {
+		job := &Job{ID: fmt.Sprintf("job-%d", i), Status: JOB_RUNNING, StartAt: base.Add(time.Duration(i) * time.Minute), Store: owner}
+		job.persist()
+		job.emit(&Event{Type: EVENT_TASK_START, Task: "task"})
+		job.Status, job.DoneAt = JOB_SUCCESS, job.StartAt
+		job.persist()
+	}
+	if events := owner.jobs["job-0"].Events; len(events) != 0 {
+		t.Errorf("events of finished job should be released: %v", events)
+	}
+	if job, err := owner.Get("job-0"); err != nil || len(job.Events) != 1 || job.Events[0].Task != "task" {
+		t.Errorf("events of finished job should be read from file: %v %v", job, err)
+	}
+
+	// finished jobs beyond max jobs & max age are dropped by compaction, unfinished jobs are kept
+	_ = owner.Close()
+	if owner, err = OpenFileJobStore(path, retention); err != nil {
+		t.Fatal(err)
+	}
+	ids := func() string {
+		jobs, err := owner.Query(JobQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res []string
+		for _, job := range jobs {
+			res = append(res, job.ID)
+		}
+		return strings.Join(res, " ")
+	}
+	if res := ids(); res != "job-3 job-2 job-1 running" {
+		t.Errorf("unexpected jobs after compaction: %s", res)
+	}
+	if job, err := owner.Get("job-3"); err != nil || len(job.Events) != 1 {
+		t.Errorf("events of kept job should be compacted: %v %v", job, err)
+	}
+
+	// owned store is compacted once file grows, records appended by other processes included
+	defer func(size int64) { compactMinSize = size }(compactMinSize)
+	compactMinSize = 8 * 1024
+	_ = owner.Close()
+	if owner, err = OpenFileJobStore(path, retention); err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Close()
+	cli, err := AttachFileJobStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	long := strings.Repeat("x", 1024)
+	for i := 4; i < 20; i++ {
+		job := &Job{ID: fmt.Sprintf("job-%d", i), Name: long, Status: JOB_SUCCESS, StartAt: base.Add(time.Duration(i) * time.Minute), DoneAt: base, Store: cli}
+		job.persist()
+	}
+	last := &Job{ID: "job-20", Status: JOB_SUCCESS, StartAt: base.Add(20 * time.Minute), DoneAt: base, Store: owner}
+	last.persist()
+	if fi, err := os.Stat(path); err != nil || fi.Size() >= compactMinSize {
+		t.Errorf("store file should be compacted: %v %v", fi.Size(), err)
+	}
+	if res := ids(); res != "job-20 job-19 job-18 running" {
+		t.Errorf("unexpected jobs after compaction: %s", res)
+	}
+}
+
+func TestJobWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pigsty-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.db")
+	owner, err := OpenFileJobStore(path, DefaultJobRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &Job{ID: "a", Status: JOB_RUNNING, PID: os.Getppid(), Store: owner}
+	job.persist()
+
+	w := NewJobWatcher(path)
+	w.Job = job.Copy()
+	if w.Done() {
+		t.Errorf("running job of live process is not done")
+	}
+	// compacted by restarted owner, then finished
+	_ = owner.Close()
+	if owner, err = OpenFileJobStore(path, DefaultJobRetention); err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Close()
+	if w.Done() {
+		t.Errorf("running job is not done after compaction")
+	}
+	job.Store, job.Status = owner, JOB_SUCCESS
+	job.persist()
+	if !w.Done() || w.Job.Status != JOB_SUCCESS {
+		t.Errorf("finished job should be done: %s", w.Job.Status)
+	}
+
+	// job of exited process never finishes
+	w = NewJobWatcher(path)
+	w.Job = &Job{ID: "b", Status: JOB_RUNNING, PID: 0}
+	if !w.Done() {
+		t.Errorf("job of exited process should be done")
+	}
+}
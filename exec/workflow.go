@@ -0,0 +1,296 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"time"
+)
+
+/**************************************************************\
+*                          Const                               *
+\**************************************************************/
+const (
+	STEP_PENDING = "pending"
+	STEP_RUNNING = "running"
+	STEP_SUCCESS = "success"
+	STEP_FAILED  = "failed"
+	STEP_SKIPPED = "skipped" // dependency failed or workflow aborted
+)
+
+/**************************************************************\
+*                         Workflow                             *
+\**************************************************************/
+// Workflow is a DAG of playbook steps, e.g: node.yml -> pgsql.yml -> infra target
+type Workflow struct {
+	Name   string                 `yaml:"name"`
+	Limit  string                 `yaml:"limit"` // default limit of steps without limit
+	Vars   map[string]interface{} `yaml:"vars"`  // default extra vars of all steps
+	Steps  []*Step                `yaml:"steps"`
+	OnStep func(s *StepRun)       `yaml:"-"` // called when step starts and finishes
+}
+
+// Step is a playbook execution in workflow
+type Step struct {
+	Name            string                 `yaml:"name"`
+	Playbook        string                 `yaml:"playbook"`
+	Tags            []string               `yaml:"tags"`
+	Limit           string                 `yaml:"limit"`
+	Vars            map[string]interface{} `yaml:"vars"`              // extra vars
+	Needs           []string               `yaml:"needs"`             // steps must finish before this
+	ContinueOnError bool                   `yaml:"continue_on_error"` // failure will not abort workflow
+	Timeout         time.Duration          `yaml:"timeout"`           // cancel step if runs longer than this, e.g: 30m
+	Serial          string                 `yaml:"serial"`            // run step in batches of N or N% hosts
+	Pause           time.Duration          `yaml:"pause"`             // wait between batches of rolling step
+	HealthCheck     string                 `yaml:"health_check"`      // shell command run after each batch
+	Rollback        *Step                  `yaml:"rollback"`          // run if workflow failed after this step ran
+}
+
+// StepRun is the execution state of a step
+type StepRun struct {
+	Step     *Step     `json:"-"`
+	Name     string    `json:"name"`
+	Index    int       `json:"index"` // 1-based position in execution order
+	Total    int       `json:"total"` // total number of steps (or rollbacks)
+	Rollback bool      `json:"rollback"`
+	Status   string    `json:"status"` // pending | running | success | failed | skipped
+	Error    string    `json:"error,omitempty"`
+	Job      *Job      `json:"job,omitempty"`
+	StartAt  time.Time `json:"start_at"`
+	DoneAt   time.Time `json:"done_at"`
+}
+
+// WorkflowRun is the execution result of a workflow
+type WorkflowRun struct {
+	Name      string     `json:"name"`
+	Status    string     `json:"status"` // success | failed
+	Steps     []*StepRun `json:"steps"`
+	Rollbacks []*StepRun `json:"rollbacks"`
+	StartAt   time.Time  `json:"start_at"`
+	DoneAt    time.Time  `json:"done_at"`
+}
+
+// LoadWorkflow will load workflow from yaml file
+func LoadWorkflow(path string) (*Workflow, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	wf, err := ParseWorkflow(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid workflow %s: %w", path, err)
+	}
+	return wf, nil
+}
+
+// ParseWorkflow will parse & validate workflow from yaml
+func ParseWorkflow(data []byte) (*Workflow, error) {
+	var wf Workflow
+	if err := yaml.Unmarshal(data, &wf); err != nil {
+		return nil, err
+	}
+	if _, err := wf.Order(); err != nil {
+		return nil, err
+	}
+	return &wf, nil
+}
+
+// Order will validate workflow and return steps in execution order:
+// a step runs after all its dependencies, ties are broken by declaration order
+func (w *Workflow) Order() ([]*Step, error) {
+	if len(w.Steps) == 0 {
+		return nil, fmt.Errorf("workflow has no steps")
+	}
+	steps := make(map[string]*Step, len(w.Steps))
+	for i, s := range w.Steps {
+		if s.Name == "" {
+			return nil, fmt.Errorf("step %d has no name", i+1)
+		}
+		if _, exists := steps[s.Name]; exists {
+			return nil, fmt.Errorf("duplicate step %s", s.Name)
+		}
+		if s.Playbook == "" {
+			return nil, fmt.Errorf("step %s has no playbook", s.Name)
+		}
+		if s.Rollback != nil && s.Rollback.Playbook == "" {
+			return nil, fmt.Errorf("rollback of step %s has no playbook", s.Name)
+		}
+		steps[s.Name] = s
+	}
+	for _, s := range w.Steps {
+		for _, dep := range s.Needs {
+			if _, exists := steps[dep]; !exists {
+				return nil, fmt.Errorf("step %s needs unknown step %s", s.Name, dep)
+			}
+		}
+	}
+
+	done := make(map[string]bool, len(w.Steps))
+	var order []*Step
+	for len(order) < len(w.Steps) {
+		progress := false
+		for _, s := range w.Steps {
+			if done[s.Name] || !allDone(s.Needs, done) {
+				continue
+			}
+			done[s.Name] = true
+			order = append(order, s)
+			progress = true
+			break
+		}
+		if !progress {
+			var pending []string
+			for _, s := range w.Steps {
+				if !done[s.Name] {
+					pending = append(pending, s.Name)
+				}
+			}
+			return nil, fmt.Errorf("dependency cycle among steps %v", pending)
+		}
+	}
+	return order, nil
+}
+
+// allDone tells whether all names are marked in done
+func allDone(names []string, done map[string]bool) bool {
+	for _, name := range names {
+		if !done[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// Run will execute workflow steps one by one in dependency order with executor.
+// A failed step aborts workflow unless continue_on_error is set, steps depend on
+// failed steps are skipped. A cancelled step (or ctx) always aborts workflow. If workflow
+// failed, rollback of steps that have run are executed in reverse order, which are not cancelled
+// by ctx. options are applied to every job of workflow.
+func (w *Workflow) Run(ctx context.Context, e *Executor, options ...JobOpts) (*WorkflowRun, error) {
+	order, err := w.Order()
+	if err != nil {
+		return nil, err
+	}
+	run := &WorkflowRun{Name: w.Name, Status: STEP_SUCCESS, StartAt: time.Now()}
+	for i, s := range order {
+		run.Steps = append(run.Steps, &StepRun{Step: s, Name: s.Name, Index: i + 1, Total: len(order), Status: STEP_PENDING})
+	}
+
+	status := make(map[string]string, len(order))
+	var ran []*StepRun // steps that have been run, in order
+	aborted := false
+	for _, sr := range run.Steps {
+		if aborted || ctx.Err() != nil || !w.depsOK(sr.Step, status) {
+			sr.Status = STEP_SKIPPED
+			status[sr.Name] = STEP_SKIPPED
+			w.notify(sr)
+			continue
+		}
+		w.runStep(ctx, e, sr, options)
+		status[sr.Name] = sr.Status
+		ran = append(ran, sr)
+		if sr.Status == STEP_FAILED && (!sr.Step.ContinueOnError || sr.Job.Status == JOB_CANCELLED) {
+			run.Status, aborted = STEP_FAILED, true
+		}
+	}
+	if ctx.Err() != nil {
+		run.Status = STEP_FAILED
+	}
+
+	// rollback steps that have run in reverse order if workflow failed
+	if run.Status == STEP_FAILED {
+		var rollbacks []*StepRun
+		for i := len(ran) - 1; i >= 0; i-- {
+			if rb := ran[i].Step.Rollback; rb != nil {
+				name := rb.Name
+				if name == "" {
+					name = ran[i].Name + "-rollback"
+				}
+				rollbacks = append(rollbacks, &StepRun{Step: rb, Name: name, Rollback: true, Status: STEP_PENDING})
+			}
+		}
+		for i, sr := range rollbacks {
+			sr.Index, sr.Total = i+1, len(rollbacks)
+			w.runStep(context.Background(), e, sr, options) // rollback even if cancelled
+		}
+		run.Rollbacks = rollbacks
+	}
+	run.DoneAt = time.Now()
+	if run.Status == STEP_FAILED {
+		return run, fmt.Errorf("workflow %s failed", w.Name)
+	}
+	return run, nil
+}
+
+// depsOK tells whether all dependencies of step succeed (or failed with continue_on_error)
+func (w *Workflow) depsOK(s *Step, status map[string]string) bool {
+	for _, dep := range s.Needs {
+		switch status[dep] {
+		case STEP_SUCCESS:
+		case STEP_FAILED:
+			if !w.step(dep).ContinueOnError {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// step will find step by name
+func (w *Workflow) step(name string) *Step {
+	for _, s := range w.Steps {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// runStep will spawn job of step and run it
+func (w *Workflow) runStep(ctx context.Context, e *Executor, sr *StepRun, options []JobOpts) {
+	s := sr.Step
+	limit := s.Limit
+	if limit == "" {
+		limit = w.Limit
+	}
+	opts := append([]JobOpts{}, options...)
+	opts = append(opts,
+		WithPlaybook(s.Playbook),
+		WithName(fmt.Sprintf("%s/%s", w.Name, sr.Name)),
+		WithLimit(limit),
+		WithTags(s.Tags...),
+	)
+	if s.Timeout > 0 {
+		opts = append(opts, WithTimeout(s.Timeout))
+	}
+	if s.Serial != "" {
+		opts = append(opts, WithSerial(s.Serial), WithPause(s.Pause), WithHealthCheck(s.HealthCheck))
+	}
+	for k, v := range w.Vars {
+		opts = append(opts, WithExtraVars(k, v))
+	}
+	for k, v := range s.Vars {
+		opts = append(opts, WithExtraVars(k, v))
+	}
+
+	sr.Job = e.NewJob(opts...)
+	sr.Status, sr.StartAt = STEP_RUNNING, time.Now()
+	w.notify(sr)
+	if err := sr.Job.Run(ctx); err != nil {
+		sr.Status, sr.Error = STEP_FAILED, err.Error()
+	} else {
+		sr.Status = STEP_SUCCESS
+	}
+	sr.DoneAt = time.Now()
+	w.notify(sr)
+}
+
+// notify will report step progress to OnStep if set
+func (w *Workflow) notify(sr *StepRun) {
+	if w.OnStep != nil {
+		w.OnStep(sr)
+	}
+}
@@ -0,0 +1,171 @@
+package exec
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sampleWorkflow = `
+name: pg-test
+limit: pg-test
+steps:
+  - name: node
+    playbook: node.yml
+    rollback:
+      playbook: node-remove.yml
+  - name: pgsql
+    playbook: pgsql.yml
+    needs: [ node ]
+    vars: { pg_exists_action: clean }
+  - name: monitor
+    playbook: bad-monitor.yml
+    needs: [ pgsql ]
+    continue_on_error: true
+  - name: register
+    playbook: infra.yml
+    tags: [ prometheus_targets ]
+    limit: meta
+    needs: [ monitor ]
+  - name: service
+    playbook: bad-service.yml
+    needs: [ node ]
+  - name: test
+    playbook: test.yml
+    needs: [ service ]
+`
+
+func TestWorkflowOrder(t *testing.T) {
+	wf, err := ParseWorkflow([]byte(`{name: x, steps: [{name: b, playbook: b.yml, needs: [a]}, {name: a, playbook: a.yml}, {name: c, playbook: c.yml}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, _ := wf.Order()
+	var names []string
+	for _, s := range order {
+		names = append(names, s.Name)
+	}
+	if strings.Join(names, " ") != "a b c" {
+		t.Errorf("unexpected order %v", names)
+	}
+
+	invalid := map[string]string{
+		`{steps: []}`: "no steps",
+		`{steps: [{name: a, playbook: a.yml}, {name: a, playbook: b.yml}]}`: "duplicate",
+		`{steps: [{name: a}]}`:                              "no playbook",
+		`{steps: [{name: a, playbook: a.yml, needs: [b]}]}`: "unknown step",
+		`{steps: [{name: a, playbook: a.yml, needs: [b]}, {name: b, playbook: b.yml, needs: [a]}]}`: "cycle",
+	}
+	for data, msg := range invalid {
+		if _, err := ParseWorkflow([]byte(data)); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: expect error %q, got %v", data, msg, err)
+		}
+	}
+}
+
+func TestWorkflowRun(t *testing.T) {
+	e, bin := newSchedulerExecutor(t)
+	dir := filepath.Dir(bin)
+	defer os.RemoveAll(dir)
+	// fake ansible-playbook record its args, and fail on bad-*.yml
+	script := "#!/bin/sh\necho \"$*\" >> " + filepath.Join(dir, "calls") + "\ncase \"$*\" in *bad-*) exit 2;; esac\n"
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	wf, err := ParseWorkflow([]byte(sampleWorkflow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var progress []string
+	wf.OnStep = func(s *StepRun) { progress = append(progress, s.Name+":"+s.Status) }
+	run, err := wf.Run(context.Background(), e, WithStdout(ioutil.Discard))
+	if err == nil || run.Status != STEP_FAILED {
+		t.Fatalf("workflow should fail, got %v", err)
+	}
+
+	status := map[string]string{}
+	for _, s := range run.Steps {
+		status[s.Name] = s.Status
+	}
+	expected := map[string]string{"node": STEP_SUCCESS, "pgsql": STEP_SUCCESS, "monitor": STEP_FAILED, "register": STEP_SUCCESS, "service": STEP_FAILED, "test": STEP_SKIPPED}
+	for name, s := range expected {
+		if status[name] != s {
+			t.Errorf("step %s: expect %s, got %s", name, s, status[name])
+		}
+	}
+	if len(run.Rollbacks) != 1 || run.Rollbacks[0].Name != "node-rollback" || run.Rollbacks[0].Status != STEP_SUCCESS {
+		t.Errorf("node should be rolled back: %+v", run.Rollbacks)
+	}
+	if p := strings.Join(progress, " "); !strings.HasPrefix(p, "node:running node:success pgsql:running") || !strings.HasSuffix(p, "test:skipped node-rollback:running node-rollback:success") {
+		t.Errorf("unexpected progress: %s", p)
+	}
+
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	calls := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(calls) != 6 {
+		t.Fatalf("expect 6 playbook calls, got %v", calls)
+	}
+	if !strings.Contains(calls[1], "--limit 10.10.10.11,10.10.10.12") || !strings.Contains(calls[1], "pg_exists_action") {
+		t.Errorf("workflow limit & step vars should be applied: %s", calls[1])
+	}
+	if !strings.Contains(calls[3], "--limit 10.10.10.10 ") || !strings.Contains(calls[3], "--tags prometheus_targets") {
+		t.Errorf("step limit & tags should be applied: %s", calls[3])
+	}
+	if !strings.HasSuffix(calls[5], "node-remove.yml") {
+		t.Errorf("rollback should run last: %s", calls[5])
+	}
+}
+
+func TestWorkflowCancel(t *testing.T) {
+	e, runner := newTestExecutor(t, map[string]*Script{"*": {Output: sampleOutput}, "slow": {Output: sampleOutput, Delay: 20 * time.Millisecond}})
+	defer os.RemoveAll(e.WorkDir)
+	data := `{name: x, limit: pg-test, steps: [
+	  {name: a, playbook: fast.yml, rollback: {playbook: undo.yml}},
+	  {name: b, playbook: slow.yml, needs: [a], continue_on_error: true},
+	  {name: c, playbook: fast.yml, needs: [b]}]}`
+
+	// cancelled step aborts workflow & rollback whatever continue_on_error says, by job cancel or ctx
+	cancels := map[string]func(ctx context.CancelFunc){
+		"job": func(context.CancelFunc) {
+			for e.CancelJobs() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		},
+		"ctx": func(cancel context.CancelFunc) { cancel() },
+	}
+	for name, cancelStep := range cancels {
+		wf, err := ParseWorkflow([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		wf.OnStep = func(s *StepRun) {
+			if s.Name == "b" && s.Status == STEP_RUNNING {
+				go cancelStep(cancel)
+			}
+		}
+		calls := len(runner.Calls())
+		run, err := wf.Run(ctx, e, WithStdout(ioutil.Discard), WithStderr(ioutil.Discard))
+		cancel()
+		if err == nil || run.Status != STEP_FAILED {
+			t.Fatalf("%s: cancelled workflow should fail, got %v", name, err)
+		}
+		if run.Steps[1].Job.Status != JOB_CANCELLED || run.Steps[2].Status != STEP_SKIPPED {
+			t.Errorf("%s: steps after cancelled step should be skipped: %s %s", name, run.Steps[1].Job.Status, run.Steps[2].Status)
+		}
+		if len(run.Rollbacks) != 1 || run.Rollbacks[0].Status != STEP_SUCCESS {
+			t.Errorf("%s: steps have run should be rolled back: %+v", name, run.Rollbacks)
+		}
+		if n := len(runner.Calls()) - calls; n != 3 {
+			t.Errorf("%s: expect 3 playbook calls, got %d", name, n)
+		}
+	}
+}
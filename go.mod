@@ -10,5 +10,6 @@ require (
 	github.com/prometheus/common v0.23.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/cobra v1.1.3
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
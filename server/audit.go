@@ -0,0 +1,94 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/Vonng/pigsty-cli/exec"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuditPath is where audit log is placed, shared with cli using same data dir
+func (ps *PigstyServer) AuditPath() string {
+	return filepath.Join(ps.DataDir, "audit", "audit.log")
+}
+
+// requestAuditor will return auditor of api request, which records its route as command
+func requestAuditor(c *gin.Context) *exec.Auditor {
+	return &exec.Auditor{
+		Log:     PS.Audit,
+		Actor:   requestActor(c),
+		Source:  exec.AUDIT_API,
+		Remote:  c.ClientIP(),
+		Command: c.Request.Method + " " + c.Request.URL.RequestURI(),
+	}
+}
+
+// requestActor will identify api caller by fingerprint of bearer token (token itself is never recorded)
+// and X-Pigsty-User header, anonymous if neither is given
+func requestActor(c *gin.Context) string {
+	var actor []string
+	if user := c.GetHeader("X-Pigsty-User"); user != "" {
+		actor = append(actor, user)
+	}
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		sum := sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer ")))
+		actor = append(actor, "token:"+hex.EncodeToString(sum[:])[:12])
+	}
+	if len(actor) == 0 {
+		return "anonymous"
+	}
+	return strings.Join(actor, " ")
+}
+
+// auditConfig will record config change made via api to audit log
+func auditConfig(c *gin.Context, before string, err error) {
+	r := &exec.AuditRecord{Action: exec.AUDIT_CONFIG, ConfigBefore: before, ConfigAfter: exec.FileHash(PS.ConfigPath), Outcome: "ok"}
+	if err != nil {
+		r.Outcome, r.Error = "error", err.Error()
+	}
+	requestAuditor(c).Record(r)
+}
+
+// ListAuditHandler will query audit records, latest first
+func ListAuditHandler(c *gin.Context) {
+	q := exec.AuditQuery{
+		Actor:  c.Query("actor"),
+		Action: c.Query("action"),
+		Host:   c.Query("host"),
+		JobID:  c.Query("job"),
+	}
+	var err error
+	if since := c.Query("since"); since != "" {
+		q.Since, err = time.Parse(time.RFC3339, since)
+	}
+	if until := c.Query("until"); until != "" && err == nil {
+		q.Until, err = time.Parse(time.RFC3339, until)
+	}
+	if limit := c.Query("limit"); limit != "" && err == nil {
+		q.Limit, err = strconv.Atoi(limit)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid query: " + err.Error(),
+			"data":    nil,
+		})
+		return
+	}
+	records, err := PS.Audit.Query(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": err.Error(),
+			"data":    nil,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "ok",
+		"data":    records,
+	})
+}
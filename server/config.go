@@ -1,7 +1,9 @@
 package server
 
 import (
+	"errors"
 	"github.com/Vonng/pigsty-cli/conf"
+	"github.com/Vonng/pigsty-cli/exec"
 	"github.com/gin-gonic/gin"
 	"io/ioutil"
 	"net/http"
@@ -24,7 +26,13 @@ func PostConfigHandler(c *gin.Context) {
 		return
 	}
 
-	_, err = conf.ParseConfig(d)
+	cfg, err := conf.ParseConfig(d)
+	if err == nil && cfg == nil {
+		err = errors.New("empty config")
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
 	if err != nil {
 		// invalid config
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -32,14 +40,20 @@ func PostConfigHandler(c *gin.Context) {
 		})
 		return
 	}
-	if err := conf.OverwriteConfig(d, PS.ConfigPath); err != nil {
+	PS.lock.Lock()
+	defer PS.lock.Unlock()
+	before := exec.FileHash(PS.ConfigPath)
+	_, err = PS.History.Save(d, configAuthor(c), "post")
+	auditConfig(c, before, err)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"message": err.Error(),
 		})
 		return
 	}
 
-	if err := PS.Reload(PS.ConfigPath); err != nil {
+	change, err := PS.reload()
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"message": err.Error(),
 		})
@@ -48,5 +62,58 @@ func PostConfigHandler(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "ok",
+		"data":    change,
+	})
+}
+
+// GetConfigHistoryHandler will list config snapshots, latest first
+func GetConfigHistoryHandler(c *gin.Context) {
+	snaps, err := PS.History.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": err.Error(),
+			"data":    nil,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "ok",
+		"data":    snaps,
 	})
 }
+
+// PostConfigRollbackHandler will restore config to snapshot and reload executor
+func PostConfigRollbackHandler(c *gin.Context) {
+	PS.lock.Lock()
+	defer PS.lock.Unlock()
+	before := exec.FileHash(PS.ConfigPath)
+	snap, err := PS.History.Rollback(c.Param("id"), configAuthor(c))
+	auditConfig(c, before, err)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": err.Error(),
+			"data":    nil,
+		})
+		return
+	}
+	change, err := PS.reload()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": err.Error(),
+			"data":    nil,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "ok",
+		"data":    gin.H{"snapshot": snap, "change": change},
+	})
+}
+
+// configAuthor will use X-Pigsty-User header as author of config change, client ip if not given
+func configAuthor(c *gin.Context) string {
+	if user := c.GetHeader("X-Pigsty-User"); user != "" {
+		return user
+	}
+	return c.ClientIP()
+}
@@ -1,22 +1,25 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/Vonng/pigsty-cli/exec"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
 	"net/http"
-	"path"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // GetConfigHandler will serve config file
 func GetJobHandler(c *gin.Context) {
 	if job := PS.GetJob(); job != nil {
 		c.JSON(http.StatusOK, gin.H{
-			"message": "job running",
-			"data":    PS.Job,
+			"message": "job " + job.Status,
+			"data":    job,
 		})
 	} else {
 		c.JSON(http.StatusOK, gin.H{
@@ -26,9 +29,53 @@ func GetJobHandler(c *gin.Context) {
 	}
 }
 
-// ListJobHandler will serve config file
+// GetJobEventsHandler will return events of job (?id=, current job by default) after given sequence number (?since=seq)
+func GetJobEventsHandler(c *gin.Context) {
+	job := PS.GetJob()
+	if id := c.Query("id"); id != "" {
+		job = PS.LoadJob(id)
+	}
+	if job == nil {
+		c.JSON(http.StatusOK, gin.H{
+			"message": "job not found",
+			"data":    nil,
+		})
+		return
+	}
+	since, _ := strconv.Atoi(c.DefaultQuery("since", "0"))
+	c.JSON(http.StatusOK, gin.H{
+		"message": "ok",
+		"job":     job.ID,
+		"status":  job.Status,
+		"data":    job.EventsSince(since),
+	})
+}
+
+// ListJobHandler will query jobs by status, cluster, playbook, start time range (RFC3339) and limit
 func ListJobHandler(c *gin.Context) {
-	if jobInfo, err := PS.LisJobDir(); err != nil {
+	q := exec.JobQuery{
+		Status:   c.Query("status"),
+		Cluster:  c.Query("cluster"),
+		Playbook: c.Query("playbook"),
+	}
+	var err error
+	if since := c.Query("since"); since != "" {
+		q.Since, err = time.Parse(time.RFC3339, since)
+	}
+	if until := c.Query("until"); until != "" && err == nil {
+		q.Until, err = time.Parse(time.RFC3339, until)
+	}
+	if limit := c.Query("limit"); limit != "" && err == nil {
+		q.Limit, err = strconv.Atoi(limit)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid query: " + err.Error(),
+			"data":    nil,
+		})
+		return
+	}
+	if jobInfo, err := PS.ListJobs(q); err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"message": "can not list jobs",
 			"data":    nil,
@@ -41,6 +88,36 @@ func ListJobHandler(c *gin.Context) {
 	}
 }
 
+// GetJobPlanHandler will return changes made (or would be made in check mode) by job
+func GetJobPlanHandler(c *gin.Context) {
+	if job := PS.LoadJob(c.Param("id")); job != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"message": "job " + job.Status,
+			"data":    job.Plan(),
+		})
+	} else {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "job not found",
+			"data":    nil,
+		})
+	}
+}
+
+// GetJobByIDHandler will return job with events by id
+func GetJobByIDHandler(c *gin.Context) {
+	if job := PS.LoadJob(c.Param("id")); job != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"message": "job " + job.Status,
+			"data":    job,
+		})
+	} else {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "job not found",
+			"data":    nil,
+		})
+	}
+}
+
 // PostJobHandler will create new job
 func PostJobHandler(c *gin.Context) {
 	// arg parsing
@@ -51,49 +128,233 @@ func PostJobHandler(c *gin.Context) {
 		playbook += ".yml"
 	}
 	logrus.Infof("post job handler called: playbook=%s cluster=%s tags=%s", playbook, cluster, tags)
+	if cluster != "" {
+		if _, err := PS.Executor.CurrentConfig().ResolveLimit(cluster); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "invalid limit: " + err.Error(),
+				"data":    nil,
+			})
+			return
+		}
+	}
+
+	pb, err := PS.Executor.LoadPlaybook(playbook)
+	if err == nil {
+		err = pb.ValidateTags(tags)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": err.Error(),
+			"data":    nil,
+		})
+		return
+	}
 
 	// build new job
-	job := PS.Executor.NewJob(
+	opts := []exec.JobOpts{
 		exec.WithPlaybook(playbook),
 		exec.WithName(fmt.Sprintf("%s-%s", playbook, cluster)),
 		exec.WithLimit(cluster),
 		exec.WithTags(tags...),
-	)
+		exec.WithStore(PS.Store),
+		exec.WithAuditor(requestAuditor(c)),
+	}
+	if c.Query("check") == "true" {
+		opts = append(opts, exec.WithCheck())
+	}
+	if c.Query("diff") == "true" {
+		opts = append(opts, exec.WithDiff())
+	}
+	if timeout := c.Query("timeout"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "invalid timeout: " + err.Error(),
+				"data":    nil,
+			})
+			return
+		}
+		opts = append(opts, exec.WithTimeout(d))
+	}
+	if serial := c.Query("serial"); serial != "" {
+		pause, err := time.ParseDuration(c.DefaultQuery("pause", "0s"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "invalid pause: " + err.Error(),
+				"data":    nil,
+			})
+			return
+		}
+		opts = append(opts, exec.WithSerial(serial), exec.WithPause(pause))
+	}
+	job := PS.Executor.NewJob(opts...)
 	//logFilenName := fmt.Sprintf(`%s-%s@%s.log`)
 	job.LogPath = PS.LogPath(job.ID)
 	logrus.Infof("new job created, log: %s", job.LogPath)
 
-	// save job info to datadir/job/
-	if err := PS.SaveJob(job); err != nil {
-		logrus.Errorf("fail to save job to %s", PS.JobPath(job.ID))
+	// job is modified by scheduler concurrently once submitted, so it is rendered before that
+	status, data := job.Status, json.RawMessage(job.JSON())
+	if _, err := PS.RunJob(job); err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"message": err.Error(),
+			"data":    nil,
+		})
+	} else {
+		c.JSON(http.StatusOK, gin.H{
+			"message": "job " + status,
+			"data":    data,
+		})
 	}
+	return
+}
 
-	if j, err := PS.RunJob(job); err != nil {
+// ListPlaybookHandler will list playbooks found in pigsty home with their plays & tags
+func ListPlaybookHandler(c *gin.Context) {
+	if playbooks, err := PS.Executor.Playbooks(); err != nil {
 		c.JSON(http.StatusOK, gin.H{
-			"message": "job exists",
+			"message": "can not list playbooks: " + err.Error(),
 			"data":    nil,
 		})
 	} else {
 		c.JSON(http.StatusOK, gin.H{
-			"message": "job created",
-			"data":    j,
+			"message": "ok",
+			"data":    playbooks,
 		})
 	}
-	return
 }
 
-func DelJobHandler(c *gin.Context) {
-	if job := PS.DelJob(); job != nil {
+// GetPlaybookHandler will return plays, tasks & tags of playbook by name
+func GetPlaybookHandler(c *gin.Context) {
+	if pb, err := PS.Executor.LoadPlaybook(c.Param("name")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": err.Error(),
+			"data":    nil,
+		})
+	} else {
 		c.JSON(http.StatusOK, gin.H{
-			"message": "job deleted",
-			"data":    job,
+			"message": "ok",
+			"data":    pb,
+		})
+	}
+}
+
+// PostJobRetryHandler will retry finished job (?failed_only=true&start_at_task=<task|->), - means first failed task
+func PostJobRetryHandler(c *gin.Context) {
+	parent := PS.LoadJob(c.Param("id"))
+	if parent == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "job not found",
+			"data":    nil,
+		})
+		return
+	}
+	opts := []exec.JobOpts{exec.WithStore(PS.Store), exec.WithAuditor(requestAuditor(c))}
+	if task := c.Query("start_at_task"); task == "-" {
+		if task = parent.FailedTask(); task == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "failed task not found",
+				"data":    nil,
+			})
+			return
+		}
+		opts = append(opts, exec.WithStartAtTask(task))
+	} else if task != "" {
+		opts = append(opts, exec.WithStartAtTask(task))
+	}
+	job, err := PS.Executor.Retry(parent, c.Query("failed_only") == "true", opts...)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": err.Error(),
+			"data":    nil,
+		})
+		return
+	}
+	job.LogPath = PS.LogPath(job.ID)
+	logrus.Infof("retry job %s of %s on %s", job.ID, parent.ID, job.Limit)
+	// job is modified by scheduler concurrently once submitted, so it is rendered before that
+	status, data := job.Status, json.RawMessage(job.JSON())
+	if _, err := PS.RunJob(job); err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"message": err.Error(),
+			"data":    nil,
 		})
 	} else {
+		c.JSON(http.StatusOK, gin.H{
+			"message": "job " + status,
+			"data":    data,
+		})
+	}
+}
+
+// DelJobHandler will cancel job by id (/api/v1/queue/:id or ?id=), latest running job by default
+func DelJobHandler(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		id = c.Query("id")
+	}
+	job, err := PS.DelJob(id)
+	record := &exec.AuditRecord{Action: exec.AUDIT_CANCEL, JobID: id, Outcome: "ok"}
+	if job != nil {
+		record.JobID, record.Playbook, record.Limit, record.Hosts = job.ID, job.Playbook, job.Limit, job.Hosts
+	}
+	if err != nil {
+		record.Outcome, record.Error = "error", err.Error()
+	}
+	requestAuditor(c).Record(record)
+	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"message": "job not found",
 			"data":    nil,
 		})
+	} else {
+		c.JSON(http.StatusOK, gin.H{
+			"message": "job cancelled",
+			"data":    job,
+		})
+	}
+}
+
+// ListQueueHandler will list running and queued jobs
+func ListQueueHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"message": "ok",
+		"data": gin.H{
+			"running": copyJobs(PS.Scheduler.Running()),
+			"queued":  copyJobs(PS.Scheduler.Queue()),
+		},
+	})
+}
+
+// MoveQueueHandler will move queued job to given position (?pos=0 means head of queue)
+func MoveQueueHandler(c *gin.Context) {
+	pos, err := strconv.Atoi(c.DefaultQuery("pos", "0"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid position",
+			"data":    nil,
+		})
+		return
+	}
+	if err := PS.Scheduler.Move(c.Param("id"), pos); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": err.Error(),
+			"data":    nil,
+		})
+		return
 	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "ok",
+		"data":    copyJobs(PS.Scheduler.Queue()),
+	})
+}
+
+// copyJobs will return snapshots of queued or running jobs, which are safe to marshal
+func copyJobs(jobs []*exec.Job) []*exec.Job {
+	res := make([]*exec.Job, 0, len(jobs))
+	for _, job := range jobs {
+		res = append(res, job.Copy())
+	}
+	return res
 }
 
 // ListLogHandler will iter log directory and return log(job) list
@@ -116,14 +377,19 @@ func GetLogHandler(c *gin.Context) {
 	jobID := c.Param("jobid")
 	logPath := PS.LogPath(jobID)
 	b, _ := ioutil.ReadFile(logPath)
-	c.String(http.StatusOK, string(b))
+	c.String(http.StatusOK, redactLog(jobID, string(b)))
 	//c.File(logPath)
 }
 
-// GetLatestLogHandler
+// GetLatestLogHandler will serve log of latest job, or newest log file if job history is empty
 func GetLatestLogHandler(c *gin.Context) {
+	if jobs, err := PS.ListJobs(exec.JobQuery{Limit: 1}); err == nil && len(jobs) > 0 {
+		b, _ := ioutil.ReadFile(PS.LogPath(jobs[0].ID))
+		c.String(http.StatusOK, redactLog(jobs[0].ID, string(b)))
+		return
+	}
 	logs, err := PS.ListLogDir()
-	if err != nil {
+	if err != nil || len(logs) == 0 {
 		c.JSON(http.StatusOK, gin.H{
 			"message": "fail to list jobs",
 			"data":    nil,
@@ -135,12 +401,82 @@ func GetLatestLogHandler(c *gin.Context) {
 	var maxMtime int64
 	for i, log := range logs {
 		if log.Mtime >= maxMtime {
-			maxInd = i
+			maxInd, maxMtime = i, log.Mtime
 		}
 	}
 
 	latestLogName := logs[maxInd].Name
-	jobPath := path.Join(PS.DataDir, latestLogName)
+	jobPath := PS.LogPath(latestLogName)
 	logrus.Infof("server latest log %s of %v", jobPath, logs)
-	c.File(jobPath)
+	b, _ := ioutil.ReadFile(jobPath)
+	c.String(http.StatusOK, redactLog(strings.TrimSuffix(latestLogName, ".log"), string(b)))
+}
+
+// GetJobOutputHandler will serve recorded output chunks of job since given byte offset,
+// poll with offset=next to follow a running job until done
+func GetJobOutputHandler(c *gin.Context) {
+	job := PS.LoadJob(c.Param("id"))
+	if job == nil || job.Recording == "" {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "job recording not found",
+			"data":    nil,
+		})
+		return
+	}
+	offset, err := strconv.ParseInt(c.DefaultQuery("offset", "0"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid offset: " + c.Query("offset"),
+			"data":    nil,
+		})
+		return
+	}
+	done := job.Finished() // checked before reading, so no output is missed after done
+	_, chunks, err := exec.ReadCast(job.Recording, offset)
+	if os.IsNotExist(err) && !done { // queued job
+		chunks, err = []exec.CastChunk{}, nil
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": err.Error(),
+			"data":    nil,
+		})
+		return
+	}
+	next := offset
+	if len(chunks) > 0 {
+		last := chunks[len(chunks)-1]
+		next = last.Offset + int64(len(last.Data))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "ok",
+		"data": gin.H{
+			"offset": offset,
+			"next":   next,
+			"done":   done,
+			"chunks": chunks,
+		},
+	})
+}
+
+// GetJobCastHandler will serve asciicast v2 recording of job, which could be played by asciinema
+func GetJobCastHandler(c *gin.Context) {
+	job := PS.LoadJob(c.Param("id"))
+	if job == nil || job.Recording == "" {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "job recording not found",
+			"data":    nil,
+		})
+		return
+	}
+	c.Header("Content-Type", "application/x-asciicast")
+	c.File(job.Recording)
+}
+
+// redactLog will mask secrets in log of job, log of running job is not redacted on disk yet
+func redactLog(jobID string, log string) string {
+	if job := PS.Scheduler.Get(jobID); job != nil {
+		log = job.Redact(log)
+	}
+	return PS.Executor.CurrentRedactor().Redact(log)
 }
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"github.com/Vonng/pigsty-cli/exec"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// DefaultWatchInterval is how often inventory file is checked for changes
+const DefaultWatchInterval = 2 * time.Second
+
+// WithWatchInterval will reload executor when inventory file changes, checked every interval, 0 disables it
+func WithWatchInterval(interval time.Duration) ServerOpt {
+	return func(ps *PigstyServer) {
+		ps.WatchInterval = interval
+	}
+}
+
+// Reload will reload executor config from inventory, new jobs use new config while
+// queued & running jobs keep their snapshot. current config is kept if inventory is invalid
+func (ps *PigstyServer) Reload() (*exec.ConfigChange, error) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return ps.reload()
+}
+
+// reload will reload executor config, caller should hold server lock
+func (ps *PigstyServer) reload() (*exec.ConfigChange, error) {
+	change, err := ps.Executor.Reload()
+	if err != nil {
+		logrus.Errorf("fail to reload config: %s", err)
+		return nil, err
+	}
+	logrus.Infof("config reloaded from %s: %s", ps.Executor.InventoryPath(), change.Summary)
+	for _, c := range change.Changes {
+		logrus.Infof("config change: %s", c)
+	}
+	return change, nil
+}
+
+// WatchConfig will reload executor when content of inventory file changes until ctx is done.
+// an invalid inventory is reported once, and tried again only when it changes again
+func (ps *PigstyServer) WatchConfig(ctx context.Context) {
+	if ps.WatchInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(ps.WatchInterval)
+	defer ticker.Stop()
+	tried := ps.Executor.ConfigHash()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ps.lock.Lock() // config saved via api is reloaded by its handler
+		if hash := exec.FileHash(ps.Executor.InventoryPath()); hash != "" && hash != tried && hash != ps.Executor.ConfigHash() {
+			tried = hash
+			logrus.Infof("inventory %s is changed, reloading", ps.Executor.InventoryPath())
+			_, _ = ps.reload()
+		}
+		ps.lock.Unlock()
+	}
+}
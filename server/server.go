@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/Vonng/pigsty-cli/conf"
 	"github.com/Vonng/pigsty-cli/exec"
 	"github.com/gin-gonic/contrib/static"
 	"github.com/gin-gonic/gin"
@@ -16,6 +17,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -48,17 +50,24 @@ var PS *PigstyServer
 
 // PigstyServer holds required information
 type PigstyServer struct {
-	ListenAddr string
-	ConfigPath string
-	DataDir    string
-	PublicDir  string
-	HomeDir    string
-	Server     *http.Server
-	Executor   *exec.Executor
-	Job        *exec.Job // shitty-implementation: only one job allow one time
-	lock       sync.Mutex
-	jobLock    sync.RWMutex
-	cancel     context.CancelFunc
+	ListenAddr    string
+	ConfigPath    string
+	DataDir       string
+	PublicDir     string
+	HomeDir       string
+	Server        *http.Server
+	Executor      *exec.Executor
+	History       *conf.History     // config snapshots & change records
+	Scheduler     *exec.Scheduler   // job queue with per-cluster locking
+	Store         exec.JobStore     // job states & events
+	JobRetention  exec.JobRetention // finished jobs kept in job store
+	Audit         *exec.AuditLog    // hash chained audit log of mutating operations
+	Concurrency   int               // max running jobs
+	Env           map[string]string // default environment of job process
+	Runner        exec.Runner       // runs jobs, ansible-playbook if nil
+	Hooks         []*exec.Hook      // run on lifecycle events of every job
+	WatchInterval time.Duration     // check inventory changes and reload, 0 disables it
+	lock          sync.Mutex
 }
 
 // ServerOpt will configure pigsty server
@@ -83,6 +92,41 @@ func WithDataDir(dataDir string) ServerOpt {
 	}
 }
 
+// WithConcurrency will set max running jobs
+func WithConcurrency(concurrency int) ServerOpt {
+	return func(ps *PigstyServer) {
+		ps.Concurrency = concurrency
+	}
+}
+
+// WithEnv will set default environment of job process, e.g: ANSIBLE_CONFIG
+func WithEnv(env map[string]string) ServerOpt {
+	return func(ps *PigstyServer) {
+		ps.Env = env
+	}
+}
+
+// WithRunner will run jobs with given runner, e.g: fake runner in tests
+func WithRunner(runner exec.Runner) ServerOpt {
+	return func(ps *PigstyServer) {
+		ps.Runner = runner
+	}
+}
+
+// WithHooks will run hooks on lifecycle events of every job, e.g: webhook notifications
+func WithHooks(hooks ...*exec.Hook) ServerOpt {
+	return func(ps *PigstyServer) {
+		ps.Hooks = hooks
+	}
+}
+
+// WithJobRetention will drop finished jobs beyond retention when job store is compacted
+func WithJobRetention(retention exec.JobRetention) ServerOpt {
+	return func(ps *PigstyServer) {
+		ps.JobRetention = retention
+	}
+}
+
 func WithConfigPath(configPath string) ServerOpt {
 	return func(ps *PigstyServer) {
 		ps.ConfigPath = configPath
@@ -103,7 +147,29 @@ func NewPigstyServer(opts ...ServerOpt) *PigstyServer {
 	if ps.Executor = exec.NewExecutor(ps.ConfigPath); ps.Executor == nil {
 		return nil
 	}
+	ps.setupExecutor(ps.Executor)
 	ps.HomeDir = ps.Executor.WorkDir
+	ps.History = conf.NewHistory(ps.ConfigPath)
+	store, err := exec.OpenFileJobStore(ps.StorePath(), ps.JobRetention)
+	if err != nil {
+		logrus.Errorf("fail to open job store: %s", err)
+		return nil
+	}
+	ps.Store = store
+	ps.importLegacyJobs()
+	if ps.Audit, err = exec.OpenAuditLog(ps.AuditPath()); err != nil {
+		logrus.Errorf("fail to open audit log: %s", err)
+		return nil
+	}
+	orphans, err := ps.Store.Recover()
+	if err != nil {
+		logrus.Errorf("fail to recover job store: %s", err)
+		return nil
+	}
+	for _, job := range orphans {
+		logrus.Warnf("job %s (%s) is interrupted by previous server exit", job.ID, job.Name)
+	}
+	ps.Scheduler = exec.NewScheduler(ps.Concurrency)
 	ps.Server = &http.Server{
 		Addr:    ps.ListenAddr,
 		Handler: ps.DefaultRouter(),
@@ -124,6 +190,7 @@ func MakeDataDir(path string) error {
 	_ = os.MkdirAll(path, 0755)
 	_ = os.MkdirAll(filepath.Join(path, "log"), 0755)
 	_ = os.MkdirAll(filepath.Join(path, "job"), 0755)
+	_ = os.MkdirAll(filepath.Join(path, "audit"), 0755)
 	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
 		return nil
 	} else {
@@ -131,8 +198,54 @@ func MakeDataDir(path string) error {
 	}
 }
 
-func (ps *PigstyServer) JobDir() string {
-	return filepath.Join(ps.DataDir, "job")
+// StorePath is where job store file is placed
+func (ps *PigstyServer) StorePath() string {
+	return filepath.Join(ps.DataDir, "job", "jobs.db")
+}
+
+// importLegacyJobs will import job files (<data>/job/<id>) written by previous versions into job store,
+// imported files are renamed with .imported suffix so they are imported only once
+func (ps *PigstyServer) importLegacyJobs() {
+	dir, storeName := filepath.Split(ps.StorePath())
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	stored, err := ps.Store.Query(exec.JobQuery{})
+	if err != nil {
+		logrus.Errorf("fail to import legacy jobs: %s", err)
+		return
+	}
+	exists := make(map[string]bool, len(stored))
+	for _, job := range stored {
+		exists[job.ID] = true
+	}
+	imported := 0
+	for _, fi := range entries {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), storeName) || strings.HasSuffix(fi.Name(), ".imported") {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		b, err := ioutil.ReadFile(path)
+		var job exec.Job
+		if err != nil || json.Unmarshal(b, &job) != nil || job.ID == "" {
+			logrus.Debugf("skip legacy job file %s: not a job", path)
+			continue
+		}
+		if !exists[job.ID] {
+			if err = ps.Store.Save(&job); err != nil {
+				logrus.Errorf("fail to import legacy job %s: %s", path, err)
+				continue
+			}
+		}
+		if err = os.Rename(path, path+".imported"); err != nil {
+			logrus.Warnf("fail to mark legacy job %s imported: %s", path, err)
+		}
+		imported++
+	}
+	if imported > 0 {
+		logrus.Infof("%d legacy jobs imported from %s", imported, dir)
+	}
 }
 
 func (ps *PigstyServer) LogDir() string {
@@ -143,17 +256,9 @@ func (ps *PigstyServer) LogPath(name string) string {
 	return filepath.Join(ps.DataDir, "log", name)
 }
 
-func (ps *PigstyServer) JobPath(name string) string {
-	return filepath.Join(ps.DataDir, "job", name)
-}
-
+// SaveJob will persist job state to job store
 func (ps *PigstyServer) SaveJob(job *exec.Job) error {
-	jobPath := ps.JobPath(job.ID)
-	b, err := json.Marshal(job)
-	if err != nil {
-		return err
-	}
-	return ioutil.WriteFile(jobPath, b, 0644)
+	return ps.Store.Save(job)
 }
 
 // LogInfo Hold log name, size, mtime info of job logs
@@ -171,101 +276,73 @@ func (ps *PigstyServer) ListLogDir() ([]LogInfo, error) {
 	}
 	var list []LogInfo
 	for _, log := range logs {
-		if !log.IsDir() {
+		if !log.IsDir() && filepath.Ext(log.Name()) != exec.CAST_EXT {
 			list = append(list, LogInfo{log.Name(), log.Size(), log.ModTime().Unix()})
 		}
 	}
 	return list, nil
 }
 
-func (ps *PigstyServer) LisJobDir() ([]exec.Job, error) {
-	jobs, err := ioutil.ReadDir(ps.JobDir())
-	if err != nil {
-		return nil, err
-	}
-	var jobData []exec.Job
-	for _, jobID := range jobs {
-		job := ps.LoadJob(jobID.Name())
-		if job != nil {
-			jobData = append(jobData, *job)
-		}
-	}
-	return jobData, nil
+// ListJobs will query jobs from job store, latest first
+func (ps *PigstyServer) ListJobs(q exec.JobQuery) ([]*exec.Job, error) {
+	return ps.Store.Query(q)
 }
 
+// LoadJob will return snapshot of queued or running job, or finished job from job store, nil if not found
 func (ps *PigstyServer) LoadJob(id string) *exec.Job {
-	jobPath := ps.JobPath(id)
-	b, err := ioutil.ReadFile(jobPath)
-	if err != nil {
-		return nil
+	if job := ps.Scheduler.Get(id); job != nil {
+		return job.Copy()
 	}
-	var job exec.Job
-	if err = json.Unmarshal(b, &job); err != nil {
+	job, err := ps.Store.Get(id)
+	if err != nil {
 		return nil
 	}
-	return &job
+	return job
 }
 
-// Reload will create a new Executor according to config
-func (ps *PigstyServer) Reload(configPath string) error {
-	if ps.Job != nil {
-		return fmt.Errorf("executor can not be reloaed while running job")
-	}
-	// acquire lock
-	ps.lock.Lock()
-	defer ps.lock.Unlock()
-	// TODO: can not reload while running jobs
-	executor := exec.NewExecutor(configPath)
-	if executor == nil {
-		return fmt.Errorf("reload failed: invalid config")
-	}
-	ps.Executor = executor
-	ps.HomeDir = configPath
-	return nil
+// setupExecutor will apply server env & runner to executor
+func (ps *PigstyServer) setupExecutor(executor *exec.Executor) {
+	for k, v := range ps.Env {
+		executor.Env[k] = v
+	}
+	if ps.Runner != nil {
+		executor.Runner = ps.Runner
+	}
+	executor.JobOpts = append(executor.JobOpts, exec.WithRecordDir(ps.LogDir()))
+	if len(ps.Hooks) > 0 {
+		executor.JobOpts = append(executor.JobOpts, exec.WithHooks(ps.Hooks...))
+	}
 }
 
-// RunJob will run job on background, error if running job already exists
+// RunJob will submit job to scheduler, it runs as soon as its targets are not locked by other jobs
 func (ps *PigstyServer) RunJob(job *exec.Job) (*exec.Job, error) {
-	ps.jobLock.Lock()
-	defer ps.jobLock.Unlock()
-	if ps.Job != nil && (ps.Job.Status == exec.JOB_RUNNING || ps.Job.Status == exec.JOB_READY) {
-		return ps.Job, fmt.Errorf("another job is running: %s", ps.Job.ID)
-	}
-	ps.Job = job
-	ctx, cancel := context.WithCancel(context.TODO())
-	ps.cancel = cancel
-	go ps.Job.Run(ctx)
+	ps.Scheduler.Submit(job)
 	return job, nil
 }
 
-// CancelJob will cancel current job
-func (ps *PigstyServer) DelJob() *exec.Job {
-	ps.jobLock.Lock()
-	defer ps.jobLock.Unlock()
-
-	if ps.Job != nil && (ps.Job.Status == exec.JOB_RUNNING || ps.Job.Status == exec.JOB_READY) {
-		ps.Job.Cancel()
-		job := ps.Job
-		ps.Job = nil
-		return job
+// DelJob will cancel queued or running job by id, latest running job if id is empty, return its snapshot
+func (ps *PigstyServer) DelJob(id string) (*exec.Job, error) {
+	if id == "" {
+		if job := ps.GetJob(); job != nil {
+			id = job.ID
+		} else {
+			return nil, fmt.Errorf("no job is running")
+		}
 	}
-	if ps.Job != nil {
-		ps.Job = nil
+	job, err := ps.Scheduler.Cancel(id)
+	if job != nil {
+		job = job.Copy() // cancelled job may be still running
 	}
-	return nil
+	return job, err
 }
 
-// Get Job will return current running job, nil if not exists
+// GetJob will return snapshot of latest running job, or head of queue if nothing is running, nil if not exists
 func (ps *PigstyServer) GetJob() *exec.Job {
-	ps.jobLock.RLock()
-	defer ps.jobLock.RUnlock()
-	if ps.Job != nil {
-		if ps.Job.Status == exec.JOB_RUNNING || ps.Job.Status == exec.JOB_READY {
-			return ps.Job
-		} else {
-			ps.Job = nil // remove finished jobs
-			return nil
-		}
+	if running := ps.Scheduler.Running(); len(running) > 0 {
+		return running[len(running)-1].Copy()
+	}
+	if queued := ps.Scheduler.Queue(); len(queued) > 0 {
+		return queued[0].Copy()
 	}
 	return nil
 }
@@ -277,13 +354,33 @@ func (ps *PigstyServer) DefaultRouter() *gin.Engine {
 	r.GET("/api/v1/config/", GetConfigHandler)
 	r.POST("/api/v1/config/", PostConfigHandler)
 	r.POST("/api/v1/config", PostConfigHandler)
+	r.GET("/api/v1/config/history", GetConfigHistoryHandler)
+	r.POST("/api/v1/config/rollback/:id", PostConfigRollbackHandler)
 
 	// job (get post del)
 	r.GET("/api/v1/jobs", ListJobHandler)
+	r.GET("/api/v1/jobs/:id", GetJobByIDHandler)
+	r.GET("/api/v1/jobs/:id/plan", GetJobPlanHandler)
+	r.GET("/api/v1/jobs/:id/output", GetJobOutputHandler)
+	r.GET("/api/v1/jobs/:id/cast", GetJobCastHandler)
+	r.POST("/api/v1/jobs/:id/retry", PostJobRetryHandler)
 	r.GET("/api/v1/job", GetJobHandler)
+	r.GET("/api/v1/job/events", GetJobEventsHandler)
 	r.POST("/api/v1/job", PostJobHandler)
 	r.DELETE("/api/v1/job", DelJobHandler)
 
+	// playbook (list get)
+	r.GET("/api/v1/playbooks", ListPlaybookHandler)
+	r.GET("/api/v1/playbooks/:name", GetPlaybookHandler)
+
+	// queue (list move cancel)
+	r.GET("/api/v1/queue", ListQueueHandler)
+	r.POST("/api/v1/queue/:id", MoveQueueHandler)
+	r.DELETE("/api/v1/queue/:id", DelJobHandler)
+
+	// audit (list)
+	r.GET("/api/v1/audit", ListAuditHandler)
+
 	// log (list latest get)
 	r.GET("/api/v1/log/", ListLogHandler)
 	r.GET("/api/v1/log/latest", GetLatestLogHandler)
@@ -312,15 +409,32 @@ func (ps *PigstyServer) Run() {
 			logrus.Fatalf("listen: %s\n", err)
 		}
 	}()
-	quit := make(chan os.Signal)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	go ps.WatchConfig(watchCtx)
+
+	// SIGHUP reloads config, SIGINT & SIGTERM shutdown server
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for s := <-sig; s == syscall.SIGHUP; s = <-sig {
+		logrus.Infof("receive %s, reloading config", s)
+		_, _ = ps.Reload()
+	}
+	stopWatch()
 	logrus.Println("Shutting down server...")
 
-	// cancel running job
-	if ps.Job != nil {
-		ps.Job.Cancel()
+	// cancel queued & running jobs, then wait them (killed after grace period) persisted
+	ps.Scheduler.CancelAll()
+	waitJobs := make(chan struct{})
+	go func() {
+		ps.Scheduler.Wait()
+		close(waitJobs)
+	}()
+	select {
+	case <-waitJobs:
+	case <-time.After(exec.DefaultGracePeriod + 5*time.Second):
+		logrus.Warnf("timeout waiting jobs to stop")
 	}
+	_ = ps.Store.Close()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -331,14 +445,15 @@ func (ps *PigstyServer) Run() {
 }
 
 // InitDefaultServer will init default pigsty singleton
-func InitDefaultServer(listenAddr, configPath, dataDir, publicDir string) {
+func InitDefaultServer(listenAddr, configPath, dataDir, publicDir string, concurrency int, opts ...ServerOpt) {
 	logrus.Infof("pigsty server listen on %s , pigsty-config=%s  , dataDir=%s, publicDir=%s", listenAddr, configPath, dataDir, publicDir)
-	PS = NewPigstyServer(
+	PS = NewPigstyServer(append([]ServerOpt{
 		WithListenAddress(listenAddr),
 		WithDataDir(dataDir),
 		WithPublicDir(publicDir),
 		WithConfigPath(configPath),
-	)
+		WithConcurrency(concurrency),
+	}, opts...)...)
 	if PS == nil {
 		os.Exit(1)
 	}
@@ -1,7 +1,393 @@
 package server
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Vonng/pigsty-cli/conf"
+	"github.com/Vonng/pigsty-cli/exec"
+	"github.com/gin-gonic/gin"
+)
+
+const testConfig = `all:
+  children:
+    meta: {hosts: {10.10.10.10: {}}}
+    pg-test:
+      hosts:
+        10.10.10.11: {pg_seq: 1, pg_role: primary}
+        10.10.10.12: {pg_seq: 2, pg_role: replica}
+      vars: {pg_cluster: pg-test}
+`
+
+// testOutput is a recorded pgsql.yml run where 10.10.10.12 failed
+const testOutput = `
+PLAY [init postgres] ***********************************************************
+
+TASK [postgres : Launch postgres] **********************************************
+ok: [10.10.10.11]
+fatal: [10.10.10.12]: FAILED! => {"msg": "postgres failed to start"}
+
+PLAY RECAP *********************************************************************
+10.10.10.11                : ok=1    changed=0    unreachable=0    failed=0    skipped=0    rescued=0    ignored=0
+10.10.10.12                : ok=0    changed=0    unreachable=0    failed=1    skipped=0    rescued=0    ignored=0
+`
+
+// newTestServer will create pigsty server on temp config & data dir, whose jobs are replayed by fake runner
+func newTestServer(t *testing.T) (*PigstyServer, *exec.FakeRunner) {
+	dir, err := ioutil.TempDir("", "pigsty-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	configPath := filepath.Join(dir, "pigsty.yml")
+	if err = ioutil.WriteFile(configPath, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	playbook := "- name: init postgres\n  hosts: all\n  tasks: [ { name: launch postgres, tags: pg_launch, debug: msg=ok } ]\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "pgsql.yml"), []byte(playbook), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runner := exec.NewFakeRunner(map[string]*exec.Script{"pgsql": {Output: testOutput, ExitCode: 2}})
+	gin.SetMode(gin.TestMode)
+	ps := NewPigstyServer(
+		WithConfigPath(configPath),
+		WithDataDir(filepath.Join(dir, "data")),
+		WithConcurrency(2),
+		WithRunner(runner),
+	)
+	if ps == nil {
+		t.Fatal("fail to create server")
+	}
+	t.Cleanup(func() { ps.Store.Close() })
+	PS = ps
+	return ps, runner
+}
+
+// call will send request to server and decode job in response data
+func call(t *testing.T, ps *PigstyServer, method, url string, code int) *exec.Job {
+	w := httptest.NewRecorder()
+	ps.Server.Handler.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	if w.Code != code {
+		t.Fatalf("%s %s: expect %d, got %d: %s", method, url, code, w.Code, w.Body.String())
+	}
+	var res struct {
+		Message string    `json:"message"`
+		Data    *exec.Job `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%s %s: %s", method, url, err)
+	}
+	return res.Data
+}
 
 func TestNewPigstyServer(t *testing.T) {
-	InitDefaultServer(`:9633`, "/Users/vonng/pigsty/pigsty.yml", "/tmp/pd", "embed")
+	ps, runner := newTestServer(t)
+
+	job := call(t, ps, "POST", "/api/v1/job?playbook=pgsql&cluster=pg-test", http.StatusOK)
+	if job == nil || job.Playbook != "pgsql.yml" || job.Limit != "pg-test" {
+		t.Fatalf("unexpected job: %+v", job)
+	}
+	ps.Scheduler.Wait()
+	job = call(t, ps, "GET", "/api/v1/jobs/"+job.ID, http.StatusOK)
+	if job.Status != exec.JOB_FAILED || job.ExitCode != 2 || len(job.Results) != 2 {
+		t.Errorf("unexpected job: %s, exit code %d, %d results", job.Status, job.ExitCode, len(job.Results))
+	}
+
+	retry := call(t, ps, "POST", "/api/v1/jobs/"+job.ID+"/retry?failed_only=true&start_at_task=-", http.StatusOK)
+	ps.Scheduler.Wait()
+	if retry.Parent != job.ID || retry.Limit != "10.10.10.12" || retry.StartAtTask != "postgres : Launch postgres" {
+		t.Errorf("unexpected retry: parent %s, limit %s, start at %s", retry.Parent, retry.Limit, retry.StartAtTask)
+	}
+	if calls := runner.Calls(); len(calls) != 2 {
+		t.Errorf("expect 2 runs, got %q", calls)
+	}
+
+	w := httptest.NewRecorder()
+	ps.Server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/jobs?playbook=pgsql.yml", nil))
+	var list struct {
+		Data []*exec.Job `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Data) != 2 {
+		t.Errorf("expect 2 jobs in store, got %d: %v", len(list.Data), err)
+	}
+	call(t, ps, "GET", "/api/v1/jobs/not-exists", http.StatusNotFound)
+}
+
+func TestPlaybookHandler(t *testing.T) {
+	ps, runner := newTestServer(t)
+	call(t, ps, "POST", "/api/v1/job?playbook=not-exists&cluster=pg-test", http.StatusBadRequest)
+	call(t, ps, "POST", "/api/v1/job?playbook=pgsql&cluster=pg-test&tags=pg_lunch", http.StatusBadRequest)
+	call(t, ps, "POST", "/api/v1/job?playbook=pgsql&cluster=pg-test&tags=pg_launch", http.StatusOK)
+	ps.Scheduler.Wait()
+	if calls := runner.Calls(); len(calls) != 1 {
+		t.Errorf("invalid jobs should not run: %q", calls)
+	}
+
+	w := httptest.NewRecorder()
+	ps.Server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/playbooks", nil))
+	var list struct {
+		Data []*exec.Playbook `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Data) != 1 || list.Data[0].Tags[0] != "pg_launch" {
+		t.Errorf("unexpected playbooks: %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	ps.Server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/playbooks/pgsql.yml", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("playbook should be found: %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	ps.Server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/playbooks/pigsty.yml", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("inventory is not a playbook: %s", w.Body.String())
+	}
+}
+
+func TestGetLogHandler(t *testing.T) {
+	ps, _ := newTestServer(t)
+	ps.Executor.Redactor = exec.NewRedactor("DBUser.Admin")
+	_ = os.MkdirAll(filepath.Dir(ps.LogPath("job-1")), 0755)
+	if err := ioutil.WriteFile(ps.LogPath("job-1"), []byte("psql -W DBUser.Admin\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	ps.Server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/log/job-1", nil))
+	if body := w.Body.String(); body != "psql -W "+exec.REDACTED+"\n" {
+		t.Errorf("log should be redacted: %s", body)
+	}
+}
+
+func TestGetJobOutputHandler(t *testing.T) {
+	ps, _ := newTestServer(t)
+	job := call(t, ps, "POST", "/api/v1/job?playbook=pgsql&cluster=pg-test", http.StatusOK)
+	ps.Scheduler.Wait()
+
+	var res struct {
+		Data struct {
+			Next   int64            `json:"next"`
+			Done   bool             `json:"done"`
+			Chunks []exec.CastChunk `json:"chunks"`
+		} `json:"data"`
+	}
+	w := httptest.NewRecorder()
+	ps.Server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/jobs/"+job.ID+"/output?offset=1", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("output should be served: %d %s", w.Code, w.Body.String())
+	}
+	var output string
+	for _, chunk := range res.Data.Chunks {
+		output += chunk.Data
+	}
+	if !res.Data.Done || output != testOutput[1:] || res.Data.Next != int64(len(testOutput)) {
+		t.Errorf("unexpected output since offset 1: done %v, next %d\n%s", res.Data.Done, res.Data.Next, output)
+	}
+
+	w = httptest.NewRecorder()
+	ps.Server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/jobs/"+job.ID+"/cast", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), `{"version":2,`) {
+		t.Errorf("recording should be served: %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	ps.Server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/log/", nil))
+	if strings.Contains(w.Body.String(), exec.CAST_EXT) {
+		t.Errorf("recordings should not be listed as logs: %s", w.Body.String())
+	}
+	call(t, ps, "GET", "/api/v1/jobs/"+job.ID+"/output?offset=x", http.StatusBadRequest)
+	call(t, ps, "GET", "/api/v1/jobs/nope/output", http.StatusNotFound)
+}
+
+func TestAuditHandler(t *testing.T) {
+	ps, _ := newTestServer(t)
+	req := httptest.NewRequest("POST", "/api/v1/job?playbook=pgsql&cluster=pg-test", nil)
+	req.Header.Set("X-Pigsty-User", "alice")
+	req.Header.Set("Authorization", "Bearer s3cret-token")
+	ps.Server.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	ps.Scheduler.Wait()
+	call(t, ps, "DELETE", "/api/v1/job?id=nope", http.StatusOK)
+
+	w := httptest.NewRecorder()
+	ps.Server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/audit?host=10.10.10.12", nil))
+	var res struct {
+		Data []exec.AuditRecord `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || len(res.Data) != 2 {
+		t.Fatalf("job should be audited: %s", w.Body.String())
+	}
+	done := res.Data[0]
+	if done.Action != exec.AUDIT_JOB_DONE || done.Outcome != exec.JOB_FAILED || done.Source != exec.AUDIT_API ||
+		!strings.HasPrefix(done.Actor, "alice token:") || done.Command != "POST /api/v1/job?playbook=pgsql&cluster=pg-test" {
+		t.Errorf("unexpected audit record: %+v", done)
+	}
+	if strings.Contains(w.Body.String(), "s3cret-token") {
+		t.Errorf("api token should not be recorded: %s", w.Body.String())
+	}
+	records, _ := ps.Audit.Query(exec.AuditQuery{Action: exec.AUDIT_CANCEL})
+	if len(records) != 1 || records[0].Actor != "anonymous" || records[0].Outcome != "error" {
+		t.Errorf("cancel should be audited: %+v", records)
+	}
+	if n, err := ps.Audit.Verify(); n != 3 || err != nil {
+		t.Errorf("audit log should be verified: %d %v", n, err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	ps, _ := newTestServer(t)
+	ps.WatchInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ps.WatchConfig(ctx)
+
+	// inventory changed on disk is reloaded, new cluster is available to jobs
+	added := testConfig + "    pg-new:\n      hosts: {10.10.10.20: {pg_seq: 1, pg_role: primary}}\n      vars: {pg_cluster: pg-new}\n"
+	if err := ioutil.WriteFile(ps.ConfigPath, []byte(added), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200 && ps.Executor.ConfigHash() != exec.FileHash(ps.ConfigPath); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	job := call(t, ps, "POST", "/api/v1/job?playbook=pgsql&cluster=pg-new", http.StatusOK)
+	ps.Scheduler.Wait()
+	if strings.Join(job.Hosts, ",") != "10.10.10.20" {
+		t.Errorf("job should use reloaded config: %v", job.Hosts)
+	}
+
+	// invalid config is rejected before saved, and is never loaded if written to disk
+	invalid := strings.Replace(added, "pg_seq: 2, pg_role: replica", "pg_seq: 2, pg_role: primary", 1)
+	w := httptest.NewRecorder()
+	ps.Server.Handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/config", strings.NewReader(invalid)))
+	if w.Code != http.StatusBadRequest || exec.FileHash(ps.ConfigPath) != ps.Executor.ConfigHash() {
+		t.Fatalf("invalid config should be rejected: %d %s", w.Code, w.Body.String())
+	}
+	loaded := ps.Executor.CurrentConfig()
+	if err := ioutil.WriteFile(ps.ConfigPath, []byte(invalid), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if ps.Executor.CurrentConfig() != loaded {
+		t.Errorf("invalid config on disk should not be loaded")
+	}
+
+	// config posted is reloaded with change summary
+	w = httptest.NewRecorder()
+	ps.Server.Handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/config", strings.NewReader(testConfig)))
+	var res struct {
+		Message string             `json:"message"`
+		Data    *exec.ConfigChange `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusOK || res.Message != "ok" || res.Data == nil {
+		t.Fatalf("config should be reloaded: %d %s", w.Code, w.Body.String())
+	}
+	if res.Data.Summary != "-cluster pg-new" || res.Data.After != ps.Executor.ConfigHash() {
+		t.Errorf("unexpected change: %+v", res.Data)
+	}
+	call(t, ps, "POST", "/api/v1/job?playbook=pgsql&cluster=pg-new", http.StatusBadRequest)
+
+	// snapshot replaced by posted config is listed in history
+	w = httptest.NewRecorder()
+	ps.Server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/config/history", nil))
+	var history struct {
+		Message string          `json:"message"`
+		Data    []conf.Snapshot `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil || history.Message != "ok" || len(history.Data) != 1 || history.Data[0].Action != "post" {
+		t.Errorf("unexpected config history: %s", w.Body.String())
+	}
+
+	// rollback to snapshot replaced by posted config, payload is wrapped in data
+	w = httptest.NewRecorder()
+	ps.Server.Handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/config", strings.NewReader(added)))
+	snaps, err := ps.History.List()
+	if w.Code != http.StatusOK || err != nil || len(snaps) != 2 {
+		t.Fatalf("config should be saved: %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	ps.Server.Handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/config/rollback/"+snaps[0].ID, nil))
+	var rollback struct {
+		Message string `json:"message"`
+		Data    struct {
+			Snapshot *conf.Snapshot     `json:"snapshot"`
+			Change   *exec.ConfigChange `json:"change"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rollback); err != nil || w.Code != http.StatusOK || rollback.Message != "ok" || rollback.Data.Snapshot == nil || rollback.Data.Change == nil {
+		t.Fatalf("unexpected config rollback: %d %s", w.Code, w.Body.String())
+	}
+	if rollback.Data.Change.Summary != "-cluster pg-new" || rollback.Data.Change.After != ps.Executor.ConfigHash() {
+		t.Errorf("unexpected rollback change: %+v", rollback.Data.Change)
+	}
+}
+
+func TestGetRunningJob(t *testing.T) {
+	ps, runner := newTestServer(t)
+	runner.Scripts["pgsql"].Delay = 2 * time.Millisecond
+	job := call(t, ps, "POST", "/api/v1/job?playbook=pgsql&cluster=pg-test", http.StatusOK)
+	done := make(chan struct{})
+	go func() {
+		ps.Scheduler.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		call(t, ps, "GET", "/api/v1/jobs/"+job.ID, http.StatusOK)
+		call(t, ps, "GET", "/api/v1/job", http.StatusOK)
+		for _, url := range []string{"/api/v1/queue", "/api/v1/job/events?id=" + job.ID} {
+			w := httptest.NewRecorder()
+			ps.Server.Handler.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		}
+	}
+	if job = call(t, ps, "GET", "/api/v1/jobs/"+job.ID, http.StatusOK); job.Status != exec.JOB_FAILED {
+		t.Errorf("unexpected job status: %s", job.Status)
+	}
+}
+
+func TestImportLegacyJobs(t *testing.T) {
+	ps, runner := newTestServer(t)
+	ps.Store.Close()
+	legacy := map[string]string{
+		"0f6b3c1e-c2a4-11eb-8529-0242ac130003": `{"id":"0f6b3c1e-c2a4-11eb-8529-0242ac130003","name":"pgsql init","playbook":"pgsql.yml","limit":"pg-test","status":"success","start_at":"2021-06-01T00:00:00Z","done_at":"2021-06-01T00:01:00Z"}`,
+		"1a2b3c4d-c2a4-11eb-8529-0242ac130003": `{"id":"1a2b3c4d-c2a4-11eb-8529-0242ac130003","name":"node init","playbook":"node.yml","status":"running","start_at":"2021-06-02T00:00:00Z"}`,
+		"garbage":                              `not a job`,
+	}
+	for name, content := range legacy {
+		if err := ioutil.WriteFile(filepath.Join(ps.DataDir, "job", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reopen := func() *PigstyServer {
+		s := NewPigstyServer(WithConfigPath(ps.ConfigPath), WithDataDir(ps.DataDir), WithRunner(runner))
+		if s == nil {
+			t.Fatal("fail to create server")
+		}
+		t.Cleanup(func() { s.Store.Close() })
+		return s
+	}
+
+	// legacy job files are imported once, unfinished ones are interrupted
+	ps = reopen()
+	if job, err := ps.Store.Get("0f6b3c1e-c2a4-11eb-8529-0242ac130003"); err != nil || job.Status != exec.JOB_SUCCESS || job.Playbook != "pgsql.yml" {
+		t.Errorf("legacy job should be imported: %v %v", job, err)
+	}
+	if job, err := ps.Store.Get("1a2b3c4d-c2a4-11eb-8529-0242ac130003"); err != nil || job.Status != exec.JOB_INTERRUPTED {
+		t.Errorf("unfinished legacy job should be interrupted: %v %v", job, err)
+	}
+	if _, err := os.Stat(filepath.Join(ps.DataDir, "job", "0f6b3c1e-c2a4-11eb-8529-0242ac130003.imported")); err != nil {
+		t.Errorf("imported legacy job file should be renamed: %v", err)
+	}
+	ps.Store.Close()
+	ps = reopen()
+	if jobs, err := ps.Store.Query(exec.JobQuery{}); err != nil || len(jobs) != 2 {
+		t.Errorf("legacy jobs should be imported only once: %v %v", jobs, err)
+	}
 }